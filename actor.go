@@ -0,0 +1,18 @@
+package expay
+
+import "context"
+
+// actorKey is the context key of the actor
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that carries the actor (the user) making the
+// changes, which is recorded by a DB that keeps history
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor carried by ctx or empty if there is none
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
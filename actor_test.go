@@ -0,0 +1,16 @@
+package expay
+
+import (
+	"context"
+	"testing"
+)
+
+func TestActor(t *testing.T) {
+	ctx := context.Background()
+	if actor := Actor(ctx); actor != "" {
+		t.Fatalf("expect empty actor got %s", actor)
+	}
+	if actor := Actor(WithActor(ctx, "alice")); actor != "alice" {
+		t.Fatalf("expect %s got %s", "alice", actor)
+	}
+}
@@ -0,0 +1,46 @@
+package expay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry is an entry of the audit log of a DB, which records a write of a
+// value and is chained to the previous entry by its hash, so that altering,
+// inserting or removing an entry breaks the chain
+type AuditEntry struct {
+	// sequence number of the entry, starting from 1 without gaps
+	Seq uint64 `json:"seq"`
+	// operation of the write, e.g. create, update, delete or archive
+	Op string `json:"op"`
+	// ID of the written value
+	ID string `json:"id"`
+	// the user who made the write (see WithActor)
+	Actor string `json:"actor,omitempty"`
+	// time of the write
+	Time time.Time `json:"time"`
+	// digest of the written value (see AuditDigest), empty if deleted
+	Digest string `json:"digest,omitempty"`
+	// hash of the previous entry, empty for the first one
+	PrevHash string `json:"prev_hash,omitempty"`
+	// hash of the entry (see ChainHash)
+	Hash string `json:"hash"`
+}
+
+// ChainHash returns the hex SHA-256 digest of e encoded in JSON without its
+// hash, which chains e to the previous entry by PrevHash
+func (e AuditEntry) ChainHash() string {
+	e.Hash = ""
+	// never fails to encode the fields of AuditEntry
+	data, _ := json.Marshal(&e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditDigest returns the hex SHA-256 digest of an encoded value
+func AuditDigest(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
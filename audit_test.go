@@ -0,0 +1,54 @@
+package expay
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditEntryChainHash(t *testing.T) {
+	entry := AuditEntry{
+		Seq:      2,
+		Op:       OpUpdate,
+		ID:       "1",
+		Actor:    "alice",
+		Time:     time.Date(2018, 1, 1, 0, 0, 0, 1, time.UTC),
+		Digest:   AuditDigest([]byte(`{"id":"1"}`)),
+		PrevHash: "abc",
+	}
+	entry.Hash = entry.ChainHash()
+	if len(entry.Hash) != 64 {
+		t.Fatalf("expect a hex SHA-256 digest got %s", entry.Hash)
+	}
+
+	// stable after a round trip of JSON
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded AuditEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if hash := decoded.ChainHash(); hash != entry.Hash {
+		t.Fatalf("expect %s got %s", entry.Hash, hash)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		alter func(e *AuditEntry)
+	}{
+		{"seq", func(e *AuditEntry) { e.Seq++ }},
+		{"op", func(e *AuditEntry) { e.Op = OpDelete }},
+		{"actor", func(e *AuditEntry) { e.Actor = "bob" }},
+		{"time", func(e *AuditEntry) { e.Time = e.Time.Add(time.Nanosecond) }},
+		{"digest", func(e *AuditEntry) { e.Digest = AuditDigest([]byte(`{"id":"2"}`)) }},
+		{"previous hash", func(e *AuditEntry) { e.PrevHash = "abd" }},
+	} {
+		altered := entry
+		tc.alter(&altered)
+		if altered.ChainHash() == entry.Hash {
+			t.Fatalf("%s: expect a different hash got the same", tc.name)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"h12.io/expay"
+	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/sharddb"
+	"h12.io/expay/service"
+	"h12.io/expay/service/admin"
+)
+
+// commands are the subcommands of expay, which run instead of the server if
+// the first argument is the name of a command
+var commands = map[string]func(args []string) error{
+	"rotate-keys": rotateKeys,
+	"backup":      backup,
+	"restore":     restore,
+	"migrate":     migrate,
+	"reshard":     reshard,
+	"audit":       audit,
+}
+
+// reshardBatchSize is the number of payments copied in a transaction
+const reshardBatchSize = 100
+
+// checksumExt is the extension of the checksum file of a backup, which is in
+// the format of sha256sum
+const checksumExt = ".sha256"
+
+// rotateKeys asks a running expay server to reload its key file and re-encrypt
+// the storage with new keys
+func rotateKeys(args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	adminHost := flags.String("admin", "localhost:"+strconv.Itoa(expay.DefaultAdminPort), "host of the admin service")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	resp, err := http.Post("http://"+*adminHost+"/v1/admin/rotate-keys", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminError(resp)
+	}
+	var rotateResp admin.RotateKeysResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rotateResp); err != nil {
+		return err
+	}
+	fmt.Printf("re-encrypted %d payments\n", rotateResp.Reencrypted)
+	return nil
+}
+
+// adminError returns the error of a failed response from the admin service
+func adminError(resp *http.Response) error {
+	var errResp service.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Message == "" {
+		return fmt.Errorf("admin service: %s", resp.Status)
+	}
+	return fmt.Errorf("admin service: %s", errResp.Message)
+}
+
+// backup downloads a snapshot of the storage from a running expay server,
+// verifies its digest and writes it with its checksum file
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	adminHost := flags.String("admin", "localhost:"+strconv.Itoa(expay.DefaultAdminPort), "host of the admin service")
+	output := flags.String("o", "", "backup file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return errors.New("missing backup file -o")
+	}
+	resp, err := http.Get("http://" + *adminHost + "/v1/admin/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminError(resp)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(*output), filepath.Base(*output)+".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, sum), resp.Body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// the trailer is only available after the body is read
+	digest := resp.Trailer.Get(admin.DigestTrailer)
+	if digest == "" {
+		return errors.New("backup is incomplete, see the server log")
+	}
+	if digest != "SHA-256="+base64.StdEncoding.EncodeToString(sum.Sum(nil)) {
+		return errors.New("backup is corrupted, digest mismatch")
+	}
+	if err := os.Rename(f.Name(), *output); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(sum.Sum(nil)) + "  " + filepath.Base(*output) + "\n"
+	if err := ioutil.WriteFile(*output+checksumExt, []byte(checksum), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("backed up %d bytes to %s\n", n, *output)
+	return nil
+}
+
+// restore replaces a boltdb storage with a backup after verifying its
+// checksum, the expay server using the storage must be stopped
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("i", "", "backup file")
+	storage := flags.String("storage", "storage.bolt", "boltdb storage URL: bolt://path or a boltdb file path")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errors.New("missing backup file -i")
+	}
+	filename, err := boltFile(*storage)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(*input); err != nil {
+		return err
+	}
+	if err := boltdb.Restore(*input, filename); err != nil {
+		return err
+	}
+	fmt.Printf("restored %s from %s\n", filename, *input)
+	return nil
+}
+
+// verifyChecksum verifies a backup file against its checksum file
+func verifyChecksum(filename string) error {
+	checksum, err := ioutil.ReadFile(filename + checksumExt)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(checksum))
+	if len(fields) == 0 {
+		return fmt.Errorf("invalid checksum file %s", filename+checksumExt)
+	}
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum.Sum(nil), expected) {
+		return fmt.Errorf("checksum mismatch of backup %s", filename)
+	}
+	return nil
+}
+
+// migrate asks a running expay server to rewrite the payments stored in an
+// older schema version, and prints the progress
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	adminHost := flags.String("admin", "localhost:"+strconv.Itoa(expay.DefaultAdminPort), "host of the admin service")
+	batchSize := flags.Int("batch-size", 100, "number of payments migrated in a transaction")
+	dryRun := flags.Bool("dry-run", false, "run the migrations without writing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("batch_size", strconv.Itoa(*batchSize))
+	query.Set("dry_run", strconv.FormatBool(*dryRun))
+	resp, err := http.Post("http://"+*adminHost+"/v1/admin/migrate?"+query.Encode(), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminError(resp)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var p admin.MigrateProgress
+		if err := dec.Decode(&p); err != nil {
+			return err
+		}
+		switch {
+		case p.Error != "":
+			return fmt.Errorf("migration failed after %d of %d payments: %s", p.Scanned, p.Total, p.Error)
+		case p.Done && *dryRun:
+			fmt.Printf("%d of %d payments to migrate\n", p.Migrated, p.Total)
+			return nil
+		case p.Done:
+			fmt.Printf("migrated %d of %d payments\n", p.Migrated, p.Total)
+			return nil
+		}
+		fmt.Printf("scanned %d of %d payments, %d migrated\n", p.Scanned, p.Total, p.Migrated)
+	}
+	return errors.New("migration is interrupted, see the server log")
+}
+
+// reshard copies the payments of a storage into a new storage, e.g. with a
+// different number of shards, while the server is stopped. IDs chosen by
+// clients are kept, while the other payments get new IDs, as their IDs encode
+// their shards, so the old and the new ID of each payment is written as a line
+// of the map file, which is required. Revisions are not copied, and a storage
+// with archived payments is refused.
+func reshard(args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	from := flags.String("from", "storage.bolt", "source storage URL")
+	to := flags.String("to", "", "target storage URL, e.g. bolt://storage.bolt?shards=4")
+	keyFile := flags.String("keyfile", "", "master key file of both storages")
+	mapFile := flags.String("map", "", "file to write the old and the new ID of each payment")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("missing target storage -to")
+	}
+	if *to == *from {
+		return errors.New("the target storage must differ from the source")
+	}
+	if *mapFile == "" {
+		return errors.New("missing map file -map")
+	}
+	src, err := openStorage(*from, *keyFile)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(src)
+	dst, err := openStorage(*to, *keyFile)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(dst)
+	f, err := os.Create(*mapFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := copyPayments(context.Background(), src, dst, f)
+	if err != nil {
+		return fmt.Errorf("resharding failed after %d payments: %v", n, err)
+	}
+	fmt.Printf("resharded %d payments\n", n)
+	return nil
+}
+
+// hasArchived returns if db has any archived payment
+func hasArchived(ctx context.Context, db expay.DB) (bool, error) {
+	var archiver expay.Archiver
+	if !expay.As(db, &archiver) {
+		return false, nil
+	}
+	iter, err := archiver.PaginateArchived(ctx, "", 1)
+	if err != nil {
+		return false, err
+	}
+	found := iter.Next()
+	return found, iter.Close()
+}
+
+// copyPayments copies every payment from src into the empty dst in batches,
+// keeping the IDs chosen by clients, and writes the old and the new ID of each
+// copied payment to mapping
+func copyPayments(ctx context.Context, src, dst expay.DB, mapping io.Writer) (n int, err error) {
+	iter, err := dst.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	empty := !iter.Next()
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	if !empty {
+		return 0, errors.New("target storage is not empty")
+	}
+	archived, err := hasArchived(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+	if archived {
+		// archived payments can only be written by archiving live ones
+		return 0, errors.New("source storage has archived payments, which cannot be copied")
+	}
+	var creator expay.IDCreator
+	keepIDs := expay.As(dst, &creator)
+	iter, err = src.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	type entry struct {
+		id  string
+		pay expay.Payment
+	}
+	copyBatch := func(batch []entry) error {
+		for i := range batch {
+			if expay.IsUUID(batch[i].id) && !keepIDs {
+				return fmt.Errorf("payment %s has an ID chosen by its client, which is not supported by the target storage", batch[i].id)
+			}
+		}
+		var lines bytes.Buffer
+		copied := 0
+		if err := dst.RunInTx(ctx, func(tx expay.Tx) error {
+			lines.Reset()
+			copied = 0
+			for i := range batch {
+				if expay.IsUUID(batch[i].id) {
+					continue
+				}
+				id, err := tx.Create(&batch[i].pay)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(&lines, "%s %s\n", batch[i].id, id)
+				copied++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if _, err := lines.WriteTo(mapping); err != nil {
+			return err
+		}
+		n += copied
+		// IDs chosen by clients are kept as they are
+		for i := range batch {
+			if !expay.IsUUID(batch[i].id) {
+				continue
+			}
+			if err := creator.CreateWithID(ctx, batch[i].id, &batch[i].pay); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(mapping, "%s %s\n", batch[i].id, batch[i].id); err != nil {
+				return err
+			}
+			n++
+		}
+		fmt.Printf("copied %d payments\n", n)
+		return nil
+	}
+	batch := []entry{}
+	for iter.Next() {
+		var e entry
+		if e.id, err = iter.Scan(&e.pay); err != nil {
+			_ = iter.Close()
+			return n, err
+		}
+		batch = append(batch, e)
+		if len(batch) == reshardBatchSize {
+			if err := copyBatch(batch); err != nil {
+				_ = iter.Close()
+				return n, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return n, err
+	}
+	if len(batch) > 0 {
+		if err := copyBatch(batch); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// audit runs the audit command given by the first argument while the server
+// is stopped: verify verifies the audit log of a storage (or a backup), and
+// baseline starts the audit log of a boltdb file whose payments have been
+// stored before the audit log was enabled
+func audit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" && args[0] != "baseline" {
+		return errors.New("usage: expay audit verify|baseline -storage [storage] -keyfile [keyfile]")
+	}
+	flags := flag.NewFlagSet("audit "+args[0], flag.ContinueOnError)
+	storage := flags.String("storage", "storage.bolt", "storage URL or a backup file")
+	keyFile := flags.String("keyfile", "", "master key file of an encrypted storage")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if args[0] == "baseline" {
+		return auditBaseline(*storage, *keyFile)
+	}
+	n, head, err := verifyAudit(*storage, *keyFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified %d audit entries, head %s\n", n, head)
+	return nil
+}
+
+// verifyAudit verifies the audit log of a boltdb storage, whose files are
+// opened read-only without ensuring their indexes, aggregates or audit log, so
+// that verifying a backup file neither changes it nor repairs its log
+func verifyAudit(storage, keyFile string) (n int, head string, err error) {
+	u, err := url.Parse(storage)
+	if err != nil {
+		return 0, "", err
+	}
+	codec := boltdb.JSON
+	filenames := []string{storage}
+	switch u.Scheme {
+	case "bolt":
+		if codec, err = boltCodec(u.Query()); err != nil {
+			return 0, "", err
+		}
+		shards, err := boltShards(u.Query())
+		if err != nil {
+			return 0, "", err
+		}
+		filenames = []string{u.Host + u.Path}
+		if shards > 1 {
+			filenames = nil
+			for i := 0; i < shards; i++ {
+				filenames = append(filenames, shardFile(u.Host+u.Path, i))
+			}
+		}
+	case "":
+	default:
+		return 0, "", fmt.Errorf("audit log is not supported by storage %s", storage)
+	}
+	shards := []expay.DB{}
+	for _, filename := range filenames {
+		db, err := boltdb.NewReadOnly(filename)
+		if err != nil {
+			return 0, "", err
+		}
+		defer db.Close()
+		bucket, err := paymentBucket(db, codec, nil, keyFile)
+		if err != nil {
+			return 0, "", err
+		}
+		shards = append(shards, bucket)
+	}
+	if len(shards) == 1 {
+		return shards[0].(expay.Auditor).VerifyAudit(context.Background())
+	}
+	db, err := sharddb.New(shards, paymentShardKey)
+	if err != nil {
+		return 0, "", err
+	}
+	return db.VerifyAudit(context.Background())
+}
+
+// auditBaseline starts the audit log of a boltdb file with a baseline entry of
+// every payment, which is trusted as it is
+func auditBaseline(storage, keyFile string) error {
+	filename, err := boltFile(storage)
+	if err != nil {
+		return err
+	}
+	db, err := boltdb.New(filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	bucket, err := paymentBucket(db, boltdb.JSON, nil, keyFile)
+	if err != nil {
+		return err
+	}
+	n, err := bucket.BaselineAudit(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("started the audit log with %d baseline entries\n", n)
+	return nil
+}
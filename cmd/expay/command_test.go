@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+	"h12.io/expay/db/memdb"
+	"h12.io/expay/service/admin"
+)
+
+func TestRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "master.key")
+	if err := ioutil.WriteFile(keyFile, []byte("1 "+strings.Repeat("01", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openStorage(path.Join(dir, "storage.bolt"), keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Create(context.Background(), &expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(admin.NewService(db))
+	defer server.Close()
+	adminHost := strings.TrimPrefix(server.URL, "http://")
+
+	if err := rotateKeys([]string{"-admin", adminHost}); err != nil {
+		t.Fatal(err)
+	}
+
+	// storage not encrypted
+	memServer := httptest.NewServer(admin.NewService(memdb.New()))
+	defer memServer.Close()
+	err = rotateKeys([]string{"-admin", strings.TrimPrefix(memServer.URL, "http://")})
+	if err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Fatalf("expect not encrypted error got %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	db, err := openStorage(path.Join(dir, "storage.bolt"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Create(ctx, &expay.Payment{OrganisationID: "org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(admin.NewService(db))
+	defer server.Close()
+	adminHost := strings.TrimPrefix(server.URL, "http://")
+	backupFile := path.Join(dir, "backup.bolt")
+
+	if err := backup([]string{"-admin", adminHost}); err == nil {
+		t.Fatal("expect missing backup file error got nil")
+	}
+	if err := backup([]string{"-admin", adminHost, "-o", backupFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the storage is in use by the server
+	err = restore([]string{"-i", backupFile, "-storage", path.Join(dir, "storage.bolt")})
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expect in use error got %v", err)
+	}
+	restored := path.Join(dir, "restored.bolt")
+	if err := restore([]string{"-i", backupFile, "-storage", "bolt://" + restored}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openStorage(restored, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pay expay.Payment
+	if err := db.Get(ctx, id, &pay); err != nil {
+		t.Fatal(err)
+	}
+	if pay.OrganisationID != "org" {
+		t.Fatalf("expect %s got %s", "org", pay.OrganisationID)
+	}
+
+	// a tampered backup is not restored
+	f, err := os.OpenFile(backupFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	err = restore([]string{"-i", backupFile, "-storage", path.Join(dir, "new.bolt")})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expect checksum mismatch error got %v", err)
+	}
+
+	// not a boltdb storage
+	if err := restore([]string{"-i", backupFile, "-storage", "mem://"}); err == nil {
+		t.Fatal("expect not a boltdb file error got nil")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	db, err := openStorage(path.Join(dir, "storage.bolt"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Create(ctx, &expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(admin.NewService(db))
+	defer server.Close()
+	adminHost := strings.TrimPrefix(server.URL, "http://")
+
+	if err := migrate([]string{"-admin", adminHost, "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate([]string{"-admin", adminHost, "-batch-size", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	err = migrate([]string{"-admin", adminHost, "-batch-size", "0"})
+	if err == nil || !strings.Contains(err.Error(), "batch_size") {
+		t.Fatalf("expect invalid batch_size error got %v", err)
+	}
+
+	// storage not versioned
+	memServer := httptest.NewServer(admin.NewService(memdb.New()))
+	defer memServer.Close()
+	err = migrate([]string{"-admin", strings.TrimPrefix(memServer.URL, "http://")})
+	if err == nil || !strings.Contains(err.Error(), "not versioned") {
+		t.Fatalf("expect not versioned error got %v", err)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	src := memdb.New()
+	pays := map[string]expay.Payment{}
+	for i := 0; i < reshardBatchSize+5; i++ {
+		pay := expay.Payment{OrganisationID: "org" + strconv.Itoa(i%7), Version: i}
+		id, err := src.Create(ctx, &pay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pays[id] = pay
+	}
+	// IDs chosen by clients are kept
+	uuids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := expay.NewUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pay := expay.Payment{OrganisationID: "org" + strconv.Itoa(i), Version: i}
+		if err := src.CreateWithID(ctx, id, &pay); err != nil {
+			t.Fatal(err)
+		}
+		pays[id] = pay
+		uuids = append(uuids, id)
+	}
+	dst, err := openStorage("bolt://"+path.Join(dir, "storage.bolt")+"?shards=3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mapping bytes.Buffer
+	n, err := copyPayments(ctx, src, dst, &mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(pays) {
+		t.Fatalf("expect %d got %d", len(pays), n)
+	}
+	lines := strings.Split(strings.TrimSpace(mapping.String()), "\n")
+	if len(lines) != len(pays) {
+		t.Fatalf("expect %d got %d", len(pays), len(lines))
+	}
+	for _, line := range lines {
+		var oldID, newID string
+		if _, err := fmt.Sscan(line, &oldID, &newID); err != nil {
+			t.Fatal(err)
+		}
+		var pay expay.Payment
+		if err := dst.Get(ctx, newID, &pay); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pay, pays[oldID]) {
+			t.Fatalf("expect %v got %v", pays[oldID], pay)
+		}
+		if expay.IsUUID(oldID) && newID != oldID {
+			t.Fatalf("expect ID %s kept got %s", oldID, newID)
+		}
+	}
+	for _, id := range uuids {
+		var pay expay.Payment
+		if err := dst.Get(ctx, id, &pay); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the target must be empty
+	if _, err := copyPayments(ctx, src, dst, &mapping); err == nil {
+		t.Fatal("expect not empty error got nil")
+	}
+	if err := reshard([]string{"-from", "mem://"}); err == nil {
+		t.Fatal("expect missing target error got nil")
+	}
+	if err := reshard([]string{"-from", "mem://", "-to", "bolt://" + path.Join(dir, "nomap.bolt")}); err == nil {
+		t.Fatal("expect missing map file error got nil")
+	}
+
+	// IDs chosen by clients are not renumbered
+	sqlite, err := openStorage("sqlite://"+path.Join(dir, "storage.sqlite"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyPayments(ctx, src, sqlite, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "chosen by its client") {
+		t.Fatalf("expect client ID error got %v", err)
+	}
+
+	// archived payments are not silently dropped
+	archived, err := openStorage(path.Join(dir, "archived.bolt"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay := expay.Payment{OrganisationID: "org"}
+	pay.Attributes.ProcessingDate = "2017-01-18"
+	if _, err := archived.Create(ctx, &pay); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := archived.(expay.Archiver).Archive(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expect 1 archived payment got %d, %v", n, err)
+	}
+	dst, err = openStorage("bolt://"+path.Join(dir, "from-archived.bolt")+"?shards=2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := copyPayments(ctx, archived, dst, ioutil.Discard); err == nil || n != 0 {
+		t.Fatalf("expect archived payments error got %d, %v", n, err)
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := expay.WithActor(context.Background(), "alice")
+	db, err := openStorage(path.Join(dir, "storage.bolt"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Create(ctx, &expay.Payment{OrganisationID: "org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(ctx, id, &expay.Payment{OrganisationID: "org2"}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(admin.NewService(db))
+	defer server.Close()
+	adminHost := strings.TrimPrefix(server.URL, "http://")
+	// the storage is in use by the server, so its backups are verified
+	backups := []string{path.Join(dir, "backup.bolt"), path.Join(dir, "tampered.bolt")}
+	for _, backupFile := range backups {
+		if err := backup([]string{"-admin", adminHost, "-o", backupFile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := audit([]string{"verify", "-storage", backups[0]}); err != nil {
+		t.Fatal(err)
+	}
+	// the backup is verified read-only, so it still matches its checksum
+	if err := verifyChecksum(backups[0]); err != nil {
+		t.Fatal(err)
+	}
+	missing := path.Join(dir, "missing.bolt")
+	if err := audit([]string{"verify", "-storage", missing}); err == nil {
+		t.Fatal("expect not exist error got nil")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("expect %s not created got %v", missing, err)
+	}
+
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := bolt.Open(backups[1], 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("payment")).Put(key, []byte(`{"organisation_id":"org"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := audit([]string{"verify", "-storage", backups[1]}); !errors.Is(err, expay.ErrAuditBroken) {
+		t.Fatalf("expect error %v got %v", expay.ErrAuditBroken, err)
+	}
+
+	if err := audit([]string{"verify", "-storage", "mem://"}); err == nil {
+		t.Fatal("expect not supported error got nil")
+	}
+	if err := audit(nil); err == nil {
+		t.Fatal("expect usage error got nil")
+	}
+}
+
+func TestAuditBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// payments stored before the audit log is enabled
+	filename := path.Join(dir, "storage.bolt")
+	file, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("payment"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte{0, 0, 0, 0, 0, 0, 0, 1}, []byte(`{"organisation_id":"org"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, err := openStorage(filename, ""); !errors.Is(err, expay.ErrAuditBroken) {
+		t.Fatalf("expect error %v got %v", expay.ErrAuditBroken, err)
+	}
+	if err := audit([]string{"baseline", "-storage", filename}); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit([]string{"baseline", "-storage", filename}); err == nil {
+		t.Fatal("expect started audit log error got nil")
+	}
+	if err := audit([]string{"verify", "-storage", filename}); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit([]string{"baseline", "-storage", "bolt://" + filename + "?shards=2"}); err == nil {
+		t.Fatal("expect sharded storage error got nil")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -13,28 +14,68 @@ import (
 	"time"
 
 	"h12.io/expay"
-	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/cachedb"
+	"h12.io/expay/db/faultdb"
+	"h12.io/expay/service"
+	"h12.io/expay/service/admin"
 	"h12.io/expay/service/payment"
 )
 
+const (
+	writeTimeout = 10 * time.Second
+	// requestTimeout is shorter than writeTimeout so that a timeout error can
+	// still be written to the client
+	requestTimeout = writeTimeout - time.Second
+)
+
 // server is the main server object of the program
 type server struct {
 	listener net.Listener
 	server   *http.Server
-	stopChan chan os.Signal
+	// admin server is nil if not enabled
+	adminListener net.Listener
+	adminServer   *http.Server
+	stopChan      chan os.Signal
+	// cancel stops the background jobs
+	cancel context.CancelFunc
 }
 
 // new creates a new server object from configurations
 func new() (*server, error) {
 	cfg := &config{}
 	flag.StringVar(&cfg.Host, "host", ":"+strconv.Itoa(expay.DefaultPort), "host of the expay service")
-	flag.StringVar(&cfg.Storage, "storage", "storage.bolt", "config of the storage")
+	flag.StringVar(&cfg.Storage, "storage", "storage.bolt", "storage URL: mem://, bolt://path[?shards=n], sqlite://path or a boltdb file path")
+	flag.StringVar(&cfg.KeyFile, "keyfile", "", "master key file to encrypt the boltdb storage at rest")
+	flag.StringVar(&cfg.AdminHost, "admin", "", "host of the admin service, disabled if empty")
+	flag.DurationVar(&cfg.Retention, "retention", 0, "retention period of deleted payments before they are purged, kept forever if 0")
+	flag.DurationVar(&cfg.PurgeInterval, "purge-interval", time.Hour, "interval between purges of deleted payments")
+	flag.DurationVar(&cfg.ArchiveAge, "archive-age", 0, "age after the processing date when payments are archived, never archived if 0")
+	flag.DurationVar(&cfg.ArchiveInterval, "archive-interval", 24*time.Hour, "interval between archivings of old payments")
+	flag.IntVar(&cfg.CacheSize, "cache-size", 0, "number of payments cached in memory, disabled if 0")
+	flag.DurationVar(&cfg.CacheTTL, "cache-ttl", time.Minute, "time to live of cached payments, never expire if 0")
+	flag.BoolVar(&cfg.Faults, "faults", false, "inject the faults set by the admin service into the storage, for chaos testing only")
 	flag.Parse()
 
-	db, err := boltdb.New(cfg.Storage)
+	db, err := openStorage(cfg.Storage, cfg.KeyFile)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkServed(cfg.Storage, db); err != nil {
+		return nil, err
+	}
+	if cfg.Faults {
+		db = faultdb.New(db)
+		log.Print("fault injection enabled")
+	}
+	if cfg.CacheSize > 0 {
+		db = cachedb.New(db, cfg.CacheSize, cfg.CacheTTL)
+	}
+	var archiver expay.Archiver
+	if cfg.ArchiveAge > 0 {
+		if !expay.As(db, &archiver) {
+			return nil, fmt.Errorf("archive is not supported by storage %s", cfg.Storage)
+		}
+	}
 
 	listener, err := net.Listen("tcp", cfg.Host)
 	if err != nil {
@@ -43,26 +84,66 @@ func new() (*server, error) {
 
 	httpServer := &http.Server{
 		Addr:           cfg.Host,
-		Handler:        payment.NewService(db.Bucket("payment")),
+		Handler:        service.TimeoutMiddleware(requestTimeout)(payment.NewService(db)),
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   writeTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
-	stopChan := make(chan os.Signal)
-	notifyStop(stopChan, httpServer.Shutdown)
-
-	log.Printf("ExPay service listening on %s", cfg.Host)
-	return &server{
+	s := &server{
 		listener: listener,
 		server:   httpServer,
-		stopChan: stopChan,
-	}, nil
+	}
+	if cfg.AdminHost != "" {
+		if s.adminListener, err = net.Listen("tcp", cfg.AdminHost); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		// admin operations may run long, so no write timeout
+		s.adminServer = &http.Server{
+			Addr:           cfg.AdminHost,
+			Handler:        admin.NewService(db),
+			ReadTimeout:    10 * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		}
+		log.Printf("ExPay admin service listening on %s", cfg.AdminHost)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if cfg.Retention > 0 {
+		go payment.NewPurger(db, cfg.Retention, cfg.PurgeInterval).Run(ctx)
+	}
+	if archiver != nil {
+		go payment.NewArchiver(archiver, cfg.ArchiveAge, cfg.ArchiveInterval).Run(ctx)
+	}
+	s.stopChan = make(chan os.Signal)
+	notifyStop(s.stopChan, s.shutdown)
+
+	log.Printf("ExPay service listening on %s", cfg.Host)
+	return s, nil
 }
 
 func (s *server) run() error {
+	if s.adminServer != nil {
+		go func() {
+			if err := s.adminServer.Serve(s.adminListener); err != http.ErrServerClosed {
+				log.Print(err)
+			}
+		}()
+	}
 	return s.server.Serve(s.listener)
 }
 
+// shutdown gracefully shuts down the servers
+func (s *server) shutdown(ctx context.Context) error {
+	s.cancel()
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}
+	return s.server.Shutdown(ctx)
+}
+
 // notifyStop listens to process signal and calls stopFn when received
 func notifyStop(stopChan chan os.Signal, stopFn func(context.Context) error) {
 	signal.Notify(stopChan, syscall.SIGTERM, syscall.SIGINT)
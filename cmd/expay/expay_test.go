@@ -23,7 +23,7 @@ func TestServerRun(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	os.Args = []string{"expay", "-host", "127.0.0.1:0", "-storage", path.Join(dir, "storage.bolt")}
+	os.Args = []string{"expay", "-host", "127.0.0.1:0", "-storage", path.Join(dir, "storage.bolt"), "-cache-size", "10"}
 	server, err := new()
 	if err != nil {
 		t.Fatal(err)
@@ -89,6 +89,27 @@ func TestServerRun(t *testing.T) {
 		}
 	}
 
+	// stats
+	{
+		resp, err := client.Get(urlPrefix + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d got %d", http.StatusOK, resp.StatusCode)
+		}
+		statsResp := &expay.StatsResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(statsResp); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		expected := expay.Aggregate{Count: 1, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "100.21"}}}
+		if !reflect.DeepEqual(statsResp.Data.Aggregate, expected) {
+			t.Fatalf("expect %+v got %+v", expected, statsResp.Data.Aggregate)
+		}
+	}
+
 	server.stopChan <- syscall.SIGINT
 
 	select {
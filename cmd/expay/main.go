@@ -12,14 +12,38 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 )
 
 type config struct {
-	Host    string
-	Storage string
+	Host      string
+	Storage   string
+	KeyFile   string
+	AdminHost string
+	// Retention of deleted payments, 0 means forever
+	Retention     time.Duration
+	PurgeInterval time.Duration
+	// ArchiveAge is how long after their processing dates payments are
+	// archived, 0 means never
+	ArchiveAge      time.Duration
+	ArchiveInterval time.Duration
+	// CacheSize is the number of cached payments, 0 disables the cache
+	CacheSize int
+	CacheTTL  time.Duration
+	// Faults enables the fault injection controlled by the admin service
+	Faults bool
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	server, err := new()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"h12.io/expay"
+	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/memdb"
+	"h12.io/expay/db/sharddb"
+	"h12.io/expay/db/sqldb"
+)
+
+// openStorage opens the payment storage given by its URL:
+//
+//	mem://                  an ephemeral in-memory DB
+//	bolt://path/to/file     a boltdb file, values are encoded by the codec
+//	                        given by query "codec" (json, gob or msgpack) and
+//	                        compressed if query "compress" is true, and
+//	                        sharded across the number of files given by
+//	                        query "shards" (see shardFile), new IDs are
+//	                        generated as given by query "ids" (seq, uuid or
+//	                        ulid, see boltIDs)
+//	path/to/file            a boltdb file
+//	sqlite:///path/to/file  a SQLite file
+//
+// The values of a boltdb file are encrypted at rest if keyFile is not empty.
+func openStorage(storage, keyFile string) (expay.DB, error) {
+	u, err := url.Parse(storage)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile != "" && u.Scheme != "bolt" && u.Scheme != "" {
+		return nil, fmt.Errorf("encryption is not supported by storage %s", storage)
+	}
+	switch u.Scheme {
+	case "mem":
+		return memdb.New(), nil
+	case "bolt":
+		codec, err := boltCodec(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		shards, err := boltShards(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		ids, err := boltIDs(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		if shards > 1 {
+			if ids != nil {
+				return nil, fmt.Errorf("ids cannot be used with shards in storage %s", storage)
+			}
+			return openShards(u.Host+u.Path, shards, codec, keyFile)
+		}
+		return openBolt(u.Host+u.Path, codec, ids, keyFile)
+	case "sqlite":
+		return openSQLite(u.Host + u.Path)
+	case "":
+		return openBolt(storage, boltdb.JSON, nil, keyFile)
+	}
+	return nil, fmt.Errorf("unsupported storage %s", storage)
+}
+
+// boltFile returns the filename of a boltdb storage URL
+func boltFile(storage string) (string, error) {
+	u, err := url.Parse(storage)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "bolt":
+		if u.Query().Get("shards") != "" {
+			return "", fmt.Errorf("storage %s is sharded, give the file of each shard instead", storage)
+		}
+		return u.Host + u.Path, nil
+	case "":
+		return storage, nil
+	}
+	return "", fmt.Errorf("storage %s is not a boltdb file", storage)
+}
+
+// openBolt opens the payment bucket of a boltdb file (see paymentBucket) with
+// its indexes, aggregates and audit log ensured
+func openBolt(filename string, codec boltdb.Codec, ids expay.IDGenerator, keyFile string) (expay.DB, error) {
+	db, err := boltdb.New(filename)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := ensureBucket(db, codec, ids, keyFile)
+	if err != nil {
+		// release the file lock
+		_ = db.Close()
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// ensureBucket returns the payment bucket of db with its indexes, aggregates
+// and audit log ensured
+func ensureBucket(db *boltdb.DB, codec boltdb.Codec, ids expay.IDGenerator, keyFile string) (*boltdb.Bucket, error) {
+	bucket, err := paymentBucket(db, codec, ids, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := bucket.EnsureIndexes(&expay.Payment{}); err != nil {
+		return nil, err
+	}
+	if err := bucket.EnsureAggregates(&expay.Payment{}); err != nil {
+		return nil, err
+	}
+	if err := bucket.EnsureAuditLog(context.Background()); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// paymentBucket returns the payment bucket of a boltdb file with its indexes
+// and aggregates (tombstones excluded), its values versioned, its changes
+// logged, its writes audited, its revisions kept and archived by their
+// processing dates, the values are encrypted by the master keys in keyFile if
+// it is not empty, and new IDs are generated by ids or from the sequence of
+// the bucket if ids is nil
+func paymentBucket(db *boltdb.DB, codec boltdb.Codec, ids expay.IDGenerator, keyFile string) (*boltdb.Bucket, error) {
+	options := []boltdb.Option{
+		boltdb.WithCodec(codec),
+		boltdb.WithIDs(ids),
+		boltdb.WithSchema(expay.PaymentMigrations, &expay.Payment{}),
+		boltdb.WithChangeLog(),
+		boltdb.WithAuditLog(),
+		boltdb.WithHistory(),
+		boltdb.WithAggregates(expay.PaymentAggregates),
+		boltdb.WithArchive("processing_date"),
+	}
+	if keyFile != "" {
+		keys, err := boltdb.LoadMasterKeys(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, boltdb.WithEncryption(keys))
+	}
+	indexes := []boltdb.Index{}
+	for _, path := range expay.PaymentIndexes {
+		indexes = append(indexes, boltdb.FieldIndex(path))
+	}
+	deleted := boltdb.TimeIndex(expay.PaymentDeletedIndex)
+	deleted.KeepExcluded = true
+	indexes = append(indexes, deleted)
+	options = append(options, boltdb.WithIndexes(indexes...), boltdb.WithIndexExclude(expay.PaymentIndexExclude))
+	return db.Bucket("payment", options...), nil
+}
+
+// boltShards returns the number of shards given by the query of a bolt URL
+func boltShards(query url.Values) (int, error) {
+	v := query.Get("shards")
+	if v == "" {
+		return 1, nil
+	}
+	shards, err := strconv.Atoi(v)
+	if err != nil || shards < 1 || shards > sharddb.MaxShards {
+		return 0, fmt.Errorf("invalid shards %s", v)
+	}
+	return shards, nil
+}
+
+// shardFile returns the filename of shard i of a sharded boltdb storage, which
+// is the shard number inserted before the extension of filename, e.g.
+// storage.0.bolt
+func shardFile(filename string, i int) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + strconv.Itoa(i) + ext
+}
+
+// openShards opens the payment buckets of the shard files of a sharded boltdb
+// storage, payments are placed by their organisations
+func openShards(filename string, n int, codec boltdb.Codec, keyFile string) (expay.DB, error) {
+	shards := []expay.DB{}
+	for i := 0; i < n; i++ {
+		shard, err := openBolt(shardFile(filename, i), codec, nil, keyFile)
+		if err != nil {
+			// release the file locks of the shards already opened
+			for _, shard := range shards {
+				_ = closeStorage(shard)
+			}
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return sharddb.New(shards, paymentShardKey)
+}
+
+// closeStorage closes the files of a storage opened by openStorage, if any
+func closeStorage(db expay.DB) error {
+	if c, ok := db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// shardedFeatures are the features of a boltdb file used by the payment
+// service, which a sharded storage must support as well to be served, except
+// events, which cannot be merged across shards and are left unsupported (501)
+var shardedFeatures = []struct {
+	name   string
+	target interface{}
+}{
+	{"descending order", (*expay.Ranger)(nil)},
+	{"client ids", (*expay.IDCreator)(nil)},
+	{"index lookups", (*expay.Indexer)(nil)},
+	{"history", (*expay.Historian)(nil)},
+	{"stats", (*expay.Aggregator)(nil)},
+	{"archive", (*expay.Archiver)(nil)},
+}
+
+// checkServed returns an error listing the features of a boltdb file that
+// db lacks if it is a sharded storage, so that it is not served with some
+// endpoints missing
+func checkServed(storage string, db expay.DB) error {
+	if _, ok := db.(*sharddb.DB); !ok {
+		return nil
+	}
+	missing := []string{}
+	for _, f := range shardedFeatures {
+		if !expay.Supports(db, f.target) {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("sharded storage %s cannot be served, it does not support %s", storage, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// paymentShardKey returns the organisation of a payment as its shard key
+func paymentShardKey(v interface{}) string {
+	switch pay := v.(type) {
+	case expay.Payment:
+		return pay.OrganisationID
+	case *expay.Payment:
+		return pay.OrganisationID
+	}
+	return ""
+}
+
+// boltIDs returns the ID generator given by the query of a bolt URL, which is
+// nil for the sequence of the bucket
+func boltIDs(query url.Values) (expay.IDGenerator, error) {
+	switch v := query.Get("ids"); v {
+	case "", "seq":
+		return nil, nil
+	case "uuid":
+		return expay.NewUUID, nil
+	case "ulid":
+		return expay.NewULID, nil
+	default:
+		return nil, fmt.Errorf("unsupported ids %s", v)
+	}
+}
+
+// boltCodec returns the boltdb codec given by the query of a bolt URL
+func boltCodec(query url.Values) (boltdb.Codec, error) {
+	var codec boltdb.Codec
+	switch query.Get("codec") {
+	case "", "json":
+		codec = boltdb.JSON
+	case "gob":
+		codec = boltdb.Gob
+	case "msgpack":
+		codec = boltdb.MsgPack
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", query.Get("codec"))
+	}
+	if compress := query.Get("compress"); compress != "" {
+		ok, err := strconv.ParseBool(compress)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			codec = boltdb.Compressed(codec)
+		}
+	}
+	return codec, nil
+}
+
+// openSQLite opens the payment table of a SQLite file
+func openSQLite(filename string) (expay.DB, error) {
+	db, err := sql.Open("sqlite3", sqldb.SQLiteSource(filename))
+	if err != nil {
+		return nil, err
+	}
+	return sqldb.New(db, "payment")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"h12.io/expay/db/boltdb"
+)
+
+func TestOpenStorage(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "master.key")
+	if err := ioutil.WriteFile(keyFile, []byte("1 "+strings.Repeat("01", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		storage  string
+		keyFile  string
+		wantType string
+		wantErr  bool
+	}{
+		{storage: "mem://", wantType: "*memdb.DB"},
+		{storage: "bolt://" + path.Join(dir, "a.bolt"), wantType: "*boltdb.Bucket"},
+		{storage: path.Join(dir, "b.bolt"), wantType: "*boltdb.Bucket"},
+		{storage: "bolt://" + path.Join(dir, "d.bolt") + "?codec=gob&compress=true", wantType: "*boltdb.Bucket"},
+		{storage: "bolt://" + path.Join(dir, "n.bolt") + "?codec=msgpack", wantType: "*boltdb.Bucket"},
+		{storage: "bolt://" + path.Join(dir, "e.bolt") + "?codec=xml", wantErr: true},
+		{storage: "bolt://" + path.Join(dir, "e.bolt") + "?compress=maybe", wantErr: true},
+		{storage: "sqlite://" + path.Join(dir, "c.sqlite"), wantType: "*sqldb.DB"},
+		{storage: "unknown://", wantErr: true},
+		{storage: path.Join(dir, "f.bolt"), keyFile: keyFile, wantType: "*boltdb.Bucket"},
+		{storage: path.Join(dir, "g.bolt"), keyFile: path.Join(dir, "missing.key"), wantErr: true},
+		{storage: "mem://", keyFile: keyFile, wantErr: true},
+		{storage: "bolt://" + path.Join(dir, "h.bolt") + "?shards=2", wantType: "*sharddb.DB"},
+		{storage: "bolt://" + path.Join(dir, "i.bolt") + "?shards=0", wantErr: true},
+		{storage: "bolt://" + path.Join(dir, "j.bolt") + "?ids=uuid", wantType: "*boltdb.Bucket"},
+		{storage: "bolt://" + path.Join(dir, "k.bolt") + "?ids=ulid", wantType: "*boltdb.Bucket"},
+		{storage: "bolt://" + path.Join(dir, "l.bolt") + "?ids=random", wantErr: true},
+		{storage: "bolt://" + path.Join(dir, "m.bolt") + "?ids=uuid&shards=2", wantErr: true},
+	}
+	for _, tc := range testcases {
+		db, err := openStorage(tc.storage, tc.keyFile)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("expect error for %s but got nil", tc.storage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := fmt.Sprintf("%T", db); typ != tc.wantType {
+			t.Fatalf("expect %s for %s got %s", tc.wantType, tc.storage, typ)
+		}
+	}
+	for _, file := range []string{"a.bolt", "c.sqlite", "d.bolt", "h.0.bolt", "h.1.bolt"} {
+		if _, err := os.Stat(path.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenShardsFailure(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "storage.bolt")
+	if err := ioutil.WriteFile(shardFile(filename, 1), bytes.Repeat([]byte("x"), 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openStorage("bolt://"+filename+"?shards=2", ""); err == nil {
+		t.Fatal("expect invalid shard error got nil")
+	}
+	// shard 0 is closed, so its file lock is released
+	db, err := boltdb.NewReadOnly(shardFile(filename, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckServed(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		storage string
+		wantErr string
+	}{
+		{storage: "mem://"},
+		{storage: path.Join(dir, "a.bolt")},
+		{storage: "bolt://" + path.Join(dir, "b.bolt") + "?shards=2"},
+	} {
+		db, err := openStorage(tc.storage, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkServed(tc.storage, db)
+		if tc.wantErr == "" && err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), tc.wantErr)) {
+			t.Fatalf("expect error %q for %s got %v", tc.wantErr, tc.storage, err)
+		}
+	}
+}
+
+func TestBoltFile(t *testing.T) {
+	testcases := []struct {
+		storage  string
+		wantFile string
+		wantErr  bool
+	}{
+		{storage: "a.bolt", wantFile: "a.bolt"},
+		{storage: "bolt://dir/b.bolt?codec=gob", wantFile: "dir/b.bolt"},
+		{storage: "mem://", wantErr: true},
+		{storage: "sqlite://c.sqlite", wantErr: true},
+		{storage: "bolt://d.bolt?shards=2", wantErr: true},
+	}
+	for _, tc := range testcases {
+		file, err := boltFile(tc.storage)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("expect error for %s but got nil", tc.storage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != tc.wantFile {
+			t.Fatalf("expect %s got %s", tc.wantFile, file)
+		}
+	}
+}
@@ -3,4 +3,6 @@ package expay
 const (
 	// DefaultPort of the expay service
 	DefaultPort = 9201
+	// DefaultAdminPort of the admin service of expay
+	DefaultAdminPort = 9202
 )
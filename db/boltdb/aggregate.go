@@ -0,0 +1,279 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+type (
+	// aggregates are the running aggregates of a bucket, kept in sibling
+	// buckets and updated in the same transaction as the values
+	aggregates struct {
+		amount, unit, exclude []string
+		// groupings are the names of the groupings and the paths of their
+		// fields
+		groupings []grouping
+	}
+	grouping struct {
+		name  string
+		names []string
+	}
+	// contribution is what a value adds to the aggregates, which is kept to
+	// remove it when the value is updated or deleted
+	contribution struct {
+		Amount string            `json:"amount,omitempty"`
+		Unit   string            `json:"unit,omitempty"`
+		Groups map[string]string `json:"groups,omitempty"`
+	}
+)
+
+// errNoAggregates is returned when reading the aggregates of a bucket without
+// aggregates
+var errNoAggregates = &expay.Error{Code: expay.CodeNotSupported, Message: "bucket has no aggregates"}
+
+// totalRow is the key of the aggregate of every value, which never collides
+// with the key of a group
+var totalRow = []byte{0}
+
+// WithAggregates maintains the running aggregates of a bucket defined by spec
+func WithAggregates(spec expay.Aggregates) Option {
+	return func(b *Bucket) {
+		a := &aggregates{
+			amount:  splitPath(spec.Amount),
+			unit:    splitPath(spec.Unit),
+			exclude: splitPath(spec.Exclude),
+		}
+		for _, path := range spec.GroupBy {
+			names := splitPath(path)
+			a.groupings = append(a.groupings, grouping{name: names[len(names)-1], names: names})
+		}
+		b.aggregates = a
+	}
+}
+
+// splitPath returns the JSON names of a dot separated path, or nil if path is
+// empty
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// contributionOf returns the contribution of v, or nil if v is not aggregated
+func (a *aggregates) contributionOf(v interface{}) *contribution {
+	if v == nil || a.exclude != nil && fieldString(v, a.exclude) != "" {
+		return nil
+	}
+	c := &contribution{Groups: make(map[string]string)}
+	if amount := fieldString(v, a.amount); a.amount != nil && expay.IsDecimal(amount) {
+		c.Amount = amount
+		c.Unit = fieldString(v, a.unit)
+	}
+	for _, g := range a.groupings {
+		if group := fieldString(v, g.names); group != "" {
+			c.Groups[g.name] = group
+		}
+	}
+	return c
+}
+
+// aggregate returns the aggregate of the contribution, which is negative if
+// sign is negative
+func (c *contribution) aggregate(sign int64) expay.Aggregate {
+	a := expay.Aggregate{Count: sign}
+	if c.Amount != "" {
+		amount := c.Amount
+		if sign < 0 {
+			amount = negate(amount)
+		}
+		a.Sums = map[string]expay.Sum{c.Unit: {Count: sign, Amount: amount}}
+	}
+	return a
+}
+
+// negate returns the negative of a decimal
+func negate(amount string) string {
+	switch amount[0] {
+	case '-':
+		return amount[1:]
+	case '+':
+		return "-" + amount[1:]
+	}
+	return "-" + amount
+}
+
+// rows returns the keys of the aggregates the contribution adds to
+func (c *contribution) rows() [][]byte {
+	rows := [][]byte{totalRow}
+	for name, group := range c.Groups {
+		rows = append(rows, groupRow(name, group))
+	}
+	return rows
+}
+
+// groupRow returns the key of the aggregate of a group
+func groupRow(name, group string) []byte {
+	return []byte(name + "\x00" + group)
+}
+
+// aggregatesBucketName returns the name of the bucket of the aggregates
+func (b *Bucket) aggregatesBucketName() []byte {
+	return []byte(b.name + ".aggregates")
+}
+
+// contributionsBucketName returns the name of the bucket of the contribution
+// of each value, used to remove it from the aggregates
+func (b *Bucket) contributionsBucketName() []byte {
+	return []byte(b.name + ".aggregates.values")
+}
+
+// updateAggregates replaces the contribution of key to the aggregates with
+// that of v within tx, a nil v removes the contribution of key
+func (b *Bucket) updateAggregates(tx *bolt.Tx, key []byte, v interface{}) error {
+	if b.aggregates == nil {
+		return nil
+	}
+	aggregatesBucket, err := tx.CreateBucketIfNotExists(b.aggregatesBucketName())
+	if err != nil {
+		return err
+	}
+	contributions, err := tx.CreateBucketIfNotExists(b.contributionsBucketName())
+	if err != nil {
+		return err
+	}
+	if value := contributions.Get(key); value != nil {
+		old := &contribution{}
+		if err := json.Unmarshal(value, old); err != nil {
+			return err
+		}
+		if err := addContribution(aggregatesBucket, old, -1); err != nil {
+			return err
+		}
+		if err := contributions.Delete(key); err != nil {
+			return err
+		}
+	}
+	c := b.aggregates.contributionOf(v)
+	if c == nil {
+		return nil
+	}
+	if err := addContribution(aggregatesBucket, c, 1); err != nil {
+		return err
+	}
+	value, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return contributions.Put(key, value)
+}
+
+// addContribution adds (or removes if sign is negative) c to the aggregates in
+// bucket, the aggregate of a group is removed once it is empty
+func addContribution(bucket *bolt.Bucket, c *contribution, sign int64) error {
+	for _, row := range c.rows() {
+		a := expay.Aggregate{}
+		if value := bucket.Get(row); value != nil {
+			if err := json.Unmarshal(value, &a); err != nil {
+				return err
+			}
+		}
+		a, err := a.Merge(c.aggregate(sign))
+		if err != nil {
+			return err
+		}
+		if a.Count == 0 && !bytes.Equal(row, totalRow) {
+			if err := bucket.Delete(row); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := json.Marshal(&a)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(row, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the running aggregates of the bucket
+func (b *Bucket) Stats(ctx context.Context) (*expay.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if b.aggregates == nil {
+		return nil, errNoAggregates
+	}
+	stats := &expay.Stats{Groups: make(map[string]map[string]expay.Aggregate)}
+	for _, g := range b.aggregates.groupings {
+		stats.Groups[g.name] = make(map[string]expay.Aggregate)
+	}
+	err := b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.aggregatesBucketName())
+		if bucket == nil {
+			// nothing has been aggregated yet
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			a := expay.Aggregate{}
+			if err := json.Unmarshal(value, &a); err != nil {
+				return err
+			}
+			if bytes.Equal(key, totalRow) {
+				stats.Aggregate = a
+				return nil
+			}
+			i := bytes.IndexByte(key, 0)
+			if i < 0 {
+				return nil
+			}
+			if groups, ok := stats.Groups[string(key[:i])]; ok {
+				groups[string(key[i+1:])] = a
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// EnsureAggregates builds the aggregates from the existing values if they have
+// not been built yet, decoding every value into a new value of the type of v
+// (a pointer to a value of the bucket's type). It should be called before
+// serving if aggregates are declared on an existing bucket.
+func (b *Bucket) EnsureAggregates(v interface{}) error {
+	if b.aggregates == nil {
+		return nil
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.name))
+		if tx.Bucket(b.aggregatesBucketName()) != nil || bucket == nil {
+			return nil
+		}
+		if err := tx.DeleteBucket(b.contributionsBucketName()); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(b.aggregatesBucketName()); err != nil {
+			return err
+		}
+		typ := reflect.TypeOf(v).Elem()
+		return bucket.ForEach(func(key, value []byte) error {
+			v := reflect.New(typ).Interface()
+			if err := b.decode(tx, key, value, v); err != nil {
+				return err
+			}
+			return b.updateAggregates(tx, key, v)
+		})
+	})
+}
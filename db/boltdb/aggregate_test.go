@@ -0,0 +1,136 @@
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+)
+
+func TestAggregates(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	newPayment := func(org, amount, currency string) *expay.Payment {
+		pay := &expay.Payment{OrganisationID: org}
+		pay.Attributes.Amount = amount
+		pay.Attributes.Currency = currency
+		return pay
+	}
+	verify := func(bucket *Bucket, expected *expay.Stats) {
+		t.Helper()
+		stats, err := bucket.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Fatalf("expect %+v got %+v", expected, stats)
+		}
+	}
+
+	// values created before aggregates are declared
+	bucket := db.Bucket("payment")
+	id1, err := bucket.Create(ctx, newPayment("org1", "100.21", "GBP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Stats(ctx); err != errNoAggregates {
+		t.Fatalf("expect error %v got %v", errNoAggregates, err)
+	}
+
+	bucket = db.Bucket("payment", WithAggregates(expay.PaymentAggregates))
+	if err := bucket.EnsureAggregates(&expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	gbp := func(count int64, amount string) expay.Aggregate {
+		return expay.Aggregate{Count: count, Sums: map[string]expay.Sum{"GBP": {Count: count, Amount: amount}}}
+	}
+	verify(bucket, &expay.Stats{
+		Aggregate: gbp(1, "100.21"),
+		Groups: map[string]map[string]expay.Aggregate{
+			"currency":        {"GBP": gbp(1, "100.21")},
+			"organisation_id": {"org1": gbp(1, "100.21")},
+		},
+	})
+
+	id2, err := bucket.Create(ctx, newPayment("org2", "0.5", "GBP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id3, err := bucket.Create(ctx, newPayment("org1", "20", "EUR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not summed
+	if _, err := bucket.Create(ctx, newPayment("org2", "n/a", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	verify(bucket, &expay.Stats{
+		Aggregate: expay.Aggregate{Count: 4, Sums: map[string]expay.Sum{
+			"GBP": {Count: 2, Amount: "100.71"},
+			"EUR": {Count: 1, Amount: "20"},
+		}},
+		Groups: map[string]map[string]expay.Aggregate{
+			"currency": {
+				"GBP": gbp(2, "100.71"),
+				"EUR": {Count: 1, Sums: map[string]expay.Sum{"EUR": {Count: 1, Amount: "20"}}},
+				"USD": {Count: 1},
+			},
+			"organisation_id": {
+				"org1": {Count: 2, Sums: map[string]expay.Sum{
+					"GBP": {Count: 1, Amount: "100.21"},
+					"EUR": {Count: 1, Amount: "20"},
+				}},
+				"org2": {Count: 2, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "0.5"}}},
+			},
+		},
+	})
+
+	// update replaces the contribution of the value
+	if err := bucket.Update(ctx, id1, newPayment("org2", "1.00", "GBP")); err != nil {
+		t.Fatal(err)
+	}
+	// a tombstone is excluded
+	deleted := newPayment("org1", "20", "EUR")
+	now := time.Now()
+	deleted.DeletedAt = &now
+	if err := bucket.Update(ctx, id3, deleted); err != nil {
+		t.Fatal(err)
+	}
+	// rolled back with its transaction
+	if err := bucket.RunInTx(ctx, func(tx expay.Tx) error {
+		if _, err := tx.Create(newPayment("org1", "5", "GBP")); err != nil {
+			return err
+		}
+		return errNoAggregates
+	}); err != errNoAggregates {
+		t.Fatalf("expect error %v got %v", errNoAggregates, err)
+	}
+	if err := bucket.Delete(ctx, id2); err != nil {
+		t.Fatal(err)
+	}
+	verify(bucket, &expay.Stats{
+		Aggregate: expay.Aggregate{Count: 2, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "1.00"}}},
+		Groups: map[string]map[string]expay.Aggregate{
+			"currency": {
+				"GBP": gbp(1, "1.00"),
+				"USD": {Count: 1},
+			},
+			"organisation_id": {
+				"org2": {Count: 2, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "1.00"}}},
+			},
+		},
+	})
+}
@@ -0,0 +1,249 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+const (
+	// archiveBatchSize is the maximum number of values archived in a
+	// transaction
+	archiveBatchSize = 1000
+	// dateLayout is the layout of the date an index key of the archive
+	// starts with
+	dateLayout = "2006-01-02"
+	// monthLayout is the layout of the name of an archive partition
+	monthLayout = "2006-01"
+)
+
+// errNoArchive is returned when archiving a bucket without an archive
+var errNoArchive = &expay.Error{Code: expay.CodeNotSupported, Message: "bucket has no archive"}
+
+// WithArchive archives the values by the keys of index, which are dates
+// starting with the form 2006-01-02, e.g. FieldIndex("attributes.processing_date").
+// An archived value is moved as is (still encrypted) into the sibling bucket of
+// its month, e.g. payment.archive.2017-01, so the live bucket stays small. A
+// value without a date is never archived, nor is a value excluded from the
+// indexes (see WithIndexExclude).
+func WithArchive(index string) Option {
+	return func(b *Bucket) {
+		b.archive = index
+	}
+}
+
+// archiveBucketName returns the name of the bucket of the values archived in
+// month
+func (b *Bucket) archiveBucketName(month string) []byte {
+	return []byte(b.name + ".archive." + month)
+}
+
+// archivedBucketName returns the name of the bucket of the archived keys,
+// whose values are the months of their archive buckets
+func (b *Bucket) archivedBucketName() []byte {
+	return []byte(b.name + ".archived")
+}
+
+// archiveMonth returns the month of the archive partition of a date
+func archiveMonth(date string) (string, bool) {
+	if len(date) < len(dateLayout) {
+		return "", false
+	}
+	t, err := time.Parse(dateLayout, date[:len(dateLayout)])
+	if err != nil {
+		return "", false
+	}
+	return t.Format(monthLayout), true
+}
+
+// Archive moves the values whose dates are before the date of t into the
+// archive in batches of small transactions, so the bucket stays available for
+// reads and writes, and returns the number of archived values. Archived values
+// are removed from the indexes and the aggregates, while their history is
+// kept.
+func (b *Bucket) Archive(ctx context.Context, before time.Time) (n int, err error) {
+	if b.archive == "" {
+		return 0, errNoArchive
+	}
+	if _, ok := b.index(b.archive); !ok {
+		return 0, expay.ErrUnknownIndex
+	}
+	if b.encryption != nil {
+		// records are moved as is, which must not miss a key rotation
+		b.encryption.rotateMu.Lock()
+		defer b.encryption.rotateMu.Unlock()
+	}
+	end := before.Format(dateLayout)
+	for lastEntry := []byte(nil); ; {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		var count int
+		if err := b.update(func(tx *bolt.Tx) error {
+			var err error
+			lastEntry, count, err = b.archiveBatch(ctx, tx, lastEntry, end)
+			return err
+		}); err != nil {
+			return n, err
+		}
+		n += count
+		if lastEntry == nil {
+			return n, nil
+		}
+	}
+}
+
+// archiveBatch archives the values of at most archiveBatchSize index entries
+// after lastEntry whose dates are before end, and returns the last entry
+// scanned or nil if there are no more entries before end
+func (b *Bucket) archiveBatch(ctx context.Context, tx *bolt.Tx, lastEntry []byte, end string) (last []byte, count int, err error) {
+	indexBucket := tx.Bucket(b.indexBucketName(b.archive))
+	if indexBucket == nil {
+		return nil, 0, nil
+	}
+	type archived struct {
+		key   []byte
+		month string
+	}
+	var values []archived
+	cursor := indexBucket.Cursor()
+	entry, _ := cursor.First()
+	if lastEntry != nil {
+		// archived entries are deleted, so lastEntry may have gone
+		entry, _ = cursor.Seek(lastEntry)
+		if bytes.Equal(entry, lastEntry) {
+			entry, _ = cursor.Next()
+		}
+	}
+	for i := 0; entry != nil && i < archiveBatchSize; i++ {
+		indexKey, key := splitIndexEntry(entry)
+		if string(indexKey) >= end {
+			entry = nil
+			break
+		}
+		last = append([]byte{}, entry...)
+		if month, ok := archiveMonth(string(indexKey)); ok {
+			values = append(values, archived{key: append([]byte{}, key...), month: month})
+		}
+		entry, _ = cursor.Next()
+	}
+	if entry == nil {
+		last = nil
+	}
+	for _, v := range values {
+		ok, err := b.archiveValue(ctx, tx, v.key, v.month)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return last, count, nil
+}
+
+// archiveValue moves the value of key into the archive bucket of month, and
+// returns false if key does not exist (e.g. already archived)
+func (b *Bucket) archiveValue(ctx context.Context, tx *bolt.Tx, key []byte, month string) (bool, error) {
+	bucket := tx.Bucket([]byte(b.name))
+	if bucket == nil {
+		return false, nil
+	}
+	value := bucket.Get(key)
+	if value == nil {
+		return false, nil
+	}
+	// copy the value because its memory is invalidated by the writes
+	value = append([]byte{}, value...)
+	archive, err := tx.CreateBucketIfNotExists(b.archiveBucketName(month))
+	if err != nil {
+		return false, err
+	}
+	if err := archive.Put(key, value); err != nil {
+		return false, err
+	}
+	archived, err := tx.CreateBucketIfNotExists(b.archivedBucketName())
+	if err != nil {
+		return false, err
+	}
+	if err := archived.Put(key, []byte(month)); err != nil {
+		return false, err
+	}
+	if err := bucket.Delete(key); err != nil {
+		return false, err
+	}
+	if err := b.logChange(tx, expay.OpArchive, key); err != nil {
+		return false, err
+	}
+	if err := b.logAudit(ctx, tx, expay.OpArchive, key, value); err != nil {
+		return false, err
+	}
+	if err := b.updateAggregates(tx, key, nil); err != nil {
+		return false, err
+	}
+	return true, b.updateIndexes(tx, key, nil)
+}
+
+// isArchived returns if key has been archived
+func (b *Bucket) isArchived(tx *bolt.Tx, key []byte) bool {
+	archived := tx.Bucket(b.archivedBucketName())
+	return archived != nil && archived.Get(key) != nil
+}
+
+// archivedValue returns the archived value of key, or nil if key is not
+// archived
+func (b *Bucket) archivedValue(tx *bolt.Tx, key []byte) []byte {
+	archived := tx.Bucket(b.archivedBucketName())
+	if archived == nil {
+		return nil
+	}
+	month := archived.Get(key)
+	if month == nil {
+		return nil
+	}
+	archive := tx.Bucket(b.archiveBucketName(string(month)))
+	if archive == nil {
+		return nil
+	}
+	return archive.Get(key)
+}
+
+// archiveBucketNames returns the names of the archive buckets
+func (b *Bucket) archiveBucketNames() (names [][]byte, err error) {
+	prefix := b.archiveBucketName("")
+	err = b.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, prefix) {
+				names = append(names, append([]byte{}, name...))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// GetArchived reads the archived value of id into v
+func (b *Bucket) GetArchived(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return b.view(func(tx *bolt.Tx) error {
+		value := b.archivedValue(tx, key)
+		if value == nil {
+			return expay.ErrNotFound
+		}
+		return b.decode(tx, key, value, v)
+	})
+}
+
+// PaginateArchived is the same as Paginate over the archived values
+func (b *Bucket) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return b.paginate(ctx, true, lastCursor, limit)
+}
@@ -0,0 +1,245 @@
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := db.Bucket("payment").Archive(ctx, time.Now()); err != errNoArchive {
+		t.Fatalf("expect error %v got %v", errNoArchive, err)
+	}
+	bucket := db.Bucket("payment",
+		WithIndexes(FieldIndex("attributes.processing_date")),
+		WithAggregates(expay.PaymentAggregates),
+		WithArchive("processing_date"),
+		WithChangeLog(),
+	)
+	ids := make(map[string]string)
+	for _, date := range []string{"2017-01-18", "2017-02-01", "2017-01-01", "2017-03-01", "", "n/a"} {
+		pay := &expay.Payment{}
+		pay.Attributes.ProcessingDate = date
+		id, err := bucket.Create(ctx, pay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[date] = id
+	}
+	n, err := bucket.Archive(ctx, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expect %d got %d", 3, n)
+	}
+	// archived once
+	if n, err := bucket.Archive(ctx, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil || n != 0 {
+		t.Fatalf("expect %d got %d, %v", 0, n, err)
+	}
+
+	for _, date := range []string{"2017-01-18", "2017-02-01", "2017-01-01"} {
+		id := ids[date]
+		pay := expay.Payment{}
+		if err := bucket.Get(ctx, id, &pay); err != expay.ErrNotFound {
+			t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+		}
+		if err := bucket.GetArchived(ctx, id, &pay); err != nil {
+			t.Fatal(err)
+		}
+		if pay.Attributes.ProcessingDate != date {
+			t.Fatalf("expect %s got %s", date, pay.Attributes.ProcessingDate)
+		}
+		// archived values are read-only
+		if err := bucket.Update(ctx, id, &pay); err != expay.ErrArchived {
+			t.Fatalf("expect error %v got %v", expay.ErrArchived, err)
+		}
+	}
+	for _, date := range []string{"2017-03-01", "", "n/a"} {
+		pay := expay.Payment{}
+		if err := bucket.Get(ctx, ids[date], &pay); err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.GetArchived(ctx, ids[date], &pay); err != expay.ErrNotFound {
+			t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+		}
+	}
+
+	// partitioned by month
+	for month, expected := range map[string][]string{
+		"2017-01": {ids["2017-01-18"], ids["2017-01-01"]},
+		"2017-02": {ids["2017-02-01"]},
+	} {
+		keys := []string{}
+		if err := bucket.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucket.archiveBucketName(month)).ForEach(func(key, _ []byte) error {
+				keys = append(keys, keyID(key))
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("expect %v got %v", expected, keys)
+		}
+	}
+
+	// removed from the indexes and the aggregates
+	iter, err := bucket.LookupRange(ctx, "processing_date", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexed []string
+	for iter.Next() {
+		pay := expay.Payment{}
+		id, err := iter.Scan(&pay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed = append(indexed, id)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{ids["2017-03-01"], ids["n/a"]}; !reflect.DeepEqual(indexed, expected) {
+		t.Fatalf("expect %v got %v", expected, indexed)
+	}
+	stats, err := bucket.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 3 {
+		t.Fatalf("expect %d got %d", 3, stats.Count)
+	}
+	changes, err := bucket.Watch(ctx, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].Op != expay.OpArchive {
+		t.Fatalf("expect 3 archive changes got %v", changes)
+	}
+
+	for _, testcase := range []struct {
+		cursor   string
+		limit    int
+		expected []string
+	}{
+		{"", 0, []string{ids["2017-01-18"], ids["2017-02-01"], ids["2017-01-01"]}},
+		{ids["2017-01-18"], 1, []string{ids["2017-02-01"]}},
+		{ids["2017-01-01"], -2, []string{ids["2017-02-01"], ids["2017-01-18"]}},
+	} {
+		iter, err := bucket.PaginateArchived(ctx, testcase.cursor, testcase.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archived := []string{}
+		for iter.Next() {
+			pay := expay.Payment{}
+			id, err := iter.Scan(&pay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archived = append(archived, id)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(archived, testcase.expected) {
+			t.Fatalf("expect %v got %v", testcase.expected, archived)
+		}
+	}
+}
+
+func TestArchiveWithID(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("payment",
+		WithIndexes(FieldIndex("attributes.processing_date")),
+		WithArchive("processing_date"),
+	)
+	id := "7c0a4e1b-0a2b-4c3d-8e9f-0123456789ab"
+	pay := &expay.Payment{}
+	pay.Attributes.ProcessingDate = "2017-01-18"
+	if err := bucket.CreateWithID(ctx, id, pay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Archive(ctx, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.CreateWithID(ctx, id, pay); err != expay.ErrArchived {
+		t.Fatalf("expect error %v got %v", expay.ErrArchived, err)
+	}
+}
+
+func TestArchiveRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	options := []Option{
+		WithIndexes(FieldIndex("attributes.processing_date")),
+		WithArchive("processing_date"),
+	}
+	bucket := db.Bucket("payment", append(options, WithEncryption(keys))...)
+	pay := &expay.Payment{OrganisationID: "org"}
+	pay.Attributes.ProcessingDate = "2017-01-18"
+	id, err := bucket.Create(ctx, pay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Archive(ctx, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keys.filename, []byte(testMasterKey1+testMasterKey2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := bucket.RotateKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expect %d got %d", 1, n)
+	}
+
+	bucket = db.Bucket("payment", append(options, WithEncryption(newTestMasterKeys(t, dir, testMasterKey2)))...)
+	archived := expay.Payment{}
+	if err := bucket.GetArchived(ctx, id, &archived); err != nil {
+		t.Fatal(err)
+	}
+	if archived.OrganisationID != "org" {
+		t.Fatalf("expect %s got %s", "org", archived.OrganisationID)
+	}
+}
@@ -0,0 +1,267 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+var (
+	// errNoAuditLog is returned when verifying a bucket without an audit log
+	errNoAuditLog = &expay.Error{Code: expay.CodeNotSupported, Message: "bucket has no audit log"}
+	// errAuditStarted is returned when starting an audit log with a baseline
+	// after it has been started
+	errAuditStarted = &expay.Error{Code: expay.CodeConflict, Message: "audit log has been started"}
+)
+
+// auditHeadKey is the key of the head of the audit log, which sorts after the
+// keys of the entries
+var auditHeadKey = []byte("head")
+
+// auditHead is the sequence number and the hash of the last entry of the
+// audit log, so that removing the last entries breaks the log
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// WithAuditLog keeps an append-only audit log of every write to the values of
+// a bucket (including archiving and migrating them), with the actor (see
+// expay.WithActor), the time and the digest of the value of each write. The
+// entries are kept in a sibling bucket keyed by their sequence numbers and are
+// chained by their hashes (see expay.AuditEntry), and they are written in the
+// same transaction as the values, so a value cannot be written without its
+// entry, while the head of the log is kept in the same bucket. The digest is
+// taken before encryption, so rotating the keys is not a write.
+func WithAuditLog() Option {
+	return func(b *Bucket) {
+		b.audit = true
+	}
+}
+
+func (b *Bucket) auditBucketName() []byte {
+	return []byte(b.name + ".audit")
+}
+
+// logAudit appends an entry of writing the record value (nil if deleted) as
+// key to the audit log within tx
+func (b *Bucket) logAudit(ctx context.Context, tx *bolt.Tx, op string, key, value []byte) error {
+	if !b.audit {
+		return nil
+	}
+	bucket, err := tx.CreateBucketIfNotExists(b.auditBucketName())
+	if err != nil {
+		return err
+	}
+	digest, err := b.auditDigest(tx, key, value)
+	if err != nil {
+		return err
+	}
+	var head auditHead
+	if value := bucket.Get(auditHeadKey); value != nil {
+		if err := json.Unmarshal(value, &head); err != nil {
+			return err
+		}
+	}
+	entry := expay.AuditEntry{
+		Seq:      head.Seq + 1,
+		Op:       op,
+		ID:       keyID(key),
+		Actor:    expay.Actor(ctx),
+		Time:     b.now().UTC(),
+		Digest:   digest,
+		PrevHash: head.Hash,
+	}
+	entry.Hash = entry.ChainHash()
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(itob(entry.Seq), data); err != nil {
+		return err
+	}
+	data, err = json.Marshal(&auditHead{Seq: entry.Seq, Hash: entry.Hash})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(auditHeadKey, data)
+}
+
+// auditDigest returns the digest of the record value of key, decrypted if it
+// is encrypted, or empty if value is nil
+func (b *Bucket) auditDigest(tx *bolt.Tx, key, value []byte) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	if len(value) > 0 && value[0] == encryptedMarker {
+		var err error
+		if value, err = b.decrypt(tx, key, value); err != nil {
+			return "", err
+		}
+	}
+	return expay.AuditDigest(value), nil
+}
+
+// EnsureAuditLog starts an empty audit log if it has not been started and
+// there is no live or archived value yet. It returns expay.ErrAuditBroken if
+// the audit log is missing while there are values, which have been stored
+// either before the audit log was enabled (see BaselineAudit) or after it was
+// removed. It should be called before serving.
+func (b *Bucket) EnsureAuditLog(ctx context.Context) error {
+	if !b.audit {
+		return nil
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(b.auditBucketName()) != nil {
+			return nil
+		}
+		if err := b.forEachValue(tx, func(key, value []byte) error {
+			return errAuditBroken("audit log is missing")
+		}); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(b.auditBucketName())
+		return err
+	})
+}
+
+// BaselineAudit starts the audit log of a bucket whose values have been stored
+// before the audit log was enabled, with a baseline entry of every live and
+// archived value, and returns the number of entries. The values are trusted
+// as they are, so it must be run explicitly, and it returns an error if the
+// audit log has been started.
+func (b *Bucket) BaselineAudit(ctx context.Context) (n int, err error) {
+	if !b.audit {
+		return 0, errNoAuditLog
+	}
+	err = b.update(func(tx *bolt.Tx) error {
+		n = 0
+		if tx.Bucket(b.auditBucketName()) != nil {
+			return errAuditStarted
+		}
+		if _, err := tx.CreateBucket(b.auditBucketName()); err != nil {
+			return err
+		}
+		return b.forEachValue(tx, func(key, value []byte) error {
+			n++
+			return b.logAudit(ctx, tx, expay.OpBaseline, key, value)
+		})
+	})
+	return n, err
+}
+
+// forEachValue calls fn with every live and archived value within tx
+func (b *Bucket) forEachValue(tx *bolt.Tx, fn func(key, value []byte) error) error {
+	names := [][]byte{[]byte(b.name)}
+	prefix := b.archiveBucketName("")
+	if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasPrefix(name, prefix) {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			continue
+		}
+		if err := bucket.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyAudit verifies within a read transaction that the entries of the audit
+// log are numbered without gaps up to the head of the log, each one is
+// chained to the previous one by its hash, and every live or archived value
+// matches the digest of its last entry, and that no value exists without its
+// entries or has gone without its delete entry. It returns the number of
+// entries and the hash of the last one.
+func (b *Bucket) VerifyAudit(ctx context.Context) (n int, head string, err error) {
+	if !b.audit {
+		return 0, "", errNoAuditLog
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+	err = b.view(func(tx *bolt.Tx) error {
+		// digests of the values by their IDs as recorded in the log
+		digests := make(map[string]string)
+		if bucket := tx.Bucket(b.auditBucketName()); bucket != nil {
+			var last uint64
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if bytes.Equal(key, auditHeadKey) {
+					continue
+				}
+				var entry expay.AuditEntry
+				if err := json.Unmarshal(value, &entry); err != nil {
+					return errAuditBroken("invalid entry %x: %v", key, err)
+				}
+				switch {
+				case len(key) != 8 || binary.BigEndian.Uint64(key) != last+1 || entry.Seq != last+1:
+					return errAuditBroken("entry %d is missing", last+1)
+				case entry.PrevHash != head:
+					return errAuditBroken("entry %d is not chained to entry %d", entry.Seq, last)
+				case entry.Hash != entry.ChainHash():
+					return errAuditBroken("entry %d is altered", entry.Seq)
+				}
+				last, head = entry.Seq, entry.Hash
+				n++
+				if entry.Op == expay.OpDelete {
+					delete(digests, entry.ID)
+				} else {
+					digests[entry.ID] = entry.Digest
+				}
+			}
+			var stored auditHead
+			if value := bucket.Get(auditHeadKey); value != nil {
+				if err := json.Unmarshal(value, &stored); err != nil {
+					return errAuditBroken("invalid head: %v", err)
+				}
+			}
+			if stored.Seq != last || stored.Hash != head {
+				return errAuditBroken("entries after entry %d are missing", last)
+			}
+		}
+		if err := b.forEachValue(tx, func(key, value []byte) error {
+			id := keyID(key)
+			expected, ok := digests[id]
+			if !ok {
+				return errAuditBroken("value %s is not in the log", id)
+			}
+			digest, err := b.auditDigest(tx, key, value)
+			if err != nil {
+				return fmt.Errorf("read value %s: %w", id, err)
+			}
+			if digest != expected {
+				return errAuditBroken("value %s is altered", id)
+			}
+			delete(digests, id)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for id := range digests {
+			return errAuditBroken("value %s is missing", id)
+		}
+		return nil
+	})
+	return n, head, err
+}
+
+// errAuditBroken returns expay.ErrAuditBroken with the break found
+func errAuditBroken(format string, args ...interface{}) error {
+	return &expay.Error{Code: expay.CodeCorrupted, Message: expay.ErrAuditBroken.Message + ": " + fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,311 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// auditEntries returns the entries of the audit log of a bucket
+func auditEntries(t *testing.T, b *Bucket) (entries []expay.AuditEntry) {
+	t.Helper()
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.auditBucketName()).ForEach(func(key, value []byte) error {
+			if bytes.Equal(key, auditHeadKey) {
+				return nil
+			}
+			var entry expay.AuditEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// newAuditedBucket creates a bucket with an audit log in a new file of dir, and
+// writes a value of each operation
+func newAuditedBucket(t *testing.T, dir, name string) (b *Bucket, ids []string) {
+	t.Helper()
+	db, err := New(path.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := expay.WithActor(context.Background(), "alice")
+	b = db.Bucket("payment",
+		WithIndexes(FieldIndex("attributes.processing_date")),
+		WithArchive("processing_date"),
+		WithAuditLog(),
+	)
+	for _, date := range []string{"2017-01-18", "2017-03-01", "2017-03-02"} {
+		pay := &expay.Payment{}
+		pay.Attributes.ProcessingDate = date
+		id, err := b.Create(ctx, pay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := b.Update(ctx, ids[1], &expay.Payment{OrganisationID: "org"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Archive(ctx, time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	return b, ids
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	bucket, ids := newAuditedBucket(t, dir, "db.bolt")
+
+	entries := auditEntries(t, bucket)
+	ops := []string{}
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) || entry.Actor != "alice" || entry.Time.IsZero() {
+			t.Fatalf("expect entry %d by alice got %+v", i+1, entry)
+		}
+		if i > 0 && entry.PrevHash != entries[i-1].Hash {
+			t.Fatalf("expect entry %d chained got %+v", i+1, entry)
+		}
+		ops = append(ops, entry.Op+" "+entry.ID)
+	}
+	expected := []string{
+		"create " + ids[0], "create " + ids[1], "create " + ids[2],
+		"update " + ids[1], "delete " + ids[2], "archive " + ids[0],
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("expect %v got %v", expected, ops)
+	}
+	if entries[4].Digest != "" || entries[5].Digest != entries[0].Digest {
+		t.Fatalf("expect digests of the deleted and archived values got %+v", entries)
+	}
+
+	n, head, err := bucket.VerifyAudit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(entries) || head != entries[len(entries)-1].Hash {
+		t.Fatalf("expect %d, %s got %d, %s", len(entries), entries[len(entries)-1].Hash, n, head)
+	}
+
+	// a failed write is not recorded
+	if err := bucket.Update(ctx, ids[0], &expay.Payment{}); err != expay.ErrArchived {
+		t.Fatalf("expect error %v got %v", expay.ErrArchived, err)
+	}
+	if n, _, err := bucket.VerifyAudit(ctx); err != nil || n != len(entries) {
+		t.Fatalf("expect %d got %d, %v", len(entries), n, err)
+	}
+}
+
+func TestAuditTampered(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	for i, testcase := range []struct {
+		name   string
+		tamper func(tx *bolt.Tx, b *Bucket, live []byte) error
+	}{
+		{"value overwritten", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.Bucket([]byte(b.name)).Put(live, []byte(`{"organisation_id":"evil"}`))
+		}},
+		{"value inserted", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.Bucket([]byte(b.name)).Put(itob(100), []byte(`{}`))
+		}},
+		{"value removed", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.Bucket([]byte(b.name)).Delete(live)
+		}},
+		{"archived value overwritten", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			archive := tx.Bucket(b.archiveBucketName("2017-01"))
+			key, _ := archive.Cursor().First()
+			return archive.Put(key, []byte(`{}`))
+		}},
+		{"entry altered", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			audit := tx.Bucket(b.auditBucketName())
+			var entry expay.AuditEntry
+			if err := json.Unmarshal(audit.Get(itob(2)), &entry); err != nil {
+				return err
+			}
+			entry.Actor = "bob"
+			value, _ := json.Marshal(&entry)
+			return audit.Put(itob(2), value)
+		}},
+		{"entry rehashed", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			audit := tx.Bucket(b.auditBucketName())
+			var entry expay.AuditEntry
+			if err := json.Unmarshal(audit.Get(itob(2)), &entry); err != nil {
+				return err
+			}
+			entry.Actor = "bob"
+			entry.Hash = entry.ChainHash()
+			value, _ := json.Marshal(&entry)
+			return audit.Put(itob(2), value)
+		}},
+		{"entry removed", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.Bucket(b.auditBucketName()).Delete(itob(3))
+		}},
+		{"last entry removed", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.Bucket(b.auditBucketName()).Delete(itob(6))
+		}},
+		{"log removed", func(tx *bolt.Tx, b *Bucket, live []byte) error {
+			return tx.DeleteBucket(b.auditBucketName())
+		}},
+	} {
+		bucket, ids := newAuditedBucket(t, dir, strconv.Itoa(i)+".bolt")
+		live, err := idKey(ids[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.db.Update(func(tx *bolt.Tx) error {
+			return testcase.tamper(tx, bucket, live)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := bucket.VerifyAudit(ctx); !errors.Is(err, expay.ErrAuditBroken) {
+			t.Fatalf("%s: expect error %v got %v", testcase.name, expay.ErrAuditBroken, err)
+		}
+		// still broken when opened again, a removed log is not restarted
+		err = bucket.EnsureAuditLog(ctx)
+		if err == nil {
+			_, _, err = bucket.VerifyAudit(ctx)
+		}
+		if !errors.Is(err, expay.ErrAuditBroken) {
+			t.Fatalf("%s: expect error %v after opening again got %v", testcase.name, expay.ErrAuditBroken, err)
+		}
+	}
+}
+
+func TestEnsureAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ids := []string{}
+	for _, name := range []string{"a", "b"} {
+		id, err := db.Bucket("test").Create(ctx, &recordV0{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	bucket := db.Bucket("test", WithAuditLog())
+	if _, _, err := bucket.VerifyAudit(ctx); !errors.Is(err, expay.ErrAuditBroken) {
+		t.Fatalf("expect error %v got %v", expay.ErrAuditBroken, err)
+	}
+	// the values stored without the log are not trusted implicitly
+	if err := bucket.EnsureAuditLog(ctx); !errors.Is(err, expay.ErrAuditBroken) {
+		t.Fatalf("expect error %v got %v", expay.ErrAuditBroken, err)
+	}
+	if n, err := bucket.BaselineAudit(ctx); err != nil || n != 2 {
+		t.Fatalf("expect %d got %d, %v", 2, n, err)
+	}
+	if _, err := bucket.BaselineAudit(ctx); err != errAuditStarted {
+		t.Fatalf("expect error %v got %v", errAuditStarted, err)
+	}
+	if err := bucket.EnsureAuditLog(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries := auditEntries(t, bucket)
+	if len(entries) != 2 || entries[0].Op != expay.OpBaseline || entries[1].ID != ids[1] {
+		t.Fatalf("expect baseline entries of %v got %+v", ids, entries)
+	}
+	if n, _, err := bucket.VerifyAudit(ctx); err != nil || n != 2 {
+		t.Fatalf("expect %d got %d, %v", 2, n, err)
+	}
+	if _, _, err := db.Bucket("test").VerifyAudit(ctx); err != errNoAuditLog {
+		t.Fatalf("expect error %v got %v", errNoAuditLog, err)
+	}
+
+	// an empty log is started without values
+	empty := db.Bucket("empty", WithAuditLog())
+	if err := empty.EnsureAuditLog(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Create(ctx, &recordV0{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.EnsureAuditLog(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := empty.VerifyAudit(ctx); err != nil || n != 1 {
+		t.Fatalf("expect %d got %d, %v", 1, n, err)
+	}
+}
+
+func TestAuditRewrites(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	bucket := db.Bucket("test", WithSchema(testMigrations[:1], nil), WithEncryption(keys), WithAuditLog())
+	if _, err := bucket.Create(ctx, map[string]interface{}{"full_name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// re-encrypted without writing
+	if err := ioutil.WriteFile(keys.filename, []byte(testMasterKey1+testMasterKey2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.RotateKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := bucket.VerifyAudit(ctx); err != nil || n != 1 {
+		t.Fatalf("expect %d got %d, %v", 1, n, err)
+	}
+
+	// migrated with an entry
+	bucket = db.Bucket("test", WithSchema(testMigrations, nil), WithEncryption(keys), WithAuditLog())
+	if err := bucket.Migrate(ctx, 10, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := bucket.VerifyAudit(ctx); err != nil || n != 2 {
+		t.Fatalf("expect %d got %d, %v", 2, n, err)
+	}
+	if op := auditEntries(t, bucket)[1].Op; op != expay.OpMigrate {
+		t.Fatalf("expect %s got %s", expay.OpMigrate, op)
+	}
+
+	// cannot be verified without the keys
+	if _, _, err := db.Bucket("test", WithAuditLog()).VerifyAudit(ctx); err == nil || errors.Is(err, expay.ErrAuditBroken) {
+		t.Fatalf("expect error %v got %v", errNoMasterKeys, err)
+	}
+}
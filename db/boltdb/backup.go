@@ -0,0 +1,157 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+// lockTimeout is how long Restore waits for the file lock of the storage
+const lockTimeout = 100 * time.Millisecond
+
+// errInUse is returned when restoring a storage that is open by a server
+var errInUse = errors.New("storage is in use, stop the server before restoring")
+
+// errTruncated is returned when verifying a truncated boltdb file
+var errTruncated = errors.New("boltdb file is truncated")
+
+// Backup writes a consistent snapshot of the whole boltdb file, including
+// every bucket, to w within a read transaction, so that writes are not
+// blocked during the backup
+func (b *Bucket) Backup(ctx context.Context, w io.Writer) (n int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	err = b.view(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(&ctxWriter{ctx: ctx, w: w})
+		return err
+	})
+	return n, err
+}
+
+// ctxWriter stops writing when ctx is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// Verify checks the consistency of a boltdb file, e.g. a backup, without
+// modifying it
+func Verify(filename string) error {
+	if err := checkSize(filename); err != nil {
+		return err
+	}
+	db, err := bolt.Open(filename, 0666, &bolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	})
+}
+
+// boltdb meta page layout, see the page and meta structs of bbolt
+const (
+	boltMagic        = 0xED0CDAED
+	metaMagicOff     = 16
+	metaPageSizeOff  = 24
+	metaHighWaterOff = 56
+	metaSize         = 64
+)
+
+// checkSize returns an error if the file is shorter than the pages referenced
+// by its meta pages, because boltdb maps the file without checking its size
+// and faults on a truncated one
+func checkSize(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var size int64
+	var offset int64
+	for i := 0; i < 2; i++ {
+		meta := make([]byte, metaSize)
+		if _, err := f.ReadAt(meta, offset); err != nil {
+			return errTruncated
+		}
+		if binary.LittleEndian.Uint32(meta[metaMagicOff:]) != boltMagic {
+			// left for boltdb to report
+			return nil
+		}
+		pageSize := int64(binary.LittleEndian.Uint32(meta[metaPageSizeOff:]))
+		highWater := int64(binary.LittleEndian.Uint64(meta[metaHighWaterOff:]))
+		if highWater*pageSize > size {
+			size = highWater * pageSize
+		}
+		offset = pageSize
+	}
+	if info.Size() < size {
+		return errTruncated
+	}
+	return nil
+}
+
+// Restore replaces the boltdb file filename with the backup file after
+// verifying it. The replacement is atomic and fails if filename is open by
+// another process.
+func Restore(backup, filename string) error {
+	if err := Verify(backup); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: lockTimeout})
+		if err == bolt.ErrTimeout {
+			return errInUse
+		} else if err != nil {
+			return err
+		}
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), filename)
+}
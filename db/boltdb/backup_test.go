@@ -0,0 +1,99 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+	id, err := bucket.Create(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := bucket.Backup(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("expect %d got %d", buf.Len(), n)
+	}
+	backup := path.Join(dir, "backup.bolt")
+	if err := ioutil.WriteFile(backup, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(backup); err != nil {
+		t.Fatal(err)
+	}
+	// written after the backup
+	if err := bucket.Update(ctx, id, "def"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the storage is open
+	if err := Restore(backup, path.Join(dir, "db.bolt")); err != errInUse {
+		t.Fatalf("expect error %v got %v", errInUse, err)
+	}
+	if err := db.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(backup, path.Join(dir, "db.bolt")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	var s string
+	if err := db.Bucket("test").Get(ctx, id, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "abc" {
+		t.Fatalf("expect %s got %s", "abc", s)
+	}
+
+	// a corrupted backup is not restored
+	if err := ioutil.WriteFile(backup, buf.Bytes()[:buf.Len()/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(backup, path.Join(dir, "new.bolt")); err != errTruncated {
+		t.Fatalf("expect error %v got %v", errTruncated, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "new.bolt")); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist got %v", err)
+	}
+}
+
+func TestBackupCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.Bucket("test").Backup(ctx, ioutil.Discard); err != context.Canceled {
+		t.Fatalf("expect error %v got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,166 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/etcd-io/bbolt"
+)
+
+// maxBatchSize is the maximum number of writes committed in a transaction
+const maxBatchSize = 1000
+
+// errLead is sent to a waiting write to make it commit the pending writes
+var errLead = errors.New("lead the next commit")
+
+type (
+	// batcher coalesces concurrent writes into shared transactions (group
+	// commit), so that they share a disk sync. A write arriving while a commit
+	// is in progress waits for the next one, which is led by the first waiting
+	// write, so there is no delay when there is no concurrent write.
+	//
+	// Unlike bolt.DB.Batch, a failed write never runs twice: the transaction
+	// is rolled back, the error is returned to that write only and the other
+	// writes are run again in a new transaction. A write that panics fails the
+	// same way.
+	batcher struct {
+		db         *bolt.DB
+		mu         sync.Mutex
+		pending    []*write
+		committing bool
+	}
+	write struct {
+		fn   func(*bolt.Tx) error
+		done chan error
+	}
+)
+
+func newBatcher(db *bolt.DB) *batcher {
+	return &batcher{db: db}
+}
+
+// update runs fn within a read-write transaction shared with other concurrent
+// writes, fn may be called more than once if another write fails. A write
+// waiting for the next commit returns ctx.Err() when ctx is done, while a
+// write already being committed waits for its result.
+func (b *batcher) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	w := &write{fn: fn, done: make(chan error, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, w)
+	lead := !b.committing
+	b.committing = true
+	b.mu.Unlock()
+
+	if !lead {
+		var err error
+		select {
+		case err = <-w.done:
+		case <-ctx.Done():
+			if b.cancel(w) {
+				return ctx.Err()
+			}
+			err = <-w.done
+		}
+		if err != errLead {
+			return err
+		}
+	}
+	b.commit(b.next())
+	return <-w.done
+}
+
+// cancel removes w from the pending writes and hands over the next commit if
+// it has been handed to w, it returns false if w is being committed
+func (b *batcher) cancel(w *write) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, p := range b.pending {
+		if p != w {
+			continue
+		}
+		b.pending = append(b.pending[:i:i], b.pending[i+1:]...)
+		select {
+		case <-w.done:
+			// errLead, the only message sent to a pending write
+			b.handOver()
+		default:
+		}
+		return true
+	}
+	return false
+}
+
+// next takes at most maxBatchSize pending writes
+func (b *batcher) next() []*write {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.pending)
+	if n > maxBatchSize {
+		n = maxBatchSize
+	}
+	writes := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	return writes
+}
+
+// commit commits writes and hands over the next commit to the first write
+// still pending
+func (b *batcher) commit(writes []*write) {
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.handOver()
+	}()
+	b.run(writes)
+}
+
+// handOver hands over the next commit to the first pending write, or ends
+// committing if there is none, b.mu must be held
+func (b *batcher) handOver() {
+	if len(b.pending) == 0 {
+		b.committing = false
+		return
+	}
+	b.pending[0].done <- errLead
+}
+
+// run commits writes in one transaction, and runs it again without a write
+// that fails
+func (b *batcher) run(writes []*write) {
+	for len(writes) > 0 {
+		failed := -1
+		err := storageError(recovered(func() error {
+			return b.db.Update(func(tx *bolt.Tx) error {
+				for i, w := range writes {
+					w := w
+					if err := recovered(func() error { return w.fn(tx) }); err != nil {
+						failed = i
+						return err
+					}
+				}
+				return nil
+			})
+		}))
+		if failed < 0 {
+			// committed or failed to commit
+			for _, w := range writes {
+				w.done <- err
+			}
+			return
+		}
+		writes[failed].done <- err
+		writes = append(writes[:failed:failed], writes[failed+1:]...)
+	}
+}
+
+// recovered calls fn and returns its panic as an error
+func recovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("write panicked: %v", r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,323 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+func TestBatchIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFail := errors.New("fail")
+	calls := make([]int, 3)
+	writes := []*write{}
+	for i := range calls {
+		i := i
+		writes = append(writes, &write{done: make(chan error, 1), fn: func(tx *bolt.Tx) error {
+			calls[i]++
+			bucket, err := tx.CreateBucketIfNotExists([]byte("test"))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(itob(uint64(i)), []byte("v")); err != nil {
+				return err
+			}
+			if i == 1 {
+				return errFail
+			}
+			return nil
+		}})
+	}
+	db.batch.run(writes)
+
+	expectedErrs := []error{nil, errFail, nil}
+	for i, w := range writes {
+		if err := <-w.done; err != expectedErrs[i] {
+			t.Fatalf("expect error %v of write %d got %v", expectedErrs[i], i, err)
+		}
+	}
+	// the failed write is not run again
+	if expected := []int{2, 1, 1}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expect calls %v got %v", expected, calls)
+	}
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("test"))
+		for i, exists := range []bool{true, false, true} {
+			if got := bucket.Get(itob(uint64(i))) != nil; got != exists {
+				t.Fatalf("expect key %d exists %v got %v", i, exists, got)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+	other := db.Bucket("other")
+
+	const n = 200
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var v interface{} = i
+			if i%10 == 0 {
+				// not encodable as JSON
+				v = make(chan int)
+			}
+			b := bucket
+			if i%2 == 1 {
+				b = other
+			}
+			ids[i], errs[i] = b.Create(ctx, v)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if failed := i%10 == 0; failed != (err != nil) {
+			t.Fatalf("expect failed %v of create %d got %v", failed, i, err)
+		}
+		if err != nil {
+			continue
+		}
+		b := bucket
+		if i%2 == 1 {
+			b = other
+		}
+		var v int
+		if err := b.Get(ctx, ids[i], &v); err != nil {
+			t.Fatal(err)
+		}
+		if v != i {
+			t.Fatalf("expect %d got %d", i, v)
+		}
+	}
+	// only the values of bucket fail
+	for b, expected := range map[*Bucket]int{bucket: n/2 - n/10, other: n / 2} {
+		if count := countValues(t, b); count != expected {
+			t.Fatalf("expect %d values got %d", expected, count)
+		}
+	}
+	if db.batch.committing || len(db.batch.pending) != 0 {
+		t.Fatal("expect no pending write")
+	}
+}
+
+func TestBatchPanic(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+	writes := []*write{
+		{done: make(chan error, 1), fn: func(tx *bolt.Tx) error {
+			_, err := bucket.create(ctx, tx, 1)
+			return err
+		}},
+		{done: make(chan error, 1), fn: func(tx *bolt.Tx) error { panic("boom") }},
+	}
+	db.batch.run(writes)
+	if err := <-writes[0].done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writes[1].done; err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expect panic error got %v", err)
+	}
+
+	// the batcher is not stuck by a panicking write
+	if err := db.batch.update(ctx, func(tx *bolt.Tx) error { panic("boom") }); err == nil {
+		t.Fatal("expect panic error got nil")
+	}
+	if _, err := bucket.Create(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if count := countValues(t, bucket); count != 2 {
+		t.Fatalf("expect 2 values got %d", count)
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := db.Bucket("test")
+
+	// a commit in progress blocked until released
+	started, release := make(chan struct{}), make(chan struct{})
+	leader := make(chan error, 1)
+	go func() {
+		leader <- db.batch.update(context.Background(), func(tx *bolt.Tx) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	// waiting writes leave on cancellation, including the one handed the
+	// next commit
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := bucket.Create(ctx, 1)
+			waiting <- err
+		}()
+	}
+	for {
+		db.batch.mu.Lock()
+		n := len(db.batch.pending)
+		db.batch.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-waiting; err != context.Canceled {
+			t.Fatalf("expect error %v got %v", context.Canceled, err)
+		}
+	}
+	close(release)
+	if err := <-leader; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Create(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if count := countValues(t, bucket); count != 1 {
+		t.Fatalf("expect 1 value got %d", count)
+	}
+	if db.batch.committing || len(db.batch.pending) != 0 {
+		t.Fatal("expect no pending write")
+	}
+}
+
+func countValues(t *testing.T, b *Bucket) int {
+	t.Helper()
+	it, err := b.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		var v int
+		if _, err := it.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	return n
+}
+
+func BenchmarkCreate(b *testing.B) {
+	bucket, cleanup := newBenchBucket(b)
+	defer cleanup()
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bucket.Create(ctx, benchValue); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateParallel(b *testing.B) {
+	bucket, cleanup := newBenchBucket(b)
+	defer cleanup()
+	ctx := context.Background()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := bucket.Create(ctx, benchValue); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkCreateParallelUnbatched is the baseline of BenchmarkCreateParallel
+// with a transaction per write
+func BenchmarkCreateParallelUnbatched(b *testing.B) {
+	bucket, cleanup := newBenchBucket(b)
+	defer cleanup()
+	ctx := context.Background()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := bucket.db.Update(func(tx *bolt.Tx) error {
+				_, err := bucket.create(ctx, tx, benchValue)
+				return err
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+var benchValue = map[string]string{"amount": "100.21", "currency": "GBP"}
+
+func newBenchBucket(b *testing.B) (*Bucket, func()) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	return db.Bucket("bench"), func() {
+		db.db.Close()
+		os.RemoveAll(dir)
+	}
+}
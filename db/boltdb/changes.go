@@ -0,0 +1,122 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// maxWatchChanges is the maximum number of changes returned by one Watch
+const maxWatchChanges = 1000
+
+// errNoChangeLog is returned when watching a bucket without a change log
+var errNoChangeLog = errors.New("bucket has no change log")
+
+// changeLog notifies watchers of committed changes. The changes themselves are
+// kept in a sibling bucket keyed by their sequence numbers, and are written in
+// the same transaction as the values, so the log never misses or invents a
+// change.
+type changeLog struct {
+	mu sync.Mutex
+	// notify is closed and replaced when changes are committed
+	notify chan struct{}
+}
+
+// WithChangeLog keeps a log of every create, update and delete of a bucket,
+// which can be watched by Watch. Watchers are only woken up by the writes done
+// via the same Bucket value, so it should be shared by writers and watchers.
+func WithChangeLog() Option {
+	return func(b *Bucket) {
+		b.changes = &changeLog{notify: make(chan struct{})}
+	}
+}
+
+func (b *Bucket) changesBucketName() []byte {
+	return []byte(b.name + ".changes")
+}
+
+// logChange appends a change of key to the change log within tx
+func (b *Bucket) logChange(tx *bolt.Tx, op string, key []byte) error {
+	if b.changes == nil {
+		return nil
+	}
+	bucket, err := tx.CreateBucketIfNotExists(b.changesBucketName())
+	if err != nil {
+		return err
+	}
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(&expay.Change{Seq: seq, Op: op, ID: keyID(key)})
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(itob(seq), value); err != nil {
+		return err
+	}
+	tx.OnCommit(b.changes.broadcast)
+	return nil
+}
+
+// Watch returns the changes after sinceSeq (at most maxWatchChanges), waiting
+// until there is at least one change or ctx is done
+func (b *Bucket) Watch(ctx context.Context, sinceSeq uint64) ([]expay.Change, error) {
+	if b.changes == nil {
+		return nil, errNoChangeLog
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// get the channel before reading so that a commit in between is not
+		// missed
+		notify := b.changes.wait()
+		changes, err := b.readChanges(sinceSeq)
+		if err != nil || len(changes) > 0 {
+			return changes, err
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// readChanges reads the changes after sinceSeq
+func (b *Bucket) readChanges(sinceSeq uint64) (changes []expay.Change, err error) {
+	err = b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.changesBucketName())
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek(itob(sinceSeq + 1)); key != nil && len(changes) < maxWatchChanges; key, value = cursor.Next() {
+			var change expay.Change
+			if err := json.Unmarshal(value, &change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, err
+}
+
+func (c *changeLog) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.notify
+}
+
+func (c *changeLog) broadcast() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
@@ -0,0 +1,102 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := db.Bucket("test").Watch(ctx, 0); err != errNoChangeLog {
+		t.Fatalf("expect error %v got %v", errNoChangeLog, err)
+	}
+	bucket := db.Bucket("test", WithChangeLog())
+
+	id, err := bucket.Create(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Update(ctx, id, "def"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is logged for a missing value or a rolled back transaction
+	if err := bucket.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	rollback := errors.New("rollback")
+	if err := bucket.RunInTx(ctx, func(tx expay.Tx) error {
+		if _, err := tx.Create("ghi"); err != nil {
+			return err
+		}
+		return rollback
+	}); err != rollback {
+		t.Fatalf("expect error %v got %v", rollback, err)
+	}
+
+	changes, err := bucket.Watch(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []expay.Change{
+		{Seq: 1, Op: expay.OpCreate, ID: id},
+		{Seq: 2, Op: expay.OpUpdate, ID: id},
+		{Seq: 3, Op: expay.OpDelete, ID: id},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expect %v got %v", expected, changes)
+	}
+	if changes, err := bucket.Watch(ctx, 2); err != nil || !reflect.DeepEqual(changes, expected[2:]) {
+		t.Fatalf("expect %v got %v, %v", expected[2:], changes, err)
+	}
+
+	// wait for a new change
+	changeChan := make(chan []expay.Change, 1)
+	go func() {
+		changes, err := bucket.Watch(ctx, 3)
+		if err != nil {
+			t.Error(err)
+		}
+		changeChan <- changes
+	}()
+	time.Sleep(10 * time.Millisecond)
+	id, err = bucket.Create(ctx, "jkl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case changes := <-changeChan:
+		expected := []expay.Change{{Seq: 4, Op: expay.OpCreate, ID: id}}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Fatalf("expect %v got %v", expected, changes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the change")
+	}
+
+	// stop waiting when ctx is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := bucket.Watch(timeoutCtx, 4); err != context.DeadlineExceeded {
+		t.Fatalf("expect error %v got %v", context.DeadlineExceeded, err)
+	}
+}
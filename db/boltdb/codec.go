@@ -0,0 +1,185 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/etcd-io/bbolt"
+	"github.com/golang/snappy"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Codec encodes and decodes the values of a bucket.
+//
+// Every record is prefixed with a marker byte of its codec ID, so a bucket can
+// always decode the records written by any of the builtin codecs and the codec
+// of a bucket can be switched without rewriting existing records. The only
+// exception is JSON, whose records have no marker and are identical to those
+// written before codecs were introduced.
+type Codec interface {
+	// ID identifies the codec in the marker byte, 0 is reserved for JSON and
+	// a custom codec should use an ID within [3, 8]
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type (
+	jsonCodec       struct{}
+	gobCodec        struct{}
+	msgpackCodec    struct{}
+	compressedCodec struct {
+		Codec
+	}
+)
+
+// compressedFlag is set in the marker byte of a compressed codec
+const compressedFlag = 0x10
+
+var (
+	// JSON codec encodes values as JSON, the default codec of a bucket
+	JSON Codec = jsonCodec{}
+	// Gob codec encodes values with encoding/gob
+	Gob Codec = gobCodec{}
+	// MsgPack codec encodes values as MessagePack, the fields of a struct are
+	// named by their json tags as in JSON
+	MsgPack Codec = msgpackCodec{}
+)
+
+// builtinCodecs are the codecs that every bucket can decode
+var builtinCodecs = []Codec{JSON, Gob, MsgPack, Compressed(JSON), Compressed(Gob), Compressed(MsgPack)}
+
+// WithCodec sets the codec used to encode values of a bucket
+func WithCodec(codec Codec) Option {
+	return func(b *Bucket) {
+		b.codec = codec
+		b.codecs[codec.ID()] = codec
+	}
+}
+
+// Compressed returns a codec that compresses the output of codec with snappy
+func Compressed(codec Codec) Codec {
+	return compressedCodec{Codec: codec}
+}
+
+func newCodecs() map[byte]Codec {
+	codecs := make(map[byte]Codec)
+	for _, codec := range builtinCodecs {
+		codecs[codec.ID()] = codec
+	}
+	return codecs
+}
+
+// encode encodes v as the record of key with the codec of the bucket, and
+// encrypts it if the bucket is encrypted
+func (b *Bucket) encode(tx *bolt.Tx, key []byte, v interface{}) ([]byte, error) {
+	if b.schema != nil {
+		var err error
+		if v, err = b.schema.wrap(v); err != nil {
+			return nil, err
+		}
+	}
+	data, err := b.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if b.codec.ID() != 0 {
+		data = append([]byte{b.codec.ID()}, data...)
+	}
+	if b.encryption != nil {
+		return b.encrypt(tx, key, data)
+	}
+	return data, nil
+}
+
+// decode decodes the record of key with the codec given by its marker, and
+// decrypts it first if it is encrypted
+func (b *Bucket) decode(tx *bolt.Tx, key, value []byte, v interface{}) error {
+	codec, data, err := b.open(tx, key, value)
+	if err != nil {
+		return err
+	}
+	if b.schema != nil {
+		return b.schema.unwrap(codec, data, v)
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// open decrypts the record of key if it is encrypted, and returns its codec
+// given by the marker and the data without the marker
+func (b *Bucket) open(tx *bolt.Tx, key, value []byte) (Codec, []byte, error) {
+	if len(value) > 0 && value[0] == encryptedMarker {
+		var err error
+		if value, err = b.decrypt(tx, key, value); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(value) == 0 || !isMarker(value[0]) {
+		return JSON, value, nil
+	}
+	codec, ok := b.codecs[value[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown codec %d", value[0])
+	}
+	return codec, value[1:], nil
+}
+
+// isMarker returns if the first byte of a record is a marker rather than the
+// first byte of a JSON value
+func isMarker(c byte) bool {
+	return c < 0x20 && c != '\t' && c != '\n' && c != '\r'
+}
+
+func (jsonCodec) ID() byte { return 0 }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (gobCodec) ID() byte { return 1 }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (msgpackCodec) ID() byte { return 2 }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).UseJSONTag(true).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(v)
+}
+
+func (c compressedCodec) ID() byte { return compressedFlag | c.Codec.ID() }
+
+func (c compressedCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+func (c compressedCodec) Unmarshal(data []byte, v interface{}) error {
+	data, err := snappy.Decode(nil, data)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
@@ -0,0 +1,168 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
+)
+
+func TestCodecs(t *testing.T) {
+	input := &expay.Payment{ID: "id", Type: "Payment", OrganisationID: "org"}
+	input.Attributes.Amount = "100.21"
+	input.Attributes.ProcessingDate = "2017-01-18"
+	for _, testcase := range []struct {
+		codec  Codec
+		marker byte
+	}{
+		{codec: JSON, marker: '{'},
+		{codec: Gob, marker: 0x01},
+		{codec: MsgPack, marker: 0x02},
+		{codec: Compressed(JSON), marker: 0x10},
+		{codec: Compressed(Gob), marker: 0x11},
+		{codec: Compressed(MsgPack), marker: 0x12},
+	} {
+		b := &Bucket{codecs: newCodecs()}
+		WithCodec(testcase.codec)(b)
+		value, err := b.encode(nil, nil, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value[0] != testcase.marker {
+			t.Fatalf("expect marker %x got %x", testcase.marker, value[0])
+		}
+		// decode with a bucket of the default codec
+		output := new(expay.Payment)
+		if err := (&Bucket{codecs: newCodecs()}).decode(nil, nil, value, output); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(output, input) {
+			t.Fatalf("expect %v got %v", input, output)
+		}
+	}
+}
+
+func TestCodecUnknown(t *testing.T) {
+	b := &Bucket{codecs: newCodecs()}
+	if err := b.decode(nil, nil, []byte{0x08, 'a'}, new(string)); err == nil {
+		t.Fatal("expect error but got nil")
+	}
+}
+
+func TestCodecSwitch(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id1, err := db.Bucket("test").Create(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := db.Bucket("test", WithCodec(Compressed(Gob)), WithIndexes(Index{
+		Name: "value",
+		Keys: func(v interface{}) []string {
+			if s, ok := v.(*string); ok {
+				return []string{*s}
+			}
+			return []string{v.(string)}
+		},
+	}))
+	if err := bucket.EnsureIndexes(new(string)); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := bucket.Create(ctx, "def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		key, _ := hex.DecodeString(id2)
+		if value := tx.Bucket([]byte("test")).Get(key); value[0] != 0x11 {
+			t.Fatalf("expect marker %x got %x", 0x11, value[0])
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// both the old and the new records are readable
+	it, err := bucket.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids, values []string
+	for it.Next() {
+		var s string
+		id, err := it.Scan(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		values = append(values, s)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{id1, id2}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expect %v got %v", expected, ids)
+	}
+	if expected := []string{"abc", "def"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expect %v got %v", expected, values)
+	}
+
+	// the old record is indexed and rewritten with the new codec on update
+	it, err = bucket.Lookup(ctx, "value", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expect the old record in the index")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := bucket.UpdateFunc(ctx, id1, &s, func() error { s += "!"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("test").Get(ctx, id1, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "abc!" {
+		t.Fatalf("expect %s got %s", "abc!", s)
+	}
+}
+
+func TestCodecConformance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, codec := range []Codec{Compressed(Gob), Compressed(MsgPack)} {
+		codec := codec
+		dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+			n++
+			return db.Bucket("test"+strconv.Itoa(n), WithCodec(codec))
+		})
+	}
+}
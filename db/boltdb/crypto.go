@@ -0,0 +1,498 @@
+package boltdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/etcd-io/bbolt"
+)
+
+// Values are encrypted with envelope encryption: a record is encrypted with
+// AES-GCM by a random data key, and data keys are kept in a sibling bucket
+// wrapped (encrypted) by a master key loaded from a local key file. An
+// encrypted record is:
+//
+//	encryptedMarker | data key ID (8 bytes) | nonce | ciphertext
+//
+// where the plaintext is the record encoded by the codec of the bucket. The
+// bucket name and the primary key are authenticated as additional data so a
+// record cannot be moved to another key. Index keys are not encrypted.
+
+const (
+	// encryptedMarker is the marker byte of an encrypted record
+	encryptedMarker = 0x1f
+	// dataKeyIDSize is the size of a data key ID
+	dataKeyIDSize = 8
+	// dataKeySize is the size of a data key (AES-256)
+	dataKeySize = 32
+	// rotateBatchSize is the number of records re-encrypted in one transaction
+	// by RotateKeys
+	rotateBatchSize = 100
+)
+
+// currentDataKey is the key of the ID of the current data key in the data key
+// bucket
+var currentDataKey = []byte("current")
+
+var (
+	// errNoMasterKeys is returned when reading an encrypted record from a
+	// bucket without encryption
+	errNoMasterKeys = errors.New("encrypted record but no master keys")
+	// errNotEncrypted is returned when rotating keys of a bucket without
+	// encryption
+	errNotEncrypted = errors.New("bucket is not encrypted")
+)
+
+type (
+	// MasterKeys are the master keys loaded from a key file. Each line of the
+	// file is a key ID followed by a hex encoded AES key (16, 24 or 32 bytes),
+	// separated by whitespaces. Empty lines and lines starting with # are
+	// ignored. The last key is the current key used to wrap new data keys,
+	// the others are kept to unwrap data keys that have not been rotated yet.
+	MasterKeys struct {
+		filename string
+		mu       sync.RWMutex
+		keys     map[string]cipher.AEAD
+		current  string
+	}
+	// encryption is the encryption state of a bucket
+	encryption struct {
+		master *MasterKeys
+		// mu protects dataKeys
+		mu sync.Mutex
+		// dataKeys caches unwrapped data keys by ID, data key IDs are random
+		// so an ID is never reused for another key
+		dataKeys map[string]cipher.AEAD
+		// rotateMu serializes key rotations
+		rotateMu sync.Mutex
+	}
+	// wrappedKey is a data key wrapped by a master key
+	wrappedKey struct {
+		MasterKeyID string `json:"master_key_id"`
+		Key         []byte `json:"key"`
+	}
+)
+
+// LoadMasterKeys loads master keys from a key file
+func LoadMasterKeys(filename string) (*MasterKeys, error) {
+	keys := &MasterKeys{filename: filename}
+	if err := keys.reload(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// reload reads the key file again, so that a newly added master key becomes
+// the current key
+func (m *MasterKeys) reload() error {
+	f, err := os.Open(m.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string]cipher.AEAD)
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid line in key file %s", m.filename)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid master key %s: %v", fields[0], err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return fmt.Errorf("invalid master key %s: %v", fields[0], err)
+		}
+		keys[fields[0]] = aead
+		current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("no master key in key file %s", m.filename)
+	}
+	m.mu.Lock()
+	m.keys, m.current = keys, current
+	m.mu.Unlock()
+	return nil
+}
+
+// wrap encrypts a data key with the current master key
+func (m *MasterKeys) wrap(id, dataKey []byte) (*wrappedKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, err := seal(m.keys[m.current], dataKey, id)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedKey{MasterKeyID: m.current, Key: key}, nil
+}
+
+// unwrap decrypts a data key with the master key that wrapped it
+func (m *MasterKeys) unwrap(id []byte, wrapped *wrappedKey) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	aead, ok := m.keys[wrapped.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s", wrapped.MasterKeyID)
+	}
+	return open(aead, wrapped.Key, id)
+}
+
+// WithEncryption encrypts values of a bucket with data keys wrapped by the
+// master keys. Records written before encryption is enabled stay readable and
+// are encrypted when they are updated or when the keys are rotated.
+//
+// Only the values (including revisions and archived values) are encrypted.
+// The keys of the values, the index keys, the aggregates, the months of the
+// archive partitions, the change log, the audit log and the times and actors
+// of revisions are stored in plaintext, so that they can be looked up, ranged
+// over and summed without the keys.
+func WithEncryption(master *MasterKeys) Option {
+	return func(b *Bucket) {
+		b.encryption = &encryption{
+			master:   master,
+			dataKeys: make(map[string]cipher.AEAD),
+		}
+	}
+}
+
+func (b *Bucket) dataKeysBucketName() []byte {
+	return []byte(b.name + ".keys")
+}
+
+// encrypt encrypts an encoded record of key with the current data key, a new
+// data key is created if there is not one yet
+func (b *Bucket) encrypt(tx *bolt.Tx, key, value []byte) ([]byte, error) {
+	id, aead, err := b.currentDataKey(tx)
+	if err != nil {
+		return nil, err
+	}
+	return b.sealRecord(id, aead, key, value)
+}
+
+func (b *Bucket) sealRecord(id []byte, aead cipher.AEAD, key, value []byte) ([]byte, error) {
+	sealed, err := seal(aead, value, b.recordAD(key))
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{encryptedMarker}, id...), sealed...), nil
+}
+
+// decrypt decrypts an encrypted record of key
+func (b *Bucket) decrypt(tx *bolt.Tx, key, value []byte) ([]byte, error) {
+	if b.encryption == nil {
+		return nil, errNoMasterKeys
+	}
+	if len(value) < 1+dataKeyIDSize {
+		return nil, errors.New("invalid encrypted record")
+	}
+	id := value[1 : 1+dataKeyIDSize]
+	aead, err := b.dataKey(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, value[1+dataKeyIDSize:], b.recordAD(key))
+}
+
+// recordAD returns the additional data authenticated with a record
+func (b *Bucket) recordAD(key []byte) []byte {
+	return append([]byte(b.name+"\x00"), key...)
+}
+
+// currentDataKey returns the current data key, which is created within tx if
+// not exists
+func (b *Bucket) currentDataKey(tx *bolt.Tx) (id []byte, aead cipher.AEAD, err error) {
+	if bucket := tx.Bucket(b.dataKeysBucketName()); bucket != nil {
+		if id := bucket.Get(currentDataKey); id != nil {
+			aead, err := b.dataKey(tx, id)
+			return id, aead, err
+		}
+	}
+	return b.newDataKey(tx)
+}
+
+// newDataKey creates a new data key within tx and makes it the current one
+func (b *Bucket) newDataKey(tx *bolt.Tx) (id []byte, aead cipher.AEAD, err error) {
+	bucket, err := tx.CreateBucketIfNotExists(b.dataKeysBucketName())
+	if err != nil {
+		return nil, nil, err
+	}
+	id = make([]byte, dataKeyIDSize)
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	if err := b.putDataKey(bucket, id, key); err != nil {
+		return nil, nil, err
+	}
+	if err := bucket.Put(currentDataKey, id); err != nil {
+		return nil, nil, err
+	}
+	aead, err = newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.encryption.mu.Lock()
+	b.encryption.dataKeys[string(id)] = aead
+	b.encryption.mu.Unlock()
+	return id, aead, nil
+}
+
+// putDataKey wraps a data key with the current master key and stores it
+func (b *Bucket) putDataKey(bucket *bolt.Bucket, id, key []byte) error {
+	wrapped, err := b.encryption.master.wrap(id, key)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(wrapped)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(id, value)
+}
+
+// dataKey returns a data key by its ID, unwrapping it if it is not cached
+func (b *Bucket) dataKey(tx *bolt.Tx, id []byte) (cipher.AEAD, error) {
+	b.encryption.mu.Lock()
+	aead, ok := b.encryption.dataKeys[string(id)]
+	b.encryption.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := b.unwrapDataKey(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	b.encryption.mu.Lock()
+	b.encryption.dataKeys[string(id)] = aead
+	b.encryption.mu.Unlock()
+	return aead, nil
+}
+
+func (b *Bucket) unwrapDataKey(tx *bolt.Tx, id []byte) ([]byte, error) {
+	bucket := tx.Bucket(b.dataKeysBucketName())
+	if bucket == nil {
+		return nil, fmt.Errorf("unknown data key %x", id)
+	}
+	value := bucket.Get(id)
+	if value == nil {
+		return nil, fmt.Errorf("unknown data key %x", id)
+	}
+	var wrapped wrappedKey
+	if err := json.Unmarshal(value, &wrapped); err != nil {
+		return nil, err
+	}
+	return b.encryption.master.unwrap(id, &wrapped)
+}
+
+// RotateKeys reloads the master keys from the key file, creates a new data
+// key, rewraps the data keys with the current master key and re-encrypts every
+// record (including the revisions in the history and the archived values) with
+// the new data key. It runs in batches of small transactions, so the bucket
+// stays available for reads and writes during the rotation. The old data keys
+// are deleted after all records are re-encrypted, and the master keys other
+// than the current one can be removed from the key file after that. It returns
+// the number of re-encrypted records.
+func (b *Bucket) RotateKeys(ctx context.Context) (n int, err error) {
+	if b.encryption == nil {
+		return 0, errNotEncrypted
+	}
+	b.encryption.rotateMu.Lock()
+	defer b.encryption.rotateMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := b.encryption.master.reload(); err != nil {
+		return 0, err
+	}
+	var currentID []byte
+	if err := b.update(func(tx *bolt.Tx) error {
+		if err := b.rewrapDataKeys(tx); err != nil {
+			return err
+		}
+		id, _, err := b.newDataKey(tx)
+		currentID = id
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	archives, err := b.archiveBucketNames()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range append([][]byte{[]byte(b.name), b.historyBucketName()}, archives...) {
+		for lastKey := []byte(nil); ; {
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+			var count int
+			if err := b.update(func(tx *bolt.Tx) error {
+				var err error
+				lastKey, count, err = b.reencryptBatch(tx, name, lastKey, currentID)
+				return err
+			}); err != nil {
+				return n, err
+			}
+			n += count
+			if lastKey == nil {
+				break
+			}
+		}
+	}
+	return n, b.update(func(tx *bolt.Tx) error {
+		return b.deleteDataKeys(tx, currentID)
+	})
+}
+
+// rewrapDataKeys wraps every data key with the current master key
+func (b *Bucket) rewrapDataKeys(tx *bolt.Tx) error {
+	bucket := tx.Bucket(b.dataKeysBucketName())
+	if bucket == nil {
+		return nil
+	}
+	keys := make(map[string][]byte)
+	if err := bucket.ForEach(func(id, _ []byte) error {
+		if bytes.Equal(id, currentDataKey) {
+			return nil
+		}
+		key, err := b.unwrapDataKey(tx, id)
+		keys[string(id)] = key
+		return err
+	}); err != nil {
+		return err
+	}
+	for id, key := range keys {
+		if err := b.putDataKey(bucket, []byte(id), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptBatch re-encrypts at most rotateBatchSize records of the bucket
+// name after lastKey that are not encrypted by the data key of currentID, and
+// returns the last key scanned or nil if there are no more records
+func (b *Bucket) reencryptBatch(tx *bolt.Tx, name, lastKey, currentID []byte) (last []byte, count int, err error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return nil, 0, nil
+	}
+	aead, err := b.dataKey(tx, currentID)
+	if err != nil {
+		return nil, 0, err
+	}
+	type record struct{ key, value []byte }
+	var records []record
+	cursor := bucket.Cursor()
+	key, value := cursor.First()
+	if lastKey != nil {
+		key, value = cursor.Seek(lastKey)
+		if bytes.Equal(key, lastKey) {
+			key, value = cursor.Next()
+		}
+	}
+	for i := 0; key != nil && i < rotateBatchSize; i++ {
+		last = append([]byte{}, key...)
+		if len(value) > 0 && value[0] == encryptedMarker && bytes.HasPrefix(value[1:], currentID) {
+			key, value = cursor.Next()
+			continue
+		}
+		// copy the record because the cursor memory is invalidated by Put
+		records = append(records, record{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+		key, value = cursor.Next()
+	}
+	if key == nil {
+		last = nil
+	}
+	for _, r := range records {
+		plain := r.value
+		if len(plain) > 0 && plain[0] == encryptedMarker {
+			if plain, err = b.decrypt(tx, r.key, plain); err != nil {
+				return nil, 0, err
+			}
+		}
+		sealed, err := b.sealRecord(currentID, aead, r.key, plain)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := bucket.Put(r.key, sealed); err != nil {
+			return nil, 0, err
+		}
+	}
+	return last, len(records), nil
+}
+
+// deleteDataKeys deletes every data key except the one of currentID
+func (b *Bucket) deleteDataKeys(tx *bolt.Tx, currentID []byte) error {
+	bucket := tx.Bucket(b.dataKeysBucketName())
+	if bucket == nil {
+		return nil
+	}
+	var ids [][]byte
+	if err := bucket.ForEach(func(id, _ []byte) error {
+		if !bytes.Equal(id, currentDataKey) && !bytes.Equal(id, currentID) {
+			ids = append(ids, append([]byte{}, id...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := bucket.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open is the reverse of seal
+func open(aead cipher.AEAD, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], ad)
+}
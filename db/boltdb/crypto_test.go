@@ -0,0 +1,234 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
+)
+
+const (
+	testMasterKey1 = "1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"
+	testMasterKey2 = "2 202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f\n"
+)
+
+func TestLoadMasterKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, testcase := range []struct {
+		content string
+		current string
+		wantErr bool
+	}{
+		{content: testMasterKey1, current: "1"},
+		{content: "# comment\n\n" + testMasterKey1 + testMasterKey2, current: "2"},
+		{content: "", wantErr: true},
+		{content: "1\n", wantErr: true},
+		{content: "1 xyz\n", wantErr: true},
+		{content: "1 0001\n", wantErr: true},
+	} {
+		filename := path.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(filename, []byte(testcase.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := LoadMasterKeys(filename)
+		if testcase.wantErr {
+			if err == nil {
+				t.Fatalf("expect error for %q but got nil", testcase.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.current != testcase.current {
+			t.Fatalf("expect %s got %s", testcase.current, keys.current)
+		}
+	}
+	if _, err := LoadMasterKeys(path.Join(dir, "missing")); err == nil {
+		t.Fatal("expect error but got nil")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	ctx := context.Background()
+	bucket := db.Bucket("test", WithEncryption(keys))
+
+	input := &expay.Payment{OrganisationID: "org"}
+	input.Attributes.BeneficiaryParty.AccountName = "W Owens"
+	id, err := bucket.Create(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := rawValue(t, db, "test", id)
+	if value[0] != encryptedMarker || bytes.Contains(value, []byte("W Owens")) {
+		t.Fatalf("expect encrypted record got %q", value)
+	}
+	output := new(expay.Payment)
+	if err := bucket.Get(ctx, id, output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Attributes.BeneficiaryParty.AccountName != "W Owens" {
+		t.Fatalf("expect %s got %s", "W Owens", output.Attributes.BeneficiaryParty.AccountName)
+	}
+
+	// reopened with the same master keys
+	if err := db.Bucket("test", WithEncryption(newTestMasterKeys(t, dir, testMasterKey1))).Get(ctx, id, output); err != nil {
+		t.Fatal(err)
+	}
+	// read without master keys
+	if err := db.Bucket("test").Get(ctx, id, output); err != errNoMasterKeys {
+		t.Fatalf("expect error %v got %v", errNoMasterKeys, err)
+	}
+	// a record moved to another key fails to authenticate
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("test")).Put(itob(100), value)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get(ctx, "0000000000000064", output); err == nil {
+		t.Fatal("expect error but got nil")
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := db.Bucket("test").RotateKeys(ctx); err != errNotEncrypted {
+		t.Fatalf("expect error %v got %v", errNotEncrypted, err)
+	}
+
+	// records written before and after encryption is enabled
+	const n = rotateBatchSize + 10
+	ids := []string{}
+	for i := 0; i < n; i++ {
+		bucket := db.Bucket("test")
+		if i >= n/2 {
+			bucket = db.Bucket("test", WithEncryption(newTestMasterKeys(t, dir, testMasterKey1)))
+		}
+		id, err := bucket.Create(ctx, strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// rotate to a new master key appended to the key file
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	bucket := db.Bucket("test", WithEncryption(keys))
+	if err := ioutil.WriteFile(keys.filename, []byte(testMasterKey1+testMasterKey2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := bucket.RotateKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != n {
+		t.Fatalf("expect %d got %d", n, rotated)
+	}
+	if rotated, err := bucket.RotateKeys(ctx); err != nil || rotated != n {
+		t.Fatalf("expect %d got %d, %v", n, rotated, err)
+	}
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		keysBucket := tx.Bucket(bucket.dataKeysBucketName())
+		if count := keysBucket.Stats().KeyN; count != 2 {
+			t.Fatalf("expect %d got %d", 2, count)
+		}
+		currentID := keysBucket.Get(currentDataKey)
+		return tx.Bucket([]byte("test")).ForEach(func(key, value []byte) error {
+			if value[0] != encryptedMarker || !bytes.Equal(value[1:1+dataKeyIDSize], currentID) {
+				t.Fatalf("expect record %x encrypted by %x", key, currentID)
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old master key is no longer needed
+	bucket = db.Bucket("test", WithEncryption(newTestMasterKeys(t, dir, testMasterKey2)))
+	for i, id := range ids {
+		var s string
+		if err := bucket.Get(ctx, id, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s != strconv.Itoa(i) {
+			t.Fatalf("expect %d got %s", i, s)
+		}
+	}
+}
+
+func TestEncryptionConformance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	n := 0
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		n++
+		return db.Bucket("test"+strconv.Itoa(n), WithEncryption(keys))
+	})
+}
+
+// newTestMasterKeys writes a key file in dir and loads it
+func newTestMasterKeys(t *testing.T, dir, content string) *MasterKeys {
+	filename := path.Join(dir, "master.key")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadMasterKeys(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// rawValue returns the stored record of id
+func rawValue(t *testing.T, db *DB, name, id string) (value []byte) {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		value = append([]byte{}, tx.Bucket([]byte(name)).Get(key)...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
@@ -1,10 +1,11 @@
 package boltdb
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
-	"errors"
+	"os"
+	"time"
 
 	"github.com/etcd-io/bbolt"
 	"h12.io/expay"
@@ -13,18 +14,62 @@ import (
 type (
 	// DB represents one boltdb file supporting multiple buckets
 	DB struct {
-		db *bolt.DB
+		db    *bolt.DB
+		batch *batcher
 	}
 	// Bucket represents a boltdb bucket that satisifies expay.DB interface
 	Bucket struct {
 		name string
 		db   *bolt.DB
+		// batch coalesces the writes of every bucket of the file
+		batch *batcher
+		// ids is nil if IDs are generated from the sequence of the bucket
+		ids     expay.IDGenerator
+		indexes []Index
+		// indexExclude is the path of the field excluding a value from the
+		// indexes if not zero, nil if no value is excluded
+		indexExclude []string
+		// aggregates is nil if no aggregate is maintained
+		aggregates *aggregates
+		// archive is the name of the index dating the values to archive,
+		// empty if values are not archived
+		archive string
+		// codec encodes new values while codecs decode existing ones by
+		// their markers
+		codec  Codec
+		codecs map[byte]Codec
+		// encryption is nil if values are not encrypted
+		encryption *encryption
+		// changes is nil if there is no change log
+		changes *changeLog
+		// history is true if every revision is kept
+		history bool
+		// audit is true if every write is recorded in the audit log
+		audit bool
+		// schema is nil if values are not versioned
+		schema *schema
+		now    func() time.Time
 	}
+	// Option configures a bucket
+	Option func(*Bucket)
+
 	iter struct {
-		tx     *bolt.Tx
-		cursor *bolt.Cursor
-		key    []byte
-		value  []byte
+		b       *Bucket
+		ctx     context.Context
+		err     error
+		tx      *bolt.Tx
+		cursor  *bolt.Cursor
+		key     []byte
+		value   []byte
+		reverse bool
+		// archived is true if the keys are scanned from the archived keys,
+		// whose values are read from the archive
+		archived bool
+		// lower (inclusive) and upper (exclusive) bounds of the keys, nil means
+		// unbounded
+		lower, upper []byte
+		// remaining number of values to scan, negative means unlimited
+		remaining int
 	}
 )
 
@@ -34,35 +79,53 @@ func New(filename string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	return &DB{db: db, batch: newBatcher(db)}, nil
+}
+
+// NewReadOnly opens an existing boltdb file read-only, so that nothing can
+// change it, waiting for the file lock held by a writer up to lockTimeout
+func NewReadOnly(filename string) (*DB, error) {
+	// bolt creates a missing file even when opening it read-only
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0666, &bolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db, batch: newBatcher(db)}, nil
+}
+
+// Close closes the boltdb file after the transactions in progress finish
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// Close closes the boltdb file of the bucket, after which no bucket of the
+// file can be used
+func (b *Bucket) Close() error {
+	return b.db.Close()
 }
 
 // Bucket returns a bucket from boltdb
-func (db *DB) Bucket(name string) *Bucket {
-	return &Bucket{name: name, db: db.db}
+func (db *DB) Bucket(name string, options ...Option) *Bucket {
+	b := &Bucket{name: name, db: db.db, batch: db.batch, codec: JSON, codecs: newCodecs(), now: time.Now}
+	for _, option := range options {
+		option(b)
+	}
+	return b
 }
 
-// Create creates a new value into the bucket
-func (b *Bucket) Create(v interface{}) (id string, err error) {
-	value, err := json.Marshal(v)
-	if err != nil {
+// Create creates a new value into the bucket, concurrent writes are committed
+// together
+func (b *Bucket) Create(ctx context.Context, v interface{}) (id string, err error) {
+	if err := ctx.Err(); err != nil {
 		return "", err
 	}
-	err = b.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
-		if err != nil {
-			return err
-		}
-		seq, err := bucket.NextSequence()
-		if err != nil {
-			return err
-		}
-		key := itob(seq)
-		if err := bucket.Put(key, value); err != nil {
-			return err
-		}
-		id = hex.EncodeToString(key)
-		return nil
+	err = b.batch.update(ctx, func(tx *bolt.Tx) error {
+		key, err := b.create(ctx, tx, v)
+		id = keyID(key)
+		return err
 	})
 	return id, err
 }
@@ -75,105 +138,301 @@ func itob(i uint64) []byte {
 }
 
 // Get gets a value from the bucket given the id
-func (b *Bucket) Get(id string, v interface{}) error {
-	key, err := hex.DecodeString(id)
+func (b *Bucket) Get(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return b.view(func(tx *bolt.Tx) error {
+		return b.get(tx, key, v)
+	})
+}
+
+// Update updates a value given the id, concurrent writes are committed
+// together
+func (b *Bucket) Update(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return b.batch.update(ctx, func(tx *bolt.Tx) error {
+		return b.put(ctx, tx, key, v)
+	})
+}
+
+// UpdateFunc reads the value of id into v, calls fn and writes v back within
+// one transaction, which is not shared with other writes so that fn is called
+// only once
+func (b *Bucket) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
 	if err != nil {
 		return err
 	}
-	var value []byte
-	err = b.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(b.name))
-		if bucket == nil {
-			return expay.ErrNotFound
+	return b.update(func(tx *bolt.Tx) error {
+		if err := b.get(tx, key, v); err != nil {
+			return err
 		}
-		value = bucket.Get(key)
-		return nil
+		if err := fn(); err != nil {
+			return err
+		}
+		return b.put(ctx, tx, key, v)
 	})
+}
+
+// Delete deletes an id from the bucket, returns nil if not exists, concurrent
+// writes are committed together
+func (b *Bucket) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
 	if err != nil {
 		return err
 	}
+	return b.batch.update(ctx, func(tx *bolt.Tx) error {
+		return b.delete(ctx, tx, key)
+	})
+}
+
+// create writes v with a new key within tx
+func (b *Bucket) create(ctx context.Context, tx *bolt.Tx, v interface{}) (key []byte, err error) {
+	key, err = b.newKey(tx)
+	if err != nil {
+		return nil, err
+	}
+	return key, b.put(ctx, tx, key, v)
+}
+
+// get reads the value of key into v within tx
+func (b *Bucket) get(tx *bolt.Tx, key []byte, v interface{}) error {
+	bucket := tx.Bucket([]byte(b.name))
+	if bucket == nil {
+		return expay.ErrNotFound
+	}
+	value := bucket.Get(key)
 	if value == nil {
 		return expay.ErrNotFound
 	}
-	return json.Unmarshal(value, v)
+	return b.decode(tx, key, value, v)
 }
 
-// Update updates a value given the id
-func (b *Bucket) Update(id string, v interface{}) error {
-	key, err := hex.DecodeString(id)
+// put writes v as the value of key and updates its index entries, the
+// aggregates, the change log, the audit log and the history within tx
+func (b *Bucket) put(ctx context.Context, tx *bolt.Tx, key []byte, v interface{}) error {
+	if b.isArchived(tx, key) {
+		return expay.ErrArchived
+	}
+	value, err := b.encode(tx, key, v)
 	if err != nil {
 		return err
 	}
-	value, err := json.Marshal(v)
+	bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
 	if err != nil {
 		return err
 	}
-	return b.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
-		if err != nil {
-			return err
-		}
-		return bucket.Put(key, value)
-	})
+	op := expay.OpCreate
+	if bucket.Get(key) != nil {
+		op = expay.OpUpdate
+	}
+	if err := bucket.Put(key, value); err != nil {
+		return err
+	}
+	if err := b.logChange(tx, op, key); err != nil {
+		return err
+	}
+	if err := b.logAudit(ctx, tx, op, key, value); err != nil {
+		return err
+	}
+	if err := b.logRevision(ctx, tx, key, v); err != nil {
+		return err
+	}
+	if err := b.updateAggregates(tx, key, v); err != nil {
+		return err
+	}
+	return b.updateIndexes(tx, key, v)
 }
 
-// Delete deletes an id from the bucket, returns nil if not exists
-func (b *Bucket) Delete(id string) error {
-	key, err := hex.DecodeString(id)
+// delete deletes key with its index entries, aggregates and history, and logs
+// the change within tx
+func (b *Bucket) delete(ctx context.Context, tx *bolt.Tx, key []byte) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
 	if err != nil {
 		return err
 	}
-	return b.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
-		if err != nil {
+	if bucket.Get(key) != nil {
+		if err := bucket.Delete(key); err != nil {
 			return err
 		}
-		return bucket.Delete(key)
-	})
+		if err := b.logChange(tx, expay.OpDelete, key); err != nil {
+			return err
+		}
+		if err := b.logAudit(ctx, tx, expay.OpDelete, key, nil); err != nil {
+			return err
+		}
+		if err := b.deleteHistory(tx, key); err != nil {
+			return err
+		}
+	}
+	if err := b.updateAggregates(tx, key, nil); err != nil {
+		return err
+	}
+	return b.updateIndexes(tx, key, nil)
 }
 
 // List returns an iterator that can be used to interate every key-value pair in
 // the bucket
-func (b *Bucket) List() (expay.Iter, error) {
-	return newIter(b)
+func (b *Bucket) List(ctx context.Context) (expay.Iter, error) {
+	return b.Range(ctx, expay.Range{})
+}
+
+// Paginate is the same as List but starts after lastCursor and returns at most
+// limit values (see expay.DB for details)
+func (b *Bucket) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return b.paginate(ctx, false, lastCursor, limit)
+}
+
+// paginate returns an iterator of the live values, or the archived values if
+// archived is true, after lastCursor
+func (b *Bucket) paginate(ctx context.Context, archived bool, lastCursor string, limit int) (*iter, error) {
+	var lastKey []byte
+	if lastCursor != "" {
+		key, err := idKey(lastCursor)
+		if err != nil {
+			return nil, err
+		}
+		lastKey = key
+	}
+	if limit < 0 {
+		return newIter(ctx, b, archived, nil, lastKey, true, -limit)
+	}
+	if lastKey != nil {
+		// the smallest key after lastKey
+		lastKey = append(lastKey, 0)
+	}
+	return newIter(ctx, b, archived, lastKey, nil, false, limit)
 }
 
-// Paginate is the same as List but supports pagination (not implmented yet)
-func (b *Bucket) Paginate(lastCursor string, limit int) (expay.Iter, error) {
-	return nil, errors.New("not implemented yet")
+// Range returns an iterator of the values whose IDs are within r in the order
+// of their keys, i.e. sequence IDs in the order of their creation
+func (b *Bucket) Range(ctx context.Context, r expay.Range) (expay.Iter, error) {
+	var lower, upper []byte
+	if r.Start != "" {
+		key, err := idKey(r.Start)
+		if err != nil {
+			return nil, err
+		}
+		lower = key
+	}
+	if r.End != "" {
+		key, err := idKey(r.End)
+		if err != nil {
+			return nil, err
+		}
+		upper = key
+	}
+	return newIter(ctx, b, false, lower, upper, r.Desc, r.Limit)
 }
 
-func newIter(b *Bucket) (*iter, error) {
-	tx, err := b.db.Begin(false)
+// newIter returns an iterator of at most limit live (or archived) values
+// (unlimited if limit is not positive) within [lower, upper)
+func newIter(ctx context.Context, b *Bucket, archived bool, lower, upper []byte, reverse bool, limit int) (*iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx, err := b.begin()
 	if err != nil {
 		return nil, err
 	}
-	bucket := tx.Bucket([]byte(b.name))
+	it := &iter{
+		b:         b,
+		ctx:       ctx,
+		tx:        tx,
+		reverse:   reverse,
+		archived:  archived,
+		lower:     lower,
+		upper:     upper,
+		remaining: limit,
+	}
+	if limit <= 0 {
+		it.remaining = -1
+	}
+	name := []byte(b.name)
+	if archived {
+		name = b.archivedBucketName()
+	}
+	bucket := tx.Bucket(name)
 	if bucket == nil {
-		tx.Rollback()
-		return nil, expay.ErrNotFound
+		// nothing has been created (or archived) yet
+		return it, nil
 	}
-	cursor := bucket.Cursor()
-	key, value := cursor.First()
-	return &iter{
-		tx:     tx,
-		cursor: cursor,
-		key:    key,
-		value:  value,
-	}, nil
+	it.cursor = bucket.Cursor()
+	it.key, it.value = it.seek()
+	return it, nil
+}
+
+// seek moves the cursor to the first key within the bounds in the iteration
+// order
+func (it *iter) seek() (key []byte, value []byte) {
+	if it.reverse {
+		if it.upper == nil {
+			return it.cursor.Last()
+		}
+		if key, _ := it.cursor.Seek(it.upper); key == nil {
+			return it.cursor.Last()
+		}
+		return it.cursor.Prev()
+	}
+	if it.lower == nil {
+		return it.cursor.First()
+	}
+	return it.cursor.Seek(it.lower)
 }
 
 func (it *iter) Next() bool {
-	return it.key != nil
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	return it.key != nil && it.remaining != 0 && it.within(it.key)
+}
+
+// within returns if key is within the bound the iteration moves towards
+func (it *iter) within(key []byte) bool {
+	if it.reverse {
+		return it.lower == nil || bytes.Compare(key, it.lower) >= 0
+	}
+	return it.upper == nil || bytes.Compare(key, it.upper) < 0
 }
 
 func (it *iter) Scan(v interface{}) (id string, err error) {
-	id = hex.EncodeToString(it.key)
-	err = json.Unmarshal(it.value, v)
-	it.key, it.value = it.cursor.Next()
+	id = keyID(it.key)
+	value := it.value
+	if it.archived {
+		value = it.b.archivedValue(it.tx, it.key)
+	}
+	err = it.b.decode(it.tx, it.key, value, v)
+	if it.reverse {
+		it.key, it.value = it.cursor.Prev()
+	} else {
+		it.key, it.value = it.cursor.Next()
+	}
+	if it.remaining > 0 {
+		it.remaining--
+	}
 	return
 }
 
 func (it *iter) Close() error {
-	return it.tx.Rollback()
+	if err := it.tx.Rollback(); err != nil {
+		return err
+	}
+	return it.err
 }
@@ -1,13 +1,16 @@
 package boltdb
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
 )
 
 func TestNewFailed(t *testing.T) {
@@ -32,18 +35,19 @@ func TestBucketOps(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 	bucket := db.Bucket("test")
 
 	// Create
 	input1 := "abc"
-	id1, err := bucket.Create(input1)
+	id1, err := bucket.Create(ctx, input1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Get
 	output1 := ""
-	if err := bucket.Get(id1, &output1); err != nil {
+	if err := bucket.Get(ctx, id1, &output1); err != nil {
 		t.Fatal(err)
 	}
 	if output1 != input1 {
@@ -52,17 +56,17 @@ func TestBucketOps(t *testing.T) {
 
 	// Update
 	input2 := "def"
-	if err := bucket.Update(id1, input2); err != nil {
+	if err := bucket.Update(ctx, id1, input2); err != nil {
 		t.Fatal(err)
 	}
 
 	input3 := "ghi"
-	id3, err := bucket.Create(input3)
+	id3, err := bucket.Create(ctx, input3)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	it, err := bucket.List()
+	it, err := bucket.List(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +95,7 @@ func TestBucketOps(t *testing.T) {
 
 	// Get 2
 	output2 := ""
-	if err := bucket.Get(id1, &output2); err != nil {
+	if err := bucket.Get(ctx, id1, &output2); err != nil {
 		t.Fatal(err)
 	}
 	if output2 != input2 {
@@ -99,13 +103,205 @@ func TestBucketOps(t *testing.T) {
 	}
 
 	// Delete
-	if err := bucket.Delete(id1); err != nil {
+	if err := bucket.Delete(ctx, id1); err != nil {
 		t.Fatal(err)
 	}
 
 	// Get deleted
 	output3 := ""
-	if err := bucket.Get(id1, &output3); err != expay.ErrNotFound {
+	if err := bucket.Get(ctx, id1, &output3); err != expay.ErrNotFound {
 		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
 	}
 }
+
+func TestBucketPaginate(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+
+	// empty bucket
+	it, err := bucket.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() {
+		t.Fatal("expect no value in an empty bucket")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, value := range []string{"a", "b", "c", "d", "e"} {
+		id, err := bucket.Create(ctx, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	testcases := []struct {
+		name       string
+		lastCursor string
+		limit      int
+		want       []string
+	}{
+		{name: "first page", lastCursor: "", limit: 2, want: []string{"a", "b"}},
+		{name: "middle page", lastCursor: ids[1], limit: 2, want: []string{"c", "d"}},
+		{name: "last page", lastCursor: ids[3], limit: 2, want: []string{"e"}},
+		{name: "after the last", lastCursor: ids[4], limit: 2, want: []string{}},
+		{name: "no limit", lastCursor: ids[0], limit: 0, want: []string{"b", "c", "d", "e"}},
+		{name: "backward from the last", lastCursor: "", limit: -2, want: []string{"e", "d"}},
+		{name: "backward page", lastCursor: ids[3], limit: -2, want: []string{"c", "b"}},
+		{name: "backward to the first", lastCursor: ids[1], limit: -2, want: []string{"a"}},
+		{name: "cursor not existed", lastCursor: "ffffffffffffffff", limit: -1, want: []string{"e"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			it, err := bucket.Paginate(ctx, tc.lastCursor, tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := []string{}
+			for it.Next() {
+				value := ""
+				if _, err := it.Scan(&value); err != nil {
+					t.Fatal(err)
+				}
+				values = append(values, value)
+			}
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tc.want) {
+				t.Fatalf("expect values %v got %v", tc.want, values)
+			}
+		})
+	}
+}
+
+func TestBucketUpdateFunc(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+
+	value := ""
+	if err := bucket.UpdateFunc(ctx, "0000000000000001", &value, func() error { return nil }); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+
+	id, err := bucket.Create(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// aborted update
+	if err := bucket.UpdateFunc(ctx, id, &value, func() error {
+		value = "def"
+		return expay.ErrVersionMismatch
+	}); err != expay.ErrVersionMismatch {
+		t.Fatalf("expect error %v got %v", expay.ErrVersionMismatch, err)
+	}
+	output := ""
+	if err := bucket.Get(ctx, id, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output != "abc" {
+		t.Fatalf("expect %s got %s", "abc", output)
+	}
+
+	// successful update
+	if err := bucket.UpdateFunc(ctx, id, &value, func() error {
+		if value != "abc" {
+			t.Fatalf("expect %s got %s", "abc", value)
+		}
+		value = "def"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get(ctx, id, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output != "def" {
+		t.Fatalf("expect %s got %s", "def", output)
+	}
+}
+
+func TestIterCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bucket := db.Bucket("test")
+	for _, value := range []string{"a", "b", "c"} {
+		if _, err := bucket.Create(ctx, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := bucket.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.Next() {
+		if _, err := it.Scan(new(string)); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		cancel()
+	}
+	if n != 1 {
+		t.Fatalf("expect iteration stopped after %d value got %d", 1, n)
+	}
+	if err := it.Close(); err != context.Canceled {
+		t.Fatalf("expect error %v got %v", context.Canceled, err)
+	}
+	if _, err := bucket.List(ctx); err != context.Canceled {
+		t.Fatalf("expect error %v got %v", context.Canceled, err)
+	}
+	if err := bucket.Get(ctx, "0000000000000001", new(string)); err != context.Canceled {
+		t.Fatalf("expect error %v got %v", context.Canceled, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		n++
+		return db.Bucket("test" + strconv.Itoa(n))
+	})
+}
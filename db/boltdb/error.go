@@ -0,0 +1,39 @@
+package boltdb
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// storageError classifies an error of bolt as an expay.Error, other errors
+// are returned as is
+func storageError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == bolt.ErrDatabaseNotOpen, err == bolt.ErrTimeout, err == bolt.ErrDatabaseReadOnly:
+		return &expay.Error{Code: expay.CodeUnavailable, Message: "storage unavailable", Err: err}
+	case err == bolt.ErrKeyTooLarge, err == bolt.ErrValueTooLarge, errors.Is(err, syscall.ENOSPC):
+		return &expay.Error{Code: expay.CodeQuotaExceeded, Message: "quota exceeded", Err: err}
+	}
+	return err
+}
+
+// update runs fn within a read-write transaction
+func (b *Bucket) update(fn func(tx *bolt.Tx) error) error {
+	return storageError(b.db.Update(fn))
+}
+
+// view runs fn within a read-only transaction
+func (b *Bucket) view(fn func(tx *bolt.Tx) error) error {
+	return storageError(b.db.View(fn))
+}
+
+// begin starts a read-only transaction
+func (b *Bucket) begin() (*bolt.Tx, error) {
+	tx, err := b.db.Begin(false)
+	return tx, storageError(err)
+}
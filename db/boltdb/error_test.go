@@ -0,0 +1,72 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+func TestStorageError(t *testing.T) {
+	errOther := errors.New("other")
+	for _, tc := range []struct {
+		err  error
+		code expay.ErrorCode
+	}{
+		{bolt.ErrDatabaseNotOpen, expay.CodeUnavailable},
+		{bolt.ErrTimeout, expay.CodeUnavailable},
+		{bolt.ErrDatabaseReadOnly, expay.CodeUnavailable},
+		{bolt.ErrKeyTooLarge, expay.CodeQuotaExceeded},
+		{bolt.ErrValueTooLarge, expay.CodeQuotaExceeded},
+		{&os.PathError{Op: "write", Path: "db.bolt", Err: syscall.ENOSPC}, expay.CodeQuotaExceeded},
+		{expay.ErrNotFound, expay.CodeNotFound},
+		{errOther, ""},
+	} {
+		err := storageError(tc.err)
+		if code := expay.CodeOf(err); code != tc.code {
+			t.Fatalf("expect %v got %v", tc.code, code)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expect %v wrapped got %v", tc.err, err)
+		}
+	}
+	if err := storageError(nil); err != nil {
+		t.Fatalf("expect nil got %v", err)
+	}
+}
+
+func TestClosedDB(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := db.Bucket("test")
+	ctx := context.Background()
+	id, err := bucket.Create(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get(ctx, id, new(int)); !errors.Is(err, expay.ErrUnavailable) {
+		t.Fatalf("expect error %v got %v", expay.ErrUnavailable, err)
+	}
+	if _, err := bucket.Create(ctx, 2); !errors.Is(err, expay.ErrUnavailable) {
+		t.Fatalf("expect error %v got %v", expay.ErrUnavailable, err)
+	}
+	if _, err := bucket.List(ctx); !errors.Is(err, expay.ErrUnavailable) {
+		t.Fatalf("expect error %v got %v", expay.ErrUnavailable, err)
+	}
+}
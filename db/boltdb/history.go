@@ -0,0 +1,224 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// errNoHistory is returned when reading the history of a bucket without one
+var errNoHistory = errors.New("bucket has no history")
+
+// revisionMeta is the metadata of a revision
+type revisionMeta struct {
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor,omitempty"`
+}
+
+// WithHistory keeps every revision of the values of a bucket, with the time
+// and the actor (see expay.WithActor) of each write. Revision values are kept
+// in a sibling bucket encoded (and encrypted) like the values, and their
+// metadata in another, both keyed by the primary key followed by the revision
+// number. The history of a value is erased when the value is deleted.
+func WithHistory() Option {
+	return func(b *Bucket) {
+		b.history = true
+	}
+}
+
+func (b *Bucket) historyBucketName() []byte {
+	return []byte(b.name + ".history")
+}
+
+func (b *Bucket) revisionsBucketName() []byte {
+	return []byte(b.name + ".revisions")
+}
+
+// revisionKey returns the key of revision n of key
+func revisionKey(key []byte, n uint64) []byte {
+	return append(append([]byte{}, key...), itob(n)...)
+}
+
+// logRevision appends v as a new revision of key within tx
+func (b *Bucket) logRevision(ctx context.Context, tx *bolt.Tx, key []byte, v interface{}) error {
+	if !b.history {
+		return nil
+	}
+	history, err := tx.CreateBucketIfNotExists(b.historyBucketName())
+	if err != nil {
+		return err
+	}
+	revisions, err := tx.CreateBucketIfNotExists(b.revisionsBucketName())
+	if err != nil {
+		return err
+	}
+	revKey := revisionKey(key, lastRevision(revisions, key)+1)
+	value, err := b.encode(tx, revKey, v)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(&revisionMeta{Time: b.now().UTC(), Actor: expay.Actor(ctx)})
+	if err != nil {
+		return err
+	}
+	if err := history.Put(revKey, value); err != nil {
+		return err
+	}
+	return revisions.Put(revKey, meta)
+}
+
+// lastRevision returns the last revision number of key or 0 if there is none
+func lastRevision(revisions *bolt.Bucket, key []byte) uint64 {
+	cursor := revisions.Cursor()
+	revKey, _ := cursor.Seek(revisionKey(key, math.MaxUint64))
+	if revKey == nil {
+		revKey, _ = cursor.Last()
+	} else if !bytes.Equal(revKey, revisionKey(key, math.MaxUint64)) {
+		revKey, _ = cursor.Prev()
+	}
+	if len(revKey) != len(key)+8 || !bytes.HasPrefix(revKey, key) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(revKey[len(key):])
+}
+
+// deleteHistory erases every revision of key within tx
+func (b *Bucket) deleteHistory(tx *bolt.Tx, key []byte) error {
+	if !b.history {
+		return nil
+	}
+	for _, name := range [][]byte{b.historyBucketName(), b.revisionsBucketName()} {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			continue
+		}
+		var revKeys [][]byte
+		cursor := bucket.Cursor()
+		for revKey, _ := cursor.Seek(key); revKey != nil && bytes.HasPrefix(revKey, key); revKey, _ = cursor.Next() {
+			revKeys = append(revKeys, append([]byte{}, revKey...))
+		}
+		for _, revKey := range revKeys {
+			if err := bucket.Delete(revKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Revisions returns the revisions of id in ascending order
+func (b *Bucket) Revisions(ctx context.Context, id string) (revs []expay.Revision, err error) {
+	err = b.viewHistory(ctx, id, func(tx *bolt.Tx, key []byte) error {
+		entries, err := b.revisionsOf(tx, key)
+		for _, entry := range entries {
+			revs = append(revs, entry.rev)
+		}
+		return err
+	})
+	if err == nil && len(revs) == 0 {
+		return nil, expay.ErrNotFound
+	}
+	return revs, err
+}
+
+// GetRevision reads revision n of id into v
+func (b *Bucket) GetRevision(ctx context.Context, id string, n int, v interface{}) (rev *expay.Revision, err error) {
+	err = b.viewHistory(ctx, id, func(tx *bolt.Tx, key []byte) error {
+		entries, err := b.revisionsOf(tx, key)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			if entries[i].rev.N == n {
+				rev = &entries[i].rev
+				return b.decodeRevision(tx, entries[i].key, v)
+			}
+		}
+		return expay.ErrNotFound
+	})
+	return rev, err
+}
+
+// GetAsOf reads the revision of id that was current at time t into v
+func (b *Bucket) GetAsOf(ctx context.Context, id string, t time.Time, v interface{}) (rev *expay.Revision, err error) {
+	err = b.viewHistory(ctx, id, func(tx *bolt.Tx, key []byte) error {
+		entries, err := b.revisionsOf(tx, key)
+		if err != nil {
+			return err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if !entries[i].rev.Time.After(t) {
+				rev = &entries[i].rev
+				return b.decodeRevision(tx, entries[i].key, v)
+			}
+		}
+		return expay.ErrNotFound
+	})
+	return rev, err
+}
+
+// viewHistory calls fn with the primary key of id within a read transaction
+func (b *Bucket) viewHistory(ctx context.Context, id string, fn func(tx *bolt.Tx, key []byte) error) error {
+	if !b.history {
+		return errNoHistory
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return b.view(func(tx *bolt.Tx) error {
+		return fn(tx, key)
+	})
+}
+
+// revisionEntry is a revision and its key
+type revisionEntry struct {
+	rev expay.Revision
+	key []byte
+}
+
+// revisionsOf returns the revisions of key in ascending order within tx
+func (b *Bucket) revisionsOf(tx *bolt.Tx, key []byte) (entries []revisionEntry, err error) {
+	revisions := tx.Bucket(b.revisionsBucketName())
+	if revisions == nil {
+		return nil, nil
+	}
+	cursor := revisions.Cursor()
+	for revKey, value := cursor.Seek(key); revKey != nil; revKey, value = cursor.Next() {
+		if len(revKey) != len(key)+8 || !bytes.HasPrefix(revKey, key) {
+			break
+		}
+		var meta revisionMeta
+		if err := json.Unmarshal(value, &meta); err != nil {
+			return nil, err
+		}
+		entries = append(entries, revisionEntry{
+			rev: expay.Revision{
+				N:     int(binary.BigEndian.Uint64(revKey[len(key):])),
+				Time:  meta.Time,
+				Actor: meta.Actor,
+			},
+			key: revKey,
+		})
+	}
+	return entries, nil
+}
+
+// decodeRevision decodes the value of a revision into v
+func (b *Bucket) decodeRevision(tx *bolt.Tx, revKey []byte, v interface{}) error {
+	value := tx.Bucket(b.historyBucketName()).Get(revKey)
+	if value == nil {
+		return expay.ErrNotFound
+	}
+	return b.decode(tx, revKey, value, v)
+}
@@ -0,0 +1,149 @@
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := db.Bucket("test").Revisions(ctx, "0000000000000001"); err != errNoHistory {
+		t.Fatalf("expect error %v got %v", errNoHistory, err)
+	}
+
+	bucket := db.Bucket("test", WithHistory())
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := start
+	bucket.now = func() time.Time {
+		clock = clock.Add(time.Hour)
+		return clock
+	}
+	id, err := bucket.Create(expay.WithActor(ctx, "alice"), "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Update(expay.WithActor(ctx, "bob"), id, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := bucket.UpdateFunc(ctx, id, &s, func() error { s = "v3"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// another value does not interfere
+	if _, err := bucket.Create(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := bucket.Revisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []expay.Revision{
+		{N: 1, Time: start.Add(time.Hour), Actor: "alice"},
+		{N: 2, Time: start.Add(2 * time.Hour), Actor: "bob"},
+		{N: 3, Time: start.Add(3 * time.Hour)},
+	}
+	if !reflect.DeepEqual(revs, expected) {
+		t.Fatalf("expect %v got %v", expected, revs)
+	}
+
+	// GetRevision
+	rev, err := bucket.GetRevision(ctx, id, 2, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "v2" || !reflect.DeepEqual(*rev, expected[1]) {
+		t.Fatalf("expect v2 of %v got %s of %v", expected[1], s, rev)
+	}
+	if _, err := bucket.GetRevision(ctx, id, 4, &s); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+
+	// GetAsOf
+	for _, testcase := range []struct {
+		t       time.Time
+		value   string
+		wantErr error
+	}{
+		{t: start, wantErr: expay.ErrNotFound},
+		{t: start.Add(time.Hour), value: "v1"},
+		{t: start.Add(150 * time.Minute), value: "v2"},
+		{t: start.Add(24 * time.Hour), value: "v3"},
+	} {
+		s = ""
+		_, err := bucket.GetAsOf(ctx, id, testcase.t, &s)
+		if err != testcase.wantErr {
+			t.Fatalf("expect error %v got %v", testcase.wantErr, err)
+		}
+		if s != testcase.value {
+			t.Fatalf("expect %s as of %v got %s", testcase.value, testcase.t, s)
+		}
+	}
+
+	// the history is erased with the value
+	if err := bucket.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Revisions(ctx, id); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+}
+
+func TestHistoryRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := newTestMasterKeys(t, dir, testMasterKey1)
+	bucket := db.Bucket("test", WithHistory(), WithEncryption(keys))
+	id, err := bucket.Create(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Update(ctx, id, "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keys.filename, []byte(testMasterKey1+testMasterKey2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := bucket.RotateKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one value and two revisions
+	if n != 3 {
+		t.Fatalf("expect %d got %d", 3, n)
+	}
+
+	bucket = db.Bucket("test", WithHistory(), WithEncryption(newTestMasterKeys(t, dir, testMasterKey2)))
+	var s string
+	if _, err := bucket.GetRevision(ctx, id, 1, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "v1" {
+		t.Fatalf("expect %s got %s", "v1", s)
+	}
+}
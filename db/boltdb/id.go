@@ -0,0 +1,94 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// seqIDLen is the length of a sequence ID, the hex of an 8-byte key
+const seqIDLen = 16
+
+var errDuplicateID = errors.New("duplicate id generated")
+
+// WithIDs generates the IDs of new values by gen, e.g. expay.NewUUID or
+// expay.NewULID, instead of the sequence of the bucket. The IDs generated by
+// gen must be UUIDs or ULIDs, and a bucket may contain IDs of every form.
+func WithIDs(gen expay.IDGenerator) Option {
+	return func(b *Bucket) {
+		b.ids = gen
+	}
+}
+
+// idKey returns the key of id: a sequence ID is stored as its 8 bytes while a
+// UUID or a ULID is stored as is
+func idKey(id string) ([]byte, error) {
+	if len(id) == seqIDLen {
+		if key, err := hex.DecodeString(id); err == nil {
+			return key, nil
+		}
+	}
+	if expay.IsUUID(id) || expay.IsULID(id) {
+		return []byte(id), nil
+	}
+	return nil, expay.ErrInvalidID
+}
+
+// keyID is the reverse of idKey
+func keyID(key []byte) string {
+	if len(key) == seqIDLen/2 {
+		return hex.EncodeToString(key)
+	}
+	return string(key)
+}
+
+// newKey returns the key of a new value within tx
+func (b *Bucket) newKey(tx *bolt.Tx) ([]byte, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(b.name))
+	if err != nil {
+		return nil, err
+	}
+	if b.ids == nil {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return nil, err
+		}
+		return itob(seq), nil
+	}
+	id, err := b.ids()
+	if err != nil {
+		return nil, err
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.Get(key) != nil || b.isArchived(tx, key) {
+		return nil, errDuplicateID
+	}
+	return key, nil
+}
+
+// CreateWithID creates v with id chosen by the client, which must be a UUID,
+// and returns expay.ErrArchived if id has been archived
+func (b *Bucket) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !expay.IsUUID(id) {
+		return expay.ErrInvalidID
+	}
+	key := []byte(id)
+	return b.batch.update(ctx, func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(b.name)); bucket != nil && bucket.Get(key) != nil {
+			return expay.ErrAlreadyExists
+		}
+		if b.isArchived(tx, key) {
+			return expay.ErrArchived
+		}
+		return b.put(ctx, tx, key, v)
+	})
+}
@@ -0,0 +1,124 @@
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"h12.io/expay"
+)
+
+func TestIDs(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		gen   expay.IDGenerator
+		valid func(string) bool
+	}{
+		{gen: expay.NewUUID, valid: expay.IsUUID},
+		{gen: expay.NewULID, valid: expay.IsULID},
+	} {
+		bucket := db.Bucket("test", WithIDs(tc.gen), WithHistory(), WithChangeLog())
+		id, err := bucket.Create(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.valid(id) {
+			t.Fatalf("expect a generated id got %s", id)
+		}
+		if err := bucket.Update(ctx, id, "b"); err != nil {
+			t.Fatal(err)
+		}
+		var s string
+		if err := bucket.Get(ctx, id, &s); err != nil || s != "b" {
+			t.Fatalf("expect b got %s, %v", s, err)
+		}
+		if revs, err := bucket.Revisions(ctx, id); err != nil || len(revs) != 2 {
+			t.Fatalf("expect 2 revisions got %v, %v", revs, err)
+		}
+		changes, err := bucket.Watch(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := changes[len(changes)-1]; last.ID != id {
+			t.Fatalf("expect change of %s got %s", id, last.ID)
+		}
+	}
+
+	// a bucket may contain IDs of every form
+	bucket := db.Bucket("test")
+	seqID, err := bucket.Create(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	it, err := bucket.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+		id, err := it.Scan(new(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != seqID {
+		t.Fatalf("expect 3 values from %s got %v", seqID, ids)
+	}
+	for _, id := range ids {
+		if err := bucket.Get(ctx, id, new(string)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"zz", "00000000000000zz", "nonexisted-id", "3F2504E0-4F89-41D3-9A0C-0305E82C3301"} {
+		if err := bucket.Get(ctx, id, new(string)); err != expay.ErrInvalidID {
+			t.Fatalf("expect error %v for %s got %v", expay.ErrInvalidID, id, err)
+		}
+		if _, err := bucket.Paginate(ctx, id, 1); err != expay.ErrInvalidID {
+			t.Fatalf("expect error %v for %s got %v", expay.ErrInvalidID, id, err)
+		}
+	}
+}
+
+func TestCreateWithSeqID(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test")
+	// sequence IDs are reserved for the bucket
+	id, err := bucket.Create(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.CreateWithID(ctx, id, "b"); err != expay.ErrInvalidID {
+		t.Fatalf("expect error %v got %v", expay.ErrInvalidID, err)
+	}
+	var s string
+	if err := bucket.Get(ctx, id, &s); err != nil || !reflect.DeepEqual(s, "a") {
+		t.Fatalf("expect a got %s, %v", s, err)
+	}
+}
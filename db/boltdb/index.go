@@ -0,0 +1,349 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+type (
+	// Index is a secondary index of a bucket. Index entries are kept in sibling
+	// buckets and updated in the same transaction as the values.
+	Index struct {
+		// Name of the index
+		Name string
+		// Keys returns the index keys of a value, a value without keys is not
+		// indexed
+		Keys func(v interface{}) []string
+		// KeepExcluded is true if the values excluded from the other indexes
+		// (see WithIndexExclude) are indexed as well, e.g. by deleted_at
+		KeepExcluded bool
+	}
+	indexIter struct {
+		b      *Bucket
+		ctx    context.Context
+		err    error
+		tx     *bolt.Tx
+		bucket *bolt.Bucket
+		cursor *bolt.Cursor
+		key    []byte
+		// in returns if an index key is still in the scanned range
+		in func(indexKey []byte) bool
+	}
+)
+
+// indexSep separates an index key and a primary key in an index entry
+const indexSep = 0
+
+// WithIndexes declares secondary indexes of a bucket
+func WithIndexes(indexes ...Index) Option {
+	return func(b *Bucket) {
+		b.indexes = append(b.indexes, indexes...)
+	}
+}
+
+// WithIndexExclude excludes a value from every index if its field given by a
+// dot separated path of JSON names is not zero, e.g. deleted_at of tombstones
+func WithIndexExclude(path string) Option {
+	return func(b *Bucket) {
+		b.indexExclude = splitPath(path)
+	}
+}
+
+// FieldIndex returns an index on a field of a struct (or a map) given by a dot
+// separated path of JSON names, e.g. "attributes.payment_id". The index is
+// named after the last element of the path. Zero values are not indexed.
+func FieldIndex(path string) Index {
+	names := strings.Split(path, ".")
+	return Index{
+		Name: names[len(names)-1],
+		Keys: func(v interface{}) []string {
+			if key := fieldString(v, names); key != "" {
+				return []string{key}
+			}
+			return nil
+		},
+	}
+}
+
+// TimeIndex returns an index on a time field given by a dot separated path of
+// JSON names like FieldIndex, whose keys are in expay.IndexTimeLayout so that
+// they sort in time order
+func TimeIndex(path string) Index {
+	names := strings.Split(path, ".")
+	return Index{
+		Name: names[len(names)-1],
+		Keys: func(v interface{}) []string {
+			if t, ok := fieldValue(v, names).(time.Time); ok {
+				return []string{t.UTC().Format(expay.IndexTimeLayout)}
+			}
+			return nil
+		},
+	}
+}
+
+// fieldString returns the field of v given by the JSON names of its path as a
+// string, or an empty string if it is missing or zero
+func fieldString(v interface{}, names []string) string {
+	if field := fieldValue(v, names); field != nil {
+		return fmt.Sprint(field)
+	}
+	return ""
+}
+
+// fieldValue returns the field of v given by the JSON names of its path, or
+// nil if it is missing or zero
+func fieldValue(v interface{}, names []string) interface{} {
+	field := reflect.ValueOf(v)
+	for _, name := range names {
+		field = fieldByJSONName(field, name)
+		if !field.IsValid() {
+			return nil
+		}
+	}
+	for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+		field = field.Elem()
+	}
+	if !field.IsValid() || field.IsZero() {
+		return nil
+	}
+	return field.Interface()
+}
+
+// fieldByJSONName returns the field of a struct or the element of a map by its
+// JSON name, or an invalid value if not found
+func fieldByJSONName(v reflect.Value, name string) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag == name || (tag == "" && t.Field(i).Name == name) {
+				return v.Field(i)
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			return v.MapIndex(reflect.ValueOf(name))
+		}
+	}
+	return reflect.Value{}
+}
+
+// indexBucketName returns the name of the bucket of an index
+func (b *Bucket) indexBucketName(index string) []byte {
+	return []byte(b.name + ".index." + index)
+}
+
+// keysBucketName returns the name of the bucket of index keys of each value,
+// used to remove stale index entries
+func (b *Bucket) keysBucketName() []byte {
+	return []byte(b.name + ".index")
+}
+
+func (b *Bucket) index(name string) (Index, bool) {
+	for _, index := range b.indexes {
+		if index.Name == name {
+			return index, true
+		}
+	}
+	return Index{}, false
+}
+
+// updateIndexes replaces the index entries of key with those of v within tx,
+// a nil v removes all the index entries of key and an excluded v all but those
+// of the indexes keeping excluded values
+func (b *Bucket) updateIndexes(tx *bolt.Tx, key []byte, v interface{}) error {
+	if len(b.indexes) == 0 {
+		return nil
+	}
+	keysBucket, err := tx.CreateBucketIfNotExists(b.keysBucketName())
+	if err != nil {
+		return err
+	}
+	oldKeys := make(map[string][]string)
+	if value := keysBucket.Get(key); value != nil {
+		if err := json.Unmarshal(value, &oldKeys); err != nil {
+			return err
+		}
+	}
+	newKeys := make(map[string][]string)
+	if v != nil {
+		excluded := b.indexExclude != nil && fieldString(v, b.indexExclude) != ""
+		for _, index := range b.indexes {
+			if excluded && !index.KeepExcluded {
+				continue
+			}
+			for _, indexKey := range index.Keys(v) {
+				if strings.IndexByte(indexKey, indexSep) == -1 {
+					newKeys[index.Name] = append(newKeys[index.Name], indexKey)
+				}
+			}
+		}
+	}
+	for _, index := range b.indexes {
+		indexBucket, err := tx.CreateBucketIfNotExists(b.indexBucketName(index.Name))
+		if err != nil {
+			return err
+		}
+		for _, indexKey := range oldKeys[index.Name] {
+			if err := indexBucket.Delete(indexEntry(indexKey, key)); err != nil {
+				return err
+			}
+		}
+		for _, indexKey := range newKeys[index.Name] {
+			if err := indexBucket.Put(indexEntry(indexKey, key), nil); err != nil {
+				return err
+			}
+		}
+	}
+	if len(newKeys) == 0 {
+		return keysBucket.Delete(key)
+	}
+	value, err := json.Marshal(newKeys)
+	if err != nil {
+		return err
+	}
+	return keysBucket.Put(key, value)
+}
+
+// indexEntry returns the key of an index entry
+func indexEntry(indexKey string, key []byte) []byte {
+	entry := make([]byte, 0, len(indexKey)+1+len(key))
+	entry = append(entry, indexKey...)
+	entry = append(entry, indexSep)
+	return append(entry, key...)
+}
+
+// splitIndexEntry splits an index entry into the index key and the primary key
+func splitIndexEntry(entry []byte) (indexKey, key []byte) {
+	i := bytes.IndexByte(entry, indexSep)
+	return entry[:i], entry[i+1:]
+}
+
+// EnsureIndexes builds the declared indexes that have not been built yet from
+// the existing values, decoding every value into a new value of the type of v
+// (a pointer to a value of the bucket's type). It should be called before
+// serving if indexes are declared on an existing bucket.
+func (b *Bucket) EnsureIndexes(v interface{}) error {
+	return b.update(func(tx *bolt.Tx) error {
+		missing := false
+		for _, index := range b.indexes {
+			if tx.Bucket(b.indexBucketName(index.Name)) == nil {
+				missing = true
+			}
+		}
+		bucket := tx.Bucket([]byte(b.name))
+		if !missing || bucket == nil {
+			return nil
+		}
+		// rebuild all indexes so that stored index keys stay consistent
+		for _, index := range b.indexes {
+			if err := tx.DeleteBucket(b.indexBucketName(index.Name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket(b.keysBucketName()); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		for _, index := range b.indexes {
+			if _, err := tx.CreateBucket(b.indexBucketName(index.Name)); err != nil {
+				return err
+			}
+		}
+		typ := reflect.TypeOf(v).Elem()
+		return bucket.ForEach(func(key, value []byte) error {
+			v := reflect.New(typ).Interface()
+			if err := b.decode(tx, key, value, v); err != nil {
+				return err
+			}
+			return b.updateIndexes(tx, key, v)
+		})
+	})
+}
+
+// Lookup returns an iterator of values whose key of the index equals key
+func (b *Bucket) Lookup(ctx context.Context, index, key string) (expay.Iter, error) {
+	prefix := indexEntry(key, nil)
+	return b.newIndexIter(ctx, index, prefix, func(indexKey []byte) bool {
+		return string(indexKey) == key
+	})
+}
+
+// LookupRange returns an iterator of values whose key of the index is within
+// [start, end) in the order of index keys, an empty end means no upper bound
+func (b *Bucket) LookupRange(ctx context.Context, index, start, end string) (expay.Iter, error) {
+	return b.newIndexIter(ctx, index, []byte(start), func(indexKey []byte) bool {
+		return end == "" || string(indexKey) < end
+	})
+}
+
+func (b *Bucket) newIndexIter(ctx context.Context, index string, seek []byte, in func(indexKey []byte) bool) (*indexIter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := b.index(index); !ok {
+		return nil, expay.ErrUnknownIndex
+	}
+	tx, err := b.begin()
+	if err != nil {
+		return nil, err
+	}
+	it := &indexIter{b: b, ctx: ctx, tx: tx, in: in}
+	indexBucket := tx.Bucket(b.indexBucketName(index))
+	it.bucket = tx.Bucket([]byte(b.name))
+	if indexBucket == nil || it.bucket == nil {
+		// nothing has been indexed yet
+		return it, nil
+	}
+	it.cursor = indexBucket.Cursor()
+	it.key, _ = it.cursor.Seek(seek)
+	return it, nil
+}
+
+func (it *indexIter) Next() bool {
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	if it.key == nil {
+		return false
+	}
+	indexKey, _ := splitIndexEntry(it.key)
+	return it.in(indexKey)
+}
+
+// IndexKey returns the index key of the value to be scanned next, so that the
+// lookups of several buckets can be merged in the order of index keys, e.g. by
+// sharddb
+func (it *indexIter) IndexKey() string {
+	indexKey, _ := splitIndexEntry(it.key)
+	return string(indexKey)
+}
+
+func (it *indexIter) Scan(v interface{}) (id string, err error) {
+	_, key := splitIndexEntry(it.key)
+	id = keyID(key)
+	err = it.b.decode(it.tx, key, it.bucket.Get(key), v)
+	it.key, _ = it.cursor.Next()
+	return
+}
+
+func (it *indexIter) Close() error {
+	if err := it.tx.Rollback(); err != nil {
+		return err
+	}
+	return it.err
+}
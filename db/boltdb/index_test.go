@@ -0,0 +1,269 @@
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+)
+
+func TestFieldIndex(t *testing.T) {
+	t.Parallel()
+
+	pay := expay.Payment{OrganisationID: "org"}
+	pay.Attributes.PaymentID = "pid"
+	testcases := []struct {
+		name string
+		path string
+		v    interface{}
+
+		wantName string
+		wantKeys []string
+	}{
+		{name: "struct field", path: "organisation_id", v: pay, wantName: "organisation_id", wantKeys: []string{"org"}},
+		{name: "nested field of pointer", path: "attributes.payment_id", v: &pay, wantName: "payment_id", wantKeys: []string{"pid"}},
+		{name: "zero value", path: "attributes.reference", v: pay, wantName: "reference", wantKeys: nil},
+		{name: "field not existed", path: "attributes.nothing", v: pay, wantName: "nothing", wantKeys: nil},
+		{name: "map element", path: "a.b", v: map[string]interface{}{"a": map[string]interface{}{"b": 1}}, wantName: "b", wantKeys: []string{"1"}},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			index := FieldIndex(tc.path)
+			if index.Name != tc.wantName {
+				t.Fatalf("expect name %s got %s", tc.wantName, index.Name)
+			}
+			if keys := index.Keys(tc.v); !reflect.DeepEqual(keys, tc.wantKeys) {
+				t.Fatalf("expect keys %v got %v", tc.wantKeys, keys)
+			}
+		})
+	}
+}
+
+func TestBucketIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("payment", WithIndexes(
+		FieldIndex("organisation_id"),
+		FieldIndex("attributes.processing_date"),
+	))
+
+	newPayment := func(org, date string) *expay.Payment {
+		pay := &expay.Payment{OrganisationID: org}
+		pay.Attributes.ProcessingDate = date
+		return pay
+	}
+	id1, err := bucket.Create(ctx, newPayment("org1", "2017-01-18"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := bucket.Create(ctx, newPayment("org2", "2017-01-19"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id3, err := bucket.Create(ctx, newPayment("org1", "2017-01-20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(it expay.Iter, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for it.Next() {
+			pay := expay.Payment{}
+			id, err := it.Scan(&pay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	verify := func(ids, wantIDs []string) {
+		t.Helper()
+		if !reflect.DeepEqual(ids, wantIDs) {
+			t.Fatalf("expect ids %v got %v", wantIDs, ids)
+		}
+	}
+
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org1")), []string{id1, id3})
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org")), []string{})
+	verify(lookup(bucket.LookupRange(ctx, "processing_date", "2017-01-19", "")), []string{id2, id3})
+	verify(lookup(bucket.LookupRange(ctx, "processing_date", "2017-01-01", "2017-01-20")), []string{id1, id2})
+	if _, err := bucket.Lookup(ctx, "reference", "ref"); err != expay.ErrUnknownIndex {
+		t.Fatalf("expect error %v got %v", expay.ErrUnknownIndex, err)
+	}
+
+	// update moves the index entry
+	if err := bucket.Update(ctx, id1, newPayment("org2", "2017-01-18")); err != nil {
+		t.Fatal(err)
+	}
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org1")), []string{id3})
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org2")), []string{id1, id2})
+
+	// delete removes the index entry
+	if err := bucket.Delete(ctx, id2); err != nil {
+		t.Fatal(err)
+	}
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org2")), []string{id1})
+
+	// indexes declared later are built from existing values
+	bucket = db.Bucket("payment", WithIndexes(
+		FieldIndex("organisation_id"),
+		FieldIndex("attributes.processing_date"),
+		FieldIndex("attributes.payment_id"),
+	))
+	if err := bucket.EnsureIndexes(&expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	verify(lookup(bucket.Lookup(ctx, "organisation_id", "org2")), []string{id1})
+	verify(lookup(bucket.Lookup(ctx, "payment_id", "")), []string{})
+	pay := newPayment("org1", "2017-01-20")
+	pay.Attributes.PaymentID = "pid"
+	if err := bucket.Update(ctx, id3, pay); err != nil {
+		t.Fatal(err)
+	}
+	verify(lookup(bucket.Lookup(ctx, "payment_id", "pid")), []string{id3})
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id1, err := db.Bucket("payment").Create(ctx, &expay.Payment{DeletedBy: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// omitted from JSON, so not overwritten when decoded into the same value
+	if _, err := db.Bucket("payment").Create(ctx, &expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	bucket := db.Bucket("payment", WithIndexes(FieldIndex("deleted_by")))
+	if err := bucket.EnsureIndexes(&expay.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := bucket.Lookup(ctx, "deleted_by", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for it.Next() {
+		id, err := it.Scan(&expay.Payment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{id1}) {
+		t.Fatalf("expect ids %v got %v", []string{id1}, ids)
+	}
+}
+
+func TestIndexExclude(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	deleted := TimeIndex(expay.PaymentDeletedIndex)
+	deleted.KeepExcluded = true
+	bucket := db.Bucket("payment",
+		WithIndexes(FieldIndex("organisation_id"), deleted),
+		WithIndexExclude(expay.PaymentIndexExclude),
+		WithAggregates(expay.PaymentAggregates),
+	)
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := bucket.Create(ctx, &expay.Payment{OrganisationID: "org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	scan := func(it expay.Iter, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for it.Next() {
+			id, err := it.Scan(&expay.Payment{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	now := time.Now()
+	verify := func(wantIDs, wantDeletedIDs []string) {
+		t.Helper()
+		if ids := scan(bucket.Lookup(ctx, "organisation_id", "org")); !reflect.DeepEqual(ids, wantIDs) {
+			t.Fatalf("expect ids %v got %v", wantIDs, ids)
+		}
+		end := now.Add(time.Second).UTC().Format(expay.IndexTimeLayout)
+		if ids := scan(bucket.LookupRange(ctx, expay.PaymentDeletedIndex, "", end)); !reflect.DeepEqual(ids, wantDeletedIDs) {
+			t.Fatalf("expect deleted ids %v got %v", wantDeletedIDs, ids)
+		}
+		stats, err := bucket.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := stats.Groups["organisation_id"]["org"].Count; stats.Count != int64(len(wantIDs)) || count != int64(len(wantIDs)) {
+			t.Fatalf("expect %d got %d, %d", len(wantIDs), stats.Count, count)
+		}
+	}
+	verify(ids, []string{})
+
+	// a tombstone is neither looked up nor aggregated, but kept by the index
+	// of tombstones
+	if err := bucket.Update(ctx, ids[0], &expay.Payment{OrganisationID: "org", DeletedAt: &now}); err != nil {
+		t.Fatal(err)
+	}
+	verify(ids[1:], ids[:1])
+
+	// until it is restored
+	if err := bucket.Update(ctx, ids[0], &expay.Payment{OrganisationID: "org"}); err != nil {
+		t.Fatal(err)
+	}
+	verify(ids, []string{})
+}
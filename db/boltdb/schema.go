@@ -0,0 +1,259 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// errNoSchema is returned when migrating a bucket without schema versions
+var errNoSchema = errors.New("bucket has no schema version")
+
+type (
+	// schema versions the values of a bucket
+	schema struct {
+		migrations []expay.Migration
+		// legacy is the type of the values stored before versioning, nil if
+		// unknown
+		legacy reflect.Type
+	}
+	// envelope is a stored value with its schema version
+	envelope struct {
+		Version int             `json:"schema_version"`
+		Data    json.RawMessage `json:"data"`
+	}
+)
+
+// WithSchema stores the values of a bucket as JSON in an envelope with their
+// schema version, which is the number of migrations. A value stored in an
+// older version, including one stored before versioning, is upgraded by the
+// remaining migrations when it is read, and is stored in the current version
+// when it is written again or by Migrate. Reading a value stored in a newer
+// version fails.
+//
+// A value stored before versioning by a codec other than JSON (e.g. Gob) does
+// not decode into a JSON document, so it is decoded into a value of the type
+// of legacy and converted to JSON before being upgraded. legacy can be nil if
+// no such value is stored.
+func WithSchema(migrations []expay.Migration, legacy interface{}) Option {
+	return func(b *Bucket) {
+		b.schema = &schema{migrations: migrations}
+		if legacy != nil {
+			b.schema.legacy = reflect.TypeOf(legacy)
+		}
+	}
+}
+
+func (s *schema) version() int {
+	return len(s.migrations)
+}
+
+// wrap returns the envelope of v in the current version
+func (s *schema) wrap(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{Version: s.version(), Data: data}, nil
+}
+
+// unwrap decodes the data of a record by codec, upgrades it and decodes it
+// into v
+func (s *schema) unwrap(codec Codec, data []byte, v interface{}) error {
+	env, _, err := s.open(codec, data)
+	if err != nil {
+		return err
+	}
+	doc, err := s.upgrade(env)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc, v)
+}
+
+// open decodes the envelope of a record by codec, wrapped is false if the
+// record is stored before versioning
+func (s *schema) open(codec Codec, data []byte) (env envelope, wrapped bool, err error) {
+	if err := codec.Unmarshal(data, &env); err == nil && env.Data != nil {
+		return env, true, nil
+	}
+	var doc json.RawMessage
+	if err := codec.Unmarshal(data, &doc); err != nil {
+		if s.legacy == nil {
+			return envelope{}, false, err
+		}
+		if doc, err = s.convert(codec, data); err != nil {
+			return envelope{}, false, err
+		}
+	}
+	return envelope{Data: doc}, false, nil
+}
+
+// convert decodes a record stored before versioning into a new value of the
+// legacy type and returns its JSON
+func (s *schema) convert(codec Codec, data []byte) (json.RawMessage, error) {
+	typ := s.legacy
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	v := reflect.New(typ).Interface()
+	if err := codec.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// upgrade returns the JSON of the value of env in the current version
+func (s *schema) upgrade(env envelope) (json.RawMessage, error) {
+	if env.Version > s.version() {
+		return nil, fmt.Errorf("schema version %d is newer than %d", env.Version, s.version())
+	}
+	if env.Version == s.version() {
+		return env.Data, nil
+	}
+	// numbers are kept as json.Number so that they are not rounded
+	dec := json.NewDecoder(bytes.NewReader(env.Data))
+	dec.UseNumber()
+	doc := make(map[string]interface{})
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for i, migration := range s.migrations[env.Version:] {
+		if err := migration(doc); err != nil {
+			return nil, fmt.Errorf("migrate to schema version %d: %v", env.Version+i+1, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// Migrate rewrites the values, archived values and revisions stored in an
+// older schema version in the current one. It runs in batches of small
+// transactions, so the bucket stays available, and the rewrites are neither
+// logged as changes nor kept as revisions, but the rewrites of the values and
+// archived values are recorded in the audit log.
+func (b *Bucket) Migrate(ctx context.Context, batchSize int, dryRun bool, progress func(expay.MigrationProgress)) error {
+	if b.schema == nil {
+		return errNoSchema
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d", batchSize)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	archives, err := b.archiveBucketNames()
+	if err != nil {
+		return err
+	}
+	names := append([][]byte{[]byte(b.name), b.historyBucketName()}, archives...)
+	var p expay.MigrationProgress
+	if err := b.view(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if bucket := tx.Bucket(name); bucket != nil {
+				p.Total += bucket.Stats().KeyN
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	run := b.update
+	if dryRun {
+		run = b.view
+	}
+	for _, name := range names {
+		for lastKey := []byte(nil); ; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var scanned, migrated int
+			if err := run(func(tx *bolt.Tx) error {
+				var err error
+				lastKey, scanned, migrated, err = b.migrateBatch(ctx, tx, name, lastKey, batchSize, dryRun)
+				return err
+			}); err != nil {
+				return err
+			}
+			p.Scanned += scanned
+			p.Migrated += migrated
+			if scanned > 0 && progress != nil {
+				progress(p)
+			}
+			if lastKey == nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// migrateBatch migrates at most batchSize records of bucket name after lastKey
+// within tx, and returns the last scanned key or nil if there is no more
+// record
+func (b *Bucket) migrateBatch(ctx context.Context, tx *bolt.Tx, name, lastKey []byte, batchSize int, dryRun bool) (last []byte, scanned, migrated int, err error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return nil, 0, 0, nil
+	}
+	type record struct {
+		key []byte
+		doc json.RawMessage
+	}
+	var records []record
+	cursor := bucket.Cursor()
+	key, value := cursor.First()
+	if lastKey != nil {
+		key, value = cursor.Seek(lastKey)
+		if bytes.Equal(key, lastKey) {
+			key, value = cursor.Next()
+		}
+	}
+	for ; key != nil && scanned < batchSize; key, value = cursor.Next() {
+		scanned++
+		last = append([]byte{}, key...)
+		codec, data, err := b.open(tx, key, value)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		env, wrapped, err := b.schema.open(codec, data)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("migrate %x: %v", key, err)
+		}
+		if wrapped && env.Version == b.schema.version() {
+			continue
+		}
+		doc, err := b.schema.upgrade(env)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("migrate %x: %v", key, err)
+		}
+		// copy the key because the cursor memory is invalidated by Put
+		records = append(records, record{key: append([]byte{}, key...), doc: doc})
+	}
+	if key == nil {
+		last = nil
+	}
+	if dryRun {
+		return last, scanned, len(records), nil
+	}
+	for _, r := range records {
+		value, err := b.encode(tx, r.key, r.doc)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if err := bucket.Put(r.key, value); err != nil {
+			return nil, 0, 0, err
+		}
+		if !bytes.Equal(name, b.historyBucketName()) {
+			if err := b.logAudit(ctx, tx, expay.OpMigrate, r.key, value); err != nil {
+				return nil, 0, 0, err
+			}
+		}
+	}
+	return last, scanned, len(records), nil
+}
@@ -0,0 +1,308 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+type (
+	recordV0 struct {
+		Name   string `json:"name"`
+		Amount int64  `json:"amount"`
+	}
+	recordV2 struct {
+		FullName string `json:"full_name"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}
+)
+
+var testMigrations = []expay.Migration{
+	// rename name to full_name
+	func(doc map[string]interface{}) error {
+		doc["full_name"] = doc["name"]
+		delete(doc, "name")
+		return nil
+	},
+	// default currency
+	func(doc map[string]interface{}) error {
+		if _, ok := doc["currency"]; !ok {
+			doc["currency"] = "GBP"
+		}
+		return nil
+	},
+}
+
+func TestSchema(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// amount is not rounded by the migrations
+	amount := int64(1<<60 + 1)
+
+	// stored before versioning
+	legacyID, err := db.Bucket("test").Create(ctx, &recordV0{Name: "a", Amount: amount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored in version 1
+	v1ID, err := db.Bucket("test", WithSchema(testMigrations[:1], nil)).Create(ctx, map[string]interface{}{"full_name": "b", "currency": "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := db.Bucket("test", WithSchema(testMigrations, nil))
+	for _, testcase := range []struct {
+		id       string
+		expected recordV2
+	}{
+		{id: legacyID, expected: recordV2{FullName: "a", Amount: amount, Currency: "GBP"}},
+		{id: v1ID, expected: recordV2{FullName: "b", Currency: "EUR"}},
+	} {
+		var r recordV2
+		if err := bucket.Get(ctx, testcase.id, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != testcase.expected {
+			t.Fatalf("expect %v got %v", testcase.expected, r)
+		}
+	}
+
+	// a newer version cannot be read
+	var r recordV0
+	err = db.Bucket("test", WithSchema(nil, nil)).Get(ctx, v1ID, &r)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("expect newer version error got %v", err)
+	}
+
+	// a failed migration
+	failed := errors.New("failed")
+	err = db.Bucket("test", WithSchema(append(testMigrations, func(map[string]interface{}) error { return failed }), nil)).Get(ctx, v1ID, &r)
+	if err == nil || !strings.Contains(err.Error(), "version 3: failed") {
+		t.Fatalf("expect failed migration error got %v", err)
+	}
+}
+
+func TestSchemaLegacyCodec(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, codec := range []Codec{Gob, Compressed(Gob), MsgPack} {
+		name := fmt.Sprintf("test%d", codec.ID())
+		// stored before versioning
+		id, err := db.Bucket(name, WithCodec(codec)).Create(ctx, &recordV0{Name: "a", Amount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r recordV2
+		if err := db.Bucket(name, WithCodec(codec), WithSchema(testMigrations, nil)).Get(ctx, id, &r); err == nil {
+			t.Fatal("expect error without the legacy type got nil")
+		}
+		bucket := db.Bucket(name, WithCodec(codec), WithSchema(testMigrations, &recordV0{}))
+		expected := recordV2{FullName: "a", Amount: 1, Currency: "GBP"}
+		if err := bucket.Get(ctx, id, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != expected {
+			t.Fatalf("expect %v got %v", expected, r)
+		}
+
+		// migrated values no longer need the legacy type
+		if err := bucket.Migrate(ctx, 10, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		r = recordV2{}
+		if err := db.Bucket(name, WithCodec(codec), WithSchema(testMigrations, nil)).Get(ctx, id, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != expected {
+			t.Fatalf("expect %v got %v", expected, r)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := db.Bucket("test").Migrate(ctx, 10, false, nil); err != errNoSchema {
+		t.Fatalf("expect error %v got %v", errNoSchema, err)
+	}
+
+	legacy := db.Bucket("test", WithHistory())
+	var ids []string
+	for _, name := range []string{"a", "b", "c"} {
+		id, err := legacy.Create(ctx, &recordV0{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// stored in the current version
+	bucket := db.Bucket("test", WithHistory(), WithSchema(testMigrations, nil), WithCodec(Compressed(Gob)))
+	if err := bucket.Update(ctx, ids[2], &recordV2{FullName: "c", Currency: "EUR"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Migrate(ctx, 0, false, nil); err == nil {
+		t.Fatal("expect invalid batch size error got nil")
+	}
+
+	// 3 values and 4 revisions, of which 2 values and 3 revisions are old
+	var progress []expay.MigrationProgress
+	record := func(p expay.MigrationProgress) { progress = append(progress, p) }
+	if err := bucket.Migrate(ctx, 2, true, record); err != nil {
+		t.Fatal(err)
+	}
+	expected := []expay.MigrationProgress{
+		{Total: 7, Scanned: 2, Migrated: 2},
+		{Total: 7, Scanned: 3, Migrated: 2},
+		{Total: 7, Scanned: 5, Migrated: 4},
+		{Total: 7, Scanned: 7, Migrated: 5},
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("expect %v got %v", expected, progress)
+	}
+	// nothing is written in a dry run
+	if n := countOld(t, bucket); n != 5 {
+		t.Fatalf("expect %d got %d", 5, n)
+	}
+
+	progress = nil
+	if err := bucket.Migrate(ctx, 2, false, record); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("expect %v got %v", expected, progress)
+	}
+	if n := countOld(t, bucket); n != 0 {
+		t.Fatalf("expect %d got %d", 0, n)
+	}
+	var r recordV2
+	if err := bucket.Get(ctx, ids[0], &r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (recordV2{FullName: "a", Currency: "GBP"}); r != expected {
+		t.Fatalf("expect %v got %v", expected, r)
+	}
+	if _, err := bucket.GetRevision(ctx, ids[2], 1, &r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (recordV2{FullName: "c", Currency: "GBP"}); r != expected {
+		t.Fatalf("expect %v got %v", expected, r)
+	}
+	// the rewrites are not kept as revisions
+	if revs, err := bucket.Revisions(ctx, ids[0]); err != nil || len(revs) != 1 {
+		t.Fatalf("expect 1 revision got %v, %v", revs, err)
+	}
+}
+
+func TestMigrateArchived(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	options := []Option{WithIndexes(FieldIndex("date")), WithArchive("date"), WithAuditLog()}
+	legacy := db.Bucket("test", options...)
+	id, err := legacy.Create(ctx, map[string]interface{}{"name": "a", "date": "2017-01-18"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := legacy.Archive(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expect 1 archived value got %d, %v", n, err)
+	}
+
+	bucket := db.Bucket("test", append(options, WithSchema(testMigrations, nil))...)
+	if err := bucket.Migrate(ctx, 10, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countOld(t, bucket); n != 0 {
+		t.Fatalf("expect %d got %d", 0, n)
+	}
+	var r recordV2
+	if err := bucket.GetArchived(ctx, id, &r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (recordV2{FullName: "a", Currency: "GBP"}); r != expected {
+		t.Fatalf("expect %v got %v", expected, r)
+	}
+	// the rewrite of the archived value is audited
+	if _, _, err := bucket.VerifyAudit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countOld returns the number of records of a bucket, its history and its
+// archive that are not stored in the current schema version
+func countOld(t *testing.T, b *Bucket) (n int) {
+	archives, err := b.archiveBucketNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{[]byte(b.name), b.historyBucketName()}, archives...) {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+			if err := bucket.ForEach(func(key, value []byte) error {
+				codec, data, err := b.open(tx, key, value)
+				if err != nil {
+					return err
+				}
+				env, wrapped, err := b.schema.open(codec, data)
+				if err != nil {
+					return err
+				}
+				if !wrapped || env.Version != b.schema.version() {
+					n++
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package boltdb
+
+import (
+	"context"
+
+	"github.com/etcd-io/bbolt"
+	"h12.io/expay"
+)
+
+// tx is a bucket bound to a bolt transaction that satisfies expay.Tx interface
+type tx struct {
+	ctx context.Context
+	b   *Bucket
+	tx  *bolt.Tx
+}
+
+// RunInTx runs fn within a bolt read-write transaction, which is committed if
+// fn returns nil or rolled back otherwise
+func (b *Bucket) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.update(func(boltTx *bolt.Tx) error {
+		if err := fn(&tx{ctx: ctx, b: b, tx: boltTx}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+func (t *tx) Create(v interface{}) (id string, err error) {
+	key, err := t.b.create(t.ctx, t.tx, v)
+	if err != nil {
+		return "", err
+	}
+	return keyID(key), nil
+}
+
+func (t *tx) Get(id string, v interface{}) error {
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return t.b.get(t.tx, key, v)
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return t.b.put(t.ctx, t.tx, key, v)
+}
+
+func (t *tx) Delete(id string) error {
+	key, err := idKey(id)
+	if err != nil {
+		return err
+	}
+	return t.b.delete(t.ctx, t.tx, key)
+}
@@ -0,0 +1,96 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"h12.io/expay"
+)
+
+func TestBucketRunInTx(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := db.Bucket("test", WithIndexes(Index{
+		Name: "value",
+		Keys: func(v interface{}) []string { return []string{v.(string)} },
+	}))
+	id1, err := bucket.Create(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rolled back
+	id2 := ""
+	injectedErr := errors.New("injected error")
+	if err := bucket.RunInTx(ctx, func(tx expay.Tx) error {
+		var err error
+		if id2, err = tx.Create("def"); err != nil {
+			return err
+		}
+		if err := tx.Update(id1, "ghi"); err != nil {
+			return err
+		}
+		return injectedErr
+	}); err != injectedErr {
+		t.Fatalf("expect error %v got %v", injectedErr, err)
+	}
+	if err := bucket.Get(ctx, id2, new(string)); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+	output := ""
+	if err := bucket.Get(ctx, id1, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output != "abc" {
+		t.Fatalf("expect %s got %s", "abc", output)
+	}
+	it, err := bucket.Lookup(ctx, "value", "ghi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() {
+		t.Fatal("expect index entry rolled back")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// committed
+	if err := bucket.RunInTx(ctx, func(tx expay.Tx) error {
+		value := ""
+		if err := tx.Get(id1, &value); err != nil {
+			return err
+		}
+		if _, err := tx.Create(value + "-refund"); err != nil {
+			return err
+		}
+		return tx.Delete(id1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get(ctx, id1, &output); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+	it, err = bucket.Lookup(ctx, "value", "abc-refund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expect the created value")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,219 @@
+// Package cachedb is a read-through cache of any expay.DB implementation.
+//
+// Values read by Get are kept encoded as JSON in a bounded LRU cache with a
+// TTL, so a cached value never shares memory with the caller. A value is
+// invalidated after it is written via the cache, so the cache is consistent
+// with the DB as long as every write goes through it. Lists are not cached.
+//
+// The cache only implements the optional interfaces it changes, e.g. Archive
+// purges the cache, and the others are found on the cached DB by expay.As.
+package cachedb
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"h12.io/expay"
+)
+
+type (
+	// DB is a caching decorator of expay.DB
+	DB struct {
+		expay.DB
+		ttl time.Duration
+		now func() time.Time
+
+		mu    sync.Mutex
+		cache *lru
+		// epoch increases on every invalidation, so a value read before an
+		// invalidation is not cached after it
+		epoch uint64
+		stats expay.CacheStats
+	}
+	// tx records the IDs written within a transaction
+	tx struct {
+		expay.Tx
+		ids []string
+	}
+)
+
+// New creates a cache of at most size values of db, which expire after ttl, a
+// zero ttl means never expire
+func New(db expay.DB, size int, ttl time.Duration) *DB {
+	return &DB{DB: db, ttl: ttl, now: time.Now, cache: newLRU(size)}
+}
+
+// Get gets a value from the cache or the DB
+func (db *DB) Get(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := db.now()
+	db.mu.Lock()
+	value, ok, expired := db.cache.get(id, now)
+	epoch := db.epoch
+	if ok {
+		db.stats.Hits++
+	} else {
+		db.stats.Misses++
+	}
+	if expired {
+		db.stats.Expirations++
+	}
+	db.mu.Unlock()
+	if ok {
+		return json.Unmarshal(value, v)
+	}
+
+	if err := db.DB.Get(ctx, id, v); err != nil {
+		return err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		// not cached
+		return nil
+	}
+	var expires time.Time
+	if db.ttl > 0 {
+		expires = now.Add(db.ttl)
+	}
+	db.mu.Lock()
+	if db.epoch == epoch && db.cache.add(id, value, expires) {
+		db.stats.Evictions++
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+// Update updates a value in the DB and invalidates its cache
+func (db *DB) Update(ctx context.Context, id string, v interface{}) error {
+	defer db.invalidate(id)
+	return db.DB.Update(ctx, id, v)
+}
+
+// UpdateFunc updates a value in the DB (see expay.DB) and invalidates its
+// cache
+func (db *DB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	defer db.invalidate(id)
+	return db.DB.UpdateFunc(ctx, id, v, fn)
+}
+
+// Delete deletes a value from the DB and invalidates its cache
+func (db *DB) Delete(ctx context.Context, id string) error {
+	defer db.invalidate(id)
+	return db.DB.Delete(ctx, id)
+}
+
+// CreateWithID creates v with id chosen by the client in the DB
+func (db *DB) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	var creator expay.IDCreator
+	if !expay.As(db.DB, &creator) {
+		return expay.ErrNotSupported
+	}
+	defer db.invalidate(id)
+	return creator.CreateWithID(ctx, id, v)
+}
+
+// RunInTx runs fn within a transaction of the DB, and invalidates the cache of
+// the values updated or deleted within it
+func (db *DB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	t := &tx{}
+	defer func() { db.invalidate(t.ids...) }()
+	return db.DB.RunInTx(ctx, func(dbTx expay.Tx) error {
+		t.Tx = dbTx
+		return fn(t)
+	})
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	t.ids = append(t.ids, id)
+	return t.Tx.Update(id, v)
+}
+
+func (t *tx) Delete(id string) error {
+	t.ids = append(t.ids, id)
+	return t.Tx.Delete(id)
+}
+
+// invalidate removes ids from the cache, it is called after they are written
+// whether the write succeeds or not
+func (db *DB) invalidate(ids ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.epoch++
+	for _, id := range ids {
+		db.cache.remove(id)
+	}
+}
+
+// purge removes every value from the cache
+func (db *DB) purge() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.epoch++
+	db.cache.clear()
+}
+
+// CacheStats returns the statistics of the cache
+func (db *DB) CacheStats() expay.CacheStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := db.stats
+	stats.Size = db.cache.len()
+	return stats
+}
+
+// Archive archives the values of the DB and purges the cache
+func (db *DB) Archive(ctx context.Context, before time.Time) (n int, err error) {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return 0, expay.ErrNotSupported
+	}
+	defer db.purge()
+	return archiver.Archive(ctx, before)
+}
+
+// GetArchived reads an archived value from the DB without caching
+func (db *DB) GetArchived(ctx context.Context, id string, v interface{}) error {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return expay.ErrNotSupported
+	}
+	return archiver.GetArchived(ctx, id, v)
+}
+
+// PaginateArchived paginates the archived values of the DB without caching
+func (db *DB) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return nil, expay.ErrNotSupported
+	}
+	return archiver.PaginateArchived(ctx, lastCursor, limit)
+}
+
+// Migrate migrates the schema of the DB and purges the cache
+func (db *DB) Migrate(ctx context.Context, batchSize int, dryRun bool, progress func(expay.MigrationProgress)) error {
+	var migrator expay.Migrator
+	if !expay.As(db.DB, &migrator) {
+		return expay.ErrNotSupported
+	}
+	if !dryRun {
+		defer db.purge()
+	}
+	return migrator.Migrate(ctx, batchSize, dryRun, progress)
+}
+
+// Unwrap returns the cached DB
+func (db *DB) Unwrap() expay.DB {
+	return db.DB
+}
+
+// Supports returns if the interface target points to is supported
+func (db *DB) Supports(target interface{}) bool {
+	if _, ok := target.(*expay.Cacher); ok {
+		return true
+	}
+	return expay.Supports(db.DB, target)
+}
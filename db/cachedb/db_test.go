@@ -0,0 +1,248 @@
+package cachedb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/dbtest"
+	"h12.io/expay/db/faultdb"
+	"h12.io/expay/db/memdb"
+)
+
+type record struct {
+	Name string `json:"name"`
+	Date string `json:"date,omitempty"`
+}
+
+// countingDB counts the reads of a DB and calls onGet before each one
+type countingDB struct {
+	expay.DB
+	gets  int
+	onGet func()
+}
+
+func (db *countingDB) Get(ctx context.Context, id string, v interface{}) error {
+	db.gets++
+	if db.onGet != nil {
+		db.onGet()
+	}
+	return db.DB.Get(ctx, id, v)
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		return New(memdb.New(), 2, time.Minute)
+	})
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingDB{DB: memdb.New()}
+	db := New(inner, 2, time.Minute)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+	ids := []string{}
+	for _, name := range []string{"a", "b", "c"} {
+		id, err := db.Create(ctx, &record{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	get := func(id, want string) {
+		t.Helper()
+		var r record
+		if err := db.Get(ctx, id, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Name != want {
+			t.Fatalf("expect %s got %s", want, r.Name)
+		}
+	}
+	get(ids[0], "a")
+	get(ids[0], "a")
+	get(ids[1], "b")
+	// evicts b, the least recently used
+	get(ids[0], "a")
+	get(ids[2], "c")
+	get(ids[1], "b")
+	if inner.gets != 4 {
+		t.Fatalf("expect %d got %d", 4, inner.gets)
+	}
+
+	// invalidated by writes
+	if err := db.Update(ctx, ids[1], &record{Name: "B"}); err != nil {
+		t.Fatal(err)
+	}
+	get(ids[1], "B")
+	if err := db.UpdateFunc(ctx, ids[1], &record{}, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	get(ids[1], "B")
+	if err := db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Update(ids[1], &record{Name: "BB"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	get(ids[1], "BB")
+	if err := db.Delete(ctx, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, ids[1], &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+
+	// expired
+	get(ids[2], "c")
+	now = now.Add(time.Minute)
+	get(ids[2], "c")
+
+	expected := expay.CacheStats{Hits: 3, Misses: 9, Evictions: 2, Expirations: 1, Size: 1}
+	if stats := db.CacheStats(); stats != expected {
+		t.Fatalf("expect %+v got %+v", expected, stats)
+	}
+}
+
+func TestCacheNotStale(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingDB{DB: memdb.New()}
+	db := New(inner, 10, 0)
+	id, err := db.Create(ctx, &record{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the value read before an update is not cached after it
+	inner.onGet = func() {
+		inner.onGet = nil
+		var r record
+		if err := inner.DB.Get(ctx, id, &r); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(ctx, id, &record{Name: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Get(ctx, id, &record{}); err != nil {
+		t.Fatal(err)
+	}
+	var r record
+	if err := db.Get(ctx, id, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "b" {
+		t.Fatalf("expect %s got %s", "b", r.Name)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	file, err := boltdb.New(path.Join(dir, "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := New(file.Bucket("test", boltdb.WithHistory(), boltdb.WithSchema(nil, nil), boltdb.WithAggregates(expay.Aggregates{}),
+		boltdb.WithIndexes(boltdb.FieldIndex("date")), boltdb.WithArchive("date")), 10, 0)
+	id, err := db.Create(ctx, &record{Name: "a", Date: "2017-01-18"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, id, &record{}); err != nil {
+		t.Fatal(err)
+	}
+	var historian expay.Historian
+	if !expay.As(db, &historian) {
+		t.Fatal("expect history supported by the cached DB")
+	}
+	if revs, err := historian.Revisions(ctx, id); err != nil || len(revs) != 1 {
+		t.Fatalf("expect 1 revision got %v, %v", revs, err)
+	}
+	var aggregator expay.Aggregator
+	if !expay.As(db, &aggregator) {
+		t.Fatal("expect aggregates supported by the cached DB")
+	}
+	if stats, err := aggregator.Stats(ctx); err != nil || stats.Count != 1 {
+		t.Fatalf("expect 1 value got %v, %v", stats, err)
+	}
+	var migrator expay.Migrator
+	if !expay.As(db, &migrator) || migrator != expay.Migrator(db) {
+		t.Fatalf("expect migrations via the cache got %T", migrator)
+	}
+	if err := db.Migrate(ctx, 10, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if size := db.CacheStats().Size; size != 0 {
+		t.Fatalf("expect purged cache got size %d", size)
+	}
+	if err := db.Get(ctx, id, &record{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Archive(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expect 1 archived value got %d, %v", n, err)
+	}
+	// the archived value is no longer cached
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+	if err := db.GetArchived(ctx, id, &record{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := New(memdb.New(), 10, 0)
+	if expay.Supports(mem, (*expay.Historian)(nil)) {
+		t.Fatal("expect history not supported")
+	}
+	if expay.Supports(mem, (*expay.KeyRotator)(nil)) {
+		t.Fatal("expect encryption not supported")
+	}
+	// a DB without any capability
+	plain := New(&struct{ expay.DB }{memdb.New()}, 10, 0)
+	for _, target := range []interface{}{
+		(*expay.Ranger)(nil),
+		(*expay.Aggregator)(nil),
+		(*expay.Archiver)(nil),
+		(*expay.Migrator)(nil),
+		(*expay.Auditor)(nil),
+		(*expay.FaultInjector)(nil),
+	} {
+		if expay.Supports(plain, target) {
+			t.Fatalf("expect %T not supported", target)
+		}
+	}
+	if !expay.Supports(plain, (*expay.Cacher)(nil)) {
+		t.Fatal("expect cache supported")
+	}
+	if _, err := plain.PaginateArchived(ctx, "", 0); !errors.Is(err, expay.ErrNotSupported) {
+		t.Fatalf("expect error %v got %v", expay.ErrNotSupported, err)
+	}
+
+	faulty := New(faultdb.New(memdb.New()), 10, 0)
+	faults := expay.Faults{Ops: map[string]expay.OpFaults{expay.FaultGet: {ErrorRate: 1}}}
+	var injector expay.FaultInjector
+	if !expay.As(faulty, &injector) {
+		t.Fatal("expect fault injection supported by the cached DB")
+	}
+	if err := injector.SetFaults(faults); err != nil {
+		t.Fatal(err)
+	}
+	if err := faulty.Get(ctx, id, &record{}); expay.CodeOf(err) != expay.CodeUnavailable {
+		t.Fatalf("expect %q got %v", expay.CodeUnavailable, err)
+	}
+	if got, err := injector.Faults(); err != nil || got.Ops[expay.FaultGet].ErrorRate != 1 {
+		t.Fatalf("expect %+v got %+v, %v", faults, got, err)
+	}
+}
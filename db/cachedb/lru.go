@@ -0,0 +1,78 @@
+package cachedb
+
+import (
+	"container/list"
+	"time"
+)
+
+type (
+	// lru is a bounded cache that evicts the least recently used entry
+	lru struct {
+		capacity int
+		ll       *list.List
+		items    map[string]*list.Element
+	}
+	entry struct {
+		key   string
+		value []byte
+		// expires is zero if the entry never expires
+		expires time.Time
+	}
+)
+
+func newLRU(capacity int) *lru {
+	return &lru{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value of key if it has not expired at now, an expired entry
+// is removed
+func (c *lru) get(key string, now time.Time) (value []byte, ok, expired bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false, false
+	}
+	e := elem.Value.(*entry)
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		c.removeElement(elem)
+		return nil, false, true
+	}
+	c.ll.MoveToFront(elem)
+	return e.value, true, false
+}
+
+// add sets the value of key and returns if the least recently used entry has
+// been evicted
+func (c *lru) add(key string, value []byte, expires time.Time) (evicted bool) {
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.ll.MoveToFront(elem)
+		return false
+	}
+	c.items[key] = c.ll.PushFront(&entry{key: key, value: value, expires: expires})
+	if c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+		return true
+	}
+	return false
+}
+
+func (c *lru) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *lru) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*entry).key)
+}
+
+func (c *lru) clear() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *lru) len() int {
+	return c.ll.Len()
+}
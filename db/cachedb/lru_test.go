@@ -0,0 +1,51 @@
+package cachedb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newLRU(2)
+	if evicted := c.add("a", []byte("1"), time.Time{}); evicted {
+		t.Fatal("expect not evicted")
+	}
+	if evicted := c.add("b", []byte("2"), now.Add(time.Minute)); evicted {
+		t.Fatal("expect not evicted")
+	}
+	// a becomes the most recently used
+	if value, ok, _ := c.get("a", now); !ok || string(value) != "1" {
+		t.Fatalf("expect 1 got %s, %v", value, ok)
+	}
+	if evicted := c.add("c", []byte("3"), time.Time{}); !evicted {
+		t.Fatal("expect evicted")
+	}
+	if _, ok, _ := c.get("b", now); ok {
+		t.Fatal("expect b evicted")
+	}
+	// replace the value
+	if evicted := c.add("a", []byte("4"), now.Add(time.Minute)); evicted {
+		t.Fatal("expect not evicted")
+	}
+	if value, ok, _ := c.get("a", now); !ok || string(value) != "4" {
+		t.Fatalf("expect 4 got %s, %v", value, ok)
+	}
+	// expired
+	if _, ok, expired := c.get("a", now.Add(time.Minute)); ok || !expired {
+		t.Fatalf("expect expired got %v, %v", ok, expired)
+	}
+	if c.len() != 1 {
+		t.Fatalf("expect %d got %d", 1, c.len())
+	}
+	c.remove("c")
+	c.remove("missing")
+	if c.len() != 0 {
+		t.Fatalf("expect %d got %d", 0, c.len())
+	}
+	c.add("d", []byte("5"), time.Time{})
+	c.clear()
+	if _, ok, _ := c.get("d", now); ok || c.len() != 0 {
+		t.Fatal("expect cleared")
+	}
+}
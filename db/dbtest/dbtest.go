@@ -0,0 +1,507 @@
+// Package dbtest provides a conformance test suite that every implementation
+// of expay.DB interface should pass.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"h12.io/expay"
+)
+
+// Factory returns a new and empty DB for a test, it should release the DB
+// when the test finishes (e.g. with t.Cleanup)
+type Factory func(t *testing.T) expay.DB
+
+// record is the value stored during the tests
+type record struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// RunConformance runs the conformance test suite against the DB returned by
+// factory
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db expay.DB)
+	}{
+		{"CRUD", testCRUD},
+		{"NotFound", testNotFound},
+		{"DeleteMissing", testDeleteMissing},
+		{"InvalidID", testInvalidID},
+		{"UpdateFunc", testUpdateFunc},
+		{"ListEmpty", testListEmpty},
+		{"ListOrder", testListOrder},
+		{"IterCloseEarly", testIterCloseEarly},
+		{"Paginate", testPaginate},
+		{"RunInTx", testRunInTx},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentUpdateFunc", testConcurrentUpdateFunc},
+		{"Canceled", testCanceled},
+		{"CreateWithID", testCreateWithID},
+		{"Range", testRange},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+func testCRUD(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id, err := db.Create(ctx, &record{Name: "a", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expect id but got empty string")
+	}
+	mustGet(t, db, id, record{Name: "a", Count: 1})
+
+	if err := db.Update(ctx, id, &record{Name: "b", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, id, record{Name: "b", Count: 2})
+
+	if err := db.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+}
+
+func testNotFound(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id := mustCreate(t, db, "a")
+	if err := db.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("Get: expect error %v got %v", expay.ErrNotFound, err)
+	}
+	err := db.UpdateFunc(ctx, id, &record{}, func() error {
+		t.Fatal("fn should not be called on a missing id")
+		return nil
+	})
+	if err != expay.ErrNotFound {
+		t.Fatalf("UpdateFunc: expect error %v got %v", expay.ErrNotFound, err)
+	}
+	err = db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Get(id, &record{})
+	})
+	if err != expay.ErrNotFound {
+		t.Fatalf("Tx.Get: expect error %v got %v", expay.ErrNotFound, err)
+	}
+}
+
+func testDeleteMissing(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id := mustCreate(t, db, "a")
+	for i := 0; i < 2; i++ {
+		if err := db.Delete(ctx, id); err != nil {
+			t.Fatalf("delete #%d: %v", i, err)
+		}
+	}
+}
+
+func testInvalidID(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	mustCreate(t, db, "a")
+	const id = "zz"
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrInvalidID {
+		t.Fatalf("Get: expect error %v got %v", expay.ErrInvalidID, err)
+	}
+	if err := db.Update(ctx, id, &record{}); err != expay.ErrInvalidID {
+		t.Fatalf("Update: expect error %v got %v", expay.ErrInvalidID, err)
+	}
+	if err := db.Delete(ctx, id); err != expay.ErrInvalidID {
+		t.Fatalf("Delete: expect error %v got %v", expay.ErrInvalidID, err)
+	}
+	if _, err := db.Paginate(ctx, id, 1); expay.CodeOf(err) != expay.CodeInvalidID {
+		t.Fatalf("Paginate: expect error code %s got %v", expay.CodeInvalidID, err)
+	}
+}
+
+func testUpdateFunc(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id := mustCreate(t, db, "a")
+
+	injectedErr := errors.New("injected error")
+	rec := record{}
+	err := db.UpdateFunc(ctx, id, &rec, func() error {
+		if rec.Name != "a" {
+			t.Fatalf("expect the stored value %s got %s", "a", rec.Name)
+		}
+		rec.Name = "b"
+		return injectedErr
+	})
+	if err != injectedErr {
+		t.Fatalf("expect error %v got %v", injectedErr, err)
+	}
+	mustGet(t, db, id, record{Name: "a"})
+
+	if err := db.UpdateFunc(ctx, id, &rec, func() error {
+		rec.Count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, id, record{Name: "a", Count: 1})
+}
+
+func testListEmpty(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scanAll(t, it); len(got) != 0 {
+		t.Fatalf("expect empty list got %v", got)
+	}
+}
+
+func testListOrder(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	ids := mustCreateN(t, db, "a", "b", "c", "d")
+	if err := db.Delete(ctx, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(ctx, ids[2], &record{Name: "C"}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []idName{{ids[0], "a"}, {ids[2], "C"}, {ids[3], "d"}}
+	if got := scanAll(t, it); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect values in creation order %v got %v", want, got)
+	}
+}
+
+func testIterCloseEarly(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	mustCreateN(t, db, "a", "b", "c")
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expect a value")
+	}
+	if _, err := it.Scan(&record{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// writes are not blocked after an iterator is closed
+	mustCreate(t, db, "d")
+}
+
+func testPaginate(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	ids := mustCreateN(t, db, "a", "b", "c", "d", "e")
+	testcases := []struct {
+		name       string
+		lastCursor string
+		limit      int
+		want       []idName
+	}{
+		{"first page", "", 2, []idName{{ids[0], "a"}, {ids[1], "b"}}},
+		{"middle page", ids[1], 2, []idName{{ids[2], "c"}, {ids[3], "d"}}},
+		{"last page", ids[3], 2, []idName{{ids[4], "e"}}},
+		{"after the last", ids[4], 2, []idName{}},
+		{"no limit", ids[2], 0, []idName{{ids[3], "d"}, {ids[4], "e"}}},
+		{"backward from the last", "", -2, []idName{{ids[4], "e"}, {ids[3], "d"}}},
+		{"backward page", ids[3], -2, []idName{{ids[2], "c"}, {ids[1], "b"}}},
+		{"backward to the first", ids[1], -2, []idName{{ids[0], "a"}}},
+	}
+	for _, tc := range testcases {
+		it, err := db.Paginate(ctx, tc.lastCursor, tc.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := scanAll(t, it); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expect %v got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func testRunInTx(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id := mustCreate(t, db, "a")
+
+	injectedErr := errors.New("injected error")
+	newID := ""
+	err := db.RunInTx(ctx, func(tx expay.Tx) error {
+		var err error
+		if newID, err = tx.Create(&record{Name: "b"}); err != nil {
+			return err
+		}
+		if err := tx.Update(id, &record{Name: "A"}); err != nil {
+			return err
+		}
+		// writes are visible within the transaction
+		rec := record{}
+		if err := tx.Get(newID, &rec); err != nil {
+			return err
+		}
+		if rec.Name != "b" {
+			t.Fatalf("expect %s got %s", "b", rec.Name)
+		}
+		return injectedErr
+	})
+	if err != injectedErr {
+		t.Fatalf("expect error %v got %v", injectedErr, err)
+	}
+	mustGet(t, db, id, record{Name: "a"})
+	if err := db.Get(ctx, newID, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+
+	if err := db.RunInTx(ctx, func(tx expay.Tx) error {
+		if newID, err = tx.Create(&record{Name: "b"}); err != nil {
+			return err
+		}
+		return tx.Delete(id)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, newID, record{Name: "b"})
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	const n = 50
+	ids := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = db.Create(ctx, &record{Count: i})
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[ids[i]] {
+			t.Fatalf("duplicated id %s", ids[i])
+		}
+		seen[ids[i]] = true
+		mustGet(t, db, ids[i], record{Count: i})
+	}
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scanAll(t, it); len(got) != n {
+		t.Fatalf("expect %d values got %d", n, len(got))
+	}
+}
+
+func testConcurrentUpdateFunc(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	id := mustCreate(t, db, "counter")
+	const n = 50
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := record{}
+			errs[i] = db.UpdateFunc(ctx, id, &rec, func() error {
+				rec.Count++
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustGet(t, db, id, record{Name: "counter", Count: n})
+}
+
+func testCanceled(t *testing.T, db expay.DB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	id := mustCreate(t, db, "a")
+	mustCreateN(t, db, "b", "c")
+
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expect a value")
+	}
+	if _, err := it.Scan(&record{}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if it.Next() {
+		t.Fatal("expect iteration stopped by the context")
+	}
+	if err := it.Close(); err != context.Canceled {
+		t.Fatalf("Iter.Close: expect error %v got %v", context.Canceled, err)
+	}
+
+	errs := map[string]error{
+		"Get":    db.Get(ctx, id, &record{}),
+		"Update": db.Update(ctx, id, &record{}),
+		"Delete": db.Delete(ctx, id),
+		"UpdateFunc": db.UpdateFunc(ctx, id, &record{}, func() error {
+			return nil
+		}),
+		"RunInTx": db.RunInTx(ctx, func(tx expay.Tx) error { return nil }),
+	}
+	_, errs["Create"] = db.Create(ctx, &record{})
+	_, errs["List"] = db.List(ctx)
+	_, errs["Paginate"] = db.Paginate(ctx, "", 1)
+	for method, err := range errs {
+		if err != context.Canceled {
+			t.Fatalf("%s: expect error %v got %v", method, context.Canceled, err)
+		}
+	}
+	mustGet(t, db, id, record{Name: "a"})
+}
+
+type idName struct {
+	ID   string
+	Name string
+}
+
+func mustCreate(t *testing.T, db expay.DB, name string) string {
+	t.Helper()
+	id, err := db.Create(context.Background(), &record{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func mustCreateN(t *testing.T, db expay.DB, names ...string) []string {
+	t.Helper()
+	ids := []string{}
+	for _, name := range names {
+		ids = append(ids, mustCreate(t, db, name))
+	}
+	return ids
+}
+
+func mustGet(t *testing.T, db expay.DB, id string, want record) {
+	t.Helper()
+	got := record{}
+	if err := db.Get(context.Background(), id, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("expect %+v got %+v", want, got)
+	}
+}
+
+func scanAll(t *testing.T, it expay.Iter) []idName {
+	t.Helper()
+	values := []idName{}
+	for it.Next() {
+		rec := record{}
+		id, err := it.Scan(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, idName{ID: id, Name: rec.Name})
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// testCreateWithID is skipped if the DB does not accept IDs chosen by clients
+func testCreateWithID(t *testing.T, db expay.DB) {
+	var creator expay.IDCreator
+	if !expay.As(db, &creator) {
+		t.Skip("client ids are not supported")
+	}
+	ctx := context.Background()
+	id := "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	if err := creator.CreateWithID(ctx, id, &record{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, id, record{Name: "a"})
+	if err := creator.CreateWithID(ctx, id, &record{Name: "b"}); err != expay.ErrAlreadyExists {
+		t.Fatalf("expect error %v got %v", expay.ErrAlreadyExists, err)
+	}
+	if err := creator.CreateWithID(ctx, "not-a-uuid", &record{}); err != expay.ErrInvalidID {
+		t.Fatalf("expect error %v got %v", expay.ErrInvalidID, err)
+	}
+	mustGet(t, db, id, record{Name: "a"})
+	// listed with the other values
+	mustCreate(t, db, "c")
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scanAll(t, it); len(got) != 2 {
+		t.Fatalf("expect 2 values got %v", got)
+	}
+}
+
+// testRange is skipped if the DB does not support range iteration
+func testRange(t *testing.T, db expay.DB) {
+	var ranger expay.Ranger
+	if !expay.As(db, &ranger) {
+		t.Skip("range iteration is not supported")
+	}
+	ctx := context.Background()
+	ids := mustCreateN(t, db, "a", "b", "c", "d", "e")
+	for _, tc := range []struct {
+		r     expay.Range
+		names string
+	}{
+		{expay.Range{}, "abcde"},
+		{expay.Range{Desc: true}, "edcba"},
+		{expay.Range{Start: ids[1], End: ids[4]}, "bcd"},
+		{expay.Range{Start: ids[1], End: ids[4], Desc: true}, "dcb"},
+		{expay.Range{Start: ids[2], Limit: 2}, "cd"},
+		{expay.Range{Start: ids[2], Desc: true}, "edc"},
+		{expay.Range{End: ids[2]}, "ab"},
+		{expay.Range{End: ids[2], Desc: true, Limit: 1}, "b"},
+		{expay.Range{Start: ids[3], End: ids[3]}, ""},
+		{expay.Range{Start: ids[3], End: ids[1], Desc: true}, ""},
+	} {
+		it, err := ranger.Range(ctx, tc.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := ""
+		for _, v := range scanAll(t, it) {
+			names += v.Name
+		}
+		if names != tc.names {
+			t.Fatalf("%+v: expect %s got %s", tc.r, tc.names, names)
+		}
+	}
+	if _, err := ranger.Range(ctx, expay.Range{Start: "zz"}); err != expay.ErrInvalidID {
+		t.Fatalf("expect error %v got %v", expay.ErrInvalidID, err)
+	}
+}
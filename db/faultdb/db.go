@@ -0,0 +1,360 @@
+// Package faultdb injects faults into any expay.DB implementation for chaos
+// testing.
+//
+// Latency and errors are injected into each operation (see expay.FaultOps),
+// and the iterators may fail to scan or stop in the middle, at random by the
+// rates of the faults. The faults can be replaced at any time, e.g. by the admin
+// service, and nothing is injected until they are set.
+//
+// The decorator only implements the optional interfaces it injects faults
+// into, and the others are found on the decorated DB by expay.As without
+// faults.
+package faultdb
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"h12.io/expay"
+)
+
+type (
+	// DB is a fault-injecting decorator of expay.DB
+	DB struct {
+		expay.DB
+
+		mu     sync.Mutex
+		faults expay.Faults
+		rand   *rand.Rand
+	}
+	// tx injects the faults of its operations with the context of the
+	// transaction
+	tx struct {
+		expay.Tx
+		db  *DB
+		ctx context.Context
+	}
+)
+
+// New creates a decorator of db without any fault
+func New(db expay.DB) *DB {
+	return &DB{DB: db, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Faults returns the faults being injected
+func (db *DB) Faults() (expay.Faults, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return copyFaults(db.faults), nil
+}
+
+// SetFaults replaces the faults being injected
+func (db *DB) SetFaults(f expay.Faults) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	f = copyFaults(f)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.faults = f
+	return nil
+}
+
+// copyFaults returns a copy of f not sharing its map
+func copyFaults(f expay.Faults) expay.Faults {
+	if f.Ops == nil {
+		return f
+	}
+	ops := make(map[string]expay.OpFaults, len(f.Ops))
+	for op, faults := range f.Ops {
+		ops[op] = faults
+	}
+	return expay.Faults{Ops: ops}
+}
+
+// opFaults returns the faults of op
+func (db *DB) opFaults(op string) expay.OpFaults {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.faults.Ops[op]
+}
+
+// happens returns true at the probability of rate
+func (db *DB) happens(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.rand.Float64() < rate
+}
+
+// inject waits for the latency of op, and returns the injected error if it
+// happens or the error of ctx if it is done while waiting
+func (db *DB) inject(ctx context.Context, op string) error {
+	f := db.opFaults(op)
+	if f.Latency > 0 {
+		timer := time.NewTimer(time.Duration(f.Latency))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if db.happens(f.ErrorRate) {
+		return injectedError(f.Error)
+	}
+	return nil
+}
+
+// injectedError returns the injected error of code, which is unavailable if
+// empty
+func injectedError(code expay.ErrorCode) error {
+	if code == "" {
+		code = expay.CodeUnavailable
+	}
+	return &expay.Error{Code: code, Message: "injected " + string(code) + " fault"}
+}
+
+// Create creates a value in the DB unless a fault is injected
+func (db *DB) Create(ctx context.Context, v interface{}) (id string, err error) {
+	if err := db.inject(ctx, expay.FaultCreate); err != nil {
+		return "", err
+	}
+	return db.DB.Create(ctx, v)
+}
+
+// Get gets a value from the DB unless a fault is injected
+func (db *DB) Get(ctx context.Context, id string, v interface{}) error {
+	if err := db.inject(ctx, expay.FaultGet); err != nil {
+		return err
+	}
+	return db.DB.Get(ctx, id, v)
+}
+
+// Update updates a value in the DB unless a fault is injected
+func (db *DB) Update(ctx context.Context, id string, v interface{}) error {
+	if err := db.inject(ctx, expay.FaultUpdate); err != nil {
+		return err
+	}
+	return db.DB.Update(ctx, id, v)
+}
+
+// UpdateFunc updates a value in the DB (see expay.DB) unless a fault is
+// injected
+func (db *DB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	if err := db.inject(ctx, expay.FaultUpdate); err != nil {
+		return err
+	}
+	return db.DB.UpdateFunc(ctx, id, v, fn)
+}
+
+// Delete deletes a value from the DB unless a fault is injected
+func (db *DB) Delete(ctx context.Context, id string) error {
+	if err := db.inject(ctx, expay.FaultDelete); err != nil {
+		return err
+	}
+	return db.DB.Delete(ctx, id)
+}
+
+// List returns an iterator of the DB with the faults of list
+func (db *DB) List(ctx context.Context) (expay.Iter, error) {
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return db.DB.List(ctx)
+	})
+}
+
+// Paginate returns an iterator of a page of the DB with the faults of list
+func (db *DB) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return db.DB.Paginate(ctx, lastCursor, limit)
+	})
+}
+
+// iterate returns the iterator opened by open with the faults of list, unless
+// a fault is injected before it is opened
+func (db *DB) iterate(ctx context.Context, open func() (expay.Iter, error)) (expay.Iter, error) {
+	if err := db.inject(ctx, expay.FaultList); err != nil {
+		return nil, err
+	}
+	it, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &iter{Iter: it, db: db, faults: db.opFaults(expay.FaultList)}, nil
+}
+
+// RunInTx runs fn within a transaction of the DB unless a fault is injected,
+// and the faults are injected into the operations within it as well
+func (db *DB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	if err := db.inject(ctx, expay.FaultTx); err != nil {
+		return err
+	}
+	return db.DB.RunInTx(ctx, func(dbTx expay.Tx) error {
+		return fn(&tx{Tx: dbTx, db: db, ctx: ctx})
+	})
+}
+
+func (t *tx) Create(v interface{}) (id string, err error) {
+	if err := t.db.inject(t.ctx, expay.FaultCreate); err != nil {
+		return "", err
+	}
+	return t.Tx.Create(v)
+}
+
+func (t *tx) Get(id string, v interface{}) error {
+	if err := t.db.inject(t.ctx, expay.FaultGet); err != nil {
+		return err
+	}
+	return t.Tx.Get(id, v)
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	if err := t.db.inject(t.ctx, expay.FaultUpdate); err != nil {
+		return err
+	}
+	return t.Tx.Update(id, v)
+}
+
+func (t *tx) Delete(id string) error {
+	if err := t.db.inject(t.ctx, expay.FaultDelete); err != nil {
+		return err
+	}
+	return t.Tx.Delete(id)
+}
+
+// CreateWithID creates v with id chosen by the client in the DB unless a fault
+// is injected
+func (db *DB) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	var creator expay.IDCreator
+	if !expay.As(db.DB, &creator) {
+		return expay.ErrNotSupported
+	}
+	if err := db.inject(ctx, expay.FaultCreate); err != nil {
+		return err
+	}
+	return creator.CreateWithID(ctx, id, v)
+}
+
+// Range iterates over a range of IDs of the DB with the faults of list
+func (db *DB) Range(ctx context.Context, r expay.Range) (expay.Iter, error) {
+	var ranger expay.Ranger
+	if !expay.As(db.DB, &ranger) {
+		return nil, expay.ErrNotSupported
+	}
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return ranger.Range(ctx, r)
+	})
+}
+
+// Lookup looks up values by an index of the DB with the faults of list
+func (db *DB) Lookup(ctx context.Context, index, key string) (expay.Iter, error) {
+	var indexer expay.Indexer
+	if !expay.As(db.DB, &indexer) {
+		return nil, expay.ErrNotSupported
+	}
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return indexer.Lookup(ctx, index, key)
+	})
+}
+
+// LookupRange looks up values by a range of an index of the DB with the faults
+// of list
+func (db *DB) LookupRange(ctx context.Context, index, start, end string) (expay.Iter, error) {
+	var indexer expay.Indexer
+	if !expay.As(db.DB, &indexer) {
+		return nil, expay.ErrNotSupported
+	}
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return indexer.LookupRange(ctx, index, start, end)
+	})
+}
+
+// Revisions returns the revisions of id kept by the DB unless a fault of get
+// is injected
+func (db *DB) Revisions(ctx context.Context, id string) ([]expay.Revision, error) {
+	var historian expay.Historian
+	if !expay.As(db.DB, &historian) {
+		return nil, expay.ErrNotSupported
+	}
+	if err := db.inject(ctx, expay.FaultGet); err != nil {
+		return nil, err
+	}
+	return historian.Revisions(ctx, id)
+}
+
+// GetRevision reads revision n of id from the DB into v unless a fault of get
+// is injected
+func (db *DB) GetRevision(ctx context.Context, id string, n int, v interface{}) (*expay.Revision, error) {
+	var historian expay.Historian
+	if !expay.As(db.DB, &historian) {
+		return nil, expay.ErrNotSupported
+	}
+	if err := db.inject(ctx, expay.FaultGet); err != nil {
+		return nil, err
+	}
+	return historian.GetRevision(ctx, id, n, v)
+}
+
+// GetAsOf reads the revision of id that was current at time t from the DB
+// into v unless a fault of get is injected
+func (db *DB) GetAsOf(ctx context.Context, id string, t time.Time, v interface{}) (*expay.Revision, error) {
+	var historian expay.Historian
+	if !expay.As(db.DB, &historian) {
+		return nil, expay.ErrNotSupported
+	}
+	if err := db.inject(ctx, expay.FaultGet); err != nil {
+		return nil, err
+	}
+	return historian.GetAsOf(ctx, id, t, v)
+}
+
+// GetArchived reads an archived value from the DB unless a fault of get is
+// injected
+func (db *DB) GetArchived(ctx context.Context, id string, v interface{}) error {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return expay.ErrNotSupported
+	}
+	if err := db.inject(ctx, expay.FaultGet); err != nil {
+		return err
+	}
+	return archiver.GetArchived(ctx, id, v)
+}
+
+// PaginateArchived paginates the archived values of the DB with the faults of
+// list
+func (db *DB) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return nil, expay.ErrNotSupported
+	}
+	return db.iterate(ctx, func() (expay.Iter, error) {
+		return archiver.PaginateArchived(ctx, lastCursor, limit)
+	})
+}
+
+// Archive archives the values of the DB without faults
+func (db *DB) Archive(ctx context.Context, before time.Time) (n int, err error) {
+	var archiver expay.Archiver
+	if !expay.As(db.DB, &archiver) {
+		return 0, expay.ErrNotSupported
+	}
+	return archiver.Archive(ctx, before)
+}
+
+// Unwrap returns the decorated DB
+func (db *DB) Unwrap() expay.DB {
+	return db.DB
+}
+
+// Supports returns if the interface target points to is supported
+func (db *DB) Supports(target interface{}) bool {
+	if _, ok := target.(*expay.FaultInjector); ok {
+		return true
+	}
+	return expay.Supports(db.DB, target)
+}
@@ -0,0 +1,190 @@
+package faultdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
+	"h12.io/expay/db/memdb"
+)
+
+type record struct {
+	Name string `json:"name"`
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		return New(memdb.New())
+	})
+}
+
+func setFaults(t *testing.T, db *DB, ops map[string]expay.OpFaults) {
+	t.Helper()
+	if err := db.SetFaults(expay.Faults{Ops: ops}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	ctx := context.Background()
+	db := New(memdb.New())
+	id, err := db.Create(ctx, &record{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFaults(t, db, map[string]expay.OpFaults{
+		expay.FaultGet:    {ErrorRate: 1},
+		expay.FaultUpdate: {ErrorRate: 1, Error: expay.CodeConflict},
+		expay.FaultTx:     {ErrorRate: 1},
+	})
+	for _, testcase := range []struct {
+		name     string
+		op       func() error
+		expected expay.ErrorCode
+	}{
+		{"get", func() error { return db.Get(ctx, id, &record{}) }, expay.CodeUnavailable},
+		{"update", func() error { return db.Update(ctx, id, &record{Name: "b"}) }, expay.CodeConflict},
+		{"update func", func() error { return db.UpdateFunc(ctx, id, &record{}, func() error { return nil }) }, expay.CodeConflict},
+		{"tx", func() error { return db.RunInTx(ctx, func(expay.Tx) error { return nil }) }, expay.CodeUnavailable},
+	} {
+		if code := expay.CodeOf(testcase.op()); code != testcase.expected {
+			t.Fatalf("%s: expect %q got %q", testcase.name, testcase.expected, code)
+		}
+	}
+
+	// the value is untouched by the failed operations
+	setFaults(t, db, nil)
+	var r record
+	if err := db.Get(ctx, id, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "a" {
+		t.Fatalf("expect %s got %s", "a", r.Name)
+	}
+}
+
+func TestInjectTxError(t *testing.T) {
+	ctx := context.Background()
+	db := New(memdb.New())
+	setFaults(t, db, map[string]expay.OpFaults{expay.FaultCreate: {ErrorRate: 1}})
+	err := db.RunInTx(ctx, func(tx expay.Tx) error {
+		_, err := tx.Create(&record{Name: "a"})
+		return err
+	})
+	if code := expay.CodeOf(err); code != expay.CodeUnavailable {
+		t.Fatalf("expect %q got %q", expay.CodeUnavailable, code)
+	}
+}
+
+func TestInjectLatency(t *testing.T) {
+	db := New(memdb.New())
+	setFaults(t, db, map[string]expay.OpFaults{expay.FaultCreate: {Latency: expay.Duration(time.Minute)}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.Create(ctx, &record{Name: "a"}); err != context.DeadlineExceeded {
+		t.Fatalf("expect error %v got %v", context.DeadlineExceeded, err)
+	}
+
+	setFaults(t, db, map[string]expay.OpFaults{expay.FaultCreate: {Latency: expay.Duration(10 * time.Millisecond)}})
+	start := time.Now()
+	if _, err := db.Create(context.Background(), &record{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("expect latency %v got %v", 10*time.Millisecond, elapsed)
+	}
+}
+
+func TestInjectIter(t *testing.T) {
+	ctx := context.Background()
+	db := New(memdb.New())
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := db.Create(ctx, &record{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, testcase := range []struct {
+		name       string
+		faults     expay.OpFaults
+		scanned    int
+		scanErrors int
+		closeError expay.ErrorCode
+	}{
+		{"no fault", expay.OpFaults{}, 3, 0, ""},
+		{"scan errors", expay.OpFaults{ScanErrorRate: 1}, 3, 3, ""},
+		{"closed", expay.OpFaults{CloseRate: 1, Error: expay.CodeQuotaExceeded}, 0, 0, expay.CodeQuotaExceeded},
+	} {
+		setFaults(t, db, map[string]expay.OpFaults{expay.FaultList: testcase.faults})
+		iter, err := db.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned, scanErrors := 0, 0
+		for iter.Next() {
+			scanned++
+			if _, err := iter.Scan(&record{}); err != nil {
+				scanErrors++
+			}
+		}
+		if code := expay.CodeOf(iter.Close()); code != testcase.closeError {
+			t.Fatalf("%s: expect %q got %q", testcase.name, testcase.closeError, code)
+		}
+		if scanned != testcase.scanned || scanErrors != testcase.scanErrors {
+			t.Fatalf("%s: expect %d, %d got %d, %d", testcase.name, testcase.scanned, testcase.scanErrors, scanned, scanErrors)
+		}
+	}
+
+	setFaults(t, db, map[string]expay.OpFaults{expay.FaultList: {ErrorRate: 1}})
+	if _, err := db.Paginate(ctx, "", 2); expay.CodeOf(err) != expay.CodeUnavailable {
+		t.Fatalf("expect %q got %v", expay.CodeUnavailable, err)
+	}
+}
+
+func TestSetFaults(t *testing.T) {
+	db := New(memdb.New())
+	ops := map[string]expay.OpFaults{expay.FaultGet: {ErrorRate: 0.5}}
+	setFaults(t, db, ops)
+	// not shared with the caller
+	ops[expay.FaultGet] = expay.OpFaults{}
+	faults, err := db.Faults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate := faults.Ops[expay.FaultGet].ErrorRate; rate != 0.5 {
+		t.Fatalf("expect %v got %v", 0.5, rate)
+	}
+	if err := db.SetFaults(expay.Faults{Ops: map[string]expay.OpFaults{"watch": {}}}); expay.CodeOf(err) != expay.CodeInvalidArgument {
+		t.Fatalf("expect %q got %v", expay.CodeInvalidArgument, err)
+	}
+	if faults, _ := db.Faults(); len(faults.Ops) != 1 {
+		t.Fatalf("expect unchanged faults got %+v", faults)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	db := New(memdb.New())
+	if _, err := db.Archive(ctx, time.Now()); expay.CodeOf(err) != expay.CodeNotSupported {
+		t.Fatalf("expect %q got %v", expay.CodeNotSupported, err)
+	}
+	for _, target := range []interface{}{
+		(*expay.Archiver)(nil),
+		(*expay.Auditor)(nil),
+		(*expay.Aggregator)(nil),
+	} {
+		if expay.Supports(db, target) {
+			t.Fatalf("expect %T not supported", target)
+		}
+	}
+	var ranger expay.Ranger
+	if !expay.As(db, &ranger) || ranger != expay.Ranger(db) {
+		t.Fatalf("expect faults injected into range got %T", ranger)
+	}
+	if !expay.Supports(db, (*expay.FaultInjector)(nil)) {
+		t.Fatal("expect a fault injector")
+	}
+}
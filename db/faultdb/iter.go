@@ -0,0 +1,41 @@
+package faultdb
+
+import "h12.io/expay"
+
+// iter injects the faults of list into an iterator
+type iter struct {
+	expay.Iter
+	db     *DB
+	faults expay.OpFaults
+	// err is the injected error that has stopped the iteration
+	err error
+}
+
+func (it *iter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.db.happens(it.faults.CloseRate) {
+		it.err = injectedError(it.faults.Error)
+		return false
+	}
+	return it.Iter.Next()
+}
+
+// Scan scans the next value, and fails at the scan error rate after moving to
+// the next value as a failed decoding does
+func (it *iter) Scan(v interface{}) (id string, err error) {
+	id, err = it.Iter.Scan(v)
+	if err == nil && it.db.happens(it.faults.ScanErrorRate) {
+		err = injectedError(it.faults.Error)
+	}
+	return id, err
+}
+
+func (it *iter) Close() error {
+	err := it.Iter.Close()
+	if it.err != nil {
+		return it.err
+	}
+	return err
+}
@@ -0,0 +1,277 @@
+// Package memdb is an in-memory implementation of expay.DB interface.
+//
+// Values are stored encoded as JSON, so a stored value never shares memory with
+// the caller. The values are kept in an immutable tree, every write creates a
+// new version of the tree and every iterator walks the version of the tree when
+// it was created (a snapshot) without blocking writers.
+package memdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"h12.io/expay"
+)
+
+type (
+	// DB is an in-memory DB that satisifies expay.DB interface
+	DB struct {
+		// wmu serializes writers
+		wmu sync.Mutex
+		// mu protects root and seq
+		mu   sync.RWMutex
+		root *node
+		seq  uint64
+	}
+	// tx is a write transaction working on its own version of the tree
+	tx struct {
+		root *node
+		seq  uint64
+	}
+	iter struct {
+		ctx    context.Context
+		err    error
+		cursor cursor
+		node   *node
+		// lower (inclusive) and upper (exclusive) bounds of the keys, empty
+		// means unbounded
+		lower, upper string
+		remaining    int
+	}
+)
+
+// New creates an empty in-memory DB
+func New() *DB {
+	return &DB{}
+}
+
+// Create creates a new value into the DB
+func (db *DB) Create(ctx context.Context, v interface{}) (id string, err error) {
+	err = db.RunInTx(ctx, func(tx expay.Tx) error {
+		id, err = tx.Create(v)
+		return err
+	})
+	return id, err
+}
+
+// CreateWithID creates v with id chosen by the client, which must be a UUID
+func (db *DB) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	if !expay.IsUUID(id) {
+		return expay.ErrInvalidID
+	}
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		if err := tx.Get(id, &json.RawMessage{}); err != expay.ErrNotFound {
+			if err == nil {
+				return expay.ErrAlreadyExists
+			}
+			return err
+		}
+		return tx.Update(id, v)
+	})
+}
+
+// Get gets a value from the DB given the id
+func (db *DB) Get(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	root, _ := db.snapshot()
+	return (&tx{root: root}).Get(id, v)
+}
+
+// Update updates a value given the id
+func (db *DB) Update(ctx context.Context, id string, v interface{}) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Update(id, v)
+	})
+}
+
+// UpdateFunc reads the value of id into v, calls fn and writes v back within
+// one transaction
+func (db *DB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		if err := tx.Get(id, v); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return tx.Update(id, v)
+	})
+}
+
+// Delete deletes an id from the DB, returns nil if not exists
+func (db *DB) Delete(ctx context.Context, id string) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Delete(id)
+	})
+}
+
+// RunInTx runs fn on a new version of the tree, which replaces the current
+// one if fn returns nil or is discarded otherwise. Writers are serialized while
+// readers are never blocked.
+func (db *DB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+	root, seq := db.snapshot()
+	t := &tx{root: root, seq: seq}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.root, db.seq = t.root, t.seq
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *DB) snapshot() (*node, uint64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.root, db.seq
+}
+
+// List returns an iterator of a snapshot of every value in the DB
+func (db *DB) List(ctx context.Context) (expay.Iter, error) {
+	return db.Paginate(ctx, "", 0)
+}
+
+// Paginate is the same as List but starts after lastCursor and returns at most
+// limit values (see expay.DB for details)
+func (db *DB) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	if lastCursor != "" && !validID(lastCursor) {
+		return nil, expay.ErrInvalidID
+	}
+	if limit < 0 {
+		return db.newIter(ctx, "", lastCursor, true, -limit)
+	}
+	if lastCursor != "" {
+		// the smallest key after lastCursor
+		lastCursor += "\x00"
+	}
+	return db.newIter(ctx, lastCursor, "", false, limit)
+}
+
+// Range returns an iterator of a snapshot of the values whose IDs are within r
+// in the order of the IDs
+func (db *DB) Range(ctx context.Context, r expay.Range) (expay.Iter, error) {
+	if r.Start != "" && !validID(r.Start) || r.End != "" && !validID(r.End) {
+		return nil, expay.ErrInvalidID
+	}
+	return db.newIter(ctx, r.Start, r.End, r.Desc, r.Limit)
+}
+
+// newIter returns an iterator of at most limit values (unlimited if limit is
+// not positive) whose keys are within [lower, upper), an empty bound means
+// unbounded
+func (db *DB) newIter(ctx context.Context, lower, upper string, reverse bool, limit int) (*iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	root, _ := db.snapshot()
+	it := &iter{
+		ctx:       ctx,
+		cursor:    cursor{reverse: reverse},
+		lower:     lower,
+		upper:     upper,
+		remaining: limit,
+	}
+	if limit <= 0 {
+		it.remaining = -1
+	}
+	if reverse {
+		it.cursor.seek(root, upper)
+	} else {
+		it.cursor.seek(root, lower)
+	}
+	it.node = it.cursor.next()
+	return it, nil
+}
+
+func (t *tx) Create(v interface{}) (id string, err error) {
+	t.seq++
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, t.seq)
+	id = hex.EncodeToString(key)
+	return id, t.Update(id, v)
+}
+
+func (t *tx) Get(id string, v interface{}) error {
+	if !validID(id) {
+		return expay.ErrInvalidID
+	}
+	value := get(t.root, id)
+	if value == nil {
+		return expay.ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	if !validID(id) {
+		return expay.ErrInvalidID
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.root = insert(t.root, id, value)
+	return nil
+}
+
+func (t *tx) Delete(id string) error {
+	if !validID(id) {
+		return expay.ErrInvalidID
+	}
+	if get(t.root, id) != nil {
+		t.root = remove(t.root, id)
+	}
+	return nil
+}
+
+// validID returns if id is of the form used by the DB, i.e. the hex of an
+// 8-byte sequence number or a UUID
+func validID(id string) bool {
+	if len(id) == 16 {
+		_, err := hex.DecodeString(id)
+		return err == nil
+	}
+	return expay.IsUUID(id)
+}
+
+func (it *iter) Next() bool {
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	return it.node != nil && it.remaining != 0 && it.within(it.node.key)
+}
+
+// within returns if key is within the bound the iteration moves towards
+func (it *iter) within(key string) bool {
+	if it.cursor.reverse {
+		return it.lower == "" || key >= it.lower
+	}
+	return it.upper == "" || key < it.upper
+}
+
+func (it *iter) Scan(v interface{}) (id string, err error) {
+	id = it.node.key
+	err = json.Unmarshal(it.node.value, v)
+	it.node = it.cursor.next()
+	if it.remaining > 0 {
+		it.remaining--
+	}
+	return
+}
+
+func (it *iter) Close() error {
+	return it.err
+}
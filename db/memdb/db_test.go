@@ -0,0 +1,166 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
+)
+
+func TestDBOps(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := New()
+
+	// stored values are copies
+	input := &expay.Payment{Type: "Payment"}
+	id, err := db.Create(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.Type = "changed"
+	output := &expay.Payment{}
+	if err := db.Get(ctx, id, output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != "Payment" {
+		t.Fatalf("expect %s got %s", "Payment", output.Type)
+	}
+	output.Type = "changed"
+	if err := db.Get(ctx, id, output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != "Payment" {
+		t.Fatalf("expect %s got %s", "Payment", output.Type)
+	}
+
+	// update
+	if err := db.UpdateFunc(ctx, id, output, func() error {
+		output.Version++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, id, output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Version != 1 {
+		t.Fatalf("expect version %d got %d", 1, output.Version)
+	}
+
+	// delete
+	if err := db.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, id, output); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+	if err := db.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIterSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := New()
+	ids := []string{}
+	for _, value := range []string{"a", "b", "c"} {
+		id, err := db.Create(ctx, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	it, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes after the iterator is created are not visible to it
+	if err := db.Delete(ctx, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Create(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	values := []string{}
+	for it.Next() {
+		value := ""
+		if _, err := it.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("expect values %v got %v", want, values)
+	}
+
+	it, err = db.Paginate(ctx, ids[2], -2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values = []string{}
+	for it.Next() {
+		value := ""
+		if _, err := it.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("expect values %v got %v", want, values)
+	}
+}
+
+func TestRunInTxRollback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := New()
+	id, err := db.Create(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectedErr := errors.New("injected error")
+	newID := ""
+	if err := db.RunInTx(ctx, func(tx expay.Tx) error {
+		if newID, err = tx.Create("b"); err != nil {
+			return err
+		}
+		if err := tx.Delete(id); err != nil {
+			return err
+		}
+		return injectedErr
+	}); err != injectedErr {
+		t.Fatalf("expect error %v got %v", injectedErr, err)
+	}
+	if err := db.Get(ctx, id, new(string)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, newID, new(string)); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+	}
+	// the sequence is rolled back too
+	if id2, err := db.Create(ctx, "c"); err != nil {
+		t.Fatal(err)
+	} else if id2 != newID {
+		t.Fatalf("expect id %s got %s", newID, id2)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		return New()
+	})
+}
@@ -0,0 +1,166 @@
+package memdb
+
+import "hash/fnv"
+
+// node is a node of an immutable treap, a new version of the tree is created
+// by copying the path from the root to the modified node, so a root is a
+// consistent snapshot of the tree that never changes
+type node struct {
+	key         string
+	value       []byte
+	priority    uint64
+	left, right *node
+}
+
+// priority returns a pseudo random priority of a key that keeps the treap
+// balanced in expectation
+func priority(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// get returns the value of key or nil if not found
+func get(n *node, key string) []byte {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.value
+		}
+	}
+	return nil
+}
+
+// insert returns a new tree with key set to value
+func insert(n *node, key string, value []byte) *node {
+	if n == nil {
+		return &node{key: key, value: value, priority: priority(key)}
+	}
+	c := *n
+	switch {
+	case key < n.key:
+		c.left = insert(n.left, key, value)
+		if c.left.priority > c.priority {
+			return rotateRight(&c)
+		}
+	case key > n.key:
+		c.right = insert(n.right, key, value)
+		if c.right.priority > c.priority {
+			return rotateLeft(&c)
+		}
+	default:
+		c.value = value
+	}
+	return &c
+}
+
+// rotateRight rotates a newly copied node with its newly copied left child
+func rotateRight(n *node) *node {
+	l := n.left
+	n.left, l.right = l.right, n
+	return l
+}
+
+// rotateLeft rotates a newly copied node with its newly copied right child
+func rotateLeft(n *node) *node {
+	r := n.right
+	n.right, r.left = r.left, n
+	return r
+}
+
+// remove returns a new tree without key
+func remove(n *node, key string) *node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	switch {
+	case key < n.key:
+		c.left = remove(n.left, key)
+	case key > n.key:
+		c.right = remove(n.right, key)
+	default:
+		return merge(n.left, n.right)
+	}
+	return &c
+}
+
+// merge returns a new tree of all the nodes of l and r, given that every key in
+// l is less than any key in r
+func merge(l, r *node) *node {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		c := *l
+		c.right = merge(l.right, r)
+		return &c
+	}
+	c := *r
+	c.left = merge(l, r.left)
+	return &c
+}
+
+// cursor walks a tree in order (or in reverse order) with an explicit stack
+type cursor struct {
+	stack   []*node
+	reverse bool
+}
+
+// seek positions the cursor at the first node from bound in the walking order,
+// which is the lower bound (inclusive) or the upper bound (exclusive) if the
+// cursor walks in reverse order, or at the first node if bound is empty
+func (c *cursor) seek(n *node, bound string) {
+	for n != nil {
+		if c.reverse {
+			if bound == "" || n.key < bound {
+				c.stack = append(c.stack, n)
+				n = n.right
+			} else {
+				n = n.left
+			}
+		} else {
+			if n.key >= bound {
+				c.stack = append(c.stack, n)
+				n = n.left
+			} else {
+				n = n.right
+			}
+		}
+	}
+}
+
+// next returns the current node and moves the cursor forward, or nil if there
+// is no more node
+func (c *cursor) next() *node {
+	if len(c.stack) == 0 {
+		return nil
+	}
+	n := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	if c.reverse {
+		c.pushSpine(n.left)
+	} else {
+		c.pushSpine(n.right)
+	}
+	return n
+}
+
+// pushSpine pushes n and the nodes on its way to the first node of its subtree
+func (c *cursor) pushSpine(n *node) {
+	for n != nil {
+		c.stack = append(c.stack, n)
+		if c.reverse {
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package memdb
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	var root *node
+	m := make(map[string]string)
+	type snapshot struct {
+		root *node
+		keys []string
+	}
+	snapshots := []snapshot{}
+	for i := 0; i < 2000; i++ {
+		key := strconv.Itoa(rnd.Intn(500))
+		if rnd.Intn(3) == 0 {
+			root = remove(root, key)
+			delete(m, key)
+		} else {
+			root = insert(root, key, []byte(key))
+			m[key] = key
+		}
+		if i%100 == 0 {
+			snapshots = append(snapshots, snapshot{root: root, keys: sortedKeys(m)})
+		}
+	}
+	for key, value := range m {
+		if got := string(get(root, key)); got != value {
+			t.Fatalf("expect %s got %s", value, got)
+		}
+	}
+	// old versions of the tree never change
+	for _, s := range snapshots {
+		if keys := walk(s.root, "", false); !reflect.DeepEqual(keys, s.keys) {
+			t.Fatalf("expect keys %v got %v", s.keys, keys)
+		}
+	}
+
+	keys := sortedKeys(m)
+	if got := walk(root, "", false); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("expect keys %v got %v", keys, got)
+	}
+	pivot := keys[len(keys)/2]
+	if got, want := walk(root, pivot, false), keys[len(keys)/2:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect keys %v got %v", want, got)
+	}
+	reversed := []string{}
+	for i := len(keys)/2 - 1; i >= 0; i-- {
+		reversed = append(reversed, keys[i])
+	}
+	if got := walk(root, pivot, true); !reflect.DeepEqual(got, reversed) {
+		t.Fatalf("expect keys %v got %v", reversed, got)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func walk(root *node, bound string, reverse bool) []string {
+	c := cursor{reverse: reverse}
+	c.seek(root, bound)
+	keys := []string{}
+	for n := c.next(); n != nil; n = c.next() {
+		keys = append(keys, n.key)
+	}
+	return keys
+}
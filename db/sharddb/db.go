@@ -0,0 +1,665 @@
+// Package sharddb is an implementation of expay.DB interface that spreads the
+// values across multiple DBs (shards), e.g. boltdb files, so that they can be
+// written concurrently.
+//
+// A value is placed in the shard given by the hash of its shard key, e.g. the
+// organisation of a payment, or in the next shard in turn if it has none. The
+// ID of a value is the ID within its shard followed by two hex digits of the
+// shard number, so the IDs of every shard must be 16 hex digits of a sequence
+// number like those of boltdb, memdb and sqldb. A UUID chosen by a client (see
+// expay.IDCreator) is kept as is in the shard given by its hash. Values are
+// listed in the order of their IDs merged from all the shards, sequence IDs
+// before UUIDs, so values created in turn are listed in creation order. Ranges
+// and index lookups are merged the same way.
+//
+// The change logs of the shards cannot be merged into one sequence, so
+// expay.Watcher is not supported.
+package sharddb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"h12.io/expay"
+)
+
+// MaxShards is the maximum number of shards
+const MaxShards = 256
+
+const (
+	// length of the ID within a shard
+	innerIDLen = 16
+	// length of the shard number suffix of an ID
+	shardLen = 2
+)
+
+var errNoShard = errors.New("at least one shard is required")
+
+type (
+	// DB is a sharded DB that satisifies expay.DB interface
+	DB struct {
+		shards []expay.DB
+		key    func(v interface{}) string
+		// next is the counter to place values without a shard key in turn
+		next uint32
+	}
+	// tx is a transaction on every shard
+	tx struct {
+		db  *DB
+		txs []expay.Tx
+	}
+)
+
+// New creates a DB of the shards, key returns the shard key of a value or an
+// empty string if it has none, and can be nil if no value has a shard key
+func New(shards []expay.DB, key func(v interface{}) string) (*DB, error) {
+	if len(shards) == 0 {
+		return nil, errNoShard
+	}
+	if len(shards) > MaxShards {
+		return nil, fmt.Errorf("%d shards exceed the maximum %d", len(shards), MaxShards)
+	}
+	return &DB{shards: shards, key: key}, nil
+}
+
+// Close closes every shard that can be closed, e.g. a boltdb file, and
+// returns the first error
+func (db *DB) Close() error {
+	var first error
+	for _, shard := range db.shards {
+		if c, ok := shard.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Shard returns the shard number of id
+func (db *DB) Shard(id string) (int, error) {
+	_, shard, err := db.split(id)
+	return shard, err
+}
+
+// split returns the ID within the shard and the shard number of id, an id of
+// a shard beyond the DB is not found
+func (db *DB) split(id string) (innerID string, shard int, err error) {
+	if expay.IsUUID(id) {
+		return id, db.hashShard(id), nil
+	}
+	if len(id) != innerIDLen+shardLen {
+		return "", 0, expay.ErrInvalidID
+	}
+	n, err := strconv.ParseUint(id[innerIDLen:], 16, 8)
+	if err != nil {
+		return "", 0, expay.ErrInvalidID
+	}
+	if int(n) >= len(db.shards) {
+		return "", 0, expay.ErrNotFound
+	}
+	return id[:innerIDLen], int(n), nil
+}
+
+// join returns the ID of a value given its ID within a shard, a UUID is the
+// same within its shard
+func join(innerID string, shard int) string {
+	if expay.IsUUID(innerID) {
+		return innerID
+	}
+	return fmt.Sprintf("%s%02x", innerID, shard)
+}
+
+// idLess returns if ID a comes before b in the merged order, where sequence
+// IDs come before the longer UUIDs
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// place returns the shard of a new value
+func (db *DB) place(v interface{}) int {
+	if db.key != nil {
+		if key := db.key(v); key != "" {
+			return db.hashShard(key)
+		}
+	}
+	return int((atomic.AddUint32(&db.next, 1) - 1) % uint32(len(db.shards)))
+}
+
+// hashShard returns the shard given by the hash of key
+func (db *DB) hashShard(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(db.shards)))
+}
+
+// Create creates a new value in its shard
+func (db *DB) Create(ctx context.Context, v interface{}) (id string, err error) {
+	shard := db.place(v)
+	innerID, err := db.shards[shard].Create(ctx, v)
+	if err != nil {
+		return "", err
+	}
+	return join(innerID, shard), nil
+}
+
+// Get gets a value from the shard of id
+func (db *DB) Get(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return err
+	}
+	return db.shards[shard].Get(ctx, innerID, v)
+}
+
+// Update updates a value in the shard of id
+func (db *DB) Update(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return err
+	}
+	return db.shards[shard].Update(ctx, innerID, v)
+}
+
+// UpdateFunc reads the value of id into v, calls fn and writes v back within
+// one transaction of the shard of id
+func (db *DB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return err
+	}
+	return db.shards[shard].UpdateFunc(ctx, innerID, v, fn)
+}
+
+// Delete deletes an id from its shard, returns nil if not exists
+func (db *DB) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	innerID, shard, err := db.split(id)
+	if err == expay.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return db.shards[shard].Delete(ctx, innerID)
+}
+
+// RunInTx runs fn within a transaction of every shard, which are started in
+// the order of the shards so that concurrent transactions never deadlock, and
+// committed in the reverse order. It blocks the writers of every shard, so it
+// should be kept short, and it is not atomic if a shard fails to commit after
+// another has committed.
+func (db *DB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t := &tx{db: db, txs: make([]expay.Tx, len(db.shards))}
+	return t.run(ctx, 0, fn)
+}
+
+// run starts the transaction of shard i and the following shards, then calls
+// fn within all of them
+func (t *tx) run(ctx context.Context, i int, fn func(tx expay.Tx) error) error {
+	if i == len(t.txs) {
+		return fn(t)
+	}
+	return t.db.shards[i].RunInTx(ctx, func(shardTx expay.Tx) error {
+		t.txs[i] = shardTx
+		return t.run(ctx, i+1, fn)
+	})
+}
+
+func (t *tx) Create(v interface{}) (id string, err error) {
+	shard := t.db.place(v)
+	innerID, err := t.txs[shard].Create(v)
+	if err != nil {
+		return "", err
+	}
+	return join(innerID, shard), nil
+}
+
+func (t *tx) Get(id string, v interface{}) error {
+	innerID, shard, err := t.db.split(id)
+	if err != nil {
+		return err
+	}
+	return t.txs[shard].Get(innerID, v)
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	innerID, shard, err := t.db.split(id)
+	if err != nil {
+		return err
+	}
+	return t.txs[shard].Update(innerID, v)
+}
+
+func (t *tx) Delete(id string) error {
+	innerID, shard, err := t.db.split(id)
+	if err == expay.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return t.txs[shard].Delete(innerID)
+}
+
+// List returns an iterator of every value of all the shards in the order of
+// their IDs
+func (db *DB) List(ctx context.Context) (expay.Iter, error) {
+	return db.Paginate(ctx, "", 0)
+}
+
+// Paginate is the same as List but starts after lastCursor and returns at most
+// limit values (see expay.DB for details)
+func (db *DB) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return db.paginate(ctx, lastCursor, limit, func(i int, cursor string) (expay.Iter, error) {
+		return db.shards[i].Paginate(ctx, cursor, limit)
+	})
+}
+
+// paginate merges the pages of every shard after lastCursor, page returns the
+// page of shard i after cursor
+func (db *DB) paginate(ctx context.Context, lastCursor string, limit int, page func(i int, cursor string) (expay.Iter, error)) (expay.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cursors, err := db.shardCursors(lastCursor, limit < 0)
+	if err != nil {
+		return nil, err
+	}
+	reverse := limit < 0
+	if reverse {
+		limit = -limit
+	}
+	return db.merge(ctx, reverse, limit, func(i int) (expay.Iter, error) {
+		return page(i, cursors[i])
+	})
+}
+
+// merge merges at most limit values (unlimited if limit is not positive) of
+// the iterators of every shard opened by open
+func (db *DB) merge(ctx context.Context, reverse bool, limit int, open func(i int) (expay.Iter, error)) (expay.Iter, error) {
+	it := newIter(ctx, reverse, limit)
+	for i := range db.shards {
+		shardIter, err := open(i)
+		if err != nil {
+			_ = it.Close()
+			return nil, err
+		}
+		if err := it.add(i, shardIter); err != nil {
+			_ = it.Close()
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// shardCursors returns the cursor of each shard from which the values come
+// after lastCursor in the merged order (or before it in reverse)
+func (db *DB) shardCursors(lastCursor string, reverse bool) ([]string, error) {
+	cursors := make([]string, len(db.shards))
+	if lastCursor == "" {
+		return cursors, nil
+	}
+	if expay.IsUUID(lastCursor) {
+		// a UUID comes after every sequence ID of every shard
+		for i := range cursors {
+			cursors[i] = lastCursor
+		}
+		return cursors, nil
+	}
+	innerID, last, err := db.split(lastCursor)
+	if err != nil {
+		return nil, &expay.Error{Code: expay.CodeInvalidID, Message: "invalid cursor " + lastCursor}
+	}
+	key, err := hex.DecodeString(innerID)
+	if err != nil {
+		return nil, &expay.Error{Code: expay.CodeInvalidID, Message: "invalid cursor " + lastCursor}
+	}
+	seq := binary.BigEndian.Uint64(key)
+	for i := range cursors {
+		switch {
+		case !reverse && i > last:
+			// the value of the same sequence number comes after lastCursor
+			cursors[i] = seqCursor(seq - 1)
+		case reverse && i < last:
+			// the value of the same sequence number comes before lastCursor
+			cursors[i] = seqCursor(seq + 1)
+		default:
+			cursors[i] = innerID
+		}
+	}
+	return cursors, nil
+}
+
+// seqCursor returns the cursor of a sequence number within a shard, the cursor
+// of 0 or an overflown sequence number is empty, i.e. from the first or the
+// last value
+func seqCursor(seq uint64) string {
+	if seq == 0 {
+		return ""
+	}
+	return seqID(seq)
+}
+
+// seqID returns the ID of a sequence number within a shard
+func seqID(seq uint64) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return hex.EncodeToString(key)
+}
+
+// shardBounds returns the ID within each shard from which the values come at
+// or after id in the merged order, or empty bounds if id is empty
+func (db *DB) shardBounds(id string) ([]string, error) {
+	bounds := make([]string, len(db.shards))
+	switch {
+	case id == "":
+		return bounds, nil
+	case expay.IsUUID(id):
+		for i := range bounds {
+			bounds[i] = id
+		}
+		return bounds, nil
+	case len(id) != innerIDLen+shardLen:
+		return nil, expay.ErrInvalidID
+	}
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, expay.ErrInvalidID
+	}
+	seq, shard := binary.BigEndian.Uint64(key), int(key[innerIDLen/2])
+	for i := range bounds {
+		if i < shard {
+			// the value of the same sequence number comes before id
+			bounds[i] = seqID(seq + 1)
+		} else {
+			bounds[i] = seqID(seq)
+		}
+	}
+	return bounds, nil
+}
+
+// CreateWithID creates v with id, which must be a UUID, in the shard given by
+// the hash of id
+func (db *DB) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	if !expay.IsUUID(id) {
+		return expay.ErrInvalidID
+	}
+	shard := db.hashShard(id)
+	var creator expay.IDCreator
+	if !expay.As(db.shards[shard], &creator) {
+		return errShardNotSupported(shard, "client ids")
+	}
+	return creator.CreateWithID(ctx, id, v)
+}
+
+// Range returns an iterator of the values whose IDs are within r merged from
+// the ranges of every shard
+func (db *DB) Range(ctx context.Context, r expay.Range) (expay.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	starts, err := db.shardBounds(r.Start)
+	if err != nil {
+		return nil, err
+	}
+	ends, err := db.shardBounds(r.End)
+	if err != nil {
+		return nil, err
+	}
+	return db.merge(ctx, r.Desc, r.Limit, func(i int) (expay.Iter, error) {
+		var ranger expay.Ranger
+		if !expay.As(db.shards[i], &ranger) {
+			return nil, errShardNotSupported(i, "range iteration")
+		}
+		return ranger.Range(ctx, expay.Range{Start: starts[i], End: ends[i], Desc: r.Desc, Limit: r.Limit})
+	})
+}
+
+// Lookup returns an iterator of values whose key of the index equals key
+// merged from every shard in the order of their IDs
+func (db *DB) Lookup(ctx context.Context, index, key string) (expay.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.merge(ctx, false, 0, func(i int) (expay.Iter, error) {
+		var indexer expay.Indexer
+		if !expay.As(db.shards[i], &indexer) {
+			return nil, errShardNotSupported(i, "indexes")
+		}
+		return indexer.Lookup(ctx, index, key)
+	})
+}
+
+// LookupRange returns an iterator of values whose key of the index is within
+// [start, end) merged from every shard in the order of index keys, an empty
+// end means no upper bound. The iterators of the shards must return the index
+// keys (see boltdb) to be merged.
+func (db *DB) LookupRange(ctx context.Context, index, start, end string) (expay.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.merge(ctx, false, 0, func(i int) (expay.Iter, error) {
+		var indexer expay.Indexer
+		if !expay.As(db.shards[i], &indexer) {
+			return nil, errShardNotSupported(i, "indexes")
+		}
+		it, err := indexer.LookupRange(ctx, index, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := it.(indexKeyer); !ok {
+			_ = it.Close()
+			return nil, errShardNotSupported(i, "merged index ranges")
+		}
+		return it, nil
+	})
+}
+
+// Supports returns if every shard supports the optional interface target
+// points to
+func (db *DB) Supports(target interface{}) bool {
+	for _, shard := range db.shards {
+		if !expay.Supports(shard, target) {
+			return false
+		}
+	}
+	return true
+}
+
+// errShardNotSupported returns the error of a shard not supporting a feature
+func errShardNotSupported(shard int, feature string) error {
+	return &expay.Error{Code: expay.CodeNotSupported, Message: fmt.Sprintf("shard %d does not support %s", shard, feature)}
+}
+
+// Revisions returns the revisions of id kept by its shard
+func (db *DB) Revisions(ctx context.Context, id string) ([]expay.Revision, error) {
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return nil, err
+	}
+	var historian expay.Historian
+	if !expay.As(db.shards[shard], &historian) {
+		return nil, errShardNotSupported(shard, "history")
+	}
+	return historian.Revisions(ctx, innerID)
+}
+
+// GetRevision reads revision n of id from its shard into v
+func (db *DB) GetRevision(ctx context.Context, id string, n int, v interface{}) (*expay.Revision, error) {
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return nil, err
+	}
+	var historian expay.Historian
+	if !expay.As(db.shards[shard], &historian) {
+		return nil, errShardNotSupported(shard, "history")
+	}
+	return historian.GetRevision(ctx, innerID, n, v)
+}
+
+// GetAsOf reads the revision of id that was current at time t from its shard
+// into v
+func (db *DB) GetAsOf(ctx context.Context, id string, t time.Time, v interface{}) (*expay.Revision, error) {
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return nil, err
+	}
+	var historian expay.Historian
+	if !expay.As(db.shards[shard], &historian) {
+		return nil, errShardNotSupported(shard, "history")
+	}
+	return historian.GetAsOf(ctx, innerID, t, v)
+}
+
+// RotateKeys rotates the keys of every shard in turn, and returns the total
+// number of re-encrypted values
+func (db *DB) RotateKeys(ctx context.Context) (n int, err error) {
+	for i, shard := range db.shards {
+		var rotator expay.KeyRotator
+		if !expay.As(shard, &rotator) {
+			return n, errShardNotSupported(i, "encryption")
+		}
+		count, err := rotator.RotateKeys(ctx)
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Stats returns the aggregates of every shard merged
+func (db *DB) Stats(ctx context.Context) (*expay.Stats, error) {
+	stats := &expay.Stats{Groups: make(map[string]map[string]expay.Aggregate)}
+	for i, shard := range db.shards {
+		var aggregator expay.Aggregator
+		if !expay.As(shard, &aggregator) {
+			return nil, errShardNotSupported(i, "aggregates")
+		}
+		shardStats, err := aggregator.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := stats.Merge(shardStats); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// Archive archives every shard in turn, and returns the total number of
+// archived values
+func (db *DB) Archive(ctx context.Context, before time.Time) (n int, err error) {
+	for i, shard := range db.shards {
+		var archiver expay.Archiver
+		if !expay.As(shard, &archiver) {
+			return n, errShardNotSupported(i, "archive")
+		}
+		count, err := archiver.Archive(ctx, before)
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// GetArchived reads the archived value of id from its shard into v
+func (db *DB) GetArchived(ctx context.Context, id string, v interface{}) error {
+	innerID, shard, err := db.split(id)
+	if err != nil {
+		return err
+	}
+	var archiver expay.Archiver
+	if !expay.As(db.shards[shard], &archiver) {
+		return errShardNotSupported(shard, "archive")
+	}
+	return archiver.GetArchived(ctx, innerID, v)
+}
+
+// PaginateArchived is the same as Paginate over the archived values of every
+// shard
+func (db *DB) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return db.paginate(ctx, lastCursor, limit, func(i int, cursor string) (expay.Iter, error) {
+		var archiver expay.Archiver
+		if !expay.As(db.shards[i], &archiver) {
+			return nil, errShardNotSupported(i, "archive")
+		}
+		return archiver.PaginateArchived(ctx, cursor, limit)
+	})
+}
+
+// VerifyAudit verifies the audit log of every shard in turn, and returns the
+// total number of verified entries and the heads of the shards joined by
+// commas in the order of the shards
+func (db *DB) VerifyAudit(ctx context.Context) (n int, head string, err error) {
+	heads := make([]string, len(db.shards))
+	for i, shard := range db.shards {
+		var auditor expay.Auditor
+		if !expay.As(shard, &auditor) {
+			return n, "", errShardNotSupported(i, "audit log")
+		}
+		count, head, err := auditor.VerifyAudit(ctx)
+		n += count
+		if err != nil {
+			return n, "", fmt.Errorf("shard %d: %w", i, err)
+		}
+		heads[i] = head
+	}
+	return n, strings.Join(heads, ","), nil
+}
+
+// Migrate migrates every shard in turn, the progress is accumulated over the
+// shards, so its total grows when a shard starts
+func (db *DB) Migrate(ctx context.Context, batchSize int, dryRun bool, progress func(expay.MigrationProgress)) error {
+	var done expay.MigrationProgress
+	for i, shard := range db.shards {
+		var migrator expay.Migrator
+		if !expay.As(shard, &migrator) {
+			return errShardNotSupported(i, "schema versions")
+		}
+		var last expay.MigrationProgress
+		err := migrator.Migrate(ctx, batchSize, dryRun, func(p expay.MigrationProgress) {
+			last = p
+			if progress != nil {
+				progress(expay.MigrationProgress{
+					Total:    done.Total + p.Total,
+					Scanned:  done.Scanned + p.Scanned,
+					Migrated: done.Migrated + p.Migrated,
+				})
+			}
+		})
+		if err != nil {
+			return err
+		}
+		done.Total += last.Total
+		done.Scanned += last.Scanned
+		done.Migrated += last.Migrated
+	}
+	return nil
+}
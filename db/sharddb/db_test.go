@@ -0,0 +1,477 @@
+package sharddb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/dbtest"
+	"h12.io/expay/db/memdb"
+)
+
+type record struct {
+	Org  string `json:"org"`
+	Name string `json:"name"`
+	Date string `json:"date,omitempty"`
+}
+
+func orgKey(v interface{}) string {
+	if r, ok := v.(*record); ok {
+		return r.Org
+	}
+	return ""
+}
+
+func newMemShards(t *testing.T, n int, key func(v interface{}) string) *DB {
+	shards := []expay.DB{}
+	for i := 0; i < n; i++ {
+		shards = append(shards, memdb.New())
+	}
+	db, err := New(shards, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		return newMemShards(t, 3, nil)
+	})
+}
+
+func TestBoltConformance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []*boltdb.DB{}
+	for i := 0; i < 2; i++ {
+		file, err := boltdb.New(path.Join(dir, strconv.Itoa(i)+".bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	n := 0
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		n++
+		shards := []expay.DB{}
+		for _, file := range files {
+			shards = append(shards, file.Bucket("test"+strconv.Itoa(n)))
+		}
+		db, err := New(shards, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil, nil); err != errNoShard {
+		t.Fatalf("expect error %v got %v", errNoShard, err)
+	}
+	if _, err := New(make([]expay.DB, MaxShards+1), nil); err == nil {
+		t.Fatal("expect too many shards error got nil")
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	ctx := context.Background()
+	db := newMemShards(t, 4, orgKey)
+	shardOf := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		org := "org" + strconv.Itoa(i%5)
+		id, err := db.Create(ctx, &record{Org: org})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard, err := db.Shard(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := shardOf[org]; ok && s != shard {
+			t.Fatalf("expect %s in shard %d got %d", org, s, shard)
+		}
+		shardOf[org] = shard
+	}
+
+	// values without a shard key are placed in turn
+	db = newMemShards(t, 3, orgKey)
+	for i := 0; i < 6; i++ {
+		id, err := db.Create(ctx, &record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard, err := db.Shard(id); err != nil || shard != i%3 {
+			t.Fatalf("expect shard %d got %d, %v", i%3, shard, err)
+		}
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	ctx := context.Background()
+	db := newMemShards(t, 2, nil)
+	for _, id := range []string{"", "abc", "0000000000000001zz"} {
+		if err := db.Get(ctx, id, &record{}); err != expay.ErrInvalidID {
+			t.Fatalf("expect error %v for %s got %v", expay.ErrInvalidID, id, err)
+		}
+		if err := db.Delete(ctx, id); err != expay.ErrInvalidID {
+			t.Fatalf("expect error %v for %s got %v", expay.ErrInvalidID, id, err)
+		}
+	}
+	// a shard beyond the DB
+	const id = "000000000000000102"
+	if err := db.Get(ctx, id, &record{}); err != expay.ErrNotFound {
+		t.Fatalf("expect error %v for %s got %v", expay.ErrNotFound, id, err)
+	}
+	if err := db.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Paginate(ctx, "abc", 1); err == nil {
+		t.Fatal("expect invalid cursor error got nil")
+	}
+}
+
+func TestPaginateUneven(t *testing.T) {
+	ctx := context.Background()
+	db := newMemShards(t, 3, orgKey)
+	ids := []string{}
+	for _, org := range []string{"a", "a", "b", "a", "c", "c", "a"} {
+		id, err := db.Create(ctx, &record{Org: org, Name: org})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	all := scanIDs(t, db, "", 0)
+	if len(all) != len(ids) {
+		t.Fatalf("expect %d values got %v", len(ids), all)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1] >= all[i] {
+			t.Fatalf("expect ascending IDs got %v", all)
+		}
+	}
+	// every page continues from its cursor in both directions
+	for i, id := range all {
+		if got := scanIDs(t, db, id, 2); !reflect.DeepEqual(got, firstN(all[i+1:], 2)) {
+			t.Fatalf("expect %v after %s got %v", firstN(all[i+1:], 2), id, got)
+		}
+		before := reversed(all[:i])
+		if got := scanIDs(t, db, id, -2); !reflect.DeepEqual(got, firstN(before, 2)) {
+			t.Fatalf("expect %v before %s got %v", firstN(before, 2), id, got)
+		}
+	}
+}
+
+func TestRangeUneven(t *testing.T) {
+	ctx := context.Background()
+	db := newMemShards(t, 3, orgKey)
+	for _, org := range []string{"a", "a", "b", "a", "c", "c", "a"} {
+		if _, err := db.Create(ctx, &record{Org: org, Name: org}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const uuid = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	if err := db.CreateWithID(ctx, uuid, &record{Name: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	all := scanIDs(t, db, "", 0)
+	if len(all) != 8 || all[7] != uuid {
+		t.Fatalf("expect the UUID after 7 sequence IDs got %v", all)
+	}
+	if err := db.Get(ctx, uuid, &record{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := scanIDs(t, db, uuid, -2); !reflect.DeepEqual(got, reversed(all[5:7])) {
+		t.Fatalf("expect %v before %s got %v", reversed(all[5:7]), uuid, got)
+	}
+	// every range of the merged IDs in both directions
+	for i := range all {
+		for j := i; j <= len(all); j++ {
+			r := expay.Range{Start: all[i]}
+			if j < len(all) {
+				r.End = all[j]
+			}
+			if got := rangeIDs(t, db, r); !reflect.DeepEqual(got, all[i:j]) {
+				t.Fatalf("%+v: expect %v got %v", r, all[i:j], got)
+			}
+			r.Desc, r.Limit = true, 2
+			if got := rangeIDs(t, db, r); !reflect.DeepEqual(got, firstN(reversed(all[i:j]), 2)) {
+				t.Fatalf("%+v: expect %v got %v", r, firstN(reversed(all[i:j]), 2), got)
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	shards := []expay.DB{}
+	for i := 0; i < 2; i++ {
+		file, err := boltdb.New(path.Join(dir, strconv.Itoa(i)+".bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, file.Bucket("test", boltdb.WithIndexes(boltdb.FieldIndex("date"))))
+	}
+	db, err := New(shards, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, r := range []record{
+		{Name: "a", Date: "2017-01-19"},
+		{Name: "b", Date: "2017-01-18"},
+		{Name: "c", Date: "2017-01-19"},
+		{Name: "d", Date: "2017-01-20"},
+		{Name: "e", Date: "2017-01-18"},
+	} {
+		r := r
+		id, err := db.Create(ctx, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[id] = r.Name
+	}
+	lookup := func(it expay.Iter, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for it.Next() {
+			var r record
+			if _, err := it.Scan(&r); err != nil {
+				t.Fatal(err)
+			}
+			got += r.Name
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := lookup(db.Lookup(ctx, "date", "2017-01-19")); got != "ac" {
+		t.Fatalf("expect %s got %s", "ac", got)
+	}
+	if got := lookup(db.LookupRange(ctx, "date", "2017-01-18", "2017-01-20")); got != "beac" {
+		t.Fatalf("expect %s got %s", "beac", got)
+	}
+	if got := lookup(db.LookupRange(ctx, "date", "2017-01-19", "")); got != "acd" {
+		t.Fatalf("expect %s got %s", "acd", got)
+	}
+	if _, err := db.Lookup(ctx, "name", "a"); err != expay.ErrUnknownIndex {
+		t.Fatalf("expect error %v got %v", expay.ErrUnknownIndex, err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	shards := []expay.DB{}
+	for i := 0; i < 2; i++ {
+		file, err := boltdb.New(path.Join(dir, strconv.Itoa(i)+".bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, file.Bucket("test", boltdb.WithHistory(), boltdb.WithSchema(nil, nil),
+			boltdb.WithAggregates(expay.Aggregates{GroupBy: []string{"name"}}),
+			boltdb.WithIndexes(boltdb.FieldIndex("date")), boltdb.WithArchive("date"), boltdb.WithAuditLog()))
+	}
+	db, err := New(shards, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := db.Create(ctx, &record{Name: "v1", Date: "2017-01-18"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(ctx, id, &record{Name: "v2", Date: "2017-01-18"}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		if revs, err := db.Revisions(ctx, id); err != nil || len(revs) != 2 {
+			t.Fatalf("expect 2 revisions got %v, %v", revs, err)
+		}
+		var r record
+		if _, err := db.GetRevision(ctx, id, 1, &r); err != nil || r.Name != "v1" {
+			t.Fatalf("expect v1 got %v, %v", r, err)
+		}
+	}
+
+	var progress []expay.MigrationProgress
+	if err := db.Migrate(ctx, 10, true, func(p expay.MigrationProgress) {
+		progress = append(progress, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 2 values in shard 0 and 1 in shard 1, each with 2 revisions
+	expected := []expay.MigrationProgress{
+		{Total: 6, Scanned: 2},
+		{Total: 6, Scanned: 6},
+		{Total: 9, Scanned: 7},
+		{Total: 9, Scanned: 9},
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("expect %v got %v", expected, progress)
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStats := &expay.Stats{
+		Aggregate: expay.Aggregate{Count: 3},
+		Groups:    map[string]map[string]expay.Aggregate{"name": {"v2": {Count: 3}}},
+	}
+	if !reflect.DeepEqual(stats, expectedStats) {
+		t.Fatalf("expect %+v got %+v", expectedStats, stats)
+	}
+
+	if n, err := db.Archive(ctx, time.Now()); err != nil || n != 3 {
+		t.Fatalf("expect 3 archived values got %d, %v", n, err)
+	}
+	for _, id := range ids {
+		var r record
+		if err := db.Get(ctx, id, &r); err != expay.ErrNotFound {
+			t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+		}
+		if err := db.GetArchived(ctx, id, &r); err != nil || r.Name != "v2" {
+			t.Fatalf("expect v2 got %v, %v", r, err)
+		}
+	}
+	iter, err := db.PaginateArchived(ctx, ids[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archived []string
+	for iter.Next() {
+		var r record
+		id, err := iter.Scan(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archived = append(archived, id)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(archived, ids[1:]) {
+		t.Fatalf("expect %v got %v", ids[1:], archived)
+	}
+	n, head, err := db.VerifyAudit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heads := strings.Split(head, ","); n == 0 || len(heads) != 2 {
+		t.Fatalf("expect the heads of 2 shards got %d, %s", n, head)
+	}
+
+	// the shards are not encrypted
+	if _, err := db.RotateKeys(ctx); err == nil {
+		t.Fatal("expect not encrypted error got nil")
+	}
+	// memdb keeps no history
+	if _, err := newMemShards(t, 1, nil).Revisions(ctx, ids[0]); err == nil {
+		t.Fatal("expect not supported error got nil")
+	}
+	if _, err := newMemShards(t, 1, nil).Stats(ctx); err == nil {
+		t.Fatal("expect not supported error got nil")
+	}
+	if _, err := newMemShards(t, 1, nil).Archive(ctx, time.Now()); err == nil {
+		t.Fatal("expect not supported error got nil")
+	}
+	if _, _, err := newMemShards(t, 1, nil).VerifyAudit(ctx); err == nil {
+		t.Fatal("expect not supported error got nil")
+	}
+	if !expay.Supports(db, (*expay.Indexer)(nil)) {
+		t.Fatal("expect indexes supported by every shard")
+	}
+	for _, target := range []interface{}{(*expay.Indexer)(nil), (*expay.Watcher)(nil)} {
+		if expay.Supports(newMemShards(t, 2, nil), target) {
+			t.Fatalf("expect %T not supported", target)
+		}
+	}
+}
+
+func scanIDs(t *testing.T, db *DB, lastCursor string, limit int) []string {
+	t.Helper()
+	it, err := db.Paginate(context.Background(), lastCursor, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for it.Next() {
+		id, err := it.Scan(&record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func rangeIDs(t *testing.T, db *DB, r expay.Range) []string {
+	t.Helper()
+	it, err := db.Range(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for it.Next() {
+		id, err := it.Scan(&record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func firstN(ids []string, n int) []string {
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return append([]string{}, ids...)
+}
+
+func reversed(ids []string) []string {
+	r := []string{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		r = append(r, ids[i])
+	}
+	return r
+}
@@ -0,0 +1,129 @@
+package sharddb
+
+import (
+	"context"
+	"encoding/json"
+
+	"h12.io/expay"
+)
+
+type (
+	// iter merges the iterators of the shards in the order of the IDs
+	iter struct {
+		ctx     context.Context
+		err     error
+		heads   []*head
+		reverse bool
+		// remaining number of values to scan, negative means unlimited
+		remaining int
+		// next is the head to scan next
+		next *head
+	}
+	// head is the next value of the iterator of a shard, which is scanned as
+	// JSON in advance to compare its ID with the other shards
+	head struct {
+		shard int
+		iter  expay.Iter
+		// index key of the value if the iterator is an indexKeyer
+		key   string
+		id    string
+		value json.RawMessage
+		ok    bool
+	}
+	// indexKeyer is implemented by an iterator of an index, e.g. of boltdb,
+	// to merge the iterators of the shards in the order of index keys
+	indexKeyer interface {
+		// IndexKey returns the index key of the value to be scanned next
+		IndexKey() string
+	}
+)
+
+// newIter returns an iterator of at most limit values, unlimited if limit is
+// not positive
+func newIter(ctx context.Context, reverse bool, limit int) *iter {
+	it := &iter{ctx: ctx, reverse: reverse, remaining: limit}
+	if limit <= 0 {
+		it.remaining = -1
+	}
+	return it
+}
+
+// add adds the iterator of a shard
+func (it *iter) add(shard int, shardIter expay.Iter) error {
+	h := &head{shard: shard, iter: shardIter}
+	it.heads = append(it.heads, h)
+	return h.advance()
+}
+
+// advance scans the next value of the shard
+func (h *head) advance() error {
+	h.ok = h.iter.Next()
+	if !h.ok {
+		return nil
+	}
+	if keyer, ok := h.iter.(indexKeyer); ok {
+		h.key = keyer.IndexKey()
+	}
+	h.value = nil
+	innerID, err := h.iter.Scan(&h.value)
+	if err != nil {
+		h.ok = false
+		return err
+	}
+	h.id = join(innerID, h.shard)
+	return nil
+}
+
+func (it *iter) Next() bool {
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	if it.remaining == 0 {
+		return false
+	}
+	it.next = nil
+	for _, h := range it.heads {
+		if !h.ok {
+			continue
+		}
+		if it.next == nil || h.less(it.next) != it.reverse {
+			it.next = h
+		}
+	}
+	return it.next != nil
+}
+
+// less returns if the value of h comes before that of o in the order of index
+// keys and then IDs
+func (h *head) less(o *head) bool {
+	if h.key != o.key {
+		return h.key < o.key
+	}
+	return idLess(h.id, o.id)
+}
+
+func (it *iter) Scan(v interface{}) (id string, err error) {
+	h := it.next
+	id = h.id
+	err = json.Unmarshal(h.value, v)
+	if advanceErr := h.advance(); advanceErr != nil && err == nil {
+		err = advanceErr
+	}
+	if it.remaining > 0 {
+		it.remaining--
+	}
+	return
+}
+
+func (it *iter) Close() error {
+	var err error
+	for _, h := range it.heads {
+		if closeErr := h.iter.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if it.err != nil {
+		return it.err
+	}
+	return err
+}
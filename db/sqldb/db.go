@@ -0,0 +1,285 @@
+// Package sqldb is an implementation of expay.DB interface on top of
+// database/sql, where values are stored as JSON text in a table.
+//
+// The SQL is written for SQLite and the schema of the table is created and
+// upgraded by the embedded migrations when the DB is created.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"h12.io/expay"
+)
+
+type (
+	// DB represents a table of a SQL database that satisifies expay.DB
+	// interface
+	DB struct {
+		db    *sql.DB
+		table string
+	}
+	// tx is a table bound to a SQL transaction that satisfies expay.Tx
+	// interface
+	tx struct {
+		ctx   context.Context
+		tx    *sql.Tx
+		table string
+	}
+	iter struct {
+		ctx  context.Context
+		err  error
+		rows *sql.Rows
+	}
+	// querier is the common interface of sql.DB and sql.Tx
+	querier interface {
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+)
+
+// SQLiteSource returns the data source name of a SQLite file for driver
+// "sqlite3" (github.com/mattn/go-sqlite3), with WAL journal mode so readers do
+// not block the writer, immediate transactions so concurrent read-modify-write
+// transactions do not deadlock, and a busy timeout to wait for the lock
+func SQLiteSource(filename string) string {
+	return "file:" + filename + "?_journal_mode=WAL&_txlock=immediate&_busy_timeout=5000"
+}
+
+// New returns a DB of a table in a SQL database, the table is created or
+// migrated to the latest schema
+func New(db *sql.DB, table string) (*DB, error) {
+	if err := migrate(db, table); err != nil {
+		return nil, err
+	}
+	return &DB{db: db, table: table}, nil
+}
+
+// Create creates a new value into the table
+func (db *DB) Create(ctx context.Context, v interface{}) (id string, err error) {
+	err = db.RunInTx(ctx, func(tx expay.Tx) error {
+		id, err = tx.Create(v)
+		return err
+	})
+	return id, err
+}
+
+// Get gets a value from the table given the id
+func (db *DB) Get(ctx context.Context, id string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	seq, err := idToSeq(id)
+	if err != nil {
+		return err
+	}
+	return storageError(get(ctx, db.db, db.table, seq, v))
+}
+
+// Update updates a value given the id
+func (db *DB) Update(ctx context.Context, id string, v interface{}) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Update(id, v)
+	})
+}
+
+// UpdateFunc reads the value of id into v, calls fn and writes v back within
+// one transaction
+func (db *DB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		if err := tx.Get(id, v); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return tx.Update(id, v)
+	})
+}
+
+// Delete deletes an id from the table, returns nil if not exists
+func (db *DB) Delete(ctx context.Context, id string) error {
+	return db.RunInTx(ctx, func(tx expay.Tx) error {
+		return tx.Delete(id)
+	})
+}
+
+// RunInTx runs fn within a SQL transaction, which is committed if fn returns
+// nil or rolled back otherwise
+func (db *DB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sqlTx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	if err := fn(&tx{ctx: ctx, tx: sqlTx, table: db.table}); err != nil {
+		_ = sqlTx.Rollback()
+		return storageError(err)
+	}
+	if err := ctx.Err(); err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+	return storageError(sqlTx.Commit())
+}
+
+// List returns an iterator that can be used to interate every value in the
+// table
+func (db *DB) List(ctx context.Context) (expay.Iter, error) {
+	return db.Paginate(ctx, "", 0)
+}
+
+// Paginate is the same as List but starts after lastCursor and returns at most
+// limit values (see expay.DB for details)
+func (db *DB) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT seq, value FROM %s", db.table)
+	args := []interface{}{}
+	if lastCursor != "" {
+		lastSeq, err := idToSeq(lastCursor)
+		if err != nil {
+			return nil, err
+		}
+		if limit < 0 {
+			query += " WHERE seq < ?"
+		} else {
+			query += " WHERE seq > ?"
+		}
+		args = append(args, lastSeq)
+	}
+	if limit < 0 {
+		query += " ORDER BY seq DESC LIMIT ?"
+		args = append(args, -limit)
+	} else if limit > 0 {
+		query += " ORDER BY seq LIMIT ?"
+		args = append(args, limit)
+	} else {
+		query += " ORDER BY seq"
+	}
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return &iter{ctx: ctx, rows: rows}, nil
+}
+
+func (t *tx) Create(v interface{}) (id string, err error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	result, err := t.tx.ExecContext(t.ctx, fmt.Sprintf("INSERT INTO %s (value) VALUES (?)", t.table), string(value))
+	if err != nil {
+		return "", err
+	}
+	seq, err := result.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	return seqToID(seq), nil
+}
+
+func (t *tx) Get(id string, v interface{}) error {
+	seq, err := idToSeq(id)
+	if err != nil {
+		return err
+	}
+	return get(t.ctx, t.tx, t.table, seq, v)
+}
+
+func (t *tx) Update(id string, v interface{}) error {
+	seq, err := idToSeq(id)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	result, err := t.tx.ExecContext(t.ctx, fmt.Sprintf("UPDATE %s SET value = ? WHERE seq = ?", t.table), string(value), seq)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = t.tx.ExecContext(t.ctx, fmt.Sprintf("INSERT INTO %s (seq, value) VALUES (?, ?)", t.table), seq, string(value))
+	return err
+}
+
+func (t *tx) Delete(id string) error {
+	seq, err := idToSeq(id)
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.ExecContext(t.ctx, fmt.Sprintf("DELETE FROM %s WHERE seq = ?", t.table), seq)
+	return err
+}
+
+// get reads the value of seq into v
+func get(ctx context.Context, db querier, table string, seq int64, v interface{}) error {
+	var value string
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT value FROM %s WHERE seq = ?", table), seq).Scan(&value)
+	if err == sql.ErrNoRows {
+		return expay.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// seqToID returns the ID of a sequence number, which is the hex of its 8-byte
+// big endian representation, the same as boltdb
+func seqToID(seq int64) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(seq))
+	return hex.EncodeToString(b)
+}
+
+// idToSeq is the reverse of seqToID, it returns expay.ErrInvalidID if id is
+// not a sequence ID, e.g. a UUID
+func idToSeq(id string) (int64, error) {
+	if len(id) != 16 {
+		return 0, expay.ErrInvalidID
+	}
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return 0, expay.ErrInvalidID
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+func (it *iter) Next() bool {
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	return it.rows.Next()
+}
+
+func (it *iter) Scan(v interface{}) (id string, err error) {
+	var (
+		seq   int64
+		value string
+	)
+	if err := it.rows.Scan(&seq, &value); err != nil {
+		return "", err
+	}
+	return seqToID(seq), json.Unmarshal([]byte(value), v)
+}
+
+func (it *iter) Close() error {
+	if err := it.rows.Close(); err != nil {
+		return err
+	}
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
@@ -0,0 +1,82 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"h12.io/expay"
+	"h12.io/expay/db/dbtest"
+)
+
+func openSQLite(t *testing.T, dir string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", SQLiteSource(path.Join(dir, "db.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlDB := openSQLite(t, dir)
+	defer sqlDB.Close()
+	n := 0
+	dbtest.RunConformance(t, func(t *testing.T) expay.DB {
+		n++
+		db, err := New(sqlDB, "test"+strconv.Itoa(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlDB := openSQLite(t, dir)
+	defer sqlDB.Close()
+
+	db, err := New(sqlDB, "payment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Create(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// migrations are not applied again
+	db, err = New(sqlDB, "payment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := ""
+	if err := db.Get(context.Background(), id, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value != "abc" {
+		t.Fatalf("expect %s got %s", "abc", value)
+	}
+
+	// a newer schema is not downgraded
+	if _, err := sqlDB.Exec("UPDATE schema_migrations SET version = ? WHERE table_name = ?", len(migrations)+1, "payment"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(sqlDB, "payment"); err == nil {
+		t.Fatal("expect error but got nil")
+	}
+}
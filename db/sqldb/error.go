@@ -0,0 +1,33 @@
+package sqldb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+	"h12.io/expay"
+)
+
+// storageError classifies an error of the SQL database as an expay.Error,
+// other errors are returned as is
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrConnDone || errors.Is(err, driver.ErrBadConn) {
+		return &expay.Error{Code: expay.CodeUnavailable, Message: "storage unavailable", Err: err}
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return &expay.Error{Code: expay.CodeUnavailable, Message: "storage unavailable", Err: err}
+		case sqlite3.ErrFull, sqlite3.ErrTooBig:
+			return &expay.Error{Code: expay.CodeQuotaExceeded, Message: "quota exceeded", Err: err}
+		case sqlite3.ErrConstraint:
+			return &expay.Error{Code: expay.CodeConflict, Message: "conflict", Err: err}
+		}
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package sqldb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"h12.io/expay"
+)
+
+func TestStorageError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code expay.ErrorCode
+	}{
+		{sql.ErrConnDone, expay.CodeUnavailable},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), expay.CodeUnavailable},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, expay.CodeUnavailable},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, expay.CodeUnavailable},
+		{sqlite3.Error{Code: sqlite3.ErrFull}, expay.CodeQuotaExceeded},
+		{sqlite3.Error{Code: sqlite3.ErrTooBig}, expay.CodeQuotaExceeded},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, expay.CodeConflict},
+		{sqlite3.Error{Code: sqlite3.ErrCorrupt}, ""},
+		{expay.ErrInvalidID, expay.CodeInvalidID},
+		{errors.New("other"), ""},
+	} {
+		err := storageError(tc.err)
+		if code := expay.CodeOf(err); code != tc.code {
+			t.Fatalf("expect %v got %v", tc.code, code)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expect %v wrapped got %v", tc.err, err)
+		}
+	}
+	if err := storageError(nil); err != nil {
+		t.Fatalf("expect nil got %v", err)
+	}
+}
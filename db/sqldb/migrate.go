@@ -0,0 +1,54 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are the schema migrations of a table in order, where %[1]s is the
+// table name. A migration is applied only once and must never be changed after
+// released, add a new one instead.
+var migrations = []string{
+	// seq is the sequence number encoded in the ID, value is the JSON of the
+	// stored value
+	`CREATE TABLE %[1]s (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		value TEXT NOT NULL
+	)`,
+}
+
+// migrate applies the migrations not applied yet to the table in one
+// transaction, the applied version of each table is kept in schema_migrations
+func migrate(db *sql.DB, table string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		table_name TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+	version := 0
+	err = tx.QueryRow("SELECT version FROM schema_migrations WHERE table_name = ?", table).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d of table %s is newer than %d", version, table, len(migrations))
+	}
+	for _, migration := range migrations[version:] {
+		if _, err := tx.Exec(fmt.Sprintf(migration, table)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM schema_migrations WHERE table_name = ?", table); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (table_name, version) VALUES (?, ?)", table, len(migrations)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,15 +2,107 @@ package expay
 
 import "errors"
 
+// ErrorCode classifies an Error, it is also the error code of an error
+// response of the services
+type ErrorCode string
+
+// error codes
+const (
+	// CodeNotFound means the item does not exist
+	CodeNotFound ErrorCode = "not_found"
+	// CodeInvalidID means the ID is not of the form used by the DB
+	CodeInvalidID ErrorCode = "invalid_id"
+	// CodeInvalidArgument means the input is invalid other than its ID
+	CodeInvalidArgument ErrorCode = "invalid_argument"
+	// CodeConflict means the write conflicts with the existing items
+	CodeConflict ErrorCode = "conflict"
+	// CodeVersionMismatch means the item has been modified by others since
+	// it was read
+	CodeVersionMismatch ErrorCode = "version_mismatch"
+	// CodeUnavailable means the storage cannot be used temporarily, e.g. it
+	// is closed or locked by another process, so the operation may be retried
+	CodeUnavailable ErrorCode = "unavailable"
+	// CodeQuotaExceeded means the storage or a value is beyond its limit,
+	// e.g. the disk is full or a value is too large
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeNotSupported means the DB does not support the operation
+	CodeNotSupported ErrorCode = "not_supported"
+	// CodeCorrupted means the stored data fails an integrity check, e.g. a
+	// break in the audit log
+	CodeCorrupted ErrorCode = "corrupted"
+)
+
+// Error is an error classified by its code, which is returned by every DB
+// implementation so that it can be handled without knowing the DB. Errors of
+// the same code are equivalent for errors.Is, e.g. errors.Is(ErrAlreadyExists,
+// ErrConflict) is true.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Err is the underlying error if any
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns if target is an Error of the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// CodeOf returns the code of err, or empty if err is not an Error
+func CodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// storage errors
 var (
 	// ErrNotFound is returned when an item is not found in the DB
-	ErrNotFound = errors.New("item not found")
+	ErrNotFound = &Error{Code: CodeNotFound, Message: "item not found"}
+	// ErrVersionMismatch is returned when an item has been modified by others
+	// since it was read
+	ErrVersionMismatch = &Error{Code: CodeVersionMismatch, Message: "version mismatch"}
+	// ErrUnknownIndex is returned when looking up by an index not defined
+	ErrUnknownIndex = &Error{Code: CodeInvalidArgument, Message: "unknown index"}
+	// ErrInvalidID is returned when an ID is not of the form used by the DB
+	ErrInvalidID = &Error{Code: CodeInvalidID, Message: "invalid id"}
+	// ErrConflict is returned when a write conflicts with the existing items
+	ErrConflict = &Error{Code: CodeConflict, Message: "conflict"}
+	// ErrAlreadyExists is returned when creating an item with an ID that
+	// exists in the DB, it is a conflict
+	ErrAlreadyExists = &Error{Code: CodeConflict, Message: "item already exists"}
+	// ErrArchived is returned when writing an archived item, which is
+	// read-only, it is a conflict
+	ErrArchived = &Error{Code: CodeConflict, Message: "item is archived"}
+	// ErrUnavailable is returned when the storage cannot be used temporarily
+	ErrUnavailable = &Error{Code: CodeUnavailable, Message: "storage unavailable"}
+	// ErrQuotaExceeded is returned when the storage or a value is beyond its
+	// limit
+	ErrQuotaExceeded = &Error{Code: CodeQuotaExceeded, Message: "quota exceeded"}
+	// ErrNotSupported is returned when the DB does not support an operation
+	ErrNotSupported = &Error{Code: CodeNotSupported, Message: "not supported"}
+	// ErrAuditBroken is returned when the audit log is not an unbroken hash
+	// chain or a stored value does not match it
+	ErrAuditBroken = &Error{Code: CodeCorrupted, Message: "audit log is broken"}
 )
 
 // verification errors
-//
-// TODO: add specific errors here
 var (
 	// ErrInvalidPayment is a general verification error for payment format
-	ErrInvalidPayment = errors.New("invalid payment")
+	ErrInvalidPayment = &Error{Code: CodeInvalidArgument, Message: "invalid payment"}
 )
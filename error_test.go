@@ -0,0 +1,37 @@
+package expay
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	wrapped := fmt.Errorf("create: %w", ErrAlreadyExists)
+	for _, tc := range []struct {
+		name   string
+		err    error
+		target error
+		is     bool
+		code   ErrorCode
+	}{
+		{"same error", ErrNotFound, ErrNotFound, true, CodeNotFound},
+		{"same code", ErrAlreadyExists, ErrConflict, true, CodeConflict},
+		{"wrapped", wrapped, ErrConflict, true, CodeConflict},
+		{"underlying error", &Error{Code: CodeUnavailable, Err: errors.New("closed")}, ErrUnavailable, true, CodeUnavailable},
+		{"different code", ErrVersionMismatch, ErrConflict, false, CodeVersionMismatch},
+		{"not an Error", errors.New("item not found"), ErrNotFound, false, ""},
+		{"nil", nil, ErrNotFound, false, ""},
+	} {
+		if is := errors.Is(tc.err, tc.target); is != tc.is {
+			t.Fatalf("%s: expect %v got %v", tc.name, tc.is, is)
+		}
+		if code := CodeOf(tc.err); code != tc.code {
+			t.Fatalf("%s: expect %v got %v", tc.name, tc.code, code)
+		}
+	}
+	err := &Error{Code: CodeUnavailable, Message: "storage unavailable", Err: errors.New("closed")}
+	if expected := "storage unavailable: closed"; err.Error() != expected {
+		t.Fatalf("expect %s got %s", expected, err.Error())
+	}
+}
@@ -0,0 +1,104 @@
+package expay
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// operations of a DB into which faults are injected
+const (
+	// FaultCreate is Create, CreateWithID and Create within a transaction
+	FaultCreate = "create"
+	// FaultGet is Get and the other reads of a value, e.g. GetArchived
+	FaultGet = "get"
+	// FaultUpdate is Update and UpdateFunc
+	FaultUpdate = "update"
+	// FaultDelete is Delete
+	FaultDelete = "delete"
+	// FaultList is every iteration, e.g. List, Paginate and Lookup
+	FaultList = "list"
+	// FaultTx is RunInTx
+	FaultTx = "tx"
+)
+
+// FaultOps are the operations into which faults are injected
+var FaultOps = []string{FaultCreate, FaultGet, FaultUpdate, FaultDelete, FaultList, FaultTx}
+
+type (
+	// Faults are the faults injected into the operations of a DB for chaos
+	// testing, the zero value injects nothing
+	Faults struct {
+		// Ops are the faults of each operation given by its name in FaultOps
+		Ops map[string]OpFaults `json:"ops,omitempty"`
+	}
+	// OpFaults are the faults injected into an operation
+	OpFaults struct {
+		// Latency is added before the operation
+		Latency Duration `json:"latency,omitempty"`
+		// ErrorRate is the probability that the operation fails
+		ErrorRate float64 `json:"error_rate,omitempty"`
+		// Error is the code of the injected errors, unavailable if empty
+		Error ErrorCode `json:"error,omitempty"`
+		// ScanErrorRate is the probability that a scan of an iterator fails,
+		// while the iteration goes on
+		ScanErrorRate float64 `json:"scan_error_rate,omitempty"`
+		// CloseRate is the probability that an iterator stops before each
+		// value as if it were closed, and its Close returns the injected error
+		CloseRate float64 `json:"close_rate,omitempty"`
+	}
+	// Duration is a time.Duration in the form of time.ParseDuration in JSON,
+	// e.g. "100ms"
+	Duration time.Duration
+)
+
+// Validate returns an invalid argument error if f has an unknown operation, a
+// negative latency or a rate out of [0, 1]
+func (f *Faults) Validate() error {
+	for op, faults := range f.Ops {
+		if !isFaultOp(op) {
+			return invalidFaults("unknown operation %q", op)
+		}
+		if faults.Latency < 0 {
+			return invalidFaults("negative latency of %s", op)
+		}
+		for _, rate := range []float64{faults.ErrorRate, faults.ScanErrorRate, faults.CloseRate} {
+			if rate < 0 || rate > 1 {
+				return invalidFaults("rate %v of %s out of [0, 1]", rate, op)
+			}
+		}
+	}
+	return nil
+}
+
+func isFaultOp(op string) bool {
+	for _, o := range FaultOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func invalidFaults(format string, args ...interface{}) error {
+	return &Error{Code: CodeInvalidArgument, Message: "invalid faults: " + fmt.Sprintf(format, args...)}
+}
+
+// MarshalJSON encodes d as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes d from a string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
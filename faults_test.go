@@ -0,0 +1,57 @@
+package expay
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFaultsJSON(t *testing.T) {
+	data := `{"ops":{"get":{"latency":"100ms","error_rate":0.5,"error":"conflict"},"list":{"close_rate":0.1}}}`
+	var faults Faults
+	if err := json.Unmarshal([]byte(data), &faults); err != nil {
+		t.Fatal(err)
+	}
+	expected := Faults{Ops: map[string]OpFaults{
+		FaultGet:  {Latency: Duration(100 * time.Millisecond), ErrorRate: 0.5, Error: CodeConflict},
+		FaultList: {CloseRate: 0.1},
+	}}
+	if !reflect.DeepEqual(faults, expected) {
+		t.Fatalf("expect %+v got %+v", expected, faults)
+	}
+	encoded, err := json.Marshal(&faults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != data {
+		t.Fatalf("expect %s got %s", data, encoded)
+	}
+	if err := json.Unmarshal([]byte(`{"ops":{"get":{"latency":"soon"}}}`), &faults); err == nil {
+		t.Fatal("expect invalid latency error got nil")
+	}
+}
+
+func TestFaultsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ops   map[string]OpFaults
+		valid bool
+	}{
+		{"empty", nil, true},
+		{"valid", map[string]OpFaults{FaultTx: {Latency: Duration(time.Second), ErrorRate: 1, CloseRate: 0}}, true},
+		{"unknown operation", map[string]OpFaults{"watch": {}}, false},
+		{"negative latency", map[string]OpFaults{FaultGet: {Latency: -1}}, false},
+		{"rate above 1", map[string]OpFaults{FaultList: {ScanErrorRate: 1.5}}, false},
+		{"negative rate", map[string]OpFaults{FaultCreate: {ErrorRate: -0.1}}, false},
+	} {
+		f := Faults{Ops: tc.ops}
+		err := f.Validate()
+		if (err == nil) != tc.valid {
+			t.Fatalf("%s: expect valid %v got %v", tc.name, tc.valid, err)
+		}
+		if err != nil && CodeOf(err) != CodeInvalidArgument {
+			t.Fatalf("%s: expect %v got %v", tc.name, CodeInvalidArgument, CodeOf(err))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package expay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// maxIDLen is the maximum length of an ID
+const maxIDLen = 64
+
+// crockford is the alphabet of Crockford's base32 used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// IDGenerator returns a new unique ID
+type IDGenerator func() (string, error)
+
+// NewUUID returns a random UUID (version 4) in lowercase
+func NewUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	var s [36]byte
+	hex.Encode(s[:8], b[:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:]), nil
+}
+
+// NewULID returns a ULID, which is made of the current time in milliseconds
+// and random bits, so that ULIDs sort in the order of their creation time
+// (within a millisecond they are random)
+func NewULID() (string, error) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// encode 128 bits into 26 characters of 5 bits from the most significant
+	// end, the first character has only 3 bits
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:]), nil
+}
+
+// IsUUID returns if id is a UUID in the canonical lowercase form
+func IsUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if id[i] != '-' {
+				return false
+			}
+		default:
+			if !isLowerHex(id[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsULID returns if id is a ULID in uppercase
+func IsULID(id string) bool {
+	if len(id) != 26 || id[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !isCrockford(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidID returns if id is well-formed, i.e. it is not empty and consists of
+// at most 64 ASCII letters, digits, '-' or '_'. A valid ID may still be
+// rejected by a DB with ErrInvalidID if it is not of the form the DB uses.
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+func isCrockford(c byte) bool {
+	for i := 0; i < len(crockford); i++ {
+		if crockford[i] == c {
+			return true
+		}
+	}
+	return false
+}
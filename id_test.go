@@ -0,0 +1,83 @@
+package expay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUUID(t *testing.T) {
+	t.Parallel()
+
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := NewUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsUUID(id) || !ValidID(id) {
+			t.Fatalf("expect a valid UUID got %s", id)
+		}
+		if id[14] != '4' || !strings.ContainsRune("89ab", rune(id[19])) {
+			t.Fatalf("expect a version 4 UUID got %s", id)
+		}
+		if ids[id] {
+			t.Fatalf("expect unique UUIDs got %s twice", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	t.Parallel()
+
+	last := ""
+	for i := 0; i < 3; i++ {
+		id, err := NewULID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsULID(id) || !ValidID(id) {
+			t.Fatalf("expect a valid ULID got %s", id)
+		}
+		// ULIDs of different milliseconds sort by time
+		if id[:10] <= last {
+			t.Fatalf("expect %s after %s", id[:10], last)
+		}
+		last = id[:10]
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestIDForms(t *testing.T) {
+	t.Parallel()
+
+	testcases := []struct {
+		id                  string
+		uuid, ulid, isValid bool
+	}{
+		{id: "0000000000000001", isValid: true},
+		{id: "3f2504e0-4f89-41d3-9a0c-0305e82c3301", uuid: true, isValid: true},
+		{id: "3F2504E0-4F89-41D3-9A0C-0305E82C3301", isValid: true},
+		{id: "3f2504e0-4f89-41d3-9a0c-0305e82c330", isValid: true},
+		{id: "3f2504e04f8941d39a0c0305e82c330100", isValid: true},
+		{id: "01ARZ3NDEKTSV4RRFFQ69G5FAV", ulid: true, isValid: true},
+		{id: "81ARZ3NDEKTSV4RRFFQ69G5FAV", isValid: true},
+		{id: "01ARZ3NDEKTSV4RRFFQ69G5FAU", isValid: true},
+		{id: "nonexisted-id", isValid: true},
+		{id: ""},
+		{id: "a/b"},
+		{id: strings.Repeat("a", 65)},
+	}
+	for _, tc := range testcases {
+		if got := IsUUID(tc.id); got != tc.uuid {
+			t.Fatalf("expect IsUUID(%q) %v got %v", tc.id, tc.uuid, got)
+		}
+		if got := IsULID(tc.id); got != tc.ulid {
+			t.Fatalf("expect IsULID(%q) %v got %v", tc.id, tc.ulid, got)
+		}
+		if got := ValidID(tc.id); got != tc.isValid {
+			t.Fatalf("expect ValidID(%q) %v got %v", tc.id, tc.isValid, got)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Package admin provides the administrative RESTful service of expay, which
+// operates on the storage and should only be exposed on a private address.
+package admin
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"h12.io/expay"
+	"h12.io/expay/service"
+)
+
+const urlPrefix = "/v1/admin"
+
+// DigestTrailer is the HTTP trailer of a backup response with the SHA-256
+// digest of the snapshot (RFC 3230), it is missing if the backup has failed
+// after the snapshot started streaming
+const DigestTrailer = "Digest"
+
+// Service provides the admin RESTful service
+type Service struct {
+	http.Handler
+	db expay.DB
+}
+
+// RotateKeysResponse is the response of rotating the encryption keys
+type RotateKeysResponse struct {
+	// number of re-encrypted values
+	Reencrypted int `json:"reencrypted"`
+}
+
+// ArchiveResponse is the response of archiving the payments
+type ArchiveResponse struct {
+	// number of archived payments
+	Archived int `json:"archived"`
+}
+
+// MigrateProgress is a line of the response of migrating the schema, which
+// streams a line of JSON after each batch
+type MigrateProgress struct {
+	expay.MigrationProgress
+	// Done is true in the last line of a successful migration
+	Done bool `json:"done,omitempty"`
+	// Error is set in the last line of a failed migration
+	Error string `json:"error,omitempty"`
+}
+
+// defaultBatchSize is the default number of values migrated in a transaction
+const defaultBatchSize = 100
+
+// NewService creates a new admin service of the storage
+func NewService(db expay.DB) *Service {
+	mux := mux.NewRouter()
+	s := &Service{Handler: mux, db: db}
+
+	mux.Use(service.CommonMiddleware, service.ActorMiddleware)
+	mux.NotFoundHandler = service.CommonMiddleware(http.HandlerFunc(s.notFound))
+	mux.HandleFunc(urlPrefix+"/rotate-keys", s.rotateKeys).Methods("POST")
+	mux.HandleFunc(urlPrefix+"/backup", s.backup).Methods("GET")
+	mux.HandleFunc(urlPrefix+"/migrate", s.migrate).Methods("POST")
+	mux.HandleFunc(urlPrefix+"/cache", s.cacheStats).Methods("GET")
+	mux.HandleFunc(urlPrefix+"/archive", s.archive).Methods("POST")
+	mux.HandleFunc(urlPrefix+"/faults", s.faults).Methods("GET")
+	mux.HandleFunc(urlPrefix+"/faults", s.setFaults).Methods("PUT")
+	return s
+}
+
+func (s *Service) notFound(w http.ResponseWriter, req *http.Request) {
+	service.Error(w, "api not found", http.StatusNotFound)
+}
+
+func (s *Service) rotateKeys(w http.ResponseWriter, req *http.Request) {
+	var rotator expay.KeyRotator
+	if !expay.As(s.db, &rotator) {
+		service.Error(w, "storage is not encrypted", http.StatusNotImplemented)
+		return
+	}
+	n, err := rotator.RotateKeys(req.Context())
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&RotateKeysResponse{Reencrypted: n})
+}
+
+func (s *Service) backup(w http.ResponseWriter, req *http.Request) {
+	var backuper expay.Backuper
+	if !expay.As(s.db, &backuper) {
+		service.Error(w, "storage does not support backup", http.StatusNotImplemented)
+		return
+	}
+	digest := sha256.New()
+	bw := &backupWriter{w: w, header: func() {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Trailer", DigestTrailer)
+	}}
+	n, err := backuper.Backup(req.Context(), io.MultiWriter(bw, digest))
+	if err != nil {
+		if !bw.started {
+			service.WriteError(w, err)
+			return
+		}
+		log.Printf("backup failed after %d bytes: %v", n, err)
+		return
+	}
+	w.Header().Set(DigestTrailer, "SHA-256="+base64.StdEncoding.EncodeToString(digest.Sum(nil)))
+}
+
+func (s *Service) migrate(w http.ResponseWriter, req *http.Request) {
+	var migrator expay.Migrator
+	if !expay.As(s.db, &migrator) {
+		service.Error(w, "storage is not versioned", http.StatusNotImplemented)
+		return
+	}
+	query := req.URL.Query()
+	batchSize := defaultBatchSize
+	if v := query.Get("batch_size"); v != "" {
+		var err error
+		if batchSize, err = strconv.Atoi(v); err != nil || batchSize <= 0 {
+			service.Error(w, "invalid batch_size", http.StatusBadRequest)
+			return
+		}
+	}
+	dryRun := false
+	if v := query.Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			service.Error(w, "invalid dry_run", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var last expay.MigrationProgress
+	err := migrator.Migrate(req.Context(), batchSize, dryRun, func(p expay.MigrationProgress) {
+		last = p
+		_ = enc.Encode(&MigrateProgress{MigrationProgress: p})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		_ = enc.Encode(&MigrateProgress{MigrationProgress: last, Error: err.Error()})
+		return
+	}
+	_ = enc.Encode(&MigrateProgress{MigrationProgress: last, Done: true})
+}
+
+// archive archives the payments processed before the date given by query
+// before (2006-01-02)
+func (s *Service) archive(w http.ResponseWriter, req *http.Request) {
+	var archiver expay.Archiver
+	if !expay.As(s.db, &archiver) {
+		service.Error(w, "storage does not support archive", http.StatusNotImplemented)
+		return
+	}
+	before, err := time.Parse("2006-01-02", req.URL.Query().Get("before"))
+	if err != nil {
+		service.Error(w, "invalid before", http.StatusBadRequest)
+		return
+	}
+	n, err := archiver.Archive(req.Context(), before)
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&ArchiveResponse{Archived: n})
+}
+
+func (s *Service) cacheStats(w http.ResponseWriter, req *http.Request) {
+	var cacher expay.Cacher
+	if !expay.As(s.db, &cacher) {
+		service.Error(w, "storage is not cached", http.StatusNotImplemented)
+		return
+	}
+	stats := cacher.CacheStats()
+	_ = json.NewEncoder(w).Encode(&stats)
+}
+
+func (s *Service) faults(w http.ResponseWriter, req *http.Request) {
+	var injector expay.FaultInjector
+	if !expay.As(s.db, &injector) {
+		service.Error(w, "storage does not support fault injection", http.StatusNotImplemented)
+		return
+	}
+	faults, err := injector.Faults()
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&faults)
+}
+
+// setFaults replaces the faults being injected with the request body, and an
+// empty body stops injecting any fault
+func (s *Service) setFaults(w http.ResponseWriter, req *http.Request) {
+	var injector expay.FaultInjector
+	if !expay.As(s.db, &injector) {
+		service.Error(w, "storage does not support fault injection", http.StatusNotImplemented)
+		return
+	}
+	var faults expay.Faults
+	if err := json.NewDecoder(req.Body).Decode(&faults); err != nil && err != io.EOF {
+		service.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := injector.SetFaults(faults); err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&faults)
+}
+
+// backupWriter sets the response header before the first write, so that an
+// error before the snapshot starts streaming can still be replied
+type backupWriter struct {
+	w       http.ResponseWriter
+	header  func()
+	started bool
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !w.started {
+		w.header()
+		w.started = true
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,552 @@
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+	"h12.io/expay/db/cachedb"
+	"h12.io/expay/db/faultdb"
+	"h12.io/expay/db/memdb"
+)
+
+type fakeRotator struct {
+	*memdb.DB
+	n   int
+	err error
+}
+
+func (r *fakeRotator) RotateKeys(ctx context.Context) (int, error) {
+	return r.n, r.err
+}
+
+type fakeBackuper struct {
+	*memdb.DB
+	snapshot string
+	err      error
+}
+
+func (b *fakeBackuper) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, b.snapshot)
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), b.err
+}
+
+type fakeMigrator struct {
+	*memdb.DB
+	progress  []expay.MigrationProgress
+	err       error
+	batchSize int
+	dryRun    bool
+}
+
+func (m *fakeMigrator) Migrate(ctx context.Context, batchSize int, dryRun bool, progress func(expay.MigrationProgress)) error {
+	m.batchSize, m.dryRun = batchSize, dryRun
+	for _, p := range m.progress {
+		progress(p)
+	}
+	return m.err
+}
+
+type fakeArchiver struct {
+	*memdb.DB
+	n      int
+	err    error
+	before time.Time
+}
+
+func (a *fakeArchiver) Archive(ctx context.Context, before time.Time) (int, error) {
+	a.before = before
+	return a.n, a.err
+}
+
+func (a *fakeArchiver) GetArchived(ctx context.Context, id string, v interface{}) error {
+	return expay.ErrNotFound
+}
+
+func (a *fakeArchiver) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return a.DB.Paginate(ctx, "", 0)
+}
+
+func TestRotateKeys(t *testing.T) {
+	testcases := []struct {
+		name     string
+		db       expay.DB
+		method   string
+		path     string
+		wantCode int
+		wantN    int
+	}{
+		{
+			name:     "rotated",
+			db:       &fakeRotator{DB: memdb.New(), n: 3},
+			method:   http.MethodPost,
+			path:     "/v1/admin/rotate-keys",
+			wantCode: http.StatusOK,
+			wantN:    3,
+		},
+		{
+			name:     "not encrypted",
+			db:       memdb.New(),
+			method:   http.MethodPost,
+			path:     "/v1/admin/rotate-keys",
+			wantCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "failed",
+			db:       &fakeRotator{DB: memdb.New(), err: errors.New("fail")},
+			method:   http.MethodPost,
+			path:     "/v1/admin/rotate-keys",
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "canceled",
+			db:       &fakeRotator{DB: memdb.New(), err: context.Canceled},
+			method:   http.MethodPost,
+			path:     "/v1/admin/rotate-keys",
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:     "wrong method",
+			db:       memdb.New(),
+			method:   http.MethodGet,
+			path:     "/v1/admin/rotate-keys",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "wrong url",
+			db:       memdb.New(),
+			method:   http.MethodPost,
+			path:     "/v1/admin/wrong",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(NewService(tc.db))
+			defer server.Close()
+			req, _ := http.NewRequest(tc.method, server.URL+tc.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var rotateResp RotateKeysResponse
+			if err := json.NewDecoder(resp.Body).Decode(&rotateResp); err != nil {
+				t.Fatal(err)
+			}
+			if rotateResp.Reencrypted != tc.wantN {
+				t.Fatalf("expect %d got %d", tc.wantN, rotateResp.Reencrypted)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	snapshot := "snapshot"
+	sum := sha256.Sum256([]byte(snapshot))
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	testcases := []struct {
+		name       string
+		db         expay.DB
+		wantCode   int
+		wantBody   string
+		wantDigest string
+	}{
+		{
+			name:       "backup",
+			db:         &fakeBackuper{DB: memdb.New(), snapshot: snapshot},
+			wantCode:   http.StatusOK,
+			wantBody:   snapshot,
+			wantDigest: digest,
+		},
+		{
+			name:     "not supported",
+			db:       memdb.New(),
+			wantCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "failed before streaming",
+			db:       &fakeBackuper{DB: memdb.New(), err: context.DeadlineExceeded},
+			wantCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:     "failed while streaming",
+			db:       &fakeBackuper{DB: memdb.New(), snapshot: snapshot, err: errors.New("fail")},
+			wantCode: http.StatusOK,
+			wantBody: snapshot,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(NewService(tc.db))
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/v1/admin/backup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tc.wantBody {
+				t.Fatalf("expect %s got %s", tc.wantBody, body)
+			}
+			if digest := resp.Trailer.Get(DigestTrailer); digest != tc.wantDigest {
+				t.Fatalf("expect %s got %s", tc.wantDigest, digest)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	progress := []expay.MigrationProgress{
+		{Total: 3, Scanned: 2, Migrated: 1},
+		{Total: 3, Scanned: 3, Migrated: 2},
+	}
+	testcases := []struct {
+		name          string
+		db            expay.DB
+		query         string
+		wantCode      int
+		wantLines     []MigrateProgress
+		wantBatchSize int
+		wantDryRun    bool
+	}{
+		{
+			name:     "migrated",
+			db:       &fakeMigrator{DB: memdb.New(), progress: progress},
+			wantCode: http.StatusOK,
+			wantLines: []MigrateProgress{
+				{MigrationProgress: progress[0]},
+				{MigrationProgress: progress[1]},
+				{MigrationProgress: progress[1], Done: true},
+			},
+			wantBatchSize: defaultBatchSize,
+		},
+		{
+			name:     "dry run",
+			db:       &fakeMigrator{DB: memdb.New()},
+			query:    "?dry_run=true&batch_size=10",
+			wantCode: http.StatusOK,
+			wantLines: []MigrateProgress{
+				{Done: true},
+			},
+			wantBatchSize: 10,
+			wantDryRun:    true,
+		},
+		{
+			name:     "failed",
+			db:       &fakeMigrator{DB: memdb.New(), progress: progress[:1], err: errors.New("fail")},
+			wantCode: http.StatusOK,
+			wantLines: []MigrateProgress{
+				{MigrationProgress: progress[0]},
+				{MigrationProgress: progress[0], Error: "fail"},
+			},
+			wantBatchSize: defaultBatchSize,
+		},
+		{
+			name:     "not versioned",
+			db:       memdb.New(),
+			wantCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "invalid batch size",
+			db:       &fakeMigrator{DB: memdb.New()},
+			query:    "?batch_size=0",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid dry run",
+			db:       &fakeMigrator{DB: memdb.New()},
+			query:    "?dry_run=maybe",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(NewService(tc.db))
+			defer server.Close()
+			resp, err := http.Post(server.URL+"/v1/admin/migrate"+tc.query, "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var lines []MigrateProgress
+			dec := json.NewDecoder(resp.Body)
+			for dec.More() {
+				var line MigrateProgress
+				if err := dec.Decode(&line); err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+			}
+			if !reflect.DeepEqual(lines, tc.wantLines) {
+				t.Fatalf("expect %v got %v", tc.wantLines, lines)
+			}
+			m := tc.db.(*fakeMigrator)
+			if m.batchSize != tc.wantBatchSize || m.dryRun != tc.wantDryRun {
+				t.Fatalf("expect %d, %v got %d, %v", tc.wantBatchSize, tc.wantDryRun, m.batchSize, m.dryRun)
+			}
+		})
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+	cached := cachedb.New(memdb.New(), 10, 0)
+	id, err := cached.Create(ctx, &expay.Payment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := cached.Get(ctx, id, &expay.Payment{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testcases := []struct {
+		name      string
+		db        expay.DB
+		method    string
+		wantCode  int
+		wantStats expay.CacheStats
+	}{
+		{
+			name:      "cached",
+			db:        cached,
+			method:    http.MethodGet,
+			wantCode:  http.StatusOK,
+			wantStats: expay.CacheStats{Hits: 2, Misses: 1, Size: 1},
+		},
+		{
+			name:     "not cached",
+			db:       memdb.New(),
+			method:   http.MethodGet,
+			wantCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "wrong method",
+			db:       cached,
+			method:   http.MethodPost,
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(NewService(tc.db))
+			defer server.Close()
+			req, _ := http.NewRequest(tc.method, server.URL+"/v1/admin/cache", nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var stats expay.CacheStats
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats != tc.wantStats {
+				t.Fatalf("expect %+v got %+v", tc.wantStats, stats)
+			}
+		})
+	}
+}
+
+func TestArchive(t *testing.T) {
+	testcases := []struct {
+		name       string
+		db         expay.DB
+		query      string
+		wantCode   int
+		wantN      int
+		wantBefore time.Time
+	}{
+		{
+			name:       "archived",
+			db:         &fakeArchiver{DB: memdb.New(), n: 3},
+			query:      "?before=2017-02-01",
+			wantCode:   http.StatusOK,
+			wantN:      3,
+			wantBefore: time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "not supported",
+			db:       memdb.New(),
+			query:    "?before=2017-02-01",
+			wantCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "missing before",
+			db:       &fakeArchiver{DB: memdb.New()},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid before",
+			db:       &fakeArchiver{DB: memdb.New()},
+			query:    "?before=2017-02",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "failed",
+			db:       &fakeArchiver{DB: memdb.New(), err: errors.New("fail")},
+			query:    "?before=2017-02-01",
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(NewService(tc.db))
+			defer server.Close()
+			resp, err := http.Post(server.URL+"/v1/admin/archive"+tc.query, "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var archiveResp ArchiveResponse
+			if err := json.NewDecoder(resp.Body).Decode(&archiveResp); err != nil {
+				t.Fatal(err)
+			}
+			if archiveResp.Archived != tc.wantN {
+				t.Fatalf("expect %d got %d", tc.wantN, archiveResp.Archived)
+			}
+			if before := tc.db.(*fakeArchiver).before; !before.Equal(tc.wantBefore) {
+				t.Fatalf("expect %v got %v", tc.wantBefore, before)
+			}
+		})
+	}
+}
+
+func TestFaults(t *testing.T) {
+	injector := faultdb.New(memdb.New())
+	server := httptest.NewServer(NewService(injector))
+	defer server.Close()
+	put := func(body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/v1/admin/faults", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	get := func() expay.Faults {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/v1/admin/faults")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expect %d got %d", http.StatusOK, resp.StatusCode)
+		}
+		var faults expay.Faults
+		if err := json.NewDecoder(resp.Body).Decode(&faults); err != nil {
+			t.Fatal(err)
+		}
+		return faults
+	}
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		wantCode int
+		want     expay.Faults
+	}{
+		{
+			name:     "set",
+			body:     `{"ops":{"get":{"latency":"10ms","error_rate":0.5,"error":"conflict"}}}`,
+			wantCode: http.StatusOK,
+			want: expay.Faults{Ops: map[string]expay.OpFaults{
+				expay.FaultGet: {Latency: expay.Duration(10 * time.Millisecond), ErrorRate: 0.5, Error: expay.CodeConflict},
+			}},
+		},
+		{
+			name:     "invalid json",
+			body:     `{"ops":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid faults",
+			body:     `{"ops":{"get":{"error_rate":2}}}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "cleared",
+			body:     "",
+			wantCode: http.StatusOK,
+			want:     expay.Faults{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := get()
+			if resp := put(tc.body); resp.StatusCode != tc.wantCode {
+				t.Fatalf("expect %d got %d", tc.wantCode, resp.StatusCode)
+			}
+			want := tc.want
+			if tc.wantCode != http.StatusOK {
+				want = before
+			}
+			if faults := get(); !reflect.DeepEqual(faults, want) {
+				t.Fatalf("expect %+v got %+v", want, faults)
+			}
+		})
+	}
+
+	for _, db := range []expay.DB{memdb.New(), cachedb.New(memdb.New(), 10, 0)} {
+		server := httptest.NewServer(NewService(db))
+		resp, err := http.Get(server.URL + "/v1/admin/faults")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("expect %d got %d", http.StatusNotImplemented, resp.StatusCode)
+		}
+	}
+}
@@ -1,10 +1,37 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"h12.io/expay"
+)
+
+// error codes of the errors not returned by the DB
+const (
+	// CodeTimeout means the request has timed out
+	CodeTimeout = "timeout"
+	// CodeCanceled means the request has been canceled, e.g. the server is
+	// shutting down
+	CodeCanceled = "canceled"
+	// CodeInternal means an unexpected error
+	CodeInternal = "internal"
 )
 
+// statuses are the HTTP statuses of the codes of expay.Error
+var statuses = map[expay.ErrorCode]int{
+	expay.CodeNotFound:        http.StatusNotFound,
+	expay.CodeInvalidID:       http.StatusBadRequest,
+	expay.CodeInvalidArgument: http.StatusBadRequest,
+	expay.CodeConflict:        http.StatusConflict,
+	expay.CodeVersionMismatch: http.StatusConflict,
+	expay.CodeUnavailable:     http.StatusServiceUnavailable,
+	expay.CodeQuotaExceeded:   http.StatusInsufficientStorage,
+	expay.CodeNotSupported:    http.StatusNotImplemented,
+}
+
 // ErrorResponse is returned when an error occurred
 //
 // swagger:response ErrorResponse
@@ -17,6 +44,8 @@ type errorResponseWrapper struct {
 type ErrorResponse struct {
 	// status code
 	Code int `json:"code,omitempty"`
+	// error code, e.g. not_found (see expay.ErrorCode)
+	ErrorCode string `json:"error_code,omitempty"`
 	// error message
 	Message string `json:"message,omitempty"`
 }
@@ -28,3 +57,28 @@ func Error(w http.ResponseWriter, msg string, code int) {
 	w.WriteHeader(code)
 	_ = json.NewEncoder(w).Encode(&ErrorResponse{Code: code, Message: msg})
 }
+
+// ErrorStatus returns the HTTP status and the error code of an error, which is
+// classified by its expay.ErrorCode
+func ErrorStatus(err error) (status int, code string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, CodeCanceled
+	}
+	if code := expay.CodeOf(err); code != "" {
+		if status, ok := statuses[code]; ok {
+			return status, string(code)
+		}
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// WriteError replies to the request with an error, e.g. returned from the DB,
+// with the HTTP status and the error code given by ErrorStatus
+func WriteError(w http.ResponseWriter, err error) {
+	status, code := ErrorStatus(err)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&ErrorResponse{Code: status, ErrorCode: code, Message: err.Error()})
+}
@@ -1,9 +1,14 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"h12.io/expay"
 )
 
 func TestError(t *testing.T) {
@@ -18,3 +23,33 @@ func TestError(t *testing.T) {
 		t.Fatalf("expect %s got %s", expectedBody, body)
 	}
 }
+
+func TestWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{expay.ErrNotFound, http.StatusNotFound, `{"code":404,"error_code":"not_found","message":"item not found"}`},
+		{expay.ErrInvalidID, http.StatusBadRequest, `{"code":400,"error_code":"invalid_id","message":"invalid id"}`},
+		{expay.ErrInvalidPayment, http.StatusBadRequest, `{"code":400,"error_code":"invalid_argument","message":"invalid payment"}`},
+		{expay.ErrAlreadyExists, http.StatusConflict, `{"code":409,"error_code":"conflict","message":"item already exists"}`},
+		{expay.ErrVersionMismatch, http.StatusConflict, `{"code":409,"error_code":"version_mismatch","message":"version mismatch"}`},
+		{&expay.Error{Code: expay.CodeUnavailable, Message: "storage unavailable", Err: errors.New("closed")}, http.StatusServiceUnavailable, `{"code":503,"error_code":"unavailable","message":"storage unavailable: closed"}`},
+		{fmt.Errorf("put: %w", expay.ErrQuotaExceeded), http.StatusInsufficientStorage, `{"code":507,"error_code":"quota_exceeded","message":"put: quota exceeded"}`},
+		{expay.ErrNotSupported, http.StatusNotImplemented, `{"code":501,"error_code":"not_supported","message":"not supported"}`},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, `{"code":504,"error_code":"timeout","message":"context deadline exceeded"}`},
+		{context.Canceled, http.StatusServiceUnavailable, `{"code":503,"error_code":"canceled","message":"context canceled"}`},
+		{&expay.Error{Code: "unknown", Message: "unknown"}, http.StatusInternalServerError, `{"code":500,"error_code":"internal","message":"unknown"}`},
+		{errors.New("err msg"), http.StatusInternalServerError, `{"code":500,"error_code":"internal","message":"err msg"}`},
+	} {
+		w := httptest.NewRecorder()
+		WriteError(w, tc.err)
+		if w.Code != tc.expectedCode {
+			t.Fatalf("expect %d got %d", tc.expectedCode, w.Code)
+		}
+		if body := w.Body.String(); body != tc.expectedBody+"\n" {
+			t.Fatalf("expect %s got %s", tc.expectedBody, body)
+		}
+	}
+}
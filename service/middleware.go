@@ -1,6 +1,12 @@
 package service
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"h12.io/expay"
+)
 
 // CommonMiddleware does common middleware logic
 func CommonMiddleware(next http.Handler) http.Handler {
@@ -9,3 +15,26 @@ func CommonMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// TimeoutMiddleware returns a middleware that cancels the request context after
+// timeout, so that slow storage operations are stopped
+func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ActorMiddleware sets the actor of the request context (see expay.WithActor)
+// from the X-User header
+func ActorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get("X-User"); user != "" {
+			r = r.WithContext(expay.WithActor(r.Context(), user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
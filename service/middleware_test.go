@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"h12.io/expay"
 )
 
 func TestCommonMiddleware(t *testing.T) {
@@ -14,3 +17,30 @@ func TestCommonMiddleware(t *testing.T) {
 		t.Fatalf("expect %s got %s", "application/json", value)
 	}
 }
+
+func TestTimeoutMiddleware(t *testing.T) {
+	var deadline time.Time
+	next := func(w http.ResponseWriter, req *http.Request) {
+		deadline, _ = req.Context().Deadline()
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	TimeoutMiddleware(time.Minute)(http.HandlerFunc(next)).ServeHTTP(w, req)
+	if deadline.IsZero() || time.Until(deadline) > time.Minute {
+		t.Fatalf("expect deadline within a minute got %v", deadline)
+	}
+}
+
+func TestActorMiddleware(t *testing.T) {
+	var actor string
+	next := func(w http.ResponseWriter, req *http.Request) {
+		actor = expay.Actor(req.Context())
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", "alice")
+	ActorMiddleware(http.HandlerFunc(next)).ServeHTTP(w, req)
+	if actor != "alice" {
+		t.Fatalf("expect %s got %s", "alice", actor)
+	}
+}
@@ -0,0 +1,50 @@
+package payment
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"h12.io/expay"
+)
+
+// Archiver moves the payments processed longer than the archive age ago out of
+// the live payments
+type Archiver struct {
+	db expay.Archiver
+	// Age is how long after its processing date a payment is archived
+	Age time.Duration
+	// Interval between two archivings
+	Interval time.Duration
+	now      func() time.Time
+}
+
+// NewArchiver creates an archiver of the payments in db
+func NewArchiver(db expay.Archiver, age, interval time.Duration) *Archiver {
+	return &Archiver{db: db, Age: age, Interval: interval, now: time.Now}
+}
+
+// Run archives periodically until ctx is done
+func (a *Archiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		n, err := a.Archive(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("archive failed: %v", err)
+		} else if n > 0 {
+			log.Printf("archived %d payments", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Archive archives the payments older than the archive age once and returns
+// the number of archived payments
+func (a *Archiver) Archive(ctx context.Context) (n int, err error) {
+	return a.db.Archive(ctx, a.now().UTC().Add(-a.Age))
+}
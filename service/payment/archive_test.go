@@ -0,0 +1,24 @@
+package payment
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	db := fakeArchiverWith(testIDs(1), testIDs(2, 3))().(*fakeArchiver)
+	now := time.Date(2018, 2, 1, 12, 0, 0, 0, time.UTC)
+	archiver := NewArchiver(db, 30*24*time.Hour, time.Hour)
+	archiver.now = func() time.Time { return now }
+	n, err := archiver.Archive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expect %d got %d", 2, n)
+	}
+	if expected := time.Date(2018, 1, 2, 12, 0, 0, 0, time.UTC); !db.before.Equal(expected) {
+		t.Fatalf("expect %v got %v", expected, db.before)
+	}
+}
@@ -1,19 +1,17 @@
 package payment
 
 import (
-	"errors"
-	"reflect"
-	"sort"
-	"strconv"
-	"sync"
+	"context"
+	"time"
 
 	"h12.io/expay"
+	"h12.io/expay/db/memdb"
 )
 
+// fakeDB injects errors into a memdb, whose optional interfaces are hidden so
+// that it also stands for a storage supporting none of them
 type fakeDB struct {
-	m  map[string]interface{}
-	id int
-	mu sync.RWMutex
+	expay.DB
 
 	// injected errors
 	getErr       error
@@ -25,129 +23,244 @@ type fakeDB struct {
 	iterCloseErr error
 }
 
-type kv struct {
-	key   string
-	value interface{}
+// fakeTx injects the errors of fakeDB into a transaction
+type fakeTx struct {
+	expay.Tx
+	db *fakeDB
 }
+
+// fakeIterator injects the errors of fakeDB into an iterator
 type fakeIterator struct {
-	kvs      []kv
-	i        int
+	expay.Iter
 	scanErr  error
 	closeErr error
 }
 
 func newFakeDB() *fakeDB {
-	return &fakeDB{m: make(map[string]interface{})}
+	return &fakeDB{DB: memdb.New()}
 }
 
-func (db *fakeDB) Create(v interface{}) (id string, err error) {
+func (db *fakeDB) Create(ctx context.Context, v interface{}) (id string, err error) {
 	if db.createErr != nil {
 		return "", db.createErr
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	db.id++
-	id = strconv.Itoa(db.id)
-	db.m[id] = v
-	return id, nil
+	return db.DB.Create(ctx, v)
 }
 
-func (db *fakeDB) Get(id string, v interface{}) error {
+func (db *fakeDB) Get(ctx context.Context, id string, v interface{}) error {
 	if db.getErr != nil {
 		return db.getErr
 	}
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	dbv, ok := db.m[id]
-	if !ok {
-		return expay.ErrNotFound
-	}
-	return scanValue(dbv, v)
+	return db.DB.Get(ctx, id, v)
 }
 
-func scanValue(dbv, v interface{}) error {
-	in := reflect.ValueOf(dbv)
-	for in.Kind() == reflect.Ptr {
-		in = in.Elem()
-	}
-	out := reflect.ValueOf(v)
-	for out.Kind() == reflect.Ptr {
-		out = out.Elem()
-	}
-	if out.Type() != in.Type() {
-		return errors.New("incompatible type")
+func (db *fakeDB) Update(ctx context.Context, id string, v interface{}) error {
+	if db.updateErr != nil {
+		return db.updateErr
 	}
-	out.Set(in)
-	return nil
+	return db.DB.Update(ctx, id, v)
 }
 
-func (db *fakeDB) Update(id string, v interface{}) error {
+func (db *fakeDB) UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error {
+	if db.getErr != nil {
+		return db.getErr
+	}
 	if db.updateErr != nil {
 		return db.updateErr
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if _, ok := db.m[id]; !ok {
-		return expay.ErrNotFound
-	}
-	db.m[id] = v
-	return nil
+	return db.DB.UpdateFunc(ctx, id, v, fn)
 }
 
-func (db *fakeDB) Delete(id string) error {
+func (db *fakeDB) Delete(ctx context.Context, id string) error {
 	if db.deleteErr != nil {
 		return db.deleteErr
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	delete(db.m, id)
-	return nil
+	return db.DB.Delete(ctx, id)
 }
 
-func (db *fakeDB) List() (expay.Iter, error) {
+func (db *fakeDB) List(ctx context.Context) (expay.Iter, error) {
 	if db.listErr != nil {
 		return nil, db.listErr
 	}
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	keys := make([]string, 0, len(db.m))
-	for key := range db.m {
-		keys = append(keys, key)
+	it, err := db.DB.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeIterator{Iter: it, scanErr: db.iterScanErr, closeErr: db.iterCloseErr}, nil
+}
+
+func (db *fakeDB) Paginate(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	if db.listErr != nil {
+		return nil, db.listErr
 	}
-	sort.Strings(keys)
-	kvs := make([]kv, 0, len(db.m))
-	for _, key := range keys {
-		value := db.m[key]
-		kvs = append(kvs, kv{key: key, value: value})
+	it, err := db.DB.Paginate(ctx, lastCursor, limit)
+	if err != nil {
+		return nil, err
 	}
-	return &fakeIterator{
-		kvs:      kvs,
-		i:        -1,
-		scanErr:  db.iterScanErr,
-		closeErr: db.iterCloseErr,
-	}, nil
+	return &fakeIterator{Iter: it, scanErr: db.iterScanErr, closeErr: db.iterCloseErr}, nil
 }
 
-func (it *fakeIterator) Next() bool {
-	defer func() {
-		it.i++
-	}()
-	return it.i < len(it.kvs)-1
+func (db *fakeDB) RunInTx(ctx context.Context, fn func(tx expay.Tx) error) error {
+	return db.DB.RunInTx(ctx, func(tx expay.Tx) error {
+		return fn(&fakeTx{Tx: tx, db: db})
+	})
 }
 
-func (it *fakeIterator) Close() error {
-	return it.closeErr
+func (tx *fakeTx) Create(v interface{}) (id string, err error) {
+	if tx.db.createErr != nil {
+		return "", tx.db.createErr
+	}
+	return tx.Tx.Create(v)
+}
+
+func (tx *fakeTx) Get(id string, v interface{}) error {
+	if tx.db.getErr != nil {
+		return tx.db.getErr
+	}
+	return tx.Tx.Get(id, v)
+}
+
+func (tx *fakeTx) Update(id string, v interface{}) error {
+	if tx.db.updateErr != nil {
+		return tx.db.updateErr
+	}
+	return tx.Tx.Update(id, v)
+}
+
+func (tx *fakeTx) Delete(id string) error {
+	if tx.db.deleteErr != nil {
+		return tx.db.deleteErr
+	}
+	return tx.Tx.Delete(id)
 }
 
 func (it *fakeIterator) Scan(v interface{}) (id string, err error) {
 	if it.scanErr != nil {
 		return "", it.scanErr
 	}
-	kv := it.kvs[it.i]
-	return kv.key, scanValue(kv.value, v)
+	return it.Iter.Scan(v)
+}
+
+func (it *fakeIterator) Close() error {
+	if err := it.Iter.Close(); err != nil {
+		return err
+	}
+	return it.closeErr
+}
+
+// fakeWatcher is a memdb with a fixed change log
+type fakeWatcher struct {
+	*memdb.DB
+	changes  []expay.Change
+	watchErr error
+}
+
+func (w *fakeWatcher) Watch(ctx context.Context, sinceSeq uint64) ([]expay.Change, error) {
+	if w.watchErr != nil {
+		return nil, w.watchErr
+	}
+	changes := []expay.Change{}
+	for _, change := range w.changes {
+		if change.Seq > sinceSeq {
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return changes, nil
+}
+
+// fakeHistorian is a memdb with fixed revisions of payments
+type fakeHistorian struct {
+	*memdb.DB
+	revisions map[string][]fakeRevision
+}
+
+type fakeRevision struct {
+	rev expay.Revision
+	pay expay.Payment
+}
+
+func (h *fakeHistorian) Revisions(ctx context.Context, id string) ([]expay.Revision, error) {
+	if len(h.revisions[id]) == 0 {
+		return nil, expay.ErrNotFound
+	}
+	revs := []expay.Revision{}
+	for _, r := range h.revisions[id] {
+		revs = append(revs, r.rev)
+	}
+	return revs, nil
+}
+
+func (h *fakeHistorian) GetRevision(ctx context.Context, id string, n int, v interface{}) (*expay.Revision, error) {
+	for _, r := range h.revisions[id] {
+		if r.rev.N == n {
+			*v.(*expay.Payment) = r.pay
+			return &r.rev, nil
+		}
+	}
+	return nil, expay.ErrNotFound
+}
+
+func (h *fakeHistorian) GetAsOf(ctx context.Context, id string, t time.Time, v interface{}) (*expay.Revision, error) {
+	revs := h.revisions[id]
+	for i := len(revs) - 1; i >= 0; i-- {
+		if !revs[i].rev.Time.After(t) {
+			*v.(*expay.Payment) = revs[i].pay
+			return &revs[i].rev, nil
+		}
+	}
+	return nil, expay.ErrNotFound
+}
+
+// fakeIDCreator is a memdb where another request creates the ID just before
+// the first CreateWithID
+type fakeIDCreator struct {
+	*memdb.DB
+	raced bool
+}
+
+func (c *fakeIDCreator) CreateWithID(ctx context.Context, id string, v interface{}) error {
+	if err := c.DB.CreateWithID(ctx, id, v); err != nil || c.raced {
+		return err
+	}
+	c.raced = true
+	return expay.ErrAlreadyExists
+}
+
+// fakeAggregator is a memdb with fixed aggregates
+type fakeAggregator struct {
+	*memdb.DB
+	stats    *expay.Stats
+	statsErr error
+}
+
+func (a *fakeAggregator) Stats(ctx context.Context) (*expay.Stats, error) {
+	return a.stats, a.statsErr
+}
+
+// fakeArchiver is a memdb of the live payments with the archived payments in
+// another memdb
+type fakeArchiver struct {
+	*memdb.DB
+	archive *memdb.DB
+	// archived is the number of the archived payments
+	archived int
+	// before is the time given to the last Archive
+	before time.Time
+}
+
+func (a *fakeArchiver) Archive(ctx context.Context, before time.Time) (n int, err error) {
+	a.before = before
+	return a.archived, nil
+}
+
+func (a *fakeArchiver) GetArchived(ctx context.Context, id string, v interface{}) error {
+	return a.archive.Get(ctx, id, v)
 }
 
-// TODO: implement cursor-based pagination
-func (db *fakeDB) Paginate(lastCursor string, limit int) (expay.Iter, error) {
-	return nil, errors.New("not implemented yet")
+func (a *fakeArchiver) PaginateArchived(ctx context.Context, lastCursor string, limit int) (expay.Iter, error) {
+	return a.archive.Paginate(ctx, lastCursor, limit)
 }
@@ -0,0 +1,115 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"h12.io/expay"
+)
+
+// Purger permanently deletes the tombstones of payments deleted longer than
+// the retention period ago
+type Purger struct {
+	db expay.DB
+	// Retention is how long a deleted payment is kept
+	Retention time.Duration
+	// Interval between two purges
+	Interval time.Duration
+	now      func() time.Time
+}
+
+// NewPurger creates a purger of the payments in db
+func NewPurger(db expay.DB, retention, interval time.Duration) *Purger {
+	return &Purger{db: db, Retention: retention, Interval: interval, now: time.Now}
+}
+
+// Run purges periodically until ctx is done
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		n, err := p.Purge(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted payments", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Purge deletes the expired tombstones once and returns the number of deleted
+// payments
+func (p *Purger) Purge(ctx context.Context) (n int, err error) {
+	deadline := p.now().Add(-p.Retention)
+	ids, err := p.expired(ctx, deadline)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		// check again in case it has been restored since listed
+		err := p.db.RunInTx(ctx, func(tx expay.Tx) error {
+			pay := expay.Payment{}
+			if err := tx.Get(id, &pay); err != nil {
+				return err
+			}
+			if !isExpired(&pay, deadline) {
+				return errUnchanged
+			}
+			return tx.Delete(id)
+		})
+		switch err {
+		case nil:
+			n++
+		case errUnchanged, expay.ErrNotFound:
+		default:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// expired returns the IDs of the tombstones deleted before deadline, looked up
+// by the index of tombstones if the DB has it or listed from every payment
+// otherwise
+func (p *Purger) expired(ctx context.Context, deadline time.Time) (ids []string, err error) {
+	iter, err := p.lookupExpired(ctx, deadline)
+	if err == expay.ErrUnknownIndex || errors.Is(err, expay.ErrNotSupported) {
+		iter, err = p.db.List(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for iter.Next() {
+		pay := expay.Payment{}
+		id, err := iter.Scan(&pay)
+		if err != nil {
+			_ = iter.Close()
+			return nil, err
+		}
+		if isExpired(&pay, deadline) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, iter.Close()
+}
+
+// lookupExpired returns an iterator of the tombstones deleted before deadline
+// by the index of tombstones
+func (p *Purger) lookupExpired(ctx context.Context, deadline time.Time) (expay.Iter, error) {
+	var indexer expay.Indexer
+	if !expay.As(p.db, &indexer) {
+		return nil, expay.ErrNotSupported
+	}
+	return indexer.LookupRange(ctx, expay.PaymentDeletedIndex, "", deadline.UTC().Format(expay.IndexTimeLayout))
+}
+
+func isExpired(pay *expay.Payment, deadline time.Time) bool {
+	return pay.Deleted() && pay.DeletedAt.Before(deadline)
+}
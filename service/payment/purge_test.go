@@ -0,0 +1,135 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"h12.io/expay"
+	"h12.io/expay/db/boltdb"
+	"h12.io/expay/db/memdb"
+)
+
+func TestPurge(t *testing.T) {
+	t.Run("list", func(t *testing.T) {
+		testPurge(t, memdb.New())
+	})
+	t.Run("index", func(t *testing.T) {
+		dir, err := ioutil.TempDir(".", "test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := boltdb.New(path.Join(dir, "db.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		deleted := boltdb.TimeIndex(expay.PaymentDeletedIndex)
+		deleted.KeepExcluded = true
+		testPurge(t, db.Bucket("payment",
+			boltdb.WithIndexes(boltdb.FieldIndex("organisation_id"), deleted),
+			boltdb.WithIndexExclude(expay.PaymentIndexExclude),
+		))
+	})
+}
+
+func testPurge(t *testing.T, db expay.DB) {
+	ctx := context.Background()
+	now := time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)
+	deletedAt := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	ids := []string{}
+	for _, pay := range []expay.Payment{
+		{},
+		{DeletedAt: deletedAt(time.Hour)},
+		{DeletedAt: deletedAt(48 * time.Hour)},
+		{DeletedAt: deletedAt(72 * time.Hour)},
+	} {
+		id, err := db.Create(ctx, pay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	purger := NewPurger(db, 24*time.Hour, time.Hour)
+	purger.now = func() time.Time { return now }
+	n, err := purger.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expect %d got %d", 2, n)
+	}
+	remaining := []string{}
+	iter, err := db.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for iter.Next() {
+		id, err := iter.Scan(&expay.Payment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, id)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, ids[:2]) {
+		t.Fatalf("expect %v got %v", ids[:2], remaining)
+	}
+
+	// nothing more to purge
+	if n, err := purger.Purge(ctx); err != nil || n != 0 {
+		t.Fatalf("expect 0 got %d, %v", n, err)
+	}
+}
+
+func TestPurgeFailed(t *testing.T) {
+	db := newFakeDB()
+	db.listErr = errors.New("injected error")
+	if _, err := NewPurger(db, time.Hour, time.Hour).Purge(context.Background()); err != db.listErr {
+		t.Fatalf("expect error %v got %v", db.listErr, err)
+	}
+}
+
+func TestPurgerRun(t *testing.T) {
+	db := memdb.New()
+	deletedAt := time.Now().Add(-time.Hour)
+	if _, err := db.Create(context.Background(), expay.Payment{DeletedAt: &deletedAt}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewPurger(db, time.Minute, time.Millisecond).Run(ctx)
+		close(done)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		iter, err := db.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		empty := !iter.Next()
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if empty {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout waiting for purge")
+		}
+	}
+	cancel()
+	<-done
+}
@@ -1,20 +1,51 @@
 package payment
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"h12.io/expay"
 	"h12.io/expay/service"
 )
 
-const urlPrefix = "/v1/payments"
+const (
+	urlPrefix = "/v1/payments"
+
+	// defaultPageSize is the number of payments listed when limit is not given
+	defaultPageSize = 100
+	// maxPageSize is the maximum number of payments listed in one page
+	maxPageSize = 1000
+
+	// pollTimeout is the maximum time an event request waits for new events,
+	// it is shorter than the request timeout so that an empty response can be
+	// returned instead
+	pollTimeout = 5 * time.Second
+)
+
+var (
+	// errPreconditionFailed is returned when If-Match does not match the ETag
+	// of the payment
+	errPreconditionFailed = errors.New("precondition failed")
+	// errUnchanged is returned within UpdateFunc to skip writing an unchanged
+	// payment
+	errUnchanged = errors.New("unchanged")
+	// errDeleted is returned within UpdateFunc when the payment is a
+	// tombstone
+	errDeleted = errors.New("deleted")
+)
 
 // Service provides a payment RESTful service
 type Service struct {
 	http.Handler
-	db expay.DB
+	db  expay.DB
+	now func() time.Time
 }
 
 // fetchParam is the parameter for fetchPayment (for doc only)
@@ -25,16 +56,52 @@ type fetchParam struct {
 	//
 	// in:path
 	ID string `json:"id"`
+	// IncludeDeleted returns the payment even if it has been deleted
+	//
+	// in:query
+	IncludeDeleted bool `json:"include_deleted"`
+	// AsOf returns the payment as it was at the time (RFC 3339)
+	//
+	// in:query
+	AsOf string `json:"as_of"`
+}
+
+// revisionsParam is the parameter for listRevision (for doc only)
+//
+// swagger:parameters listRevision
+type revisionsParam struct {
+	// ID is payment ID
+	//
+	// in:path
+	ID string `json:"id"`
+}
+
+// revisionParam is the parameter for fetchRevision (for doc only)
+//
+// swagger:parameters fetchRevision
+type revisionParam struct {
+	// ID is payment ID
+	//
+	// in:path
+	ID string `json:"id"`
+	// N is the revision number starting from 1
+	//
+	// in:path
+	N int `json:"n"`
 }
 
 // updateParam is the parameter for updatePayment (for doc only)
 //
 // swagger:parameters updatePayment
 type updateParam struct {
-	// ID is payment ID
+	// ID is payment ID, or a new UUID to create a payment with
 	//
 	// in:path
 	ID string `json:"id"`
+	// IfMatch is the ETag of the payment to update
+	//
+	// in:header
+	IfMatch string `json:"If-Match"`
 	// Payment info
 	//
 	// in:body
@@ -59,6 +126,85 @@ type deleteParam struct {
 	//
 	// in:path
 	ID string `json:"id"`
+	// XUser is the user who deletes the payment
+	//
+	// in:header
+	XUser string `json:"X-User"`
+}
+
+// restoreParam is the parameter for restorePayment (for doc only)
+//
+// swagger:parameters restorePayment
+type restoreParam struct {
+	// ID is payment ID
+	//
+	// in:path
+	ID string `json:"id"`
+}
+
+// listParam is the parameter for listPayment (for doc only)
+//
+// swagger:parameters listPayment
+type listParam struct {
+	// Limit is the maximum number of payments in a page (default 100, max 1000)
+	//
+	// in:query
+	Limit int `json:"limit"`
+	// After is the cursor (payment ID) after which the page starts
+	//
+	// in:query
+	After string `json:"after"`
+	// Before is the cursor (payment ID) before which the page ends
+	//
+	// in:query
+	Before string `json:"before"`
+	// Order is the order of payments: asc (default) or desc, i.e. the latest
+	// payments first
+	//
+	// in:query
+	Order string `json:"order"`
+	// Archived lists the archived payments instead of the live ones
+	//
+	// in:query
+	Archived bool `json:"archived"`
+	// IncludeDeleted lists deleted payments as well
+	//
+	// in:query
+	IncludeDeleted bool `json:"include_deleted"`
+}
+
+// eventParam is the parameter for listEvent (for doc only)
+//
+// swagger:parameters listEvent
+type eventParam struct {
+	// Since is the sequence number after which events are returned (default 0)
+	//
+	// in:query
+	Since uint64 `json:"since"`
+}
+
+// RevisionResponse is an envelope for a payment revision response
+//
+// swagger:response RevisionResponse
+type revisionResponseWrapper struct {
+	// in:body
+	Resp expay.RevisionResponse
+}
+
+// EventResponse is an envelope for a payment event response
+//
+// swagger:response EventResponse
+type eventResponseWrapper struct {
+	// in:body
+	Resp expay.EventResponse
+}
+
+// StatsResponse is an envelope for a payment statistics response
+//
+// swagger:response StatsResponse
+type statsResponseWrapper struct {
+	// in:body
+	Resp expay.StatsResponse
 }
 
 // PaymentResponse is an envelope for a payment response
@@ -72,17 +218,119 @@ type paymentResponseWrapper struct {
 // NewService creates a new payment service
 func NewService(db expay.DB) *Service {
 	mux := mux.NewRouter()
-	s := &Service{Handler: mux, db: db}
+	s := &Service{Handler: mux, db: db, now: time.Now}
 
-	mux.Use(service.CommonMiddleware)
+	mux.Use(service.CommonMiddleware, service.ActorMiddleware)
 	mux.NotFoundHandler = service.CommonMiddleware(http.HandlerFunc(s.notFound))
+
+	// swagger:route GET /v1/payments/events listEvent
+	//
+	// List payment events
+	//
+	// This will show the changes (create, update and delete) of payments after
+	// the sequence number since, in the order of their sequence numbers. If
+	// there is no new change, the request waits for one until it times out with
+	// an empty list. Use the next link to poll for further events.
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Produces:
+	//     - application/json
+	//
+	//     Schemes: http, https
+	//
+	//     Responses:
+	//       200: EventResponse
+	//       400: ErrorResponse
+	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
+	mux.HandleFunc(urlPrefix+"/events", s.listEvent).Methods("GET")
+
+	// swagger:route GET /v1/payments/stats getStats
+	//
+	// Get payment statistics
+	//
+	// This will show the number of payments and the sums of their amounts by
+	// currency, in total and grouped by currency and by organisation. Deleted
+	// payments are excluded. The statistics are maintained on writes, so they
+	// are read without scanning the payments.
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Produces:
+	//     - application/json
+	//
+	//     Schemes: http, https
+	//
+	//     Responses:
+	//       200: StatsResponse
+	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
+	mux.HandleFunc(urlPrefix+"/stats", s.getStats).Methods("GET")
 	mux.HandleFunc(urlPrefix+"/{id}", s.getPayment).Methods("GET")
 
+	// swagger:route GET /v1/payments/{id}/revisions listRevision
+	//
+	// List payment revisions
+	//
+	// This will show every revision of the payment with the ID in ascending
+	// order, with the time and the user (X-User header) of each write
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Produces:
+	//     - application/json
+	//
+	//     Schemes: http, https
+	//
+	//     Responses:
+	//       200: RevisionResponse
+	//       404: ErrorResponse
+	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
+	mux.HandleFunc(urlPrefix+"/{id}/revisions", s.listRevision).Methods("GET")
+
+	// swagger:route GET /v1/payments/{id}/revisions/{n} fetchRevision
+	//
+	// Fetch payment revision
+	//
+	// This will show revision n of the payment with the ID
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Produces:
+	//     - application/json
+	//
+	//     Schemes: http, https
+	//
+	//     Responses:
+	//       200: RevisionResponse
+	//       400: ErrorResponse
+	//       404: ErrorResponse
+	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
+	mux.HandleFunc(urlPrefix+"/{id}/revisions/{n}", s.getRevision).Methods("GET")
+
 	// swagger:route GET /v1/payments listPayment
 	//
 	// List payments
 	//
-	// This will show all available payments
+	// This will show available payments page by page, in the order of their IDs
+	// (ascending by default or descending with order=desc). Use the links in the
+	// response to walk through the pages. Archived payments are only listed with
+	// archived=true, which lists them instead of the live ones.
 	//
 	//     Consumes:
 	//     - application/json
@@ -94,14 +342,23 @@ func NewService(db expay.DB) *Service {
 	//
 	//     Responses:
 	//       200: PaymentResponse
+	//       400: ErrorResponse
 	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
 	mux.HandleFunc(urlPrefix, s.listPayment).Methods("GET")
 
 	// swagger:route PUT /v1/payments/{id} updatePayment
 	//
 	// Update payment
 	//
-	// This will update the payment with the ID
+	// This will update the payment with the ID. The update is rejected if the
+	// payment has been modified since it was read, i.e. If-Match header does not
+	// match its ETag (412) or the version in the body does not match (409), or
+	// if the payment has been archived (409).
+	// If the ID is a UUID (in lowercase) that does not exist, the payment is
+	// created with the ID instead (201), unless If-Match is given (412).
 	//
 	//     Consumes:
 	//     - application/json
@@ -113,15 +370,25 @@ func NewService(db expay.DB) *Service {
 	//
 	//     Responses:
 	//       200: PaymentResponse
+	//       201: PaymentResponse
 	//       400: ErrorResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       412: ErrorResponse
 	//       500: ErrorResponse
+	//       501: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
 	mux.HandleFunc(urlPrefix+"/{id}", s.updatePayment).Methods("PUT")
 
 	// swagger:route DELETE /v1/payments/{id} deletePayment
 	//
 	// Delete payment
 	//
-	// This will delete the payment with the ID
+	// This will delete the payment with the ID. The payment is kept as a
+	// tombstone, which is hidden unless include_deleted is true, until it is
+	// purged after the retention period. An archived payment cannot be
+	// deleted (409).
 	//
 	//     Consumes:
 	//     - application/json
@@ -133,9 +400,36 @@ func NewService(db expay.DB) *Service {
 	//
 	//     Responses:
 	//       200: PaymentResponse
+	//       409: ErrorResponse
 	//       500: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
 	mux.HandleFunc(urlPrefix+"/{id}", s.deletePayment).Methods("DELETE")
 
+	// swagger:route POST /v1/payments/{id}/restore restorePayment
+	//
+	// Restore payment
+	//
+	// This will restore a deleted payment with the ID if it has not been
+	// purged yet, an archived payment cannot be restored (409)
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Produces:
+	//     - application/json
+	//
+	//     Schemes: http, https
+	//
+	//     Responses:
+	//       200: PaymentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       500: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
+	mux.HandleFunc(urlPrefix+"/{id}/restore", s.restorePayment).Methods("POST")
+
 	// swagger:route POST /v1/payments createPayment
 	//
 	// Create payment
@@ -154,6 +448,8 @@ func NewService(db expay.DB) *Service {
 	//       201: PaymentResponse
 	//       400: ErrorResponse
 	//       500: ErrorResponse
+	//       503: ErrorResponse
+	//       504: ErrorResponse
 	mux.HandleFunc(urlPrefix, s.createPayment).Methods("POST")
 
 	return s
@@ -164,21 +460,66 @@ func (s *Service) notFound(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *Service) getPayment(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	id := vars["id"]
+	id, ok := pathID(w, req)
+	if !ok {
+		return
+	}
 	pay := expay.Payment{}
-	if err := s.db.Get(id, &pay); err != nil {
-		if err == expay.ErrNotFound {
-			service.Error(w, err.Error(), http.StatusNotFound)
+	if asOf := req.URL.Query().Get("as_of"); asOf != "" {
+		t, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			service.Error(w, "invalid as_of", http.StatusBadRequest)
+			return
+		}
+		var historian expay.Historian
+		if !expay.As(s.db, &historian) {
+			service.Error(w, "history is not supported by the storage", http.StatusNotImplemented)
+			return
+		}
+		if _, err := historian.GetAsOf(req.Context(), id, t, &pay); err != nil {
+			service.WriteError(w, err)
 			return
 		}
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if err := s.get(req.Context(), id, &pay); err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	if pay.Deleted() && !includeDeleted(req) {
+		service.WriteError(w, expay.ErrNotFound)
 		return
 	}
 	pay.ID = id
+	setETag(w, pay.Version)
 	_ = json.NewEncoder(w).Encode(&expay.PaymentResponse{Data: []expay.Payment{pay}})
 }
 
+// get reads the payment of id, or the archived payment if it has been archived
+func (s *Service) get(ctx context.Context, id string, pay *expay.Payment) error {
+	err := s.db.Get(ctx, id, pay)
+	var archiver expay.Archiver
+	if err != expay.ErrNotFound || !expay.As(s.db, &archiver) {
+		return err
+	}
+	if err := archiver.GetArchived(ctx, id, pay); err != nil {
+		return err
+	}
+	pay.Archived = true
+	return nil
+}
+
+// checkArchived returns expay.ErrArchived if err is expay.ErrNotFound but id
+// has been archived, as an archived payment is read-only, or err otherwise
+func (s *Service) checkArchived(ctx context.Context, id string, err error) error {
+	var archiver expay.Archiver
+	if err != expay.ErrNotFound || !expay.As(s.db, &archiver) {
+		return err
+	}
+	if archiver.GetArchived(ctx, id, &expay.Payment{}) == nil {
+		return expay.ErrArchived
+	}
+	return err
+}
+
 func (s *Service) createPayment(w http.ResponseWriter, req *http.Request) {
 	pay := expay.Payment{}
 	if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
@@ -186,32 +527,31 @@ func (s *Service) createPayment(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if err := pay.Verify(); err != nil {
-		service.Error(w, err.Error(), http.StatusBadRequest)
+		service.WriteError(w, err)
 		return
 	}
-	id, err := s.db.Create(pay)
+	pay.Version = 0
+	pay.DeletedAt, pay.DeletedBy = nil, ""
+	pay.Archived = false
+	id, err := s.db.Create(req.Context(), pay)
 	if err != nil {
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+		service.WriteError(w, err)
 		return
 	}
 	w.Header().Set("Location", urlPrefix+"/"+id)
+	setETag(w, pay.Version)
 	w.WriteHeader(http.StatusCreated)
 	pay.ID = id
 	_ = json.NewEncoder(w).Encode(&expay.PaymentResponse{Data: []expay.Payment{pay}})
 }
 
+// updatePayment replaces the payment with the ID, or creates it if the ID is a
+// UUID that does not exist
 func (s *Service) updatePayment(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	id := vars["id"]
-	if err := s.db.Get(id, &expay.Payment{}); err != nil {
-		if err == expay.ErrNotFound {
-			service.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+	id, ok := pathID(w, req)
+	if !ok {
 		return
 	}
-
 	pay := expay.Payment{}
 	if err := json.NewDecoder(req.Body).Decode(&pay); err != nil {
 		service.Error(w, err.Error(), http.StatusBadRequest)
@@ -219,52 +559,458 @@ func (s *Service) updatePayment(w http.ResponseWriter, req *http.Request) {
 	}
 	pay.ID = id
 	if err := pay.Verify(); err != nil {
-		service.Error(w, err.Error(), http.StatusBadRequest)
+		service.WriteError(w, err)
 		return
 	}
-	if err := s.db.Update(id, pay); err != nil {
-		service.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	pay.DeletedAt, pay.DeletedBy = nil, ""
+	pay.Archived = false
+
+	ifMatch := req.Header.Get("If-Match")
+	version := pay.Version
+	created := false
+	var creator expay.IDCreator
+	for {
+		stored := expay.Payment{}
+		err := s.db.UpdateFunc(req.Context(), id, &stored, func() error {
+			if stored.Deleted() {
+				return errDeleted
+			}
+			if ifMatch != "" {
+				if !matchETag(ifMatch, stored.Version) {
+					return errPreconditionFailed
+				}
+			} else if version != stored.Version {
+				return expay.ErrVersionMismatch
+			}
+			pay.Version = stored.Version + 1
+			stored = pay
+			return nil
+		})
+		err = s.checkArchived(req.Context(), id, err)
+		if (err == expay.ErrNotFound || err == expay.ErrInvalidID) && expay.IsUUID(id) {
+			if ifMatch != "" {
+				// If-Match requires an existing payment
+				err = errPreconditionFailed
+			} else if !expay.As(s.db, &creator) {
+				service.Error(w, "client ids are not supported by the storage", http.StatusNotImplemented)
+				return
+			} else {
+				pay.Version = 0
+				err = creator.CreateWithID(req.Context(), id, pay)
+				if err == expay.ErrAlreadyExists {
+					// created by another request, so update it instead
+					continue
+				}
+				created = err == nil
+			}
+		}
+		if err == errPreconditionFailed {
+			service.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err == errDeleted {
+			service.WriteError(w, expay.ErrNotFound)
+			return
+		} else if err != nil {
+			service.WriteError(w, err)
+			return
+		}
+		break
+	}
+	setETag(w, pay.Version)
+	if created {
+		w.Header().Set("Location", urlPrefix+"/"+id)
+		w.WriteHeader(http.StatusCreated)
 	}
 	_ = json.NewEncoder(w).Encode(&expay.PaymentResponse{Data: []expay.Payment{pay}})
 }
 
+func (s *Service) listRevision(w http.ResponseWriter, req *http.Request) {
+	var historian expay.Historian
+	if !expay.As(s.db, &historian) {
+		service.Error(w, "history is not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	id, ok := pathID(w, req)
+	if !ok {
+		return
+	}
+	revs, err := historian.Revisions(req.Context(), id)
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	payRevs := []expay.PaymentRevision{}
+	for _, rev := range revs {
+		payRev := expay.PaymentRevision{}
+		if _, err := historian.GetRevision(req.Context(), id, rev.N, &payRev.Payment); err != nil {
+			service.WriteError(w, err)
+			return
+		}
+		payRev.Revision = rev
+		payRev.Payment.ID = id
+		payRevs = append(payRevs, payRev)
+	}
+	_ = json.NewEncoder(w).Encode(&expay.RevisionResponse{
+		Data:  payRevs,
+		Links: &expay.Links{Self: req.URL.RequestURI()},
+	})
+}
+
+func (s *Service) getRevision(w http.ResponseWriter, req *http.Request) {
+	var historian expay.Historian
+	if !expay.As(s.db, &historian) {
+		service.Error(w, "history is not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	id, ok := pathID(w, req)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(mux.Vars(req)["n"])
+	if err != nil || n <= 0 {
+		service.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	payRev := expay.PaymentRevision{}
+	rev, err := historian.GetRevision(req.Context(), id, n, &payRev.Payment)
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	payRev.Revision = *rev
+	payRev.Payment.ID = id
+	_ = json.NewEncoder(w).Encode(&expay.RevisionResponse{Data: []expay.PaymentRevision{payRev}})
+}
+
+// deletePayment replaces the payment with a tombstone, deleting a missing or
+// deleted payment does nothing but an archived one is rejected
 func (s *Service) deletePayment(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	id := vars["id"]
-	if err := s.db.Delete(id); err != nil {
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+	id, ok := pathID(w, req)
+	if !ok {
+		return
+	}
+	stored := expay.Payment{}
+	err := s.db.UpdateFunc(req.Context(), id, &stored, func() error {
+		if stored.Deleted() {
+			return errUnchanged
+		}
+		now := s.now().UTC()
+		stored.DeletedAt, stored.DeletedBy = &now, expay.Actor(req.Context())
+		stored.Version++
+		return nil
+	})
+	err = s.checkArchived(req.Context(), id, err)
+	if err != nil && err != errUnchanged && err != expay.ErrNotFound {
+		service.WriteError(w, err)
 		return
 	}
 	_ = json.NewEncoder(w).Encode(&expay.PaymentResponse{})
 }
 
+// restorePayment turns a tombstone back into a payment, restoring a payment
+// that is not deleted does nothing
+func (s *Service) restorePayment(w http.ResponseWriter, req *http.Request) {
+	id, ok := pathID(w, req)
+	if !ok {
+		return
+	}
+	pay := expay.Payment{}
+	err := s.db.UpdateFunc(req.Context(), id, &pay, func() error {
+		if !pay.Deleted() {
+			return errUnchanged
+		}
+		pay.DeletedAt, pay.DeletedBy = nil, ""
+		pay.Version++
+		return nil
+	})
+	err = s.checkArchived(req.Context(), id, err)
+	if err != nil && err != errUnchanged {
+		service.WriteError(w, err)
+		return
+	}
+	pay.ID = id
+	setETag(w, pay.Version)
+	_ = json.NewEncoder(w).Encode(&expay.PaymentResponse{Data: []expay.Payment{pay}})
+}
+
 func (s *Service) listPayment(w http.ResponseWriter, req *http.Request) {
-	iter, err := s.db.List()
+	query := req.URL.Query()
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageSize {
+			service.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	after, before := query.Get("after"), query.Get("before")
+	if after != "" && before != "" {
+		service.Error(w, "after and before cannot be used together", http.StatusBadRequest)
+		return
+	}
+	if after != "" && !expay.ValidID(after) || before != "" && !expay.ValidID(before) {
+		service.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+	l := listing{limit: limit, withDeleted: includeDeleted(req)}
+	l.archived, _ = strconv.ParseBool(query.Get("archived"))
+	page := s.db.Paginate
+	if l.archived {
+		var archiver expay.Archiver
+		if !expay.As(s.db, &archiver) {
+			service.Error(w, "archive is not supported by the storage", http.StatusNotImplemented)
+			return
+		}
+		page = archiver.PaginateArchived
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		if l.archived {
+			page, l.desc = reversePage(page), true
+			break
+		}
+		var ranger expay.Ranger
+		if !expay.As(s.db, &ranger) {
+			service.Error(w, "descending order is not supported by the storage", http.StatusNotImplemented)
+			return
+		}
+		page, l.desc = descPage(ranger), true
+	default:
+		service.Error(w, "invalid order", http.StatusBadRequest)
+		return
+	}
+
+	// read one more payment to find out if there are more pages
+	var (
+		payments []expay.Payment
+		err      error
+	)
+	if before != "" {
+		payments, err = readPage(req.Context(), page, before, -(limit + 1), l.withDeleted)
+	} else {
+		payments, err = readPage(req.Context(), page, after, limit+1, l.withDeleted)
+	}
 	if err != nil {
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+		service.WriteError(w, err)
 		return
 	}
-	payments := []expay.Payment{}
-	for iter.Next() {
-		payment := expay.Payment{}
-		id, err := iter.Scan(&payment)
+	hasMore := len(payments) > limit
+	if hasMore {
+		payments = payments[:limit]
+	}
+	if before != "" {
+		// backward pages are read in the reverse order
+		for i, j := 0, len(payments)-1; i < j; i, j = i+1, j-1 {
+			payments[i], payments[j] = payments[j], payments[i]
+		}
+	}
+	for i := range payments {
+		payments[i].Archived = l.archived
+	}
+
+	links := &expay.Links{
+		Self:  req.URL.RequestURI(),
+		First: l.link("", ""),
+	}
+	if n := len(payments); n > 0 {
+		if hasMore || before != "" {
+			links.Next = l.link("after", payments[n-1].ID)
+		}
+		if after != "" || (before != "" && hasMore) {
+			links.Prev = l.link("before", payments[0].ID)
+		}
+	}
+	paymentResponse := &expay.PaymentResponse{
+		Data:  payments,
+		Links: links,
+	}
+	_ = json.NewEncoder(w).Encode(paymentResponse)
+}
+
+func (s *Service) listEvent(w http.ResponseWriter, req *http.Request) {
+	var watcher expay.Watcher
+	if !expay.As(s.db, &watcher) {
+		service.Error(w, "events are not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	var since uint64
+	if v := req.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
 		if err != nil {
-			service.Error(w, err.Error(), http.StatusInternalServerError)
+			service.Error(w, "invalid since", http.StatusBadRequest)
 			return
 		}
-		payment.ID = id
-		payments = append(payments, payment)
+		since = n
 	}
-	if err := iter.Close(); err != nil {
-		service.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(req.Context(), pollTimeout)
+	defer cancel()
+	changes, err := watcher.Watch(ctx, since)
+	if err == context.DeadlineExceeded && req.Context().Err() == nil {
+		// no new event within pollTimeout
+		changes, err = []expay.Change{}, nil
+	}
+	if err != nil {
+		service.WriteError(w, err)
 		return
 	}
-	paymentResponse := &expay.PaymentResponse{
-		Data: payments,
+	if n := len(changes); n > 0 {
+		since = changes[n-1].Seq
+	}
+	_ = json.NewEncoder(w).Encode(&expay.EventResponse{
+		Data: changes,
 		Links: &expay.Links{
-			Self: "/v1/payments",
+			Self: req.URL.RequestURI(),
+			Next: urlPrefix + "/events?since=" + strconv.FormatUint(since, 10),
 		},
+	})
+}
+
+// listing is the query of a payment listing kept in its page links
+type listing struct {
+	limit                       int
+	desc, archived, withDeleted bool
+}
+
+// pageFunc returns an iterator of at most |limit| payments after (or before if
+// limit is negative) the cursor in the order of a listing, see expay.DB
+// Paginate, a page may start from the cursor itself
+type pageFunc func(ctx context.Context, cursor string, limit int) (expay.Iter, error)
+
+// descPage returns the pageFunc of the listing in descending order by r
+func descPage(r expay.Ranger) pageFunc {
+	return func(ctx context.Context, cursor string, limit int) (expay.Iter, error) {
+		if limit >= 0 {
+			return r.Range(ctx, expay.Range{End: cursor, Desc: true, Limit: limit})
+		}
+		// the start of a range is inclusive, so one more payment is read in
+		// case it is the cursor
+		return r.Range(ctx, expay.Range{Start: cursor, Limit: -limit + 1})
 	}
-	_ = json.NewEncoder(w).Encode(paymentResponse)
+}
+
+// reversePage returns the pageFunc of the listing by page in the reverse order
+func reversePage(page pageFunc) pageFunc {
+	return func(ctx context.Context, cursor string, limit int) (expay.Iter, error) {
+		return page(ctx, cursor, -limit)
+	}
+}
+
+func (s *Service) getStats(w http.ResponseWriter, req *http.Request) {
+	var aggregator expay.Aggregator
+	if !expay.As(s.db, &aggregator) {
+		service.Error(w, "stats are not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	stats, err := aggregator.Stats(req.Context())
+	if err != nil {
+		service.WriteError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&expay.StatsResponse{
+		Data:  stats,
+		Links: &expay.Links{Self: req.URL.RequestURI()},
+	})
+}
+
+// readPage reads at most |limit| payments after (or before if limit is
+// negative) the cursor by page, skipping tombstones unless withDeleted is true
+func readPage(ctx context.Context, page pageFunc, cursor string, limit int, withDeleted bool) ([]expay.Payment, error) {
+	n := limit
+	if n < 0 {
+		n = -n
+	}
+	payments := []expay.Payment{}
+	for len(payments) < n {
+		want := n - len(payments)
+		pageLimit := want
+		if limit < 0 {
+			pageLimit = -want
+		}
+		iter, err := page(ctx, cursor, pageLimit)
+		if err != nil {
+			return nil, err
+		}
+		scanned := 0
+		for len(payments) < n && iter.Next() {
+			payment := expay.Payment{}
+			id, err := iter.Scan(&payment)
+			if err != nil {
+				_ = iter.Close()
+				return nil, err
+			}
+			if id == cursor {
+				continue
+			}
+			scanned++
+			cursor = id
+			if payment.Deleted() && !withDeleted {
+				continue
+			}
+			payment.ID = id
+			payments = append(payments, payment)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		if scanned < want {
+			// no more payments
+			break
+		}
+	}
+	return payments, nil
+}
+
+// link returns the link to a page of the listing starting from the cursor
+func (l listing) link(direction, cursor string) string {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(l.limit))
+	if direction != "" {
+		query.Set(direction, cursor)
+	}
+	if l.desc {
+		query.Set("order", "desc")
+	}
+	if l.archived {
+		query.Set("archived", "true")
+	}
+	if l.withDeleted {
+		query.Set("include_deleted", "true")
+	}
+	return urlPrefix + "?" + query.Encode()
+}
+
+// pathID returns the payment ID in the URL path, or replies to the request with
+// an error if it is invalid
+func pathID(w http.ResponseWriter, req *http.Request) (string, bool) {
+	id := mux.Vars(req)["id"]
+	if !expay.ValidID(id) {
+		service.WriteError(w, expay.ErrInvalidID)
+		return "", false
+	}
+	return id, true
+}
+
+// includeDeleted returns if deleted payments are requested
+func includeDeleted(req *http.Request) bool {
+	v, _ := strconv.ParseBool(req.URL.Query().Get("include_deleted"))
+	return v
+}
+
+// setETag sets the ETag header of a payment response from the payment version
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", `"`+strconv.Itoa(version)+`"`)
+}
+
+// matchETag returns if the If-Match header matches the payment version
+func matchETag(ifMatch string, version int) bool {
+	etag := `"` + strconv.Itoa(version) + `"`
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
 }
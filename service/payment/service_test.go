@@ -1,15 +1,19 @@
 package payment
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"h12.io/expay"
+	"h12.io/expay/db/memdb"
 	"h12.io/expay/testdata"
 )
 
@@ -19,7 +23,9 @@ func TestPaymentService(t *testing.T) {
 	getReq := func(id string) func(string) *http.Request {
 		return func(baseURL string) *http.Request {
 			uri := baseURL + urlPrefix
-			if id != "" {
+			if strings.HasPrefix(id, "?") {
+				uri += id
+			} else if id != "" {
 				uri += "/" + id
 			}
 			req, _ := http.NewRequest(http.MethodGet, uri, nil)
@@ -41,6 +47,13 @@ func TestPaymentService(t *testing.T) {
 		}
 	}
 
+	restoreReq := func(id string) func(string) *http.Request {
+		return func(baseURL string) *http.Request {
+			req, _ := http.NewRequest(http.MethodPost, baseURL+urlPrefix+"/"+id+"/restore", nil)
+			return req
+		}
+	}
+
 	deleteReq := func(id string) func(string) *http.Request {
 		return func(baseURL string) *http.Request {
 			uri := baseURL + urlPrefix + "/" + id
@@ -82,7 +95,7 @@ func TestPaymentService(t *testing.T) {
 
 		{
 			name: "fetch payment _ 404 not found",
-			req:  getReq("nonexisted-id"),
+			req:  getReq(testID(1)),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusNotFound)
 			},
@@ -100,15 +113,21 @@ func TestPaymentService(t *testing.T) {
 			},
 		},
 		{
-			name: "fetch payment _ 200 ok",
-			req:  getReq("1"),
+			name: "fetch payment _ deadline exceeded _ 504 gateway timeout",
+			req:  getReq("id"),
 			db: func() expay.DB {
 				db := newFakeDB()
-				pay := &expay.Payment{}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
+				db.getErr = context.DeadlineExceeded
 				return db
 			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusGatewayTimeout)
+			},
+		},
+		{
+			name: "fetch payment _ 200 ok",
+			req:  getReq(testID(1)),
+			db:   memdbWithTestPayment(testID(1), 0),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusOK)
 				respPay := &expay.PaymentResponse{}
@@ -118,7 +137,7 @@ func TestPaymentService(t *testing.T) {
 				if n := len(respPay.Data); n != 1 {
 					t.Fatalf("expect 1 payment returned but got %d", n)
 				}
-				wantPay := expay.Payment{ID: "1"}
+				wantPay := expay.Payment{ID: testID(1)}
 				_ = json.Unmarshal([]byte(testdata.Payment), &wantPay)
 				if !reflect.DeepEqual(respPay.Data[0], wantPay) {
 					t.Fatalf("expect %+v got %v", wantPay, respPay)
@@ -152,6 +171,30 @@ func TestPaymentService(t *testing.T) {
 				verifyCode(t, resp, http.StatusInternalServerError)
 			},
 		},
+		{
+			name: "create payment _ storage unavailable _ 503 service unavailable",
+			req:  postReq(testdata.Payment),
+			db: func() expay.DB {
+				db := newFakeDB()
+				db.createErr = &expay.Error{Code: expay.CodeUnavailable, Message: "storage unavailable", Err: errors.New("injected db error")}
+				return db
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "create payment _ quota exceeded _ 507 insufficient storage",
+			req:  postReq(testdata.Payment),
+			db: func() expay.DB {
+				db := newFakeDB()
+				db.createErr = expay.ErrQuotaExceeded
+				return db
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusInsufficientStorage)
+			},
+		},
 		{
 			name: "create payment _ 201 created",
 			req:  postReq(testdata.Payment),
@@ -187,7 +230,7 @@ func TestPaymentService(t *testing.T) {
 				}
 
 				dbPay := expay.Payment{}
-				if err := s.db.Get(id, &dbPay); err != nil {
+				if err := s.db.Get(context.Background(), id, &dbPay); err != nil {
 					t.Fatal(err)
 				}
 				dbPay.ID = id
@@ -197,37 +240,58 @@ func TestPaymentService(t *testing.T) {
 			},
 		},
 
+		{
+			name: "create payment _ archived flag not stored _ 201 created",
+			req:  postReq(strings.Replace(testdata.Payment, `"type"`, `"archived": true, "type"`, 1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusCreated)
+				respPay := &expay.PaymentResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(respPay); err != nil {
+					t.Fatal(err)
+				}
+				dbPay := expay.Payment{}
+				if err := s.db.Get(context.Background(), respPay.Data[0].ID, &dbPay); err != nil {
+					t.Fatal(err)
+				}
+				if respPay.Data[0].Archived || dbPay.Archived {
+					t.Fatalf("expect a live payment got %+v", dbPay)
+				}
+			},
+		},
+		{
+			name: "update payment _ archived flag not stored _ 200 ok",
+			req:  putReq(testID(1), strings.Replace(testdata.Payment, `"type"`, `"archived": true, "type"`, 1)),
+			db:   memdbWithTestPayment(testID(1), 0),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				dbPay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testID(1), &dbPay); err != nil {
+					t.Fatal(err)
+				}
+				if dbPay.Archived {
+					t.Fatalf("expect a live payment got %+v", dbPay)
+				}
+			},
+		},
 		{
 			name: "update payment _ 404 not found",
-			req:  putReq("nonexisted-id", testdata.Payment),
+			req:  putReq(testID(1), testdata.Payment),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusNotFound)
 			},
 		},
 		{
 			name: "update payment _ 400 invalid request of empty body",
-			db: func() expay.DB {
-				db := newFakeDB()
-				pay := &expay.Payment{ID: "1"}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
-				return db
-			},
-			req: putReq("1", ""),
+			db:   memdbWithTestPayment(testID(1), 0),
+			req:  putReq(testID(1), ""),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusBadRequest)
 			},
 		},
 		{
 			name: "update payment _ 400 missing field",
-			db: func() expay.DB {
-				db := newFakeDB()
-				pay := &expay.Payment{ID: "1"}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
-				return db
-			},
-			req: putReq("1", "{}"),
+			db:   memdbWithTestPayment(testID(1), 0),
+			req:  putReq(testID(1), "{}"),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusBadRequest)
 			},
@@ -248,38 +312,181 @@ func TestPaymentService(t *testing.T) {
 			name: "update payment _ update error _ 500 internal error",
 			db: func() expay.DB {
 				db := newFakeDB()
-				pay := &expay.Payment{ID: "1"}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
+				seedTestPayment(db, testID(1), 0)
 				db.updateErr = errors.New("injected error")
 				return db
 			},
-			req: putReq("1", testdata.Payment),
+			req: putReq(testID(1), testdata.Payment),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusInternalServerError)
 			},
 		},
 		{
 			name: "update payment _ 200 ok",
-			req:  putReq("1", testdata.Payment2),
-			db: func() expay.DB {
-				db := newFakeDB()
-				pay := &expay.Payment{ID: "1"}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
-				return db
-			},
+			req:  putReq(testID(1), testdata.Payment2),
+			db:   memdbWithTestPayment(testID(1), 0),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusOK)
 				dbPay := &expay.Payment{}
-				if err := s.db.Get("1", dbPay); err != nil {
+				if err := s.db.Get(context.Background(), testID(1), dbPay); err != nil {
 					t.Fatal(err)
 				}
-				wantPay := &expay.Payment{ID: "1"}
+				wantPay := &expay.Payment{ID: testID(1)}
 				_ = json.Unmarshal([]byte(testdata.Payment2), wantPay)
+				wantPay.Version = 1
 				if !reflect.DeepEqual(dbPay, wantPay) {
 					t.Fatalf("expect %+v got %v", wantPay, dbPay)
 				}
+				if etag := resp.Header.Get("ETag"); etag != `"1"` {
+					t.Fatalf("expect ETag %s got %s", `"1"`, etag)
+				}
+			},
+		},
+		{
+			name: "update payment _ version mismatch _ 409 conflict",
+			req:  putReq(testID(1), testdata.Payment2),
+			db:   memdbWithTestPayment(testID(1), 3),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusConflict)
+				dbPay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testID(1), &dbPay); err != nil {
+					t.Fatal(err)
+				}
+				if dbPay.Version != 3 {
+					t.Fatalf("expect version %d got %d", 3, dbPay.Version)
+				}
+			},
+		},
+		{
+			name: "update payment _ If-Match mismatch _ 412 precondition failed",
+			req: func(baseURL string) *http.Request {
+				req := putReq(testID(1), testdata.Payment2)(baseURL)
+				req.Header.Set("If-Match", `"2"`)
+				return req
+			},
+			db: memdbWithTestPayment(testID(1), 3),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusPreconditionFailed)
+			},
+		},
+		{
+			name: "update payment _ If-Match matched _ 200 ok",
+			req: func(baseURL string) *http.Request {
+				req := putReq(testID(1), testdata.Payment2)(baseURL)
+				req.Header.Set("If-Match", `"3"`)
+				return req
+			},
+			db: memdbWithTestPayment(testID(1), 3),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				if etag := resp.Header.Get("ETag"); etag != `"4"` {
+					t.Fatalf("expect ETag %s got %s", `"4"`, etag)
+				}
+			},
+		},
+
+		{
+			name: "update payment _ new UUID _ 201 created",
+			req:  putReq(testUUID, testdata.Payment),
+			db: func() expay.DB {
+				return memdb.New()
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusCreated)
+				if location := resp.Header.Get("Location"); location != urlPrefix+"/"+testUUID {
+					t.Fatalf("expect location %s got %s", urlPrefix+"/"+testUUID, location)
+				}
+				if etag := resp.Header.Get("ETag"); etag != `"0"` {
+					t.Fatalf("expect ETag %s got %s", `"0"`, etag)
+				}
+				dbPay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testUUID, &dbPay); err != nil {
+					t.Fatal(err)
+				}
+				if dbPay.ID != testUUID || dbPay.Version != 0 {
+					t.Fatalf("expect payment %s of version 0 got %s of version %d", testUUID, dbPay.ID, dbPay.Version)
+				}
+			},
+		},
+		{
+			name: "update payment _ UUID created concurrently _ 200 ok",
+			req:  putReq(testUUID, testdata.Payment),
+			db: func() expay.DB {
+				return &fakeIDCreator{DB: memdb.New()}
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				if etag := resp.Header.Get("ETag"); etag != `"1"` {
+					t.Fatalf("expect ETag %s got %s", `"1"`, etag)
+				}
+			},
+		},
+		{
+			name: "update payment _ existing UUID _ 200 ok",
+			req:  putReq(testUUID, testdata.Payment2),
+			db:   memdbWithTestPayment(testUUID, 0),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+			},
+		},
+		{
+			name: "update payment _ new UUID with If-Match _ 412 precondition failed",
+			req: func(baseURL string) *http.Request {
+				req := putReq(testUUID, testdata.Payment)(baseURL)
+				req.Header.Set("If-Match", "*")
+				return req
+			},
+			db: func() expay.DB {
+				return memdb.New()
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusPreconditionFailed)
+			},
+		},
+		{
+			name: "update payment _ new UUID not supported _ 501 not implemented",
+			req:  putReq(testUUID, testdata.Payment),
+			db: func() expay.DB {
+				return newFakeDB()
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "update payment _ deleted UUID _ 404 not found",
+			req:  putReq(testUUID, testdata.Payment),
+			db:   memdbWith(nil, testUUID),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "update payment _ invalid id _ 400 bad request",
+			req:  putReq("a.b", testdata.Payment),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "fetch payment _ invalid id _ 400 bad request",
+			req:  getReq(strings.Repeat("a", 65)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "fetch payment _ id rejected by the storage _ 400 bad request",
+			req:  getReq("1"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "list payment _ invalid cursor _ 400 bad request",
+			req:  getReq("?after=a%2Fb"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
 			},
 		},
 
@@ -288,7 +495,7 @@ func TestPaymentService(t *testing.T) {
 			req:  deleteReq("id"),
 			db: func() expay.DB {
 				db := newFakeDB()
-				db.deleteErr = errors.New("injected error")
+				db.updateErr = errors.New("injected error")
 				return db
 			},
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
@@ -297,29 +504,121 @@ func TestPaymentService(t *testing.T) {
 		},
 		{
 			name: "delete payment _ 200 ok",
-			req:  deleteReq("1"),
-			db: func() expay.DB {
-				db := newFakeDB()
-				pay := &expay.Payment{}
-				_ = json.Unmarshal([]byte(testdata.Payment), pay)
-				db.m["1"] = pay
-				return db
+			req: func(baseURL string) *http.Request {
+				req := deleteReq(testID(1))(baseURL)
+				req.Header.Set("X-User", "alice")
+				return req
 			},
+			db: memdbWithTestPayment(testID(1), 0),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusOK)
 
-				if err := s.db.Get("1", &expay.Payment{}); err != expay.ErrNotFound {
-					t.Fatalf("expect error %v got %v", expay.ErrNotFound, err)
+				// kept as a tombstone
+				pay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testID(1), &pay); err != nil {
+					t.Fatal(err)
+				}
+				if !pay.Deleted() || pay.DeletedBy != "alice" || pay.Version != 1 {
+					t.Fatalf("expect a tombstone deleted by alice got %+v", pay)
+				}
+			},
+		},
+		{
+			name: "delete payment _ missing _ 200 ok",
+			req:  deleteReq(testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+			},
+		},
+		{
+			name: "delete payment _ deleted _ 200 ok",
+			req:  deleteReq(testID(1)),
+			db:   memdbWith(nil, testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				pay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testID(1), &pay); err != nil {
+					t.Fatal(err)
+				}
+				if !pay.DeletedAt.Equal(testDeletedAt) || pay.Version != 0 {
+					t.Fatalf("expect an unchanged tombstone got %+v", pay)
+				}
+			},
+		},
+		{
+			name: "fetch payment _ deleted _ 404 not found",
+			req:  getReq(testID(1)),
+			db:   memdbWith(nil, testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "fetch payment _ deleted with include_deleted _ 200 ok",
+			req:  getReq(testID(1) + "?include_deleted=true"),
+			db:   memdbWith(nil, testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				payResp := &expay.PaymentResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(payResp); err != nil {
+					t.Fatal(err)
+				}
+				if len(payResp.Data) != 1 || !payResp.Data[0].Deleted() {
+					t.Fatalf("expect a deleted payment got %+v", payResp.Data)
+				}
+			},
+		},
+		{
+			name: "update payment _ deleted _ 404 not found",
+			req:  putReq(testID(1), testdata.Payment),
+			db:   memdbWith(nil, testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "restore payment _ 200 ok",
+			req:  restoreReq(testID(1)),
+			db:   memdbWith(nil, testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				if etag := resp.Header.Get("ETag"); etag != `"1"` {
+					t.Fatalf("expect ETag %s got %s", `"1"`, etag)
+				}
+				pay := expay.Payment{}
+				if err := s.db.Get(context.Background(), testID(1), &pay); err != nil {
+					t.Fatal(err)
+				}
+				if pay.Deleted() || pay.DeletedBy != "" {
+					t.Fatalf("expect a restored payment got %+v", pay)
+				}
+			},
+		},
+		{
+			name: "restore payment _ not deleted _ 200 ok",
+			req:  restoreReq(testID(1)),
+			db:   memdbWith(testIDs(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				if etag := resp.Header.Get("ETag"); etag != `"0"` {
+					t.Fatalf("expect ETag %s got %s", `"0"`, etag)
 				}
 			},
 		},
+		{
+			name: "restore payment _ missing _ 404 not found",
+			req:  restoreReq(testID(1)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
 
 		{
 			name: "list payments _ db error _ 500 internal error",
 			req:  getReq(""),
 			db: func() expay.DB {
 				db := newFakeDB()
-				db.m["1"] = &expay.Payment{}
+				seed(db, testID(1), &expay.Payment{})
 				db.listErr = errors.New("injected error")
 				return db
 			},
@@ -332,7 +631,7 @@ func TestPaymentService(t *testing.T) {
 			req:  getReq(""),
 			db: func() expay.DB {
 				db := newFakeDB()
-				db.m["1"] = &expay.Payment{}
+				seed(db, testID(1), &expay.Payment{})
 				db.iterScanErr = errors.New("injected error")
 				return db
 			},
@@ -345,7 +644,7 @@ func TestPaymentService(t *testing.T) {
 			req:  getReq(""),
 			db: func() expay.DB {
 				db := newFakeDB()
-				db.m["1"] = &expay.Payment{}
+				seed(db, testID(1), &expay.Payment{})
 				db.iterCloseErr = errors.New("injected error")
 				return db
 			},
@@ -354,14 +653,22 @@ func TestPaymentService(t *testing.T) {
 			},
 		},
 		{
-			name: "list payments _ 200 ok",
+			name: "list payments _ db iter canceled _ 503 service unavailable",
 			req:  getReq(""),
 			db: func() expay.DB {
 				db := newFakeDB()
-				db.m["1"] = &expay.Payment{}
-				db.m["2"] = &expay.Payment{}
+				seed(db, testID(1), &expay.Payment{})
+				db.iterCloseErr = context.Canceled
 				return db
 			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "list payments _ 200 ok",
+			req:  getReq(""),
+			db:   memdbWith(testIDs(1, 2)),
 			verify: func(t *testing.T, resp *http.Response, s *Service) {
 				verifyCode(t, resp, http.StatusOK)
 				paymentResp := &expay.PaymentResponse{Data: []expay.Payment{}}
@@ -371,10 +678,11 @@ func TestPaymentService(t *testing.T) {
 
 				wantResp := &expay.PaymentResponse{
 					Data: []expay.Payment{
-						{ID: "1"}, {ID: "2"},
+						{ID: testID(1)}, {ID: testID(2)},
 					},
 					Links: &expay.Links{
-						Self: "/v1/payments",
+						Self:  "/v1/payments",
+						First: "/v1/payments?limit=100",
 					},
 				}
 				if !reflect.DeepEqual(paymentResp, wantResp) {
@@ -382,6 +690,455 @@ func TestPaymentService(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "list payments _ invalid limit _ 400 bad request",
+			req:  getReq("?limit=0"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "list payments _ both after and before _ 400 bad request",
+			req:  getReq("?after=" + testID(1) + "&before=" + testID(3)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "list payments _ first page _ 200 ok",
+			req:  getReq("?limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(1, 2), &expay.Links{
+				Self:  "/v1/payments?limit=2",
+				First: "/v1/payments?limit=2",
+				Next:  "/v1/payments?after=" + testID(2) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ page after cursor _ 200 ok",
+			req:  getReq("?after=" + testID(2) + "&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(3, 4), &expay.Links{
+				Self:  "/v1/payments?after=" + testID(2) + "&limit=2",
+				First: "/v1/payments?limit=2",
+				Prev:  "/v1/payments?before=" + testID(3) + "&limit=2",
+				Next:  "/v1/payments?after=" + testID(4) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ last page _ 200 ok",
+			req:  getReq("?after=" + testID(4) + "&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(5), &expay.Links{
+				Self:  "/v1/payments?after=" + testID(4) + "&limit=2",
+				First: "/v1/payments?limit=2",
+				Prev:  "/v1/payments?before=" + testID(5) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ page before cursor _ 200 ok",
+			req:  getReq("?before=" + testID(5) + "&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(3, 4), &expay.Links{
+				Self:  "/v1/payments?before=" + testID(5) + "&limit=2",
+				First: "/v1/payments?limit=2",
+				Prev:  "/v1/payments?before=" + testID(3) + "&limit=2",
+				Next:  "/v1/payments?after=" + testID(4) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ page before cursor reaching the first _ 200 ok",
+			req:  getReq("?before=" + testID(3) + "&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(1, 2), &expay.Links{
+				Self:  "/v1/payments?before=" + testID(3) + "&limit=2",
+				First: "/v1/payments?limit=2",
+				Next:  "/v1/payments?after=" + testID(2) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ skipping deleted _ 200 ok",
+			req:  getReq("?limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5), testID(2), testID(3)),
+			verify: verifyPage(testIDs(1, 4), &expay.Links{
+				Self:  "/v1/payments?limit=2",
+				First: "/v1/payments?limit=2",
+				Next:  "/v1/payments?after=" + testID(4) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ before cursor skipping deleted _ 200 ok",
+			req:  getReq("?before=" + testID(5) + "&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5), testID(3), testID(4)),
+			verify: verifyPage(testIDs(1, 2), &expay.Links{
+				Self:  "/v1/payments?before=" + testID(5) + "&limit=2",
+				First: "/v1/payments?limit=2",
+				Next:  "/v1/payments?after=" + testID(2) + "&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ include deleted _ 200 ok",
+			req:  getReq("?include_deleted=true&limit=2"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5), testID(2), testID(3)),
+			verify: verifyPage(testIDs(1, 2), &expay.Links{
+				Self:  "/v1/payments?include_deleted=true&limit=2",
+				First: "/v1/payments?include_deleted=true&limit=2",
+				Next:  "/v1/payments?after=" + testID(2) + "&include_deleted=true&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ invalid order _ 400 bad request",
+			req:  getReq("?order=up"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "list payments _ descending not supported _ 501 not implemented",
+			req:  getReq("?order=desc"),
+			db: func() expay.DB {
+				return newFakeDB()
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "list payments _ descending first page _ 200 ok",
+			req:  getReq("?limit=2&order=desc"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(5, 4), &expay.Links{
+				Self:  "/v1/payments?limit=2&order=desc",
+				First: "/v1/payments?limit=2&order=desc",
+				Next:  "/v1/payments?after=" + testID(4) + "&limit=2&order=desc",
+			}),
+		},
+		{
+			name: "list payments _ descending page after cursor _ 200 ok",
+			req:  getReq("?after=" + testID(4) + "&limit=2&order=desc"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(3, 2), &expay.Links{
+				Self:  "/v1/payments?after=" + testID(4) + "&limit=2&order=desc",
+				First: "/v1/payments?limit=2&order=desc",
+				Prev:  "/v1/payments?before=" + testID(3) + "&limit=2&order=desc",
+				Next:  "/v1/payments?after=" + testID(2) + "&limit=2&order=desc",
+			}),
+		},
+		{
+			name: "list payments _ descending last page _ 200 ok",
+			req:  getReq("?after=" + testID(2) + "&limit=2&order=desc"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(1), &expay.Links{
+				Self:  "/v1/payments?after=" + testID(2) + "&limit=2&order=desc",
+				First: "/v1/payments?limit=2&order=desc",
+				Prev:  "/v1/payments?before=" + testID(1) + "&limit=2&order=desc",
+			}),
+		},
+		{
+			name: "list payments _ descending page before cursor _ 200 ok",
+			req:  getReq("?before=" + testID(2) + "&limit=2&order=desc"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5)),
+			verify: verifyPage(testIDs(4, 3), &expay.Links{
+				Self:  "/v1/payments?before=" + testID(2) + "&limit=2&order=desc",
+				First: "/v1/payments?limit=2&order=desc",
+				Prev:  "/v1/payments?before=" + testID(4) + "&limit=2&order=desc",
+				Next:  "/v1/payments?after=" + testID(3) + "&limit=2&order=desc",
+			}),
+		},
+		{
+			name: "list payments _ descending before cursor skipping deleted _ 200 ok",
+			req:  getReq("?before=" + testID(2) + "&limit=2&order=desc"),
+			db:   memdbWith(testIDs(1, 2, 3, 4, 5), testID(3), testID(4)),
+			verify: verifyPage(testIDs(5), &expay.Links{
+				Self:  "/v1/payments?before=" + testID(2) + "&limit=2&order=desc",
+				First: "/v1/payments?limit=2&order=desc",
+				Next:  "/v1/payments?after=" + testID(5) + "&limit=2&order=desc",
+			}),
+		},
+		{
+			name: "fetch payment _ archived _ 200 ok",
+			req:  getReq(testID(2)),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				payResp := &expay.PaymentResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(payResp); err != nil {
+					t.Fatal(err)
+				}
+				if len(payResp.Data) != 1 || payResp.Data[0].ID != testID(2) || !payResp.Data[0].Archived {
+					t.Fatalf("expect archived payment 2 got %+v", payResp.Data)
+				}
+			},
+		},
+		{
+			name: "fetch payment _ neither live nor archived _ 404 not found",
+			req:  getReq(testID(3)),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "update payment _ archived _ 409 conflict",
+			req:  putReq(testID(2), testdata.Payment),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusConflict)
+			},
+		},
+		{
+			name: "delete payment _ archived _ 409 conflict",
+			req:  deleteReq(testID(2)),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusConflict)
+				var pay expay.Payment
+				if err := s.db.(expay.Archiver).GetArchived(context.Background(), testID(2), &pay); err != nil || pay.Deleted() {
+					t.Fatalf("expect the archived payment unchanged got %+v, %v", pay, err)
+				}
+			},
+		},
+		{
+			name: "restore payment _ archived _ 409 conflict",
+			req:  restoreReq(testID(2)),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusConflict)
+			},
+		},
+		{
+			name: "delete payment _ neither live nor archived _ 200 ok",
+			req:  deleteReq(testID(3)),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+			},
+		},
+		{
+			name: "list payments _ archived not supported _ 501 not implemented",
+			req:  getReq("?archived=true"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "list payments _ archived excluded by default _ 200 ok",
+			req:  getReq("?limit=2"),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2, 3, 4)),
+			verify: verifyPage(testIDs(1), &expay.Links{
+				Self:  "/v1/payments?limit=2",
+				First: "/v1/payments?limit=2",
+			}),
+		},
+		{
+			name: "list payments _ archived first page _ 200 ok",
+			req:  getReq("?archived=true&limit=2"),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2, 3, 4)),
+			verify: verifyPage(testIDs(2, 3), &expay.Links{
+				Self:  "/v1/payments?archived=true&limit=2",
+				First: "/v1/payments?archived=true&limit=2",
+				Next:  "/v1/payments?after=" + testID(3) + "&archived=true&limit=2",
+			}),
+		},
+		{
+			name: "list payments _ archived descending page before cursor _ 200 ok",
+			req:  getReq("?archived=true&before=" + testID(2) + "&limit=1&order=desc"),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2, 3, 4)),
+			verify: verifyPage(testIDs(3), &expay.Links{
+				Self:  "/v1/payments?archived=true&before=" + testID(2) + "&limit=1&order=desc",
+				First: "/v1/payments?archived=true&limit=1&order=desc",
+				Prev:  "/v1/payments?archived=true&before=" + testID(3) + "&limit=1&order=desc",
+				Next:  "/v1/payments?after=" + testID(3) + "&archived=true&limit=1&order=desc",
+			}),
+		},
+		{
+			name: "list payments _ archived flag _ 200 ok",
+			req:  getReq("?archived=true&after=" + testID(3) + "&order=desc"),
+			db:   fakeArchiverWith(testIDs(1), testIDs(2, 3, 4)),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				payResp := &expay.PaymentResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(payResp); err != nil {
+					t.Fatal(err)
+				}
+				if len(payResp.Data) != 1 || payResp.Data[0].ID != testID(2) || !payResp.Data[0].Archived {
+					t.Fatalf("expect archived payment 2 got %+v", payResp.Data)
+				}
+			},
+		},
+		{
+			name: "list revisions _ not supported _ 501 not implemented",
+			req:  getReq(testID(1) + "/revisions"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "list revisions _ missing _ 404 not found",
+			req:  getReq(testID(2) + "/revisions"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name:   "list revisions _ 200 ok",
+			req:    getReq(testID(1) + "/revisions"),
+			db:     newTestHistorian,
+			verify: verifyRevisions([]int{1, 2}, []string{"1.00", "2.00"}),
+		},
+		{
+			name:   "fetch revision _ 200 ok",
+			req:    getReq(testID(1) + "/revisions/1"),
+			db:     newTestHistorian,
+			verify: verifyRevisions([]int{1}, []string{"1.00"}),
+		},
+		{
+			name: "fetch revision _ invalid revision _ 400 bad request",
+			req:  getReq(testID(1) + "/revisions/x"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "fetch revision _ missing _ 404 not found",
+			req:  getReq(testID(1) + "/revisions/3"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "fetch payment _ as of _ 200 ok",
+			req:  getReq(testID(1) + "?as_of=2018-01-01T01:30:00Z"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				payResp := &expay.PaymentResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(payResp); err != nil {
+					t.Fatal(err)
+				}
+				if len(payResp.Data) != 1 || payResp.Data[0].Attributes.Amount != "1.00" {
+					t.Fatalf("expect amount 1.00 got %+v", payResp.Data)
+				}
+			},
+		},
+		{
+			name: "fetch payment _ as of before created _ 404 not found",
+			req:  getReq(testID(1) + "?as_of=2017-01-01T00:00:00Z"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotFound)
+			},
+		},
+		{
+			name: "fetch payment _ invalid as of _ 400 bad request",
+			req:  getReq(testID(1) + "?as_of=yesterday"),
+			db:   newTestHistorian,
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "fetch payment _ as of not supported _ 501 not implemented",
+			req:  getReq(testID(1) + "?as_of=2018-01-01T01:30:00Z"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "get stats _ not supported _ 501 not implemented",
+			req:  getReq("stats"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "get stats _ storage unavailable _ 503 service unavailable",
+			req:  getReq("stats"),
+			db: func() expay.DB {
+				return &fakeAggregator{DB: memdb.New(), statsErr: expay.ErrUnavailable}
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "get stats _ 200 ok",
+			req:  getReq("stats"),
+			db: func() expay.DB {
+				return &fakeAggregator{DB: memdb.New(), stats: testStats}
+			},
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusOK)
+				statsResp := &expay.StatsResponse{}
+				if err := json.NewDecoder(resp.Body).Decode(statsResp); err != nil {
+					t.Fatal(err)
+				}
+				wantResp := &expay.StatsResponse{Data: testStats, Links: &expay.Links{Self: "/v1/payments/stats"}}
+				if !reflect.DeepEqual(statsResp, wantResp) {
+					t.Fatalf("expect \n%+v\n got \n%+v", wantResp, statsResp)
+				}
+			},
+		},
+		{
+			name: "list events _ not supported _ 501 not implemented",
+			req:  getReq("events"),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusNotImplemented)
+			},
+		},
+		{
+			name: "list events _ invalid since _ 400 bad request",
+			req:  getReq("events?since=-1"),
+			db:   fakeWatcherWithChanges(nil, nil),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusBadRequest)
+			},
+		},
+		{
+			name: "list events _ watch error _ 500 internal server error",
+			req:  getReq("events"),
+			db:   fakeWatcherWithChanges(nil, errors.New("fail")),
+			verify: func(t *testing.T, resp *http.Response, s *Service) {
+				verifyCode(t, resp, http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "list events _ no new event _ 200 ok",
+			req:  getReq("events?since=2"),
+			db:   fakeWatcherWithChanges(nil, context.DeadlineExceeded),
+			verify: verifyEvents([]uint64{}, &expay.Links{
+				Self: "/v1/payments/events?since=2",
+				Next: "/v1/payments/events?since=2",
+			}),
+		},
+		{
+			name: "list events _ all _ 200 ok",
+			req:  getReq("events"),
+			db: fakeWatcherWithChanges([]expay.Change{
+				{Seq: 1, Op: expay.OpCreate, ID: testID(1)},
+				{Seq: 2, Op: expay.OpUpdate, ID: testID(1)},
+			}, nil),
+			verify: verifyEvents([]uint64{1, 2}, &expay.Links{
+				Self: "/v1/payments/events",
+				Next: "/v1/payments/events?since=2",
+			}),
+		},
+		{
+			name: "list events _ since _ 200 ok",
+			req:  getReq("events?since=1"),
+			db: fakeWatcherWithChanges([]expay.Change{
+				{Seq: 1, Op: expay.OpCreate, ID: testID(1)},
+				{Seq: 2, Op: expay.OpUpdate, ID: testID(1)},
+				{Seq: 3, Op: expay.OpDelete, ID: testID(1)},
+			}, nil),
+			verify: verifyEvents([]uint64{2, 3}, &expay.Links{
+				Self: "/v1/payments/events?since=1",
+				Next: "/v1/payments/events?since=3",
+			}),
+		},
 	}
 
 	for _, tc := range testcases {
@@ -389,7 +1146,7 @@ func TestPaymentService(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			db := expay.DB(newFakeDB())
+			db := expay.DB(memdb.New())
 			if tc.db != nil {
 				db = tc.db()
 			}
@@ -409,3 +1166,176 @@ func TestPaymentService(t *testing.T) {
 		})
 	}
 }
+
+// testUUID is a payment ID chosen by a client
+const testUUID = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+
+// testID returns the nth sequence ID of memdb
+func testID(n int) string {
+	return fmt.Sprintf("%016x", n)
+}
+
+func testIDs(ns ...int) []string {
+	ids := []string{}
+	for _, n := range ns {
+		ids = append(ids, testID(n))
+	}
+	return ids
+}
+
+// seed writes v as id into db before a test
+func seed(db expay.DB, id string, v interface{}) {
+	if err := db.RunInTx(context.Background(), func(tx expay.Tx) error {
+		return tx.Update(id, v)
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// seedTestPayment writes testdata.Payment of version as id into db
+func seedTestPayment(db expay.DB, id string, version int) {
+	pay := &expay.Payment{ID: id}
+	_ = json.Unmarshal([]byte(testdata.Payment), pay)
+	pay.Version = version
+	seed(db, id, pay)
+}
+
+// memdbWithTestPayment returns a memdb of testdata.Payment of version as id
+func memdbWithTestPayment(id string, version int) func() expay.DB {
+	return func() expay.DB {
+		db := memdb.New()
+		seedTestPayment(db, id, version)
+		return db
+	}
+}
+
+// testDeletedAt is the time when the payments of memdbWith are deleted
+var testDeletedAt = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// memdbWith returns a memdb of payments, some of which are deleted
+func memdbWith(ids []string, deletedIDs ...string) func() expay.DB {
+	return func() expay.DB {
+		db := memdb.New()
+		for _, id := range ids {
+			seed(db, id, &expay.Payment{})
+		}
+		for _, id := range deletedIDs {
+			seed(db, id, &expay.Payment{DeletedAt: &testDeletedAt, DeletedBy: "bob"})
+		}
+		return db
+	}
+}
+
+// fakeArchiverWith returns a fakeArchiver of live and archived payments
+func fakeArchiverWith(ids, archivedIDs []string) func() expay.DB {
+	return func() expay.DB {
+		return &fakeArchiver{
+			DB:       memdbWith(ids)().(*memdb.DB),
+			archive:  memdbWith(archivedIDs)().(*memdb.DB),
+			archived: len(archivedIDs),
+		}
+	}
+}
+
+// newTestHistorian returns a fakeHistorian with two revisions of payment 1
+func newTestHistorian() expay.DB {
+	h := &fakeHistorian{DB: memdb.New(), revisions: make(map[string][]fakeRevision)}
+	for i, amount := range []string{"1.00", "2.00"} {
+		pay := expay.Payment{Version: i}
+		pay.Attributes.Amount = amount
+		h.revisions[testID(1)] = append(h.revisions[testID(1)], fakeRevision{
+			rev: expay.Revision{N: i + 1, Time: time.Date(2018, 1, 1, i+1, 0, 0, 0, time.UTC), Actor: "alice"},
+			pay: pay,
+		})
+		seed(h, testID(1), &pay)
+	}
+	return h
+}
+
+func verifyRevisions(wantNs []int, wantAmounts []string) func(t *testing.T, resp *http.Response, s *Service) {
+	return func(t *testing.T, resp *http.Response, s *Service) {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expect HTTP status code %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		revResp := &expay.RevisionResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(revResp); err != nil {
+			t.Fatal(err)
+		}
+		ns, amounts := []int{}, []string{}
+		for _, rev := range revResp.Data {
+			if rev.Payment.ID != testID(1) || rev.Actor != "alice" {
+				t.Fatalf("expect payment 1 by alice got %+v", rev)
+			}
+			ns = append(ns, rev.N)
+			amounts = append(amounts, rev.Payment.Attributes.Amount)
+		}
+		if !reflect.DeepEqual(ns, wantNs) || !reflect.DeepEqual(amounts, wantAmounts) {
+			t.Fatalf("expect %v %v got %v %v", wantNs, wantAmounts, ns, amounts)
+		}
+	}
+}
+
+// testStats are the aggregates of fakeAggregator
+var testStats = &expay.Stats{
+	Aggregate: expay.Aggregate{Count: 2, Sums: map[string]expay.Sum{"GBP": {Count: 2, Amount: "100.71"}}},
+	Groups: map[string]map[string]expay.Aggregate{
+		"currency": {"GBP": {Count: 2, Sums: map[string]expay.Sum{"GBP": {Count: 2, Amount: "100.71"}}}},
+		"organisation_id": {
+			"org1": {Count: 1, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "100.21"}}},
+			"org2": {Count: 1, Sums: map[string]expay.Sum{"GBP": {Count: 1, Amount: "0.5"}}},
+		},
+	},
+}
+
+func fakeWatcherWithChanges(changes []expay.Change, err error) func() expay.DB {
+	return func() expay.DB {
+		return &fakeWatcher{DB: memdb.New(), changes: changes, watchErr: err}
+	}
+}
+
+func verifyEvents(wantSeqs []uint64, wantLinks *expay.Links) func(t *testing.T, resp *http.Response, s *Service) {
+	return func(t *testing.T, resp *http.Response, s *Service) {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expect HTTP status code %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		eventResp := &expay.EventResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(eventResp); err != nil {
+			t.Fatal(err)
+		}
+		seqs := []uint64{}
+		for _, change := range eventResp.Data {
+			seqs = append(seqs, change.Seq)
+		}
+		if !reflect.DeepEqual(seqs, wantSeqs) {
+			t.Fatalf("expect seqs %v got %v", wantSeqs, seqs)
+		}
+		if !reflect.DeepEqual(eventResp.Links, wantLinks) {
+			t.Fatalf("expect links \n%+v\n got \n%+v", wantLinks, eventResp.Links)
+		}
+	}
+}
+
+func verifyPage(wantIDs []string, wantLinks *expay.Links) func(t *testing.T, resp *http.Response, s *Service) {
+	return func(t *testing.T, resp *http.Response, s *Service) {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expect HTTP status code %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		paymentResp := &expay.PaymentResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(paymentResp); err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, pay := range paymentResp.Data {
+			ids = append(ids, pay.ID)
+		}
+		if !reflect.DeepEqual(ids, wantIDs) {
+			t.Fatalf("expect ids %v got %v", wantIDs, ids)
+		}
+		if !reflect.DeepEqual(paymentResp.Links, wantLinks) {
+			t.Fatalf("expect links \n%+v\n got \n%+v", wantLinks, paymentResp.Links)
+		}
+	}
+}
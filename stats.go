@@ -0,0 +1,146 @@
+package expay
+
+import (
+	"math/big"
+	"strings"
+)
+
+// AddDecimal returns the sum of decimal numbers a and b, e.g. "100.21" and
+// "-0.2" gives "100.01". The sum has as many decimal places as the one of a
+// and b with more, and an empty string is zero.
+func AddDecimal(a, b string) (string, error) {
+	x, xScale, err := parseDecimal(a)
+	if err != nil {
+		return "", err
+	}
+	y, yScale, err := parseDecimal(b)
+	if err != nil {
+		return "", err
+	}
+	ten := big.NewInt(10)
+	for ; xScale < yScale; xScale++ {
+		x.Mul(x, ten)
+	}
+	for ; yScale < xScale; yScale++ {
+		y.Mul(y, ten)
+	}
+	return formatDecimal(x.Add(x, y), xScale), nil
+}
+
+// IsDecimal returns if s is a decimal number, i.e. digits with an optional sign
+// and an optional fraction
+func IsDecimal(s string) bool {
+	_, _, err := parseDecimal(s)
+	return s != "" && err == nil
+}
+
+// parseDecimal returns the unscaled integer and the number of decimal places
+// of s
+func parseDecimal(s string) (*big.Int, int, error) {
+	if s == "" {
+		return new(big.Int), 0, nil
+	}
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 {
+		return nil, 0, invalidDecimal(s)
+	}
+	intPart, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, frac = digits[:i], digits[i+1:]
+		if frac == "" {
+			return nil, 0, invalidDecimal(s)
+		}
+	}
+	if intPart == "" || !isDigits(intPart) || !isDigits(frac) {
+		return nil, 0, invalidDecimal(s)
+	}
+	n, _ := new(big.Int).SetString(intPart+frac, 10)
+	if s[0] == '-' {
+		n.Neg(n)
+	}
+	return n, len(frac), nil
+}
+
+// formatDecimal returns the decimal of unscaled integer n with scale decimal
+// places
+func formatDecimal(n *big.Int, scale int) string {
+	s := new(big.Int).Abs(n).String()
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	if scale > 0 {
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	}
+	if n.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func invalidDecimal(s string) error {
+	return &Error{Code: CodeInvalidArgument, Message: "invalid decimal " + s}
+}
+
+// Merge returns the aggregate of the values of a and o, where o may be negative
+// to remove values from a. The sum of a unit is removed once its count drops
+// to zero.
+func (a Aggregate) Merge(o Aggregate) (Aggregate, error) {
+	merged := Aggregate{Count: a.Count + o.Count}
+	for unit, sum := range a.Sums {
+		merged.setSum(unit, sum)
+	}
+	for unit, sum := range o.Sums {
+		amount, err := AddDecimal(merged.Sums[unit].Amount, sum.Amount)
+		if err != nil {
+			return Aggregate{}, err
+		}
+		merged.setSum(unit, Sum{Count: merged.Sums[unit].Count + sum.Count, Amount: amount})
+	}
+	return merged, nil
+}
+
+// setSum sets the sum of unit, or removes it if its count is zero
+func (a *Aggregate) setSum(unit string, sum Sum) {
+	if sum.Count == 0 {
+		delete(a.Sums, unit)
+		return
+	}
+	if a.Sums == nil {
+		a.Sums = make(map[string]Sum)
+	}
+	a.Sums[unit] = sum
+}
+
+// Merge adds the aggregates of o to s, e.g. those of another shard
+func (s *Stats) Merge(o *Stats) error {
+	aggregate, err := s.Aggregate.Merge(o.Aggregate)
+	if err != nil {
+		return err
+	}
+	s.Aggregate = aggregate
+	for name, groups := range o.Groups {
+		if s.Groups == nil {
+			s.Groups = make(map[string]map[string]Aggregate)
+		}
+		if s.Groups[name] == nil {
+			s.Groups[name] = make(map[string]Aggregate)
+		}
+		for group, a := range groups {
+			merged, err := s.Groups[name][group].Merge(a)
+			if err != nil {
+				return err
+			}
+			s.Groups[name][group] = merged
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package expay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		sum  string
+		ok   bool
+	}{
+		{"100.21", "0.5", "100.71", true},
+		{"100.21", "-0.2", "100.01", true},
+		{"1", "-1.00", "0.00", true},
+		{"0.05", "-0.1", "-0.05", true},
+		{"", "+12", "12", true},
+		{"", "", "0", true},
+		{"99999999999999999999.99", "0.01", "100000000000000000000.00", true},
+		{"1e3", "1", "", false},
+		{"1.", "1", "", false},
+		{".5", "1", "", false},
+		{"--1", "1", "", false},
+		{"1", "0x10", "", false},
+	} {
+		sum, err := AddDecimal(tc.a, tc.b)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s + %s: expect ok %v got %v", tc.a, tc.b, tc.ok, err)
+		}
+		if sum != tc.sum {
+			t.Fatalf("%s + %s: expect %s got %s", tc.a, tc.b, tc.sum, sum)
+		}
+	}
+	if IsDecimal("") || !IsDecimal("-3.14") {
+		t.Fatal("expect only -3.14 is a decimal")
+	}
+}
+
+func TestStatsMerge(t *testing.T) {
+	stats := &Stats{
+		Aggregate: Aggregate{Count: 2, Sums: map[string]Sum{"GBP": {Count: 2, Amount: "3.50"}}},
+		Groups: map[string]map[string]Aggregate{
+			"currency": {"GBP": {Count: 2, Sums: map[string]Sum{"GBP": {Count: 2, Amount: "3.50"}}}},
+		},
+	}
+	if err := stats.Merge(&Stats{
+		Aggregate: Aggregate{Count: 1, Sums: map[string]Sum{"EUR": {Count: 1, Amount: "1"}}},
+		Groups: map[string]map[string]Aggregate{
+			"currency": {"EUR": {Count: 1, Sums: map[string]Sum{"EUR": {Count: 1, Amount: "1"}}}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := &Stats{
+		Aggregate: Aggregate{Count: 3, Sums: map[string]Sum{"GBP": {Count: 2, Amount: "3.50"}, "EUR": {Count: 1, Amount: "1"}}},
+		Groups: map[string]map[string]Aggregate{
+			"currency": {
+				"GBP": {Count: 2, Sums: map[string]Sum{"GBP": {Count: 2, Amount: "3.50"}}},
+				"EUR": {Count: 1, Sums: map[string]Sum{"EUR": {Count: 1, Amount: "1"}}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expect %+v got %+v", expected, stats)
+	}
+
+	// a negative aggregate removes values
+	a, err := expected.Aggregate.Merge(Aggregate{Count: -1, Sums: map[string]Sum{"EUR": {Count: -1, Amount: "-1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Aggregate{Count: 2, Sums: map[string]Sum{"GBP": {Count: 2, Amount: "3.50"}}}); !reflect.DeepEqual(a, want) {
+		t.Fatalf("expect %+v got %+v", want, a)
+	}
+}
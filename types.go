@@ -1,25 +1,294 @@
 package expay
 
+import (
+	"context"
+	"io"
+	"time"
+)
+
 type (
-	// DB is an abstraction of persistent storage
+	// DB is an abstraction of persistent storage. Every method returns the
+	// context error if ctx is done before the operation completes.
 	DB interface {
+		Create(ctx context.Context, v interface{}) (id string, err error)
+		Get(ctx context.Context, id string, v interface{}) error
+		Delete(ctx context.Context, id string) error
+		Update(ctx context.Context, id string, v interface{}) error
+		// UpdateFunc atomically reads the value of id into v, calls fn to check
+		// and modify v, and writes v back. Nothing is written if fn returns an
+		// error, which is returned as is, so it can be used for compare-and-swap.
+		UpdateFunc(ctx context.Context, id string, v interface{}, fn func() error) error
+		// List returns an iterator of every value, which stops when ctx is done
+		List(ctx context.Context) (Iter, error)
+
+		// Paginate returns an iterator of at most limit values whose ids come
+		// after lastCursor, or from the first value if lastCursor is empty. A
+		// negative limit reads backwards: at most -limit values before
+		// lastCursor (or from the last value) in descending order. A zero limit
+		// means no limit.
+		Paginate(ctx context.Context, lastCursor string, limit int) (Iter, error)
+
+		// RunInTx runs fn within a transaction so that all the operations done
+		// via tx are atomic. Everything done via tx is rolled back if fn returns
+		// an error, which is returned as is, or if ctx is done before commit.
+		RunInTx(ctx context.Context, fn func(tx Tx) error) error
+	}
+	// Tx is a transaction of a DB
+	Tx interface {
 		Create(v interface{}) (id string, err error)
 		Get(id string, v interface{}) error
 		Delete(id string) error
 		Update(id string, v interface{}) error
-		List() (Iter, error)
-
-		// TODO: implement cursor-based pagination
-		Paginate(lastCursor string, limit int) (Iter, error)
+	}
+	// IDCreator is implemented by a DB that accepts IDs chosen by its clients
+	IDCreator interface {
+		// CreateWithID creates v with id, which must be a UUID, and returns
+		// ErrAlreadyExists if id exists
+		CreateWithID(ctx context.Context, id string, v interface{}) error
+	}
+	// Ranger is implemented by a DB that iterates over a range of IDs in
+	// either order
+	Ranger interface {
+		// Range returns an iterator of the values whose IDs are within r in
+		// the order of r
+		Range(ctx context.Context, r Range) (Iter, error)
+	}
+	// Indexer is implemented by a DB that supports lookup by secondary indexes
+	Indexer interface {
+		// Lookup returns an iterator of values whose key of the index equals
+		// key
+		Lookup(ctx context.Context, index, key string) (Iter, error)
+		// LookupRange returns an iterator of values whose key of the index is
+		// within [start, end) in the order of index keys, an empty end means no
+		// upper bound
+		LookupRange(ctx context.Context, index, start, end string) (Iter, error)
+	}
+	// KeyRotator is implemented by a DB that encrypts values at rest
+	KeyRotator interface {
+		// RotateKeys re-encrypts every value with a new key while the DB stays
+		// available, and returns the number of re-encrypted values
+		RotateKeys(ctx context.Context) (n int, err error)
+	}
+	// Watcher is implemented by a DB that keeps a log of changes
+	Watcher interface {
+		// Watch returns the changes after sinceSeq in the order of their
+		// sequence numbers. It waits until there is at least one change or
+		// ctx is done.
+		Watch(ctx context.Context, sinceSeq uint64) ([]Change, error)
+	}
+	// Historian is implemented by a DB that keeps every revision of values
+	Historian interface {
+		// Revisions returns the revisions of id in ascending order
+		Revisions(ctx context.Context, id string) ([]Revision, error)
+		// GetRevision reads revision n of id into v
+		GetRevision(ctx context.Context, id string, n int, v interface{}) (*Revision, error)
+		// GetAsOf reads the revision of id that was current at time t into v,
+		// and returns ErrNotFound if id did not exist at that time
+		GetAsOf(ctx context.Context, id string, t time.Time, v interface{}) (*Revision, error)
+	}
+	// Backuper is implemented by a DB that supports online backup
+	Backuper interface {
+		// Backup writes a consistent snapshot of the whole storage to w while
+		// the DB stays available, and returns the number of bytes written
+		Backup(ctx context.Context, w io.Writer) (n int64, err error)
+	}
+	// Migrator is implemented by a DB that versions the schema of values
+	Migrator interface {
+		// Migrate rewrites the values stored in an older schema version in
+		// batches of at most batchSize values while the DB stays available,
+		// and calls progress after each batch. Nothing is written if dryRun is
+		// true, but the migrations are still run to find the failing ones.
+		Migrate(ctx context.Context, batchSize int, dryRun bool, progress func(MigrationProgress)) error
+	}
+	// Cacher is implemented by a DB that caches values
+	Cacher interface {
+		// CacheStats returns the statistics of the cache
+		CacheStats() CacheStats
+	}
+	// Aggregator is implemented by a DB that maintains running aggregates of
+	// its values
+	Aggregator interface {
+		// Stats returns the aggregates of the values, which are read without
+		// scanning the values
+		Stats(ctx context.Context) (*Stats, error)
+	}
+	// Archiver is implemented by a DB that moves old values out of the live
+	// values into archive partitions. An archived value is read-only and
+	// only read by GetArchived and PaginateArchived, e.g. Get, List and
+	// Paginate return live values only.
+	Archiver interface {
+		// Archive moves the values dated before t into the archive in
+		// batches while the DB stays available, and returns the number of
+		// archived values
+		Archive(ctx context.Context, before time.Time) (n int, err error)
+		// GetArchived reads the archived value of id into v
+		GetArchived(ctx context.Context, id string, v interface{}) error
+		// PaginateArchived is the same as Paginate over the archived values
+		PaginateArchived(ctx context.Context, lastCursor string, limit int) (Iter, error)
+	}
+	// FaultInjector is implemented by a DB that injects faults into its
+	// operations for chaos testing
+	FaultInjector interface {
+		// Faults returns the faults being injected
+		Faults() (Faults, error)
+		// SetFaults replaces the faults being injected, and returns an
+		// invalid argument error if f is invalid
+		SetFaults(f Faults) error
+	}
+	// Auditor is implemented by a DB that keeps a tamper-evident audit log of
+	// every write, where each entry is chained to the previous one by its
+	// hash (see AuditEntry)
+	Auditor interface {
+		// VerifyAudit verifies that the audit log is an unbroken hash chain
+		// and that every stored value matches its last entry, and returns
+		// the number of verified entries and the hash of the last one. It
+		// returns ErrAuditBroken with the first break found otherwise.
+		VerifyAudit(ctx context.Context) (n int, head string, err error)
+	}
+	// Wrapper is implemented by a DB that wraps another DB to add or change
+	// features, e.g. a cache. It only implements the optional interfaces it
+	// adds or changes, and As finds the others on the wrapped DB.
+	Wrapper interface {
+		// Unwrap returns the wrapped DB
+		Unwrap() DB
+	}
+	// Supporter is implemented by a DB that implements optional interfaces
+	// it does not always support, e.g. by forwarding them to other DBs
+	Supporter interface {
+		// Supports returns if the optional interface target points to is
+		// supported, e.g. (*Watcher)(nil)
+		Supports(target interface{}) bool
 	}
 	// Iter is used to iterate through a list of values
 	Iter interface {
+		// Next returns false if there is no more value or the context of the
+		// iterator is done
 		Next() bool
 		Scan(v interface{}) (id string, err error)
+		// Close releases the iterator and returns the context error if the
+		// iteration has been stopped by the context
 		Close() error
 	}
 )
 
+// Range is a range of IDs in the order of a DB, e.g. sequence IDs in the order
+// of their creation
+type Range struct {
+	// Start is the first ID of the range, empty means from the first value
+	Start string
+	// End is the ID after the range (exclusive), empty means to the last value
+	End string
+	// Desc iterates from the end of the range backwards
+	Desc bool
+	// Limit is the maximum number of values, zero or negative means no limit
+	Limit int
+}
+
+// Change is a change of a value in a DB
+type Change struct {
+	// sequence number of the change, which increases monotonically
+	Seq uint64 `json:"seq"`
+	// operation of the change: create, update, delete or archive
+	Op string `json:"op"`
+	// ID of the changed value
+	ID string `json:"id"`
+}
+
+// Revision is a revision of a value in a DB
+type Revision struct {
+	// revision number, starting from 1
+	N int `json:"revision"`
+	// time when the revision was written
+	Time time.Time `json:"time"`
+	// the user who wrote the revision
+	Actor string `json:"actor,omitempty"`
+}
+
+// MigrationProgress is the progress of a schema migration
+type MigrationProgress struct {
+	// number of stored values (including revisions) when the migration started
+	Total int `json:"total"`
+	// number of values scanned so far
+	Scanned int `json:"scanned"`
+	// number of values migrated (or to be migrated in a dry run) so far
+	Migrated int `json:"migrated"`
+}
+
+// CacheStats are the statistics of a cache
+type CacheStats struct {
+	// number of reads served from the cache
+	Hits uint64 `json:"hits"`
+	// number of reads not found in the cache
+	Misses uint64 `json:"misses"`
+	// number of values evicted because the cache is full
+	Evictions uint64 `json:"evictions"`
+	// number of values expired
+	Expirations uint64 `json:"expirations"`
+	// number of values in the cache
+	Size int `json:"size"`
+}
+
+// Aggregates define the running aggregates of the values of a DB by dot
+// separated paths of JSON names: the count of values and the count and the sum
+// of their amounts by unit, in total and grouped by fields
+type Aggregates struct {
+	// Amount is the path of the decimal amount of a value, which is not
+	// summed if it is not a decimal
+	Amount string
+	// Unit is the path of the unit of the amount, e.g. currency, the amounts
+	// of different units are summed separately
+	Unit string
+	// GroupBy are the paths of the fields to group values by, each grouping
+	// is named after the last element of its path
+	GroupBy []string
+	// Exclude is the path of a field, a value whose field is not zero is not
+	// aggregated, e.g. deleted_at of tombstones
+	Exclude string
+}
+
+// Stats are the running aggregates of the values of a DB
+type Stats struct {
+	// the aggregate of every value
+	Aggregate
+	// the aggregates of values by the name of the grouping and then by group
+	Groups map[string]map[string]Aggregate `json:"groups"`
+}
+
+// Aggregate is the count and the sums of some values
+type Aggregate struct {
+	// number of values
+	Count int64 `json:"count"`
+	// sums of the amounts by unit
+	Sums map[string]Sum `json:"sums,omitempty"`
+}
+
+// Sum is the sum of the amounts of a unit
+type Sum struct {
+	// number of amounts
+	Count int64 `json:"count"`
+	// the sum as a decimal
+	Amount string `json:"amount"`
+}
+
+// Migration upgrades a stored value decoded from JSON from the previous schema
+// version to the next one in place
+type Migration func(doc map[string]interface{}) error
+
+// operations of a change
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+	// OpArchive moves a value out of the live values into the archive
+	OpArchive = "archive"
+	// OpMigrate rewrites a value in the current schema version, which is
+	// only recorded in the audit log
+	OpMigrate = "migrate"
+	// OpBaseline records a value that existed when the audit log was
+	// started, which is only recorded in the audit log
+	OpBaseline = "baseline"
+)
+
 // Payment represents a payment resource
 type Payment struct {
 	ID             string            `json:"id"`
@@ -27,8 +296,60 @@ type Payment struct {
 	Version        int               `json:"version"`
 	OrganisationID string            `json:"organisation_id"`
 	Attributes     PaymentAttributes `json:"attributes"`
+	// time when the payment was deleted, a deleted payment is kept as a
+	// tombstone until it is purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// the user who deleted the payment
+	DeletedBy string `json:"deleted_by,omitempty"`
+	// Archived is true if the payment has been archived, it is set when read
+	// from the archive and never stored
+	Archived bool `json:"archived,omitempty"`
 }
 
+// Deleted returns if the payment is a tombstone
+func (p *Payment) Deleted() bool {
+	return p.DeletedAt != nil
+}
+
+// PaymentIndexes are the JSON paths of payment fields that are indexed for
+// lookup, each index is named after the last element of its path
+var PaymentIndexes = []string{
+	"organisation_id",
+	"attributes.end_to_end_reference",
+	"attributes.payment_id",
+	"attributes.processing_date",
+}
+
+// PaymentDeletedIndex is the JSON path of the time when a payment was deleted,
+// by which the tombstones, and only them, are indexed in time order (see
+// IndexTimeLayout) to be purged
+const PaymentDeletedIndex = "deleted_at"
+
+// IndexTimeLayout is the layout of the keys of an index of times, which are in
+// UTC so that they sort in time order
+const IndexTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// PaymentIndexExclude is the JSON path of the field that excludes a payment
+// from the indexes if it is not zero, i.e. tombstones are not indexed
+const PaymentIndexExclude = "deleted_at"
+
+// PaymentAggregates are the running aggregates of payments, grouped by
+// currency and by organisation, tombstones excluded
+var PaymentAggregates = Aggregates{
+	Amount:  "attributes.amount",
+	Unit:    "attributes.currency",
+	GroupBy: []string{"attributes.currency", "organisation_id"},
+	Exclude: "deleted_at",
+}
+
+// PaymentMigrations are the schema migrations of stored payments in order, the
+// schema version of a payment is the number of migrations applied to it, and a
+// payment stored before versioning is of version 0. A migration must never be
+// changed after released, add a new one instead. A payment stored before
+// versioning by the gob codec is decoded as a Payment, so a copy of the version
+// 0 type must be kept for it once a migration changes the fields.
+var PaymentMigrations = []Migration{}
+
 // PaymentAttributes contains properties of a payment
 type PaymentAttributes struct {
 	Amount               string             `json:"amount"`
@@ -106,6 +427,12 @@ type SponsorParty struct {
 type Links struct {
 	// self link
 	Self string `json:"self,omitempty"`
+	// link to the first page
+	First string `json:"first,omitempty"`
+	// link to the previous page
+	Prev string `json:"prev,omitempty"`
+	// link to the next page
+	Next string `json:"next,omitempty"`
 }
 
 // PaymentResponse is an envelope for a payment response
@@ -115,3 +442,34 @@ type PaymentResponse struct {
 	// response links
 	Links *Links `json:"links,omitempty"`
 }
+
+// PaymentRevision is a revision of a payment
+type PaymentRevision struct {
+	Revision
+	// the payment at the revision
+	Payment Payment `json:"payment"`
+}
+
+// RevisionResponse is an envelope for a payment revision response
+type RevisionResponse struct {
+	// an array of payment revisions
+	Data []PaymentRevision `json:"data,omitempty"`
+	// response links
+	Links *Links `json:"links,omitempty"`
+}
+
+// StatsResponse is an envelope for a payment statistics response
+type StatsResponse struct {
+	// the aggregates of payments
+	Data *Stats `json:"data"`
+	// response links
+	Links *Links `json:"links,omitempty"`
+}
+
+// EventResponse is an envelope for a payment event response
+type EventResponse struct {
+	// an array of changes of payments
+	Data []Change `json:"data"`
+	// response links
+	Links *Links `json:"links,omitempty"`
+}
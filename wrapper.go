@@ -0,0 +1,56 @@
+package expay
+
+import "reflect"
+
+// As finds the first DB in the chain of wrapped DBs starting from db (see
+// Wrapper) that supports the optional interface target points to, sets target
+// to it and returns true, or returns false if none does, e.g.
+//
+//	var watcher expay.Watcher
+//	if expay.As(db, &watcher) {
+//		...
+//	}
+//
+// A DB supports an optional interface if it implements it, unless it is a
+// Supporter whose Supports returns false. As panics if target is not a non-nil
+// pointer to an interface type.
+func As(db DB, target interface{}) bool {
+	v := reflect.ValueOf(target)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		panic("expay: target must be a non-nil pointer")
+	}
+	found := find(db, target)
+	if found == nil {
+		return false
+	}
+	v.Elem().Set(reflect.ValueOf(found))
+	return true
+}
+
+// Supports is the same as As without setting target, which can be a nil
+// pointer, e.g. (*Watcher)(nil)
+func Supports(db DB, target interface{}) bool {
+	return find(db, target) != nil
+}
+
+func find(db DB, target interface{}) DB {
+	typ := reflect.TypeOf(target)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Interface {
+		panic("expay: target must be a pointer to an interface type")
+	}
+	iface := typ.Elem()
+	for db != nil {
+		if reflect.TypeOf(db).Implements(iface) {
+			if s, ok := db.(Supporter); ok && !s.Supports(target) {
+				return nil
+			}
+			return db
+		}
+		w, ok := db.(Wrapper)
+		if !ok {
+			return nil
+		}
+		db = w.Unwrap()
+	}
+	return nil
+}
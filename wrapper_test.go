@@ -0,0 +1,60 @@
+package expay
+
+import (
+	"context"
+	"testing"
+)
+
+type baseDB struct{ DB }
+
+func (baseDB) Stats(ctx context.Context) (*Stats, error) { return &Stats{}, nil }
+
+type wrapperDB struct {
+	DB
+	supported bool
+}
+
+func (db wrapperDB) Unwrap() DB { return db.DB }
+
+func (db wrapperDB) CacheStats() CacheStats { return CacheStats{} }
+
+func (db wrapperDB) VerifyAudit(ctx context.Context) (int, string, error) { return 0, "", nil }
+
+func (db wrapperDB) Supports(target interface{}) bool {
+	switch target.(type) {
+	case *Cacher:
+		return true
+	case *Auditor:
+		return db.supported
+	}
+	return Supports(db.DB, target)
+}
+
+func TestAs(t *testing.T) {
+	base := baseDB{}
+	db := wrapperDB{DB: wrapperDB{DB: base}}
+	var aggregator Aggregator
+	if !As(db, &aggregator) {
+		t.Fatal("expect aggregator found on the wrapped DB")
+	}
+	if _, ok := aggregator.(baseDB); !ok {
+		t.Fatalf("expect %T got %T", base, aggregator)
+	}
+	var cacher Cacher
+	if !As(db, &cacher) || cacher != Cacher(db) {
+		t.Fatalf("expect %v got %v", db, cacher)
+	}
+	var watcher Watcher
+	if As(db, &watcher) || watcher != nil {
+		t.Fatalf("expect no watcher got %v", watcher)
+	}
+	if Supports(db, (*Auditor)(nil)) {
+		t.Fatal("expect auditor not supported")
+	}
+	if !Supports(wrapperDB{DB: base, supported: true}, (*Auditor)(nil)) {
+		t.Fatal("expect auditor supported")
+	}
+	if Supports(base, (*Cacher)(nil)) {
+		t.Fatal("expect cacher not supported")
+	}
+}